@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	AuditPasswordResetRequested = "password_reset.requested"
+	AuditPasswordResetCompleted = "password_reset.completed"
+	AuditPasswordResetRejected  = "password_reset.rejected"
+)
+
+// AuditEvent records a security relevant operation. Subject is what the
+// operation was about when there is no user to attach it to, like the email
+// typed in a reset form.
+type AuditEvent struct {
+	EventID   uuid.UUID  `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"event_id"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	Action    string     `gorm:"index" json:"action"`
+	Subject   string     `json:"subject"`
+	IP        string     `json:"ip"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type AuditRepository interface {
+	CreateAuditEvent(event AuditEvent) (AuditEvent, error)
+	CountAuditEventsBySubject(action string, subject string, since time.Time) (int64, error)
+	CountAuditEventsByIP(action string, ip string, since time.Time) (int64, error)
+	GetAuditEventsByUser(userID uuid.UUID) ([]AuditEvent, error)
+}
+
+func (repository *CovoitRepository) CreateAuditEvent(event AuditEvent) (AuditEvent, error) {
+	ctx := context.Background()
+	err := gorm.G[AuditEvent](repository.db).Create(ctx, &event)
+	if err != nil {
+		return AuditEvent{}, fmt.Errorf("could not create audit event %s, err : %s", event.Action, err)
+	}
+	return event, nil
+}
+
+func (repository *CovoitRepository) CountAuditEventsBySubject(action string, subject string, since time.Time) (int64, error) {
+	ctx := context.Background()
+	count, err := gorm.G[AuditEvent](repository.db).
+		Where("action = ? AND subject = ? AND created_at >= ?", action, subject, since).
+		Count(ctx, "*")
+	if err != nil {
+		return 0, fmt.Errorf("could not count audit events %s, err : %s", action, err)
+	}
+	return count, nil
+}
+
+func (repository *CovoitRepository) CountAuditEventsByIP(action string, ip string, since time.Time) (int64, error) {
+	ctx := context.Background()
+	count, err := gorm.G[AuditEvent](repository.db).
+		Where("action = ? AND ip = ? AND created_at >= ?", action, ip, since).
+		Count(ctx, "*")
+	if err != nil {
+		return 0, fmt.Errorf("could not count audit events %s, err : %s", action, err)
+	}
+	return count, nil
+}
+
+func (repository *CovoitRepository) GetAuditEventsByUser(userID uuid.UUID) ([]AuditEvent, error) {
+	ctx := context.Background()
+	events, err := gorm.G[AuditEvent](repository.db).Where("user_id = ?", userID).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get audit events of user %s, err : %s", userID, err)
+	}
+	return events, nil
+}
+
+func init() {
+	registerPersonalData("audit_events", []string{"audit_events"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.audits.GetAuditEventsByUser(userID)
+	})
+}
+
+// audit records an event. Failing to audit never fails the operation itself.
+func (service *CovoitService) audit(userID *uuid.UUID, action string, subject string, ip string) {
+	_, err := service.audits.CreateAuditEvent(AuditEvent{
+		UserID:    userID,
+		Action:    action,
+		Subject:   subject,
+		IP:        ip,
+		CreatedAt: service.clock(),
+	})
+	if err != nil {
+		log.Println("could not record audit event, err :", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	sessionTTL        = 30 * 24 * time.Hour
+	minPasswordLength = 8
+	// bcrypt ignores anything past 72 bytes.
+	maxPasswordLength = 72
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidPassword    = fmt.Errorf("password must be between %d and %d characters", minPasswordLength, maxPasswordLength)
+)
+
+// dummyPasswordHash is compared against when the email is unknown, so that
+// login takes the same time whether the account exists or not.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("covoit-dummy-password"), bcrypt.DefaultCost)
+
+type Session struct {
+	SessionID uuid.UUID  `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"session_id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	TokenHash string     `gorm:"uniqueIndex" json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+type AuthRepository interface {
+	CreateSession(session Session) (Session, error)
+	GetSessionByTokenHash(tokenHash string) (Session, error)
+	GetSessionsByUser(userID uuid.UUID) ([]Session, error)
+
+	CreatePasswordReset(reset PasswordReset) (PasswordReset, error)
+	GetPasswordResetByTokenHash(tokenHash string) (PasswordReset, error)
+	CompletePasswordReset(reset PasswordReset, passwordHash string, at time.Time) error
+	GetPasswordResetsByUser(userID uuid.UUID) ([]PasswordReset, error)
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "", ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("could not hash password, err : %s", err)
+	}
+	return string(hash), nil
+}
+
+func (repository *CovoitRepository) CreateSession(session Session) (Session, error) {
+	ctx := context.Background()
+	err := gorm.G[Session](repository.db).Create(ctx, &session)
+	if err != nil {
+		return Session{}, fmt.Errorf("could not create session for user %s, err : %s", session.UserID, err)
+	}
+	return session, nil
+}
+
+func (repository *CovoitRepository) GetSessionByTokenHash(tokenHash string) (Session, error) {
+	ctx := context.Background()
+	session, err := gorm.G[Session](repository.db).Where("token_hash = ?", tokenHash).First(ctx)
+	if err != nil {
+		return Session{}, fmt.Errorf("could not retrieve session, err : %s", err)
+	}
+	return session, nil
+}
+
+func (repository *CovoitRepository) GetSessionsByUser(userID uuid.UUID) ([]Session, error) {
+	ctx := context.Background()
+	sessions, err := gorm.G[Session](repository.db).Where("user_id = ?", userID).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get sessions of user %s, err : %s", userID, err)
+	}
+	return sessions, nil
+}
+
+func init() {
+	registerPersonalData("sessions", []string{"sessions"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.auth.GetSessionsByUser(userID)
+	})
+}
+
+func (service *CovoitService) Login(email string, password string) (string, error) {
+	user, err := service.repository.GetUserByEmail(email)
+	if err != nil || user.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return "", ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return "", ErrInvalidCredentials
+	}
+	token, tokenHash, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	now := service.clock()
+	_, err = service.auth.CreateSession(Session{
+		UserID:    user.UserID,
+		TokenHash: tokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (service *CovoitService) AuthenticateSession(token string) (Actor, error) {
+	session, err := service.auth.GetSessionByTokenHash(hashToken(token))
+	if err != nil {
+		return Actor{}, ErrInvalidToken
+	}
+	if session.RevokedAt != nil || !service.clock().Before(session.ExpiresAt) {
+		return Actor{}, ErrInvalidToken
+	}
+	user, err := service.repository.GetUserById(session.UserID)
+	if err != nil {
+		return Actor{}, ErrInvalidToken
+	}
+	return Actor{UserID: user.UserID, Role: user.Role}, nil
+}
+
+// SessionAuthenticator resolves actors from the bearer token handed out at
+// login.
+type SessionAuthenticator struct {
+	Service Service
+}
+
+func (a *SessionAuthenticator) Authenticate(r *http.Request) (Actor, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return Actor{}, ErrInvalidToken
+	}
+	return a.Service.AuthenticateSession(token)
+}
+
+// clientIP returns the address of the peer. Forwarding headers are ignored as
+// they can be set by anyone.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (h *Handler) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body := struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token, err := h.Service.Login(body.Email, body.Password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
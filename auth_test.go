@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) CreateSession(session Session) (Session, error) {
+	session.SessionID = uuid.New()
+	m.DB.Sessions = append(m.DB.Sessions, session)
+	return session, nil
+}
+
+func (m *MockRepository) GetSessionByTokenHash(tokenHash string) (Session, error) {
+	for _, session := range m.DB.Sessions {
+		if session.TokenHash == tokenHash {
+			return session, nil
+		}
+	}
+	return Session{}, fmt.Errorf("session not found")
+}
+
+func (m *MockRepository) GetSessionsByUser(userID uuid.UUID) ([]Session, error) {
+	found := []Session{}
+	for _, session := range m.DB.Sessions {
+		if session.UserID == userID {
+			found = append(found, session)
+		}
+	}
+	return found, nil
+}
+
+func TestLogin(t *testing.T) {
+	now := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+
+	user, err := s.CreateNewUser(User{UserID: uuid.New(), Email: "login@test.com", Password: "correct horse", Role: RoleDriver})
+	require.NoError(t, err)
+	require.Empty(t, user.Password)
+	require.NotEqual(t, "correct horse", user.PasswordHash)
+
+	t.Run("wrong password", func(t *testing.T) {
+		_, err := s.Login("login@test.com", "battery staple")
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+	})
+
+	t.Run("unknown email", func(t *testing.T) {
+		_, err := s.Login("nobody@test.com", "correct horse")
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+	})
+
+	t.Run("user without password", func(t *testing.T) {
+		_, err := s.Login("mehdibenfredj3@gmail.com", "")
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+	})
+
+	t.Run("session resolves the actor until it expires", func(t *testing.T) {
+		token, err := s.Login("login@test.com", "correct horse")
+		require.NoError(t, err)
+
+		actor, err := s.AuthenticateSession(token)
+		require.NoError(t, err)
+		require.Equal(t, Actor{UserID: user.UserID, Role: RoleDriver}, actor)
+
+		now = now.Add(sessionTTL)
+		_, err = s.AuthenticateSession(token)
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+}
+
+func TestCreateNewUserRejectsShortPassword(t *testing.T) {
+	s := NewMockService(CreateNewMockDB(t))
+	_, err := s.CreateNewUser(User{Email: "short@test.com", Password: "1234"})
+	require.ErrorIs(t, err, ErrInvalidPassword)
+}
+
+func TestCreateNewUserRejectsInvalidEmail(t *testing.T) {
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	users := len(db.Users)
+	for _, email := range []string{"", "not an email", "Amel <amel@test.com>"} {
+		_, err := s.CreateNewUser(User{Email: email, Password: "correct horse"})
+		require.ErrorIs(t, err, ErrInvalidEmail, email)
+	}
+	require.Len(t, db.Users, users)
+}
+
+func TestSessionAuthenticator(t *testing.T) {
+	mockSvc := new(MockService)
+	actor := Actor{UserID: uuid.New(), Role: RolePassenger}
+	mockSvc.On("AuthenticateSession", "good").Return(actor, nil)
+	mockSvc.On("AuthenticateSession", "bad").Return(Actor{}, ErrInvalidToken)
+	h := &Handler{Service: mockSvc, Authenticator: &SessionAuthenticator{Service: mockSvc}}
+
+	var got *Actor
+	next := h.authenticate(func(w http.ResponseWriter, r *http.Request) {
+		if actor, ok := ActorFromContext(r.Context()); ok {
+			got = &actor
+		}
+	})
+
+	for header, want := range map[string]*Actor{
+		"Bearer good": &actor,
+		"Bearer bad":  nil,
+		"good":        nil,
+		"":            nil,
+	} {
+		got = nil
+		req := httptest.NewRequest(http.MethodGet, "/bookings", nil)
+		req.Header.Set("Authorization", header)
+		next(httptest.NewRecorder(), req)
+		require.Equal(t, want, got, header)
+	}
+}
+
+func TestSessionsHandler(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("Login", "a@test.com", "good password").Return("token", nil)
+	mockSvc.On("Login", "a@test.com", "bad password").Return("", ErrInvalidCredentials)
+
+	req := httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBufferString(`{"email":"a@test.com","password":"good password"}`))
+	w := httptest.NewRecorder()
+	h.SessionsHandler(w, req)
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	body := map[string]string{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	require.Equal(t, "token", body["token"])
+
+	req = httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBufferString(`{"email":"a@test.com","password":"bad password"}`))
+	w = httptest.NewRecorder()
+	h.SessionsHandler(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
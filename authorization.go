@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+type Role string
+
+const (
+	RolePassenger Role = "passenger"
+	RoleDriver    Role = "driver"
+	RoleAdmin     Role = "admin"
+)
+
+// Actor is the authenticated user performing a request.
+type Actor struct {
+	UserID uuid.UUID
+	Role   Role
+}
+
+func (a Actor) IsAdmin() bool {
+	return a.Role == RoleAdmin
+}
+
+type actorContextKey struct{}
+
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+func ActorFromContext(ctx context.Context) (Actor, bool) {
+	actor, ok := ctx.Value(actorContextKey{}).(Actor)
+	return actor, ok
+}
+
+// Authenticator resolves the actor behind an incoming request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Actor, error)
+}
+
+// authenticate attaches the request's actor to its context when one can be
+// resolved. Anonymous requests go through untouched, handlers decide whether
+// they need an actor.
+func (h *Handler) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.Authenticator != nil {
+			if actor, err := h.Authenticator.Authenticate(r); err == nil {
+				r = r.WithContext(WithActor(r.Context(), actor))
+			}
+		}
+		next(w, r)
+	}
+}
+
+type Action string
+
+const (
+	ActionViewUserPII   Action = "user:view_pii"
+	ActionCreateUser    Action = "user:create"
+	ActionEditUser      Action = "user:edit"
+	ActionDeleteUser    Action = "user:delete"
+	ActionCreateRide    Action = "ride:create"
+	ActionEditRide      Action = "ride:edit"
+	ActionCancelRide    Action = "ride:cancel"
+	ActionCompleteRide  Action = "ride:complete"
+	ActionCreateBooking Action = "booking:create"
+	ActionViewBooking   Action = "booking:view"
+	ActionCancelBooking Action = "booking:cancel"
+	ActionManageVehicle Action = "vehicle:manage"
+	ActionManageTrash   Action = "trash:manage"
+
+	ActionManageNotifications Action = "notification:manage"
+	ActionManageWebhooks      Action = "webhook:manage"
+	ActionRefundPayment       Action = "payment:refund"
+	ActionViewWallet          Action = "wallet:view"
+	ActionViewInvoice         Action = "invoice:view"
+	ActionManagePromotions    Action = "promotion:manage"
+	ActionManagePayoutAccount Action = "payout_account:manage"
+	ActionViewPayouts         Action = "payout:view"
+	ActionManagePayouts       Action = "payout:manage"
+)
+
+// Resource carries the ownership facts a policy needs to make a decision.
+type Resource struct {
+	// OwnerID is the user the resource belongs to : the user itself, the
+	// passenger of a booking or the driver of a ride.
+	OwnerID uuid.UUID
+	// DriverID is the driver of the ride the resource is attached to.
+	DriverID uuid.UUID
+	// Role is the role requested for a user being created.
+	Role Role
+	// Counterpart is true when the actor and the owner share a confirmed booking.
+	Counterpart bool
+}
+
+func UserResource(user User, counterpart bool) Resource {
+	return Resource{OwnerID: user.UserID, Role: user.Role, Counterpart: counterpart}
+}
+
+func RideResource(ride Ride) Resource {
+	return Resource{OwnerID: ride.DriverID, DriverID: ride.DriverID}
+}
+
+func BookingResource(booking Booking, ride Ride) Resource {
+	return Resource{OwnerID: booking.UserID, DriverID: ride.DriverID}
+}
+
+type policy func(actor Actor, resource Resource) bool
+
+// policies is the single place where access rules live. Admins are allowed
+// everything before any policy is consulted.
+var policies = map[Action]policy{
+	ActionViewUserPII: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID || resource.Counterpart
+	},
+	ActionCreateUser: func(actor Actor, resource Resource) bool {
+		return resource.Role != RoleAdmin
+	},
+	ActionEditUser: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID
+	},
+	ActionDeleteUser: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID
+	},
+	ActionCreateRide: func(actor Actor, resource Resource) bool {
+		return actor.Role == RoleDriver && actor.UserID == resource.DriverID
+	},
+	ActionEditRide: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.DriverID
+	},
+	ActionCancelRide: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.DriverID
+	},
+	ActionCompleteRide: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.DriverID
+	},
+	ActionCreateBooking: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID
+	},
+	ActionViewBooking: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID || actor.UserID == resource.DriverID
+	},
+	ActionCancelBooking: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID || actor.UserID == resource.DriverID
+	},
+	ActionManageVehicle: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID
+	},
+	// Only admins restore what was deleted.
+	ActionManageTrash: func(actor Actor, resource Resource) bool {
+		return false
+	},
+	// Only admins look into the dead notifications and preview their
+	// templates.
+	ActionManageNotifications: func(actor Actor, resource Resource) bool {
+		return false
+	},
+	// Only admins register the webhooks of partners.
+	ActionManageWebhooks: func(actor Actor, resource Resource) bool {
+		return false
+	},
+	// Only admins refund, the escrow settles the payments otherwise.
+	ActionRefundPayment: func(actor Actor, resource Resource) bool {
+		return false
+	},
+	ActionViewWallet: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID
+	},
+	ActionViewInvoice: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID
+	},
+	// Only admins run promotions.
+	ActionManagePromotions: func(actor Actor, resource Resource) bool {
+		return false
+	},
+	ActionManagePayoutAccount: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID
+	},
+	ActionViewPayouts: func(actor Actor, resource Resource) bool {
+		return actor.UserID == resource.OwnerID
+	},
+	// Only admins export the payouts for the bank and record their outcome.
+	ActionManagePayouts: func(actor Actor, resource Resource) bool {
+		return false
+	},
+}
+
+// Authorize tells whether actor may perform action on resource. Unknown
+// actions are denied.
+func Authorize(actor Actor, action Action, resource Resource) bool {
+	if actor.IsAdmin() {
+		return true
+	}
+	p, ok := policies[action]
+	if !ok {
+		return false
+	}
+	return p(actor, resource)
+}
+
+// PublicProfile strips the personal data of a user.
+func (u User) PublicProfile() User {
+	u.Email = ""
+	u.Phone = ""
+	u.Address = ""
+	return u
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAuthorize(t *testing.T) {
+	passenger := Actor{UserID: uuid.New(), Role: RolePassenger}
+	driver := Actor{UserID: uuid.New(), Role: RoleDriver}
+	stranger := Actor{UserID: uuid.New(), Role: RolePassenger}
+	admin := Actor{UserID: uuid.New(), Role: RoleAdmin}
+	anonymous := Actor{}
+
+	ride := Ride{RideID: uuid.New(), DriverID: driver.UserID}
+	booking := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passenger.UserID}
+	passengerUser := User{UserID: passenger.UserID, Role: RolePassenger}
+
+	tests := []struct {
+		name     string
+		actor    Actor
+		action   Action
+		resource Resource
+		want     bool
+	}{
+		{"user sees own PII", passenger, ActionViewUserPII, UserResource(passengerUser, false), true},
+		{"stranger cannot see PII", stranger, ActionViewUserPII, UserResource(passengerUser, false), false},
+		{"counterpart sees PII", driver, ActionViewUserPII, UserResource(passengerUser, true), true},
+		{"admin sees PII", admin, ActionViewUserPII, UserResource(passengerUser, false), true},
+
+		{"anonymous signs up as passenger", anonymous, ActionCreateUser, Resource{Role: RolePassenger}, true},
+		{"anonymous signs up as driver", anonymous, ActionCreateUser, Resource{Role: RoleDriver}, true},
+		{"anonymous cannot sign up as admin", anonymous, ActionCreateUser, Resource{Role: RoleAdmin}, false},
+		{"admin creates admin", admin, ActionCreateUser, Resource{Role: RoleAdmin}, true},
+
+		{"user edits own profile", passenger, ActionEditUser, UserResource(passengerUser, false), true},
+		{"counterpart cannot edit profile", driver, ActionEditUser, UserResource(passengerUser, true), false},
+		{"admin edits profile", admin, ActionEditUser, UserResource(passengerUser, false), true},
+
+		{"user deletes own account", passenger, ActionDeleteUser, UserResource(passengerUser, false), true},
+		{"stranger cannot delete account", stranger, ActionDeleteUser, UserResource(passengerUser, false), false},
+		{"counterpart cannot delete account", driver, ActionDeleteUser, UserResource(passengerUser, true), false},
+
+		{"driver publishes own ride", driver, ActionCreateRide, RideResource(ride), true},
+		{"passenger cannot publish ride", passenger, ActionCreateRide, RideResource(Ride{DriverID: passenger.UserID}), false},
+		{"driver cannot publish for another driver", Actor{UserID: uuid.New(), Role: RoleDriver}, ActionCreateRide, RideResource(ride), false},
+
+		{"driver edits own ride", driver, ActionEditRide, RideResource(ride), true},
+		{"passenger cannot edit ride", passenger, ActionEditRide, RideResource(ride), false},
+		{"driver cancels own ride", driver, ActionCancelRide, RideResource(ride), true},
+		{"passenger cannot cancel ride", passenger, ActionCancelRide, RideResource(ride), false},
+		{"admin cancels ride", admin, ActionCancelRide, RideResource(ride), true},
+		{"driver completes own ride", driver, ActionCompleteRide, RideResource(ride), true},
+		{"passenger cannot complete ride", passenger, ActionCompleteRide, RideResource(ride), false},
+
+		{"passenger books for self", passenger, ActionCreateBooking, Resource{OwnerID: passenger.UserID}, true},
+		{"passenger cannot book for others", stranger, ActionCreateBooking, Resource{OwnerID: passenger.UserID}, false},
+
+		{"passenger sees booking", passenger, ActionViewBooking, BookingResource(booking, ride), true},
+		{"driver sees booking", driver, ActionViewBooking, BookingResource(booking, ride), true},
+		{"stranger cannot see booking", stranger, ActionViewBooking, BookingResource(booking, ride), false},
+		{"passenger cancels booking", passenger, ActionCancelBooking, BookingResource(booking, ride), true},
+		{"driver cancels booking", driver, ActionCancelBooking, BookingResource(booking, ride), true},
+		{"stranger cannot cancel booking", stranger, ActionCancelBooking, BookingResource(booking, ride), false},
+		{"anonymous cannot cancel booking", anonymous, ActionCancelBooking, BookingResource(booking, ride), false},
+
+		{"user manages own vehicles", driver, ActionManageVehicle, Resource{OwnerID: driver.UserID}, true},
+		{"stranger cannot manage vehicles", stranger, ActionManageVehicle, Resource{OwnerID: driver.UserID}, false},
+
+		{"unknown action is denied", passenger, Action("ride:teleport"), RideResource(ride), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Authorize(tt.actor, tt.action, tt.resource); got != tt.want {
+				t.Errorf("Authorize(%v, %s) = %v, want %v", tt.actor, tt.action, got, tt.want)
+			}
+		})
+	}
+}
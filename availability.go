@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// availabilityHistory is how many events are kept for the subscribers
+	// resuming with Last-Event-ID, older ones get a fresh snapshot instead.
+	availabilityHistory = 1024
+	// availabilityBuffer is how many events a subscriber may lag behind, a
+	// slower one is disconnected and resumes when it reconnects.
+	availabilityBuffer = 16
+	// maxAvailabilityRides caps the rides of a subscription.
+	maxAvailabilityRides = 200
+	// availabilityRetry is how long browsers wait before reconnecting, in
+	// milliseconds.
+	availabilityRetry = 3000
+)
+
+// availabilityHeartbeat is how often an idle stream gets a comment, to keep
+// proxies from closing it.
+var availabilityHeartbeat = 15 * time.Second
+
+var ErrInvalidSubscription = errors.New("invalid subscription")
+
+// AvailabilityEvent tells the seats left on a ride and its status.
+type AvailabilityEvent struct {
+	ID        uint64    `json:"-"`
+	RideID    uuid.UUID `json:"ride_id"`
+	Status    string    `json:"status"`
+	SeatsLeft int       `json:"seats_left"`
+}
+
+// AvailabilityBus fans the availability events out to the subscribers of
+// their ride. It lives in process, every instance of the server has its own.
+type AvailabilityBus struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []AvailabilityEvent
+	subscribers map[uuid.UUID]map[*AvailabilitySubscription]struct{}
+}
+
+func NewAvailabilityBus() *AvailabilityBus {
+	return &AvailabilityBus{subscribers: map[uuid.UUID]map[*AvailabilitySubscription]struct{}{}}
+}
+
+// AvailabilitySubscription receives the events of its rides on Events, which
+// is closed once the subscription is.
+type AvailabilitySubscription struct {
+	Events chan AvailabilityEvent
+	rides  []uuid.UUID
+	bus    *AvailabilityBus
+	closed bool
+}
+
+// Subscribe registers a subscription to rideIDs. When resuming after
+// lastEventID, it also returns the events missed since then, and false when
+// they are no longer all kept.
+func (bus *AvailabilityBus) Subscribe(rideIDs []uuid.UUID, lastEventID *uint64) (*AvailabilitySubscription, []AvailabilityEvent, bool) {
+	subscription := &AvailabilitySubscription{Events: make(chan AvailabilityEvent, availabilityBuffer), rides: rideIDs, bus: bus}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for _, rideID := range rideIDs {
+		if bus.subscribers[rideID] == nil {
+			bus.subscribers[rideID] = map[*AvailabilitySubscription]struct{}{}
+		}
+		bus.subscribers[rideID][subscription] = struct{}{}
+	}
+	if lastEventID == nil || *lastEventID > bus.lastID {
+		return subscription, nil, false
+	}
+	if len(bus.history) > 0 && *lastEventID+1 < bus.history[0].ID {
+		return subscription, nil, false
+	}
+	missed := []AvailabilityEvent{}
+	for _, event := range bus.history {
+		if event.ID > *lastEventID && subscription.watches(event.RideID) {
+			missed = append(missed, event)
+		}
+	}
+	return subscription, missed, true
+}
+
+func (subscription *AvailabilitySubscription) watches(rideID uuid.UUID) bool {
+	for _, id := range subscription.rides {
+		if id == rideID {
+			return true
+		}
+	}
+	return false
+}
+
+// Close unregisters the subscription.
+func (subscription *AvailabilitySubscription) Close() {
+	subscription.bus.mu.Lock()
+	defer subscription.bus.mu.Unlock()
+	subscription.bus.remove(subscription)
+}
+
+// remove must be called with mu held.
+func (bus *AvailabilityBus) remove(subscription *AvailabilitySubscription) {
+	if subscription.closed {
+		return
+	}
+	subscription.closed = true
+	for _, rideID := range subscription.rides {
+		delete(bus.subscribers[rideID], subscription)
+		if len(bus.subscribers[rideID]) == 0 {
+			delete(bus.subscribers, rideID)
+		}
+	}
+	close(subscription.Events)
+}
+
+// Watched tells whether anyone subscribed to the ride, the events of the
+// others need not be computed.
+func (bus *AvailabilityBus) Watched(rideID uuid.UUID) bool {
+	if bus == nil {
+		return false
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return len(bus.subscribers[rideID]) > 0
+}
+
+// LastEventID is the id of the latest event published.
+func (bus *AvailabilityBus) LastEventID() uint64 {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return bus.lastID
+}
+
+// Publish numbers event and hands it to the subscribers of its ride without
+// ever waiting on them.
+func (bus *AvailabilityBus) Publish(event AvailabilityEvent) AvailabilityEvent {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.lastID++
+	event.ID = bus.lastID
+	if len(bus.history) == availabilityHistory {
+		bus.history = bus.history[1:]
+	}
+	bus.history = append(bus.history, event)
+	for subscription := range bus.subscribers[event.RideID] {
+		select {
+		case subscription.Events <- event:
+		default:
+			bus.remove(subscription)
+		}
+	}
+	return event
+}
+
+// rideAvailability returns the current availability of the ride. A ride that
+// is gone is reported as cancelled.
+func (service *CovoitService) rideAvailability(rideID uuid.UUID) (AvailabilityEvent, error) {
+	ride, err := service.repository.GetRideById(rideID)
+	if err != nil {
+		return AvailabilityEvent{RideID: rideID, Status: RideCancelled}, nil
+	}
+	bookings, err := service.repository.GetBookingsByRide(rideID)
+	if err != nil {
+		return AvailabilityEvent{}, err
+	}
+	seatsLeft := ride.NumberOfSeats
+	for _, booking := range bookings {
+		if booking.Status == BookingPending || booking.Status == BookingConfirmed {
+			seatsLeft -= booking.NumberOfSeats
+		}
+	}
+	if ride.Status != RideScheduled {
+		seatsLeft = 0
+	}
+	return AvailabilityEvent{RideID: rideID, Status: ride.Status, SeatsLeft: seatsLeft}, nil
+}
+
+// publishAvailability tells the subscribers of the rides about their seats
+// left, after a change.
+func (service *CovoitService) publishAvailability(rideIDs ...uuid.UUID) {
+	for _, rideID := range rideIDs {
+		if !service.availability.Watched(rideID) {
+			continue
+		}
+		event, err := service.rideAvailability(rideID)
+		if err != nil {
+			log.Printf("could not publish availability of ride %s : %s", rideID, err)
+			continue
+		}
+		service.availability.Publish(event)
+	}
+}
+
+// ridesOf returns the rides the user drives or booked, the availability of
+// which changes with the account.
+func (service *CovoitService) ridesOf(userID uuid.UUID) []uuid.UUID {
+	rideIDs := []uuid.UUID{}
+	if rides, err := service.repository.GetRidesByDriver(userID); err == nil {
+		for _, ride := range rides {
+			rideIDs = append(rideIDs, ride.RideID)
+		}
+	}
+	if bookings, err := service.repository.GetBookingsByUser(userID); err == nil {
+		for _, booking := range bookings {
+			rideIDs = append(rideIDs, booking.RideID)
+		}
+	}
+	return rideIDs
+}
+
+// SubscribeAvailability subscribes to the availability of the rides. It
+// returns the events to send first : the ones missed since lastEventID, or
+// the current availability of every ride when those are unknown.
+func (service *CovoitService) SubscribeAvailability(rideIDs []uuid.UUID, lastEventID *uint64) (*AvailabilitySubscription, []AvailabilityEvent, error) {
+	if len(rideIDs) == 0 || len(rideIDs) > maxAvailabilityRides {
+		return nil, nil, fmt.Errorf("%w : between 1 and %d rides", ErrInvalidSubscription, maxAvailabilityRides)
+	}
+	lastID := service.availability.LastEventID()
+	subscription, missed, resumed := service.availability.Subscribe(rideIDs, lastEventID)
+	if resumed {
+		return subscription, missed, nil
+	}
+	snapshot := []AvailabilityEvent{}
+	for _, rideID := range rideIDs {
+		event, err := service.rideAvailability(rideID)
+		if err != nil {
+			subscription.Close()
+			return nil, nil, err
+		}
+		event.ID = lastID
+		snapshot = append(snapshot, event)
+	}
+	return subscription, snapshot, nil
+}
+
+// parseRideIDs reads the ride_id parameters, each one a ride id or a comma
+// separated list of them.
+func parseRideIDs(values []string) ([]uuid.UUID, error) {
+	rideIDs := []uuid.UUID{}
+	for _, value := range values {
+		for _, id := range strings.Split(value, ",") {
+			rideID, err := uuid.Parse(strings.TrimSpace(id))
+			if err != nil {
+				return nil, fmt.Errorf("%w : ride id %q", ErrInvalidSubscription, id)
+			}
+			rideIDs = append(rideIDs, rideID)
+		}
+	}
+	return rideIDs, nil
+}
+
+func writeAvailabilityEvent(w http.ResponseWriter, event AvailabilityEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: availability\ndata: %s\n\n", event.ID, data)
+	return err
+}
+
+// AvailabilityHandler streams the seat availability of the rides given as
+// ride_id as Server-Sent Events. Clients resume with the Last-Event-ID header,
+// or the last_event_id parameter.
+func (h *Handler) AvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rideIDs, err := parseRideIDs(r.URL.Query()["ride_id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var lastEventID *uint64
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("last_event_id")
+	}
+	if last != "" {
+		id, err := strconv.ParseUint(last, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lastEventID = &id
+	}
+	subscription, events, err := h.Service.SubscribeAvailability(rideIDs, lastEventID)
+	if errors.Is(err, ErrInvalidSubscription) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", availabilityRetry)
+	for _, event := range events {
+		if err := writeAvailabilityEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(availabilityHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+			if err := writeAvailabilityEvent(w, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
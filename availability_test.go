@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvailabilityBus(t *testing.T) {
+	bus := NewAvailabilityBus()
+	watched, other := uuid.New(), uuid.New()
+	subscription, missed, resumed := bus.Subscribe([]uuid.UUID{watched}, nil)
+	require.False(t, resumed)
+	require.Empty(t, missed)
+	require.True(t, bus.Watched(watched))
+	require.False(t, bus.Watched(other))
+
+	first := bus.Publish(AvailabilityEvent{RideID: watched, Status: RideScheduled, SeatsLeft: 2})
+	bus.Publish(AvailabilityEvent{RideID: other, Status: RideScheduled, SeatsLeft: 3})
+	last := bus.Publish(AvailabilityEvent{RideID: watched, Status: RideScheduled, SeatsLeft: 1})
+	require.Equal(t, first, <-subscription.Events)
+	require.Equal(t, last, <-subscription.Events)
+	require.Empty(t, subscription.Events, "events of other rides are not received")
+
+	resumedSubscription, missed, resumed := bus.Subscribe([]uuid.UUID{watched}, &first.ID)
+	require.True(t, resumed)
+	require.Equal(t, []AvailabilityEvent{last}, missed)
+	resumedSubscription.Close()
+	resumedSubscription.Close()
+
+	for i := 0; i <= availabilityBuffer; i++ {
+		bus.Publish(AvailabilityEvent{RideID: watched, Status: RideScheduled, SeatsLeft: 1})
+	}
+	for range subscription.Events {
+	}
+	require.False(t, bus.Watched(watched), "a subscriber lagging behind is dropped")
+	subscription.Close()
+
+	for i := 0; i < availabilityHistory; i++ {
+		bus.Publish(AvailabilityEvent{RideID: other, Status: RideScheduled, SeatsLeft: 3})
+	}
+	subscription, _, resumed = bus.Subscribe([]uuid.UUID{watched}, &last.ID)
+	require.False(t, resumed, "the events missed are no longer all kept")
+	subscription.Close()
+	future := bus.LastEventID() + 1
+	subscription, _, resumed = bus.Subscribe([]uuid.UUID{watched}, &future)
+	require.False(t, resumed, "an id from another instance")
+	subscription.Close()
+}
+
+type sseEvent struct {
+	id   string
+	data string
+}
+
+// readSSE returns the next event of the stream, recording the comments it
+// skips.
+func readSSE(t *testing.T, stream *bufio.Reader, comments *[]string) sseEvent {
+	t.Helper()
+	event := sseEvent{}
+	for {
+		line, err := stream.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event.data != "":
+			return event
+		case strings.HasPrefix(line, ":"):
+			*comments = append(*comments, line)
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func openAvailabilityStream(t *testing.T, server *httptest.Server, query string, lastEventID string) *bufio.Reader {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/rides/availability?"+query, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	return bufio.NewReader(res.Body)
+}
+
+func TestAvailabilityStream(t *testing.T) {
+	heartbeat := availabilityHeartbeat
+	availabilityHeartbeat = 20 * time.Millisecond
+	t.Cleanup(func() { availabilityHeartbeat = heartbeat })
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	h := &Handler{Service: s}
+	server := httptest.NewServer(http.HandlerFunc(h.AvailabilityHandler))
+	t.Cleanup(server.Close)
+	driverID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	passengerID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	ride := Ride{RideID: uuid.New(), DriverID: driverID, DepartureTime: now.Add(24 * time.Hour), NumberOfSeats: 3, Status: RideScheduled}
+	db.Rides = append(db.Rides, ride)
+	gone := uuid.New()
+
+	comments := []string{}
+	stream := openAvailabilityStream(t, server, "ride_id="+ride.RideID.String()+","+gone.String(), "")
+	var event AvailabilityEvent
+	require.NoError(t, json.Unmarshal([]byte(readSSE(t, stream, &comments).data), &event))
+	require.Equal(t, AvailabilityEvent{RideID: ride.RideID, Status: RideScheduled, SeatsLeft: 3}, event)
+	require.NoError(t, json.Unmarshal([]byte(readSSE(t, stream, &comments).data), &event))
+	require.Equal(t, AvailabilityEvent{RideID: gone, Status: RideCancelled}, event)
+
+	booking, err := s.CreateBooking(Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 2})
+	require.NoError(t, err)
+	booked := readSSE(t, stream, &comments)
+	require.NoError(t, json.Unmarshal([]byte(booked.data), &event))
+	require.Equal(t, 1, event.SeatsLeft)
+
+	require.NoError(t, s.DeleteBooking(booking.BookingID, passengerID))
+	require.NoError(t, json.Unmarshal([]byte(readSSE(t, stream, &comments).data), &event))
+	require.Equal(t, 3, event.SeatsLeft)
+	require.NoError(t, s.DeleteRide(ride.RideID, driverID))
+	cancelled := readSSE(t, stream, &comments)
+	require.NoError(t, json.Unmarshal([]byte(cancelled.data), &event))
+	require.Equal(t, AvailabilityEvent{RideID: ride.RideID, Status: RideCancelled}, event)
+
+	line, err := stream.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, ": heartbeat\n", line, "an idle stream is kept alive")
+
+	resumed := openAvailabilityStream(t, server, "ride_id="+ride.RideID.String(), booked.id)
+	replayed := readSSE(t, resumed, &comments)
+	require.NoError(t, json.Unmarshal([]byte(replayed.data), &event))
+	require.Equal(t, 3, event.SeatsLeft, "the events missed are replayed in order")
+	require.Equal(t, cancelled, readSSE(t, resumed, &comments))
+}
+
+func TestAvailabilityHandler(t *testing.T) {
+	h := &Handler{Service: NewMockService(CreateNewMockDB(t))}
+	rideID := uuid.New().String()
+	tooMany := make([]string, maxAvailabilityRides+1)
+	for i := range tooMany {
+		tooMany[i] = uuid.New().String()
+	}
+	for _, tc := range []struct {
+		name        string
+		method      string
+		url         string
+		lastEventID string
+		status      int
+	}{
+		{"no rides", http.MethodGet, "/rides/availability", "", http.StatusBadRequest},
+		{"invalid ride", http.MethodGet, "/rides/availability?ride_id=lyon", "", http.StatusBadRequest},
+		{"too many rides", http.MethodGet, "/rides/availability?ride_id=" + strings.Join(tooMany, ","), "", http.StatusBadRequest},
+		{"invalid last event id", http.MethodGet, "/rides/availability?ride_id=" + rideID, "yesterday", http.StatusBadRequest},
+		{"post", http.MethodPost, "/rides/availability?ride_id=" + rideID, "", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		if tc.lastEventID != "" {
+			req.Header.Set("Last-Event-ID", tc.lastEventID)
+		}
+		w := httptest.NewRecorder()
+		h.AvailabilityHandler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
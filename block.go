@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidBlock = errors.New("invalid block")
+	ErrUserBlocked  = errors.New("you blocked this user")
+	// ErrRideNotFound is also what a blocked user gets for the rides of the
+	// blocker, blocking must not show.
+	ErrRideNotFound = errors.New("ride not found")
+)
+
+// Block is a user, the blocker, keeping another one away. Only the blocker
+// ever sees it.
+type Block struct {
+	BlockerID uuid.UUID `gorm:"type:uuid;primaryKey" json:"blocker_id"`
+	BlockedID uuid.UUID `gorm:"type:uuid;primaryKey;index" json:"blocked_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BlockRepository interface {
+	// CreateBlock records the block and flags the future bookings between the
+	// two users for the blocker to cancel free of charge.
+	CreateBlock(block Block) error
+	// DeleteBlock lifts the block and the flags it set.
+	DeleteBlock(blockerID uuid.UUID, blockedID uuid.UUID) error
+	GetBlocksByBlocker(blockerID uuid.UUID) ([]Block, error)
+	// GetBlocksInvolving returns the blocks made by or against the user.
+	GetBlocksInvolving(userID uuid.UUID) ([]Block, error)
+}
+
+// betweenBookings selects the bookings of rides a drives that b booked, and
+// the other way around.
+func betweenBookings(tx *gorm.DB, a uuid.UUID, b uuid.UUID) (string, []any) {
+	ridesOf := func(driverID uuid.UUID) *gorm.DB {
+		return tx.Model(&Ride{}).Select("ride_id").Where("driver_id = ?", driverID)
+	}
+	return "(user_id = ? AND ride_id IN (?)) OR (user_id = ? AND ride_id IN (?))", []any{b, ridesOf(a), a, ridesOf(b)}
+}
+
+func (repository *CovoitRepository) CreateBlock(block Block) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		err := gorm.G[Block](tx, clause.OnConflict{DoNothing: true}).Create(ctx, &block)
+		if err != nil {
+			return fmt.Errorf("could not block user %s, err : %s", block.BlockedID, err)
+		}
+		between, args := betweenBookings(tx, block.BlockerID, block.BlockedID)
+		futureRides := tx.Model(&Ride{}).Select("ride_id").Where("status = ? AND departure_time > ?", RideScheduled, block.CreatedAt)
+		_, err = gorm.G[Booking](tx).
+			Where("status = ? AND ride_id IN (?)", BookingConfirmed, futureRides).
+			Where(between, args...).
+			Update(ctx, "free_cancellation_for", block.BlockerID)
+		if err != nil {
+			return fmt.Errorf("could not flag bookings with user %s, err : %s", block.BlockedID, err)
+		}
+		return nil
+	})
+}
+
+func (repository *CovoitRepository) DeleteBlock(blockerID uuid.UUID, blockedID uuid.UUID) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		_, err := gorm.G[Block](tx).Where("blocker_id = ? AND blocked_id = ?", blockerID, blockedID).Delete(ctx)
+		if err != nil {
+			return fmt.Errorf("could not unblock user %s, err : %s", blockedID, err)
+		}
+		between, args := betweenBookings(tx, blockerID, blockedID)
+		_, err = gorm.G[Booking](tx).
+			Where("free_cancellation_for = ?", blockerID).
+			Where(between, args...).
+			Update(ctx, "free_cancellation_for", nil)
+		if err != nil {
+			return fmt.Errorf("could not unflag bookings with user %s, err : %s", blockedID, err)
+		}
+		return nil
+	})
+}
+
+func (repository *CovoitRepository) GetBlocksByBlocker(blockerID uuid.UUID) ([]Block, error) {
+	ctx := context.Background()
+	blocks, err := gorm.G[Block](repository.db).Where("blocker_id = ?", blockerID).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get blocks of user %s, err : %s", blockerID, err)
+	}
+	return blocks, nil
+}
+
+func (repository *CovoitRepository) GetBlocksInvolving(userID uuid.UUID) ([]Block, error) {
+	ctx := context.Background()
+	blocks, err := gorm.G[Block](repository.db).Where("blocker_id = ? OR blocked_id = ?", userID, userID).Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get blocks involving user %s, err : %s", userID, err)
+	}
+	return blocks, nil
+}
+
+func init() {
+	// The blocks made against the user are not theirs to see.
+	registerPersonalData("blocks", []string{"blocks"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.blocks.GetBlocksByBlocker(userID)
+	})
+}
+
+// findBlock returns the block blockerID made against blockedID among blocks.
+func findBlock(blocks []Block, blockerID uuid.UUID, blockedID uuid.UUID) (Block, bool) {
+	for _, block := range blocks {
+		if block.BlockerID == blockerID && block.BlockedID == blockedID {
+			return block, true
+		}
+	}
+	return Block{}, false
+}
+
+// checkBookingBlock keeps a passenger from booking the ride of a driver when
+// either blocked the other. A blocked passenger is told the ride does not
+// exist.
+func (service *CovoitService) checkBookingBlock(booking Booking) error {
+	blocks, err := service.blocks.GetBlocksInvolving(booking.UserID)
+	if err != nil || len(blocks) == 0 {
+		return err
+	}
+	ride, err := service.repository.GetRideById(booking.RideID)
+	if err != nil {
+		return ErrRideNotFound
+	}
+	if _, ok := findBlock(blocks, ride.DriverID, booking.UserID); ok {
+		return ErrRideNotFound
+	}
+	if _, ok := findBlock(blocks, booking.UserID, ride.DriverID); ok {
+		return ErrUserBlocked
+	}
+	return nil
+}
+
+func (service *CovoitService) BlockUser(blockerID uuid.UUID, blockedID uuid.UUID) error {
+	if blockerID == blockedID {
+		return fmt.Errorf("%w : users cannot block themselves", ErrInvalidBlock)
+	}
+	if _, err := service.repository.GetUserById(blockedID); err != nil {
+		return fmt.Errorf("%w : unknown user %s", ErrInvalidBlock, blockedID)
+	}
+	return service.blocks.CreateBlock(Block{BlockerID: blockerID, BlockedID: blockedID, CreatedAt: service.clock()})
+}
+
+func (service *CovoitService) UnblockUser(blockerID uuid.UUID, blockedID uuid.UUID) error {
+	return service.blocks.DeleteBlock(blockerID, blockedID)
+}
+
+func (service *CovoitService) GetBlockedUsers(blockerID uuid.UUID) ([]Block, error) {
+	return service.blocks.GetBlocksByBlocker(blockerID)
+}
+
+// GetRidesFor returns the rides viewerID may see, the rides of the users it
+// blocked or that blocked it are left out.
+func (service *CovoitService) GetRidesFor(viewerID uuid.UUID) ([]Ride, error) {
+	blocks, err := service.blocks.GetBlocksInvolving(viewerID)
+	if err != nil {
+		return nil, err
+	}
+	rides, err := service.GetAllRides()
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]Ride, 0, len(rides))
+	for _, ride := range rides {
+		_, blocked := findBlock(blocks, ride.DriverID, viewerID)
+		_, blocking := findBlock(blocks, viewerID, ride.DriverID)
+		if !blocked && !blocking {
+			visible = append(visible, ride)
+		}
+	}
+	return visible, nil
+}
+
+func (h *Handler) BlocksHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			blocks, err := h.Service.GetBlockedUsers(actor.UserID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(blocks)
+		}
+	case http.MethodPost:
+		{
+			body := struct {
+				UserID uuid.UUID `json:"user_id"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := h.Service.BlockUser(actor.UserID, body.UserID)
+			if errors.Is(err, ErrInvalidBlock) {
+				w.WriteHeader(http.StatusBadRequest)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	case http.MethodDelete:
+		{
+			userID, err := uuid.Parse(r.URL.Query().Get("user_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := h.Service.UnblockUser(actor.UserID, userID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
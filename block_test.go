@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// between tells whether booking is on a ride a drives and b booked.
+func (m *MockRepository) between(booking Booking, a uuid.UUID, b uuid.UUID) bool {
+	ride, err := m.GetRideById(booking.RideID)
+	return err == nil && ride.DriverID == a && booking.UserID == b
+}
+
+func (m *MockRepository) CreateBlock(block Block) error {
+	if _, ok := findBlock(m.DB.Blocks, block.BlockerID, block.BlockedID); !ok {
+		m.DB.Blocks = append(m.DB.Blocks, block)
+	}
+	for i, booking := range m.DB.Bookings {
+		ride, err := m.GetRideById(booking.RideID)
+		if err != nil || booking.Status != BookingConfirmed || ride.Status != RideScheduled || !ride.DepartureTime.After(block.CreatedAt) {
+			continue
+		}
+		if m.between(booking, block.BlockerID, block.BlockedID) || m.between(booking, block.BlockedID, block.BlockerID) {
+			m.DB.Bookings[i].FreeCancellationFor = &block.BlockerID
+		}
+	}
+	return nil
+}
+
+func (m *MockRepository) DeleteBlock(blockerID uuid.UUID, blockedID uuid.UUID) error {
+	m.DB.Blocks = slices.DeleteFunc(m.DB.Blocks, func(block Block) bool {
+		return block.BlockerID == blockerID && block.BlockedID == blockedID
+	})
+	for i, booking := range m.DB.Bookings {
+		if booking.FreeCancellationFor == nil || *booking.FreeCancellationFor != blockerID {
+			continue
+		}
+		if m.between(booking, blockerID, blockedID) || m.between(booking, blockedID, blockerID) {
+			m.DB.Bookings[i].FreeCancellationFor = nil
+		}
+	}
+	return nil
+}
+
+func (m *MockRepository) GetBlocksByBlocker(blockerID uuid.UUID) ([]Block, error) {
+	blocks := []Block{}
+	for _, block := range m.DB.Blocks {
+		if block.BlockerID == blockerID {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+func (m *MockRepository) GetBlocksInvolving(userID uuid.UUID) ([]Block, error) {
+	blocks := []Block{}
+	for _, block := range m.DB.Blocks {
+		if block.BlockerID == userID || block.BlockedID == userID {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+func rideIDs(rides []Ride) []uuid.UUID {
+	ids := []uuid.UUID{}
+	for _, ride := range rides {
+		ids = append(ids, ride.RideID)
+	}
+	return ids
+}
+
+func TestBlockUser(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	passengerID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+
+	ride := Ride{RideID: uuid.New(), DriverID: driverID, DepartureTime: now.Add(24 * time.Hour), NumberOfSeats: 3, Status: RideScheduled}
+	seat := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, Status: BookingConfirmed}
+	db.Rides = append(db.Rides, ride)
+	db.Bookings = append(db.Bookings, seat)
+
+	require.ErrorIs(t, s.BlockUser(driverID, driverID), ErrInvalidBlock)
+	require.ErrorIs(t, s.BlockUser(driverID, uuid.New()), ErrInvalidBlock)
+	require.NoError(t, s.BlockUser(driverID, passengerID))
+	require.NoError(t, s.BlockUser(driverID, passengerID), "blocking twice is harmless")
+	blocks, err := s.GetBlockedUsers(driverID)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	blocks, err = s.GetBlockedUsers(passengerID)
+	require.NoError(t, err)
+	require.Empty(t, blocks, "the blocked user does not learn of the block")
+
+	rides, err := s.GetRidesFor(passengerID)
+	require.NoError(t, err)
+	require.NotContains(t, rideIDs(rides), ride.RideID)
+	rides, err = s.GetRidesFor(driverID)
+	require.NoError(t, err)
+	require.Contains(t, rideIDs(rides), ride.RideID)
+
+	_, err = s.CreateBooking(Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1})
+	require.ErrorIs(t, err, ErrRideNotFound)
+
+	bookings, err := s.GetBookingsForUser(driverID)
+	require.NoError(t, err)
+	require.Len(t, bookings, 1)
+	require.True(t, bookings[0].FreeCancellation)
+	bookings, err = s.GetBookingsForUser(passengerID)
+	require.NoError(t, err)
+	require.Len(t, bookings, 1)
+	require.False(t, bookings[0].FreeCancellation)
+	body, err := json.Marshal(bookings[0])
+	require.NoError(t, err)
+	require.NotContains(t, string(body), "free_cancellation")
+
+	require.NoError(t, s.DeleteBooking(seat.BookingID, driverID))
+	require.Zero(t, db.Reputations[passengerID].Cancellations, "the blocker cancels free of charge")
+
+	require.NoError(t, s.UnblockUser(driverID, passengerID))
+	require.NoError(t, s.BlockUser(passengerID, driverID))
+	_, err = s.CreateBooking(Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1})
+	require.ErrorIs(t, err, ErrUserBlocked)
+	rides, err = s.GetRidesFor(passengerID)
+	require.NoError(t, err)
+	require.NotContains(t, rideIDs(rides), ride.RideID)
+
+	require.NoError(t, s.UnblockUser(passengerID, driverID))
+	_, err = s.CreateBooking(Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1})
+	require.NoError(t, err)
+}
+
+func TestBlocksHandler(t *testing.T) {
+	owner := Actor{UserID: uuid.New(), Role: RolePassenger}
+	otherID := uuid.New()
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("GetBlockedUsers", owner.UserID).Return([]Block{{BlockerID: owner.UserID, BlockedID: otherID}}, nil)
+	mockSvc.On("BlockUser", owner.UserID, otherID).Return(nil)
+	mockSvc.On("BlockUser", owner.UserID, owner.UserID).Return(ErrInvalidBlock)
+	mockSvc.On("UnblockUser", owner.UserID, otherID).Return(nil)
+
+	blockBody := func(userID uuid.UUID) *bytes.Buffer {
+		body, _ := json.Marshal(map[string]uuid.UUID{"user_id": userID})
+		return bytes.NewBuffer(body)
+	}
+	for _, tc := range []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"list", asActor(httptest.NewRequest(http.MethodGet, "/blocks", nil), owner), http.StatusOK},
+		{"block", asActor(httptest.NewRequest(http.MethodPost, "/blocks", blockBody(otherID)), owner), http.StatusNoContent},
+		{"block oneself", asActor(httptest.NewRequest(http.MethodPost, "/blocks", blockBody(owner.UserID)), owner), http.StatusBadRequest},
+		{"unblock", asActor(httptest.NewRequest(http.MethodDelete, "/blocks?user_id="+otherID.String(), nil), owner), http.StatusNoContent},
+		{"unblock without id", asActor(httptest.NewRequest(http.MethodDelete, "/blocks", nil), owner), http.StatusBadRequest},
+		{"anonymous", httptest.NewRequest(http.MethodGet, "/blocks", nil), http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		h.BlocksHandler(w, tc.req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
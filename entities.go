@@ -1,39 +1,108 @@
 package main
 
 import (
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type User struct {
-	UserID    uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()"  json:"user_id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `gorm:"uniqueIndex" json:"email"`
-	Phone     string    `json:"phone"`
-	Address   string    `json:"adress"`
-	Bookings  []Booking `gorm:"foreignKey:UserID" json:"bookings"`
+	UserID          uuid.UUID   `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()"  json:"user_id"`
+	FirstName       string      `json:"first_name"`
+	LastName        string      `json:"last_name"`
+	Email           string      `gorm:"uniqueIndex" json:"email"`
+	Phone           string      `json:"phone"`
+	Address         string      `json:"adress"`
+	Bio             string      `json:"bio"`
+	Preferences     Preferences `gorm:"type:jsonb;serializer:json" json:"preferences"`
+	Role            Role        `gorm:"default:passenger" json:"role"`
+	EmailVerifiedAt *time.Time  `json:"email_verified_at"`
+	PhoneVerifiedAt *time.Time  `json:"phone_verified_at"`
+	PasswordHash    string      `json:"-"`
+	Password        string      `gorm:"-" json:"password,omitempty"`
+	CreatedAt       time.Time   `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	ErasedAt        *time.Time  `json:"erased_at,omitempty"`
+	Bookings        []Booking   `gorm:"foreignKey:UserID" json:"bookings"`
+
+	// DeletedAt is set while the account is deactivated.
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at,omitempty"`
+	DeletedBy *uuid.UUID     `gorm:"type:uuid" json:"deleted_by,omitempty"`
+
+	Reputation *ReputationSummary `gorm:"-" json:"reputation,omitempty"`
 }
 
 type Ride struct {
-	RideID        uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"ride_id"`
-	Origin        string    `json:"origin"`
-	Destination   string    `json:"destination"`
-	DriverID      uuid.UUID `json:"driver_id"`
-	DepartureTime time.Time `json:"departure_time"`
-	ArrivalTime   time.Time `json:"arrival_time"`
-	Distance      float64   `json:"distance"`
-	Price         float64   `json:"price"`
-	NumberOfSeats int       `json:"number_of_seats"`
-	Bookings      []Booking `gorm:"foreignKey:RideID" json:"bookings"`
+	RideID        uuid.UUID  `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"ride_id"`
+	Origin        string     `json:"origin"`
+	Destination   string     `json:"destination"`
+	DriverID      uuid.UUID  `json:"driver_id"`
+	VehicleID     *uuid.UUID `gorm:"type:uuid" json:"vehicle_id"`
+	DepartureTime time.Time  `json:"departure_time"`
+	ArrivalTime   time.Time  `json:"arrival_time"`
+	Distance      float64    `json:"distance"`
+	Price         Money      `gorm:"embedded;embeddedPrefix:price_" json:"price"`
+	NumberOfSeats int        `json:"number_of_seats"`
+	Status        string     `gorm:"default:scheduled" json:"status"`
+	Bookings      []Booking  `gorm:"foreignKey:RideID" json:"bookings"`
+
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at,omitempty"`
+	DeletedBy *uuid.UUID     `gorm:"type:uuid" json:"deleted_by,omitempty"`
+	// PurgedAt archives a deleted ride past the retention period whose
+	// bookings or reviews are still kept.
+	PurgedAt *time.Time `json:"-"`
+
+	DriverReputation *ReputationSummary `gorm:"-" json:"driver_reputation,omitempty"`
 }
 
+const (
+	RideScheduled = "scheduled"
+	RideCompleted = "completed"
+	RideCancelled = "cancelled"
+)
+
 type Booking struct {
 	BookingID     uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"booking_id"`
 	RideID        uuid.UUID `json:"ride_id"`
 	UserID        uuid.UUID `json:"user_id"`
 	NumberOfSeats int       `json:"number_of_seats"`
-	TotalPrice    float64   `json:"total_price"`
+	TotalPrice    Money     `gorm:"embedded;embeddedPrefix:total_price_" json:"total_price"`
 	BookingTime   time.Time `json:"booking_time"`
+	Status        string    `gorm:"default:confirmed" json:"status"`
+
+	// PromoCode is the promotion code the passenger books with. PromotionID
+	// is the promotion applied and Discount what it took off TotalPrice.
+	PromoCode   string     `gorm:"-" json:"promo_code,omitempty"`
+	PromotionID *uuid.UUID `gorm:"type:uuid;index" json:"promotion_id,omitempty"`
+	Discount    Money      `gorm:"embedded;embeddedPrefix:discount_" json:"discount,omitzero"`
+
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at,omitempty"`
+	DeletedBy *uuid.UUID     `gorm:"type:uuid" json:"deleted_by,omitempty"`
+	// PurgedAt archives a deleted booking past the retention period that
+	// payments or reviews still refer to.
+	PurgedAt *time.Time `json:"-"`
+
+	// FreeCancellationFor is the user who blocked the other party of the
+	// booking and may cancel it without penalty. It never leaves the server,
+	// FreeCancellation tells the blocker alone.
+	FreeCancellationFor *uuid.UUID `gorm:"type:uuid" json:"-"`
+	FreeCancellation    bool       `gorm:"-" json:"free_cancellation,omitempty"`
+
+	Vehicle *Vehicle `gorm:"-" json:"vehicle,omitempty"`
 }
+
+const (
+	// BookingPending is a booking awaiting confirmation, contact details in
+	// its messages are masked.
+	BookingPending   = "pending"
+	BookingConfirmed = "confirmed"
+	BookingCancelled = "cancelled"
+	BookingNoShow    = "no_show"
+)
+
+var (
+	ErrBookingNotPending = errors.New("booking is not pending")
+	ErrInvalidBooking    = errors.New("invalid booking")
+	ErrRideNotEditable   = errors.New("ride cannot be edited")
+)
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrUserErased = errors.New("user already erased")
+
+// Erasure records that the personal data of a user was erased. The user row is
+// kept, anonymized, so that the rides, bookings and reviews it is part of stay
+// consistent for accounting and for the other party.
+type Erasure struct {
+	ErasureID uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"erasure_id"`
+	UserID    uuid.UUID `gorm:"type:uuid;uniqueIndex" json:"user_id"`
+	// RidesCancelled are the future rides the user was driving.
+	RidesCancelled []uuid.UUID `gorm:"type:jsonb;serializer:json" json:"rides_cancelled"`
+	// BookingsCancelled are the future bookings of the user and the bookings
+	// of the passengers of RidesCancelled.
+	BookingsCancelled []uuid.UUID `gorm:"type:jsonb;serializer:json" json:"bookings_cancelled"`
+	ErasedAt          time.Time   `json:"erased_at"`
+}
+
+type ErasureRepository interface {
+	// EraseUser cancels the future rides and bookings of the user, anonymizes
+	// its personal data and records the erasure, all at once.
+	EraseUser(userID uuid.UUID, at time.Time) (Erasure, error)
+	GetErasuresByUser(userID uuid.UUID) ([]Erasure, error)
+}
+
+// erasedEmail is a placeholder that keeps the email unique and frees the real
+// one for a future account.
+func erasedEmail(userID uuid.UUID) string {
+	return fmt.Sprintf("erased-%s@erased.invalid", userID)
+}
+
+func (repository *CovoitRepository) EraseUser(userID uuid.UUID, at time.Time) (Erasure, error) {
+	erasure := Erasure{UserID: userID, RidesCancelled: []uuid.UUID{}, BookingsCancelled: []uuid.UUID{}, ErasedAt: at}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		user, err := gorm.G[User](tx).Scopes(unscoped).Where("user_id = ?", userID).First(ctx)
+		if err != nil {
+			return fmt.Errorf("User %v not found, err : %s", userID, err)
+		}
+		if user.ErasedAt != nil {
+			return ErrUserErased
+		}
+
+		rides, err := gorm.G[Ride](tx).Where("driver_id = ? AND status = ? AND departure_time > ?", userID, RideScheduled, at).Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get future rides of user %s, err : %s", userID, err)
+		}
+		for _, ride := range rides {
+			erasure.RidesCancelled = append(erasure.RidesCancelled, ride.RideID)
+		}
+		// Pending bookings hold an authorized payment too, they go with the
+		// confirmed ones.
+		futureRides := tx.Model(&Ride{}).Select("ride_id").Where("status = ? AND departure_time > ?", RideScheduled, at)
+		bookings, err := gorm.G[Booking](tx).
+			Where("status IN ? AND (ride_id IN ? OR (user_id = ? AND ride_id IN (?)))", []string{BookingPending, BookingConfirmed}, erasure.RidesCancelled, userID, futureRides).
+			Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get future bookings of user %s, err : %s", userID, err)
+		}
+		notifications := []Notification{}
+		for _, booking := range bookings {
+			erasure.BookingsCancelled = append(erasure.BookingsCancelled, booking.BookingID)
+			if booking.UserID == userID {
+				continue
+			}
+			for _, ride := range rides {
+				if ride.RideID == booking.RideID {
+					notifications = append(notifications, rideNotification(NotificationRideCancelled, booking.UserID, ride, &booking))
+				}
+			}
+		}
+		if len(erasure.BookingsCancelled) > 0 {
+			_, err = gorm.G[Booking](tx).Where("booking_id IN ?", erasure.BookingsCancelled).Update(ctx, "status", BookingCancelled)
+			if err != nil {
+				return fmt.Errorf("could not cancel bookings of user %s, err : %s", userID, err)
+			}
+		}
+		if err := settlePayments(tx, PaymentRelease, 0, erasure.BookingsCancelled...); err != nil {
+			return err
+		}
+		if err := releasePromotions(tx, bookings...); err != nil {
+			return err
+		}
+		if len(erasure.RidesCancelled) > 0 {
+			_, err = gorm.G[Ride](tx).Where("ride_id IN ?", erasure.RidesCancelled).Update(ctx, "status", RideCancelled)
+			if err != nil {
+				return fmt.Errorf("could not cancel rides of user %s, err : %s", userID, err)
+			}
+		}
+
+		_, err = gorm.G[User](tx).Scopes(unscoped).
+			Where("user_id = ?", userID).
+			Select("first_name", "last_name", "email", "phone", "address", "bio", "preferences", "email_verified_at", "phone_verified_at", "password_hash", "erased_at").
+			Updates(ctx, User{FirstName: "Deleted", LastName: "user", Email: erasedEmail(userID), ErasedAt: &at})
+		if err != nil {
+			return fmt.Errorf("could not anonymize user %s, err : %s", userID, err)
+		}
+		_, err = gorm.G[Vehicle](tx).Where("owner_id = ?", userID).Select("plate", "color").Updates(ctx, Vehicle{})
+		if err != nil {
+			return fmt.Errorf("could not anonymize vehicles of user %s, err : %s", userID, err)
+		}
+		_, err = gorm.G[AuditEvent](tx).Where("user_id = ?", userID).Select("subject", "ip").Updates(ctx, AuditEvent{})
+		if err != nil {
+			return fmt.Errorf("could not anonymize audit events of user %s, err : %s", userID, err)
+		}
+		_, err = gorm.G[Session](tx).Where("user_id = ? AND revoked_at IS NULL", userID).Update(ctx, "revoked_at", at)
+		if err != nil {
+			return fmt.Errorf("could not revoke sessions of user %s, err : %s", userID, err)
+		}
+		if _, err = gorm.G[EmailVerification](tx).Where("user_id = ?", userID).Delete(ctx); err != nil {
+			return fmt.Errorf("could not delete email verifications of user %s, err : %s", userID, err)
+		}
+		if _, err = gorm.G[PhoneVerification](tx).Where("user_id = ?", userID).Delete(ctx); err != nil {
+			return fmt.Errorf("could not delete phone verifications of user %s, err : %s", userID, err)
+		}
+		if _, err = gorm.G[PasswordReset](tx).Where("user_id = ?", userID).Delete(ctx); err != nil {
+			return fmt.Errorf("could not delete password resets of user %s, err : %s", userID, err)
+		}
+		if _, err = gorm.G[DataExport](tx).Where("user_id = ?", userID).Delete(ctx); err != nil {
+			return fmt.Errorf("could not delete data exports of user %s, err : %s", userID, err)
+		}
+		// The payouts made keep the account they were paid to.
+		if _, err = gorm.G[PayoutAccount](tx).Where("user_id = ?", userID).Delete(ctx); err != nil {
+			return fmt.Errorf("could not delete payout account of user %s, err : %s", userID, err)
+		}
+		if _, err = gorm.G[Block](tx).Where("blocker_id = ? OR blocked_id = ?", userID, userID).Delete(ctx); err != nil {
+			return fmt.Errorf("could not delete blocks of user %s, err : %s", userID, err)
+		}
+		// The reviews written stay in the reputation of their subject, with
+		// their rating only.
+		_, err = gorm.G[Review](tx).Where("author_id = ?", userID).Select("comment", "tags").Updates(ctx, Review{})
+		if err != nil {
+			return fmt.Errorf("could not clear reviews of user %s, err : %s", userID, err)
+		}
+		// The messages stay in their conversation, emptied.
+		if _, err = gorm.G[Message](tx).Where("sender_id = ?", userID).Update(ctx, "body", ""); err != nil {
+			return fmt.Errorf("could not clear messages of user %s, err : %s", userID, err)
+		}
+		if _, err = gorm.G[MessageReceipt](tx).Where("user_id = ?", userID).Delete(ctx); err != nil {
+			return fmt.Errorf("could not delete message receipts of user %s, err : %s", userID, err)
+		}
+		if _, err = gorm.G[Notification](tx).Where("user_id = ?", userID).Delete(ctx); err != nil {
+			return fmt.Errorf("could not delete notifications of user %s, err : %s", userID, err)
+		}
+		if err := enqueueNotifications(tx, notifications...); err != nil {
+			return err
+		}
+		for _, ride := range rides {
+			ride.Status = RideCancelled
+			if err := publishWebhookEvent(tx, WebhookRideCancelled, ride); err != nil {
+				return err
+			}
+		}
+
+		if err := gorm.G[Erasure](tx).Create(ctx, &erasure); err != nil {
+			return fmt.Errorf("could not record erasure of user %s, err : %s", userID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Erasure{}, err
+	}
+	return erasure, nil
+}
+
+func (repository *CovoitRepository) GetErasuresByUser(userID uuid.UUID) ([]Erasure, error) {
+	ctx := context.Background()
+	erasures, err := gorm.G[Erasure](repository.db).Where("user_id = ?", userID).Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get erasures of user %s, err : %s", userID, err)
+	}
+	return erasures, nil
+}
+
+func init() {
+	registerPersonalData("erasures", []string{"erasures"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.erasures.GetErasuresByUser(userID)
+	})
+}
+
+// EraseUser closes the account of the user. Its future commitments are
+// cancelled and the passengers who lose their seat are told so, its personal
+// data is anonymized while its history is kept.
+func (service *CovoitService) EraseUser(userID uuid.UUID) (Erasure, error) {
+	rideIDs := service.ridesOf(userID)
+	erasure, err := service.erasures.EraseUser(userID, service.clock())
+	if err != nil {
+		return Erasure{}, err
+	}
+	service.publishAvailability(rideIDs...)
+	return erasure, nil
+}
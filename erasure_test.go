@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) EraseUser(userID uuid.UUID, at time.Time) (Erasure, error) {
+	erasure := Erasure{UserID: userID, RidesCancelled: []uuid.UUID{}, BookingsCancelled: []uuid.UUID{}, ErasedAt: at}
+	users := m.DB.Users
+	i := slices.IndexFunc(users, func(user User) bool { return user.UserID == userID })
+	if i < 0 {
+		users = m.DB.DeletedUsers
+		i = slices.IndexFunc(users, func(user User) bool { return user.UserID == userID })
+	}
+	if i < 0 {
+		return Erasure{}, fmt.Errorf("user not found with userID : %s", userID)
+	}
+	if users[i].ErasedAt != nil {
+		return Erasure{}, ErrUserErased
+	}
+	future := map[uuid.UUID]bool{}
+	notifications := []Notification{}
+	for j, ride := range m.DB.Rides {
+		if ride.Status != RideScheduled || !ride.DepartureTime.After(at) {
+			continue
+		}
+		future[ride.RideID] = true
+		if ride.DriverID == userID {
+			erasure.RidesCancelled = append(erasure.RidesCancelled, ride.RideID)
+			m.DB.Rides[j].Status = RideCancelled
+			m.publish(WebhookRideCancelled, m.DB.Rides[j])
+		}
+	}
+	for j, booking := range m.DB.Bookings {
+		if (booking.Status != BookingPending && booking.Status != BookingConfirmed) || !future[booking.RideID] {
+			continue
+		}
+		if booking.UserID == userID || slices.Contains(erasure.RidesCancelled, booking.RideID) {
+			erasure.BookingsCancelled = append(erasure.BookingsCancelled, booking.BookingID)
+			m.DB.Bookings[j].Status = BookingCancelled
+			m.settle(PaymentRelease, 0, booking.BookingID)
+			m.releasePromotions(booking)
+		}
+		if booking.UserID != userID && slices.Contains(erasure.RidesCancelled, booking.RideID) {
+			ride, _ := m.GetRideById(booking.RideID)
+			notifications = append(notifications, rideNotification(NotificationRideCancelled, booking.UserID, ride, &booking))
+		}
+	}
+	users[i] = User{
+		UserID:    userID,
+		FirstName: "Deleted",
+		LastName:  "user",
+		Email:     erasedEmail(userID),
+		Role:      users[i].Role,
+		CreatedAt: users[i].CreatedAt,
+		ErasedAt:  &at,
+		DeletedAt: users[i].DeletedAt,
+		DeletedBy: users[i].DeletedBy,
+	}
+	for j := range m.DB.Sessions {
+		if m.DB.Sessions[j].UserID == userID && m.DB.Sessions[j].RevokedAt == nil {
+			m.DB.Sessions[j].RevokedAt = &at
+		}
+	}
+	m.DB.DataExports = slices.DeleteFunc(m.DB.DataExports, func(export DataExport) bool { return export.UserID == userID })
+	m.DB.PayoutAccounts = slices.DeleteFunc(m.DB.PayoutAccounts, func(account PayoutAccount) bool { return account.UserID == userID })
+	m.DB.Blocks = slices.DeleteFunc(m.DB.Blocks, func(block Block) bool { return block.BlockerID == userID || block.BlockedID == userID })
+	for j, review := range m.DB.Reviews {
+		if review.AuthorID == userID {
+			m.DB.Reviews[j].Comment, m.DB.Reviews[j].Tags = "", nil
+		}
+	}
+	m.DB.Notifications = slices.DeleteFunc(m.DB.Notifications, func(notification Notification) bool { return notification.UserID == userID })
+	m.enqueue(notifications...)
+	for j, message := range m.DB.Messages {
+		if message.SenderID == userID {
+			m.DB.Messages[j].Body = ""
+		}
+		m.DB.Messages[j].ReadBy = slices.DeleteFunc(message.ReadBy, func(receipt MessageReceipt) bool { return receipt.UserID == userID })
+	}
+	m.DB.Erasures = append(m.DB.Erasures, erasure)
+	return erasure, nil
+}
+
+func (m *MockRepository) GetErasuresByUser(userID uuid.UUID) ([]Erasure, error) {
+	erasures := []Erasure{}
+	for _, erasure := range m.DB.Erasures {
+		if erasure.UserID == userID {
+			erasures = append(erasures, erasure)
+		}
+	}
+	return erasures, nil
+}
+
+func TestEraseUser(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	s := NewMockService(db)
+	s.mailer = mailer
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	db.Users[1].Phone = "+33612345678"
+	db.Users[1].Address = "1 rue de la Paix"
+	db.PayoutAccounts = append(db.PayoutAccounts, PayoutAccount{UserID: driverID, HolderName: "Faten Sayeh", IBAN: "FR1420041010050500013M02606"})
+
+	past, pastBooking := completedRide(db, driverID, passengerID, now.Add(-24*time.Hour))
+	db.Rides[len(db.Rides)-1].Status = RideCompleted
+	upcoming := Ride{RideID: uuid.New(), DriverID: driverID, Origin: "Lyon", Destination: "Paris", DepartureTime: now.Add(24 * time.Hour), Status: RideScheduled}
+	seat := Booking{BookingID: uuid.New(), RideID: upcoming.RideID, UserID: passengerID, Status: BookingConfirmed}
+	elsewhere := Ride{RideID: uuid.New(), DriverID: passengerID, DepartureTime: now.Add(48 * time.Hour), Status: RideScheduled}
+	ownSeat := Booking{BookingID: uuid.New(), RideID: elsewhere.RideID, UserID: driverID, Status: BookingConfirmed}
+	request := Booking{BookingID: uuid.New(), RideID: upcoming.RideID, UserID: passengerID, Status: BookingPending}
+	ownRequest := Booking{BookingID: uuid.New(), RideID: elsewhere.RideID, UserID: driverID, Status: BookingPending}
+	db.Rides = append(db.Rides, upcoming, elsewhere)
+	db.Bookings = append(db.Bookings, seat, ownSeat, request, ownRequest)
+	db.Payments = append(db.Payments,
+		Payment{PaymentID: uuid.New(), BookingID: request.BookingID, Amount: eur(1000)},
+		Payment{PaymentID: uuid.New(), BookingID: ownRequest.BookingID, Amount: eur(1000)})
+	written := Review{ReviewID: uuid.New(), BookingID: pastBooking.BookingID, AuthorID: driverID, SubjectID: passengerID, RideID: past.RideID, Stars: 4, Comment: "Always late", Tags: []string{"punctual"}}
+	received := Review{ReviewID: uuid.New(), BookingID: pastBooking.BookingID, AuthorID: passengerID, SubjectID: driverID, RideID: past.RideID, Stars: 5, Comment: "Smooth ride"}
+	db.Reviews = append(db.Reviews, written, received)
+	db.Blocks = append(db.Blocks, Block{BlockerID: driverID, BlockedID: uuid.New()}, Block{BlockerID: passengerID, BlockedID: driverID})
+	_, err := s.auth.CreateSession(Session{UserID: driverID, TokenHash: hashToken("token"), ExpiresAt: now.Add(sessionTTL)})
+	require.NoError(t, err)
+
+	erasure, err := s.EraseUser(driverID)
+	require.NoError(t, err)
+	_, err = s.DispatchNotifications()
+	require.NoError(t, err)
+	require.Equal(t, []uuid.UUID{upcoming.RideID}, erasure.RidesCancelled)
+	require.ElementsMatch(t, []uuid.UUID{seat.BookingID, ownSeat.BookingID, request.BookingID, ownRequest.BookingID}, erasure.BookingsCancelled)
+	for _, payment := range db.Payments {
+		require.Equal(t, PaymentRelease, payment.Settlement, "pending bookings release their payment")
+	}
+
+	user, err := s.repository.GetUserById(driverID)
+	require.NoError(t, err)
+	require.NotNil(t, user.ErasedAt)
+	require.Equal(t, erasedEmail(driverID), user.Email)
+	require.Empty(t, user.Phone)
+	require.Empty(t, user.Address)
+	_, err = s.GetUserByEmail("sayehfaten1195@gmail.com")
+	require.Error(t, err)
+
+	ride, err := s.GetRideById(past.RideID)
+	require.NoError(t, err)
+	require.Equal(t, RideCompleted, ride.Status, "history is kept")
+	booking, err := s.GetBookingById(pastBooking.BookingID)
+	require.NoError(t, err)
+	require.Equal(t, BookingConfirmed, booking.Status)
+	ride, err = s.GetRideById(upcoming.RideID)
+	require.NoError(t, err)
+	require.Equal(t, RideCancelled, ride.Status)
+	booking, err = s.GetBookingById(ownSeat.BookingID)
+	require.NoError(t, err)
+	require.Equal(t, BookingCancelled, booking.Status)
+
+	_, err = s.AuthenticateSession("token")
+	require.ErrorIs(t, err, ErrInvalidToken)
+	_, err = s.GetPayoutAccount(driverID)
+	require.ErrorIs(t, err, ErrPayoutAccountNotFound, "the bank details go")
+	require.Empty(t, db.Blocks, "the blocks go both ways")
+	require.Equal(t, 4, db.Reviews[0].Stars, "the rating stays")
+	require.Empty(t, db.Reviews[0].Comment)
+	require.Empty(t, db.Reviews[0].Tags)
+	require.Equal(t, received, db.Reviews[1], "the reviews about the user stay")
+
+	mail, ok := mailer.Last()
+	require.True(t, ok)
+	require.Equal(t, "mehdibenfredj3@gmail.com", mail.To)
+	require.Contains(t, mail.Body, "Lyon")
+	require.Len(t, mailer.Sent, 2, "only the passengers who lose their seat or their request are told")
+
+	erasures, err := s.erasures.GetErasuresByUser(driverID)
+	require.NoError(t, err)
+	require.Len(t, erasures, 1)
+	_, err = s.EraseUser(driverID)
+	require.ErrorIs(t, err, ErrUserErased)
+}
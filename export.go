@@ -0,0 +1,358 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// dataExportTTL is how long the download link of an export stays valid.
+const dataExportTTL = 7 * 24 * time.Hour
+
+const (
+	DataExportPending = "pending"
+	DataExportReady   = "ready"
+	DataExportFailed  = "failed"
+)
+
+const JobDataExportBuild = "exports.build"
+
+// DataExport is an archive of the personal data of a user. The archive is
+// built in the background and downloaded with a token sent by email.
+type DataExport struct {
+	ExportID    uuid.UUID  `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"export_id"`
+	UserID      uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	Status      string     `json:"status"`
+	TokenHash   string     `gorm:"index" json:"-"`
+	Archive     []byte     `json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+// personalDataSource is the contribution of a subsystem to data exports :
+// the tables it covers and how to collect their rows for a user. The
+// collected value becomes <name>.json in the archive.
+type personalDataSource struct {
+	name    string
+	tables  []string
+	collect func(service *CovoitService, userID uuid.UUID) (any, error)
+}
+
+var personalDataSources []personalDataSource
+
+// registerPersonalData adds a source to every data export. Each subsystem
+// registers the tables it owns from an init function, a table holding user
+// data that nobody registers makes TestPersonalDataCoversEveryTable fail.
+func registerPersonalData(name string, tables []string, collect func(service *CovoitService, userID uuid.UUID) (any, error)) {
+	personalDataSources = append(personalDataSources, personalDataSource{name: name, tables: tables, collect: collect})
+}
+
+// impersonalTables are the tables that hold no data about any user.
+var impersonalTables = map[string]bool{}
+
+// registerImpersonalTables exempts tables from the data exports.
+func registerImpersonalTables(tables ...string) {
+	for _, table := range tables {
+		impersonalTables[table] = true
+	}
+}
+
+func init() {
+	registerPersonalData("profile", []string{"users"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.repository.GetUserById(userID)
+	})
+	registerPersonalData("rides", []string{"rides"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.repository.GetRidesByDriver(userID)
+	})
+	registerPersonalData("bookings", []string{"bookings"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.repository.GetBookingsByUser(userID)
+	})
+	registerPersonalData("data_exports", []string{"data_exports"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.exports.GetDataExportsByUser(userID)
+	})
+	registerJob(JobDataExportBuild, (*CovoitService).buildDataExportJob)
+}
+
+// DataExportJob is the payload of the job building an export.
+type DataExportJob struct {
+	ExportID uuid.UUID `json:"export_id"`
+}
+
+func dataExportJob(export DataExport) Job {
+	data, _ := json.Marshal(DataExportJob{ExportID: export.ExportID})
+	return Job{
+		Name:    JobDataExportBuild,
+		Key:     fmt.Sprintf("%s:%s", JobDataExportBuild, export.ExportID),
+		Payload: data,
+		RunAt:   export.CreatedAt,
+		Status:  JobPending,
+	}
+}
+
+type DataExportRepository interface {
+	// CreateDataExport creates the export with the job that builds it.
+	CreateDataExport(export DataExport) (DataExport, error)
+	GetDataExportById(exportID uuid.UUID) (DataExport, error)
+	GetDataExportsByUser(userID uuid.UUID) ([]DataExport, error)
+	GetDataExportByTokenHash(tokenHash string) (DataExport, error)
+	CompleteDataExport(exportID uuid.UUID, archive []byte, tokenHash string, at time.Time, expiresAt time.Time) error
+	FailDataExport(exportID uuid.UUID, at time.Time) error
+}
+
+func (repository *CovoitRepository) CreateDataExport(export DataExport) (DataExport, error) {
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		if err := gorm.G[DataExport](tx).Create(ctx, &export); err != nil {
+			return fmt.Errorf("could not create data export of user %s, err : %s", export.UserID, err)
+		}
+		return scheduleJobs(tx, dataExportJob(export))
+	})
+	if err != nil {
+		return DataExport{}, err
+	}
+	return export, nil
+}
+
+// GetDataExportById returns the export without its archive.
+func (repository *CovoitRepository) GetDataExportById(exportID uuid.UUID) (DataExport, error) {
+	ctx := context.Background()
+	export, err := gorm.G[DataExport](repository.db).Omit("archive").Where("export_id = ?", exportID).First(ctx)
+	if err != nil {
+		return DataExport{}, fmt.Errorf("could not retrieve data export %s, err : %s", exportID, err)
+	}
+	return export, nil
+}
+
+// GetDataExportsByUser returns the exports of the user, newest first, without
+// their archive.
+func (repository *CovoitRepository) GetDataExportsByUser(userID uuid.UUID) ([]DataExport, error) {
+	ctx := context.Background()
+	exports, err := gorm.G[DataExport](repository.db).
+		Omit("archive").
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get data exports of user %s, err : %s", userID, err)
+	}
+	return exports, nil
+}
+
+func (repository *CovoitRepository) GetDataExportByTokenHash(tokenHash string) (DataExport, error) {
+	ctx := context.Background()
+	export, err := gorm.G[DataExport](repository.db).Where("token_hash = ?", tokenHash).First(ctx)
+	if err != nil {
+		return DataExport{}, fmt.Errorf("could not retrieve data export, err : %s", err)
+	}
+	return export, nil
+}
+
+func (repository *CovoitRepository) CompleteDataExport(exportID uuid.UUID, archive []byte, tokenHash string, at time.Time, expiresAt time.Time) error {
+	ctx := context.Background()
+	_, err := gorm.G[DataExport](repository.db).
+		Where("export_id = ?", exportID).
+		Select("status", "archive", "token_hash", "completed_at", "expires_at").
+		Updates(ctx, DataExport{Status: DataExportReady, Archive: archive, TokenHash: tokenHash, CompletedAt: &at, ExpiresAt: &expiresAt})
+	if err != nil {
+		return fmt.Errorf("could not complete data export %s, err : %s", exportID, err)
+	}
+	return nil
+}
+
+func (repository *CovoitRepository) FailDataExport(exportID uuid.UUID, at time.Time) error {
+	ctx := context.Background()
+	_, err := gorm.G[DataExport](repository.db).
+		Where("export_id = ?", exportID).
+		Select("status", "completed_at").
+		Updates(ctx, DataExport{Status: DataExportFailed, CompletedAt: &at})
+	if err != nil {
+		return fmt.Errorf("could not fail data export %s, err : %s", exportID, err)
+	}
+	return nil
+}
+
+// goJob runs job in the background. Tests swap runJob to run it inline.
+func (service *CovoitService) goJob(job func()) {
+	if service.runJob != nil {
+		service.runJob(job)
+		return
+	}
+	go job()
+}
+
+// RequestDataExport starts building an export of the personal data of the
+// user. A user has at most one export being built at a time, the scheduler
+// builds it even if the instance that took the request stops.
+func (service *CovoitService) RequestDataExport(userID uuid.UUID) (DataExport, error) {
+	exports, err := service.exports.GetDataExportsByUser(userID)
+	if err != nil {
+		return DataExport{}, err
+	}
+	for _, export := range exports {
+		if export.Status == DataExportPending {
+			return export, nil
+		}
+	}
+	export, err := service.exports.CreateDataExport(DataExport{
+		UserID:    userID,
+		Status:    DataExportPending,
+		CreatedAt: service.clock(),
+	})
+	if err != nil {
+		return DataExport{}, err
+	}
+	return export, nil
+}
+
+// buildDataExportJob builds the export of job, unless it is built already. An
+// export that cannot be built is failed, so that the user can ask again.
+func (service *CovoitService) buildDataExportJob(job Job) error {
+	var payload DataExportJob
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("could not decode job %s, err : %s", job.Key, err)
+	}
+	export, err := service.exports.GetDataExportById(payload.ExportID)
+	if err != nil {
+		return err
+	}
+	if export.Status != DataExportPending {
+		return nil
+	}
+	if err := service.buildDataExport(export); err != nil {
+		log.Printf("could not build data export %s : %s", export.ExportID, err)
+		return service.exports.FailDataExport(export.ExportID, service.clock())
+	}
+	return nil
+}
+
+// personalDataArchive zips one JSON file per registered source.
+func (service *CovoitService) personalDataArchive(userID uuid.UUID) ([]byte, error) {
+	sources := slices.Clone(personalDataSources)
+	slices.SortFunc(sources, func(a, b personalDataSource) int {
+		return strings.Compare(a.name, b.name)
+	})
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	for _, source := range sources {
+		data, err := source.collect(service, userID)
+		if err != nil {
+			return nil, fmt.Errorf("could not collect %s : %w", source.name, err)
+		}
+		file, err := archive.Create(source.name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(data); err != nil {
+			return nil, fmt.Errorf("could not encode %s : %w", source.name, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (service *CovoitService) buildDataExport(export DataExport) error {
+	user, err := service.repository.GetUserById(export.UserID)
+	if err != nil {
+		return err
+	}
+	archive, err := service.personalDataArchive(export.UserID)
+	if err != nil {
+		return err
+	}
+	token, tokenHash, err := generateToken()
+	if err != nil {
+		return err
+	}
+	now := service.clock()
+	err = service.exports.CompleteDataExport(export.ExportID, archive, tokenHash, now, now.Add(dataExportTTL))
+	if err != nil {
+		return err
+	}
+	logMailError(service.mailer.Send(Mail{
+		To:      user.Email,
+		Subject: "Your data export is ready",
+		Body: fmt.Sprintf("Hello %s,\n\nThe export of your personal data is ready, you can download it from the following link :\n%s/exports/download?token=%s\n\nThis link expires in 7 days.",
+			user.FirstName, appURL, token),
+	}))
+	return nil
+}
+
+func (service *CovoitService) GetDataExports(userID uuid.UUID) ([]DataExport, error) {
+	return service.exports.GetDataExportsByUser(userID)
+}
+
+// DownloadDataExport returns the archive behind an export link.
+func (service *CovoitService) DownloadDataExport(token string) ([]byte, error) {
+	export, err := service.exports.GetDataExportByTokenHash(hashToken(token))
+	if err != nil || export.Status != DataExportReady || export.ExpiresAt == nil || !service.clock().Before(*export.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	return export.Archive, nil
+}
+
+func (h *Handler) DataExportsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			exports, err := h.Service.GetDataExports(actor.UserID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(exports)
+		}
+	case http.MethodPost:
+		{
+			export, err := h.Service.RequestDataExport(actor.UserID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(export)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) DataExportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	archive, err := h.Service.DownloadDataExport(r.URL.Query().Get("token"))
+	if errors.Is(err, ErrInvalidToken) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="covoit-data.zip"`)
+	w.Write(archive)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm/schema"
+)
+
+func (m *MockRepository) CreateDataExport(export DataExport) (DataExport, error) {
+	export.ExportID = uuid.New()
+	m.DB.DataExports = append(m.DB.DataExports, export)
+	m.schedule(dataExportJob(export))
+	return export, nil
+}
+
+func (m *MockRepository) GetDataExportById(exportID uuid.UUID) (DataExport, error) {
+	for _, export := range m.DB.DataExports {
+		if export.ExportID == exportID {
+			export.Archive = nil
+			return export, nil
+		}
+	}
+	return DataExport{}, errors.New("data export not found")
+}
+
+func (m *MockRepository) GetDataExportsByUser(userID uuid.UUID) ([]DataExport, error) {
+	exports := []DataExport{}
+	for _, export := range m.DB.DataExports {
+		if export.UserID == userID {
+			export.Archive = nil
+			exports = append(exports, export)
+		}
+	}
+	return exports, nil
+}
+
+func (m *MockRepository) GetDataExportByTokenHash(tokenHash string) (DataExport, error) {
+	for _, export := range m.DB.DataExports {
+		if export.TokenHash != "" && export.TokenHash == tokenHash {
+			return export, nil
+		}
+	}
+	return DataExport{}, errors.New("data export not found")
+}
+
+func (m *MockRepository) CompleteDataExport(exportID uuid.UUID, archive []byte, tokenHash string, at time.Time, expiresAt time.Time) error {
+	for i := range m.DB.DataExports {
+		if m.DB.DataExports[i].ExportID == exportID {
+			m.DB.DataExports[i].Status = DataExportReady
+			m.DB.DataExports[i].Archive = archive
+			m.DB.DataExports[i].TokenHash = tokenHash
+			m.DB.DataExports[i].CompletedAt = &at
+			m.DB.DataExports[i].ExpiresAt = &expiresAt
+		}
+	}
+	return nil
+}
+
+func (m *MockRepository) FailDataExport(exportID uuid.UUID, at time.Time) error {
+	for i := range m.DB.DataExports {
+		if m.DB.DataExports[i].ExportID == exportID {
+			m.DB.DataExports[i].Status = DataExportFailed
+			m.DB.DataExports[i].CompletedAt = &at
+		}
+	}
+	return nil
+}
+
+func TestPersonalDataCoversEveryTable(t *testing.T) {
+	covered := map[string]string{}
+	names := map[string]bool{}
+	for _, source := range personalDataSources {
+		require.False(t, names[source.name], "%s is registered twice", source.name)
+		names[source.name] = true
+		for _, table := range source.tables {
+			covered[table] = source.name
+		}
+	}
+	for _, model := range models {
+		s, err := schema.Parse(model, &sync.Map{}, schema.NamingStrategy{})
+		require.NoError(t, err)
+		_, ok := covered[s.Table]
+		require.True(t, ok || impersonalTables[s.Table], "table %s is missing from data exports, register it with registerPersonalData", s.Table)
+	}
+}
+
+// archiveFiles unzips archive into its files by name.
+func archiveFiles(t *testing.T, archive []byte) map[string]string {
+	t.Helper()
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+	files := map[string]string{}
+	for _, file := range reader.File {
+		f, err := file.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(f)
+		require.NoError(t, err)
+		f.Close()
+		files[file.Name] = string(content)
+	}
+	return files
+}
+
+func TestDataExport(t *testing.T) {
+	arrival := time.Date(2025, 9, 1, 18, 0, 0, 0, time.UTC)
+	now := arrival.Add(time.Hour)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	s := NewMockService(db)
+	s.mailer = mailer
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	db.Users[1].PasswordHash = "$2a$10$secret"
+	_, booking := completedRide(db, driverID, passengerID, arrival)
+	_, err := s.CreateReview(driverID, Review{BookingID: booking.BookingID, Stars: 4, Comment: "on time"})
+	require.NoError(t, err)
+	_, err = s.CreateReview(passengerID, Review{BookingID: booking.BookingID, Stars: 2, Comment: "hidden from the driver"})
+	require.NoError(t, err)
+	db.Reviews[0].RevealedAt, db.Reviews[1].RevealedAt = nil, nil
+	db.AuditEvents = append(db.AuditEvents, AuditEvent{UserID: &driverID, Action: AuditPasswordResetRequested, IP: "192.0.2.1"})
+	_, err = s.CreateVehicle(driverID, Vehicle{Make: "Renault", Model: "Clio", Plate: "AB123CD", Seats: 5})
+	require.NoError(t, err)
+
+	export, err := s.RequestDataExport(driverID)
+	require.NoError(t, err)
+	require.Equal(t, DataExportPending, export.Status)
+	again, err := s.RequestDataExport(driverID)
+	require.NoError(t, err)
+	require.Equal(t, export.ExportID, again.ExportID, "one export at a time")
+	job := jobByKey(t, db, JobDataExportBuild+":"+export.ExportID.String())
+	var payload DataExportJob
+	require.NoError(t, json.Unmarshal(job.Payload, &payload))
+	require.Equal(t, export.ExportID, payload.ExportID)
+	_, err = s.RunDueJobs()
+	require.NoError(t, err)
+	require.Equal(t, JobDone, jobByKey(t, db, job.Key).Status)
+	sent := len(mailer.Sent)
+	require.NoError(t, s.buildDataExportJob(job), "the export is built once")
+	require.Len(t, mailer.Sent, sent)
+
+	exports, err := s.GetDataExports(driverID)
+	require.NoError(t, err)
+	require.Equal(t, DataExportReady, exports[0].Status)
+	mail, ok := mailer.Last()
+	require.True(t, ok)
+	require.Equal(t, "sayehfaten1195@gmail.com", mail.To)
+	token := tokenFromMail(t, mail)
+
+	archive, err := s.DownloadDataExport(token)
+	require.NoError(t, err)
+	files := archiveFiles(t, archive)
+	for _, source := range personalDataSources {
+		require.Contains(t, files, source.name+".json")
+	}
+	require.Contains(t, files["profile.json"], "sayehfaten1195@gmail.com")
+	require.NotContains(t, files["profile.json"], "secret")
+	require.Contains(t, files["rides.json"], booking.RideID.String())
+	require.Contains(t, files["reviews.json"], "on time")
+	require.NotContains(t, files["reviews.json"], "hidden from the driver")
+	require.Contains(t, files["audit_events.json"], "192.0.2.1")
+	require.Contains(t, files["vehicles.json"], "AB123CD")
+	reviews := []Review{}
+	require.NoError(t, json.Unmarshal([]byte(files["reviews.json"]), &reviews))
+	require.Len(t, reviews, 1)
+
+	_, err = s.DownloadDataExport("not a token")
+	require.ErrorIs(t, err, ErrInvalidToken)
+	now = now.Add(dataExportTTL)
+	_, err = s.DownloadDataExport(token)
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestDataExportHandlers(t *testing.T) {
+	actor := Actor{UserID: uuid.New(), Role: RolePassenger}
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("RequestDataExport", actor.UserID).Return(DataExport{ExportID: uuid.New(), Status: DataExportPending}, nil)
+	mockSvc.On("GetDataExports", actor.UserID).Return([]DataExport{}, nil)
+	mockSvc.On("DownloadDataExport", "good").Return([]byte("PK"), nil)
+	mockSvc.On("DownloadDataExport", "bad").Return([]byte(nil), ErrInvalidToken)
+
+	for _, tc := range []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"request", asActor(httptest.NewRequest(http.MethodPost, "/exports", nil), actor), http.StatusAccepted},
+		{"list", asActor(httptest.NewRequest(http.MethodGet, "/exports", nil), actor), http.StatusOK},
+		{"anonymous", httptest.NewRequest(http.MethodPost, "/exports", nil), http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		h.DataExportsHandler(w, tc.req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+
+	w := httptest.NewRecorder()
+	h.DataExportDownloadHandler(w, httptest.NewRequest(http.MethodGet, "/exports/download?token=good", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "application/zip", w.Result().Header.Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	h.DataExportDownloadHandler(w, httptest.NewRequest(http.MethodGet, "/exports/download?token=bad", nil))
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	require.True(t, slices.Contains([]string{"", "text/plain; charset=utf-8"}, w.Result().Header.Get("Content-Type")))
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"slices"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// InvoiceReceipt is what a passenger paid for a booking.
+	InvoiceReceipt = "receipt"
+	// InvoiceCreditNote corrects a receipt by what was refunded.
+	InvoiceCreditNote = "credit_note"
+	// InvoiceStatement sums up what a driver earned over a month.
+	InvoiceStatement = "statement"
+)
+
+// The lines of an invoice. A receipt splits the price between the
+// contribution to the costs of the ride, earned by the driver, and the
+// service fee of the platform, less the discount of a promotion. A statement
+// shows the fares a driver collected and the fees withheld from them.
+const (
+	InvoiceLineContribution = "contribution"
+	InvoiceLineFee          = "fee"
+	InvoiceLineDiscount     = "discount"
+	InvoiceLineFares        = "fares"
+	InvoiceLineFeesWithheld = "fees_withheld"
+)
+
+// VATPercent is the VAT included in the service fee. Sharing the costs of a
+// ride is not a sale, the contribution bears no VAT.
+const VATPercent = 20
+
+// StatementInterval is how often the statements of the month before are
+// issued, the drivers who got none yet get theirs.
+const StatementInterval = 24 * time.Hour
+
+// invoicePrefixes start the numbers of each kind of invoice, every kind is
+// numbered in its own series, one per year.
+var invoicePrefixes = map[string]string{
+	InvoiceReceipt:    "R",
+	InvoiceCreditNote: "C",
+	InvoiceStatement:  "S",
+}
+
+var (
+	ErrInvoiceNotFound  = errors.New("invoice not found")
+	ErrInvoiceImmutable = errors.New("an issued invoice cannot be changed")
+)
+
+type InvoiceLine struct {
+	Kind string `json:"kind"`
+	// Amount includes VAT.
+	Amount Money `json:"amount"`
+	VAT    Money `json:"vat"`
+}
+
+// InvoiceTrip is the ride a receipt or a credit note is about.
+type InvoiceTrip struct {
+	Origin        string    `json:"origin"`
+	Destination   string    `json:"destination"`
+	DepartureTime time.Time `json:"departure_time"`
+	Seats         int       `json:"seats"`
+}
+
+// Invoice is a receipt, a credit note or a statement. It holds a copy of
+// everything it shows, so that it renders the same for as long as it is kept,
+// whatever becomes of the ride, the booking or the user. It is never changed
+// once issued, a refund is a credit note. Invoices are accounting records and
+// outlive the erasure of their recipient.
+type Invoice struct {
+	InvoiceID uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"invoice_id"`
+	// Number follows the invoice before it in its series, without gaps.
+	Number string `gorm:"uniqueIndex" json:"number"`
+	Kind   string `json:"kind"`
+	// Key identifies what is invoiced, it is invoiced once.
+	Key            string    `gorm:"uniqueIndex" json:"-"`
+	UserID         uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	Locale         string    `json:"locale"`
+	RecipientName  string    `json:"recipient_name"`
+	RecipientEmail string    `json:"recipient_email"`
+	// Reference is the payment of a receipt or a credit note.
+	Reference *uuid.UUID `gorm:"type:uuid;index" json:"reference,omitempty"`
+	// CreditedInvoiceID is the receipt a credit note corrects.
+	CreditedInvoiceID *uuid.UUID   `gorm:"type:uuid" json:"credited_invoice_id,omitempty"`
+	CreditedNumber    string       `json:"credited_number,omitempty"`
+	Trip              *InvoiceTrip `gorm:"type:jsonb;serializer:json" json:"trip,omitempty"`
+	// PeriodStart and PeriodEnd bound the month of a statement, PeriodEnd
+	// excluded.
+	PeriodStart *time.Time    `json:"period_start,omitempty"`
+	PeriodEnd   *time.Time    `json:"period_end,omitempty"`
+	Lines       []InvoiceLine `gorm:"type:jsonb;serializer:json" json:"lines"`
+	Total       Money         `gorm:"embedded;embeddedPrefix:total_" json:"total"`
+	VAT         Money         `gorm:"embedded;embeddedPrefix:vat_" json:"vat"`
+	IssuedAt    time.Time     `json:"issued_at"`
+}
+
+// BeforeUpdate refuses to change an issued invoice.
+func (invoice *Invoice) BeforeUpdate(tx *gorm.DB) error {
+	return ErrInvoiceImmutable
+}
+
+// BeforeDelete refuses to delete an issued invoice.
+func (invoice *Invoice) BeforeDelete(tx *gorm.DB) error {
+	return ErrInvoiceImmutable
+}
+
+// PeriodLastDay is the last day a statement covers.
+func (invoice Invoice) PeriodLastDay() time.Time {
+	if invoice.PeriodEnd == nil {
+		return time.Time{}
+	}
+	return invoice.PeriodEnd.AddDate(0, 0, -1)
+}
+
+// InvoiceSequence holds the last number given in a series.
+type InvoiceSequence struct {
+	Series string `gorm:"primaryKey"`
+	Last   int64
+}
+
+// invoiceImmutability makes the database itself refuse to change or delete
+// an invoice, whatever the path taken.
+const invoiceImmutability = `
+CREATE OR REPLACE FUNCTION forbid_invoice_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'an issued invoice cannot be changed';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS invoices_immutable ON invoices;
+CREATE TRIGGER invoices_immutable BEFORE UPDATE OR DELETE ON invoices
+    FOR EACH ROW EXECUTE FUNCTION forbid_invoice_change();`
+
+func invoiceSeries(kind string, at time.Time) string {
+	return fmt.Sprintf("%s-%d", invoicePrefixes[kind], at.Year())
+}
+
+func invoiceNumber(series string, number int64) string {
+	return fmt.Sprintf("%s-%06d", series, number)
+}
+
+// vatIncluded is the VAT within amount.
+func vatIncluded(amount Money) Money {
+	return amount.Sub(amount.Share(100, 100+VATPercent))
+}
+
+func newInvoice(kind string, key string, recipient User, at time.Time, lines ...InvoiceLine) Invoice {
+	invoice := Invoice{
+		Kind:           kind,
+		Key:            key,
+		UserID:         recipient.UserID,
+		Locale:         recipient.Preferences.Language,
+		RecipientName:  recipient.FirstName + " " + recipient.LastName,
+		RecipientEmail: recipient.Email,
+		Lines:          lines,
+		IssuedAt:       at,
+	}
+	for _, line := range lines {
+		invoice.Total = invoice.Total.Add(line.Amount)
+		invoice.VAT = invoice.VAT.Add(line.VAT)
+	}
+	return invoice
+}
+
+// journalInvoice returns the receipt of a charge journal, or the credit note
+// of a refund journal, for the passenger who paid. The driver's part of the
+// postings is the contribution, the platform's the fee, and the discount
+// funded by the platform is taken off.
+func journalInvoice(journal Journal, passenger User, booking Booking, ride Ride) (Invoice, bool) {
+	kind, key := InvoiceReceipt, fmt.Sprintf("%s:%s", InvoiceReceipt, journal.Reference)
+	switch journal.Type {
+	case JournalCharge:
+	case JournalRefund:
+		kind, key = InvoiceCreditNote, fmt.Sprintf("%s:%s", InvoiceCreditNote, journal.Key)
+	default:
+		return Invoice{}, false
+	}
+	contribution, fee, discount := Money{}, Money{}, Money{}
+	for _, posting := range journal.Postings {
+		switch posting.Account {
+		case AccountWallet:
+			contribution = posting.Amount.Neg()
+		case AccountFees:
+			fee = posting.Amount.Neg()
+		case AccountPromotions:
+			discount = posting.Amount.Neg()
+		}
+	}
+	lines := []InvoiceLine{
+		{Kind: InvoiceLineContribution, Amount: contribution, VAT: NewMoney(0, contribution.Currency)},
+		{Kind: InvoiceLineFee, Amount: fee, VAT: vatIncluded(fee)},
+	}
+	if !discount.IsZero() {
+		lines = append(lines, InvoiceLine{Kind: InvoiceLineDiscount, Amount: discount, VAT: NewMoney(0, discount.Currency)})
+	}
+	invoice := newInvoice(kind, key, passenger, journal.CreatedAt, lines...)
+	reference := journal.Reference
+	invoice.Reference = &reference
+	invoice.Trip = &InvoiceTrip{Origin: ride.Origin, Destination: ride.Destination, DepartureTime: ride.DepartureTime, Seats: booking.NumberOfSeats}
+	return invoice, true
+}
+
+// statementInvoices returns the statements of the drivers paid by the
+// journals of the month starting at from, one per driver and currency.
+func statementInvoices(journals []Journal, drivers map[uuid.UUID]User, from time.Time, at time.Time) []Invoice {
+	type statement struct {
+		driverID uuid.UUID
+		currency string
+	}
+	fares, fees := map[statement]Money{}, map[statement]Money{}
+	order := []statement{}
+	for _, journal := range journals {
+		if journal.Type != JournalCharge && journal.Type != JournalRefund {
+			continue
+		}
+		i := slices.IndexFunc(journal.Postings, func(posting Posting) bool { return posting.Account == AccountWallet && posting.UserID != nil })
+		if i < 0 {
+			continue
+		}
+		key := statement{*journal.Postings[i].UserID, journal.Postings[i].Amount.Currency}
+		if _, ok := fares[key]; !ok {
+			order = append(order, key)
+			fares[key], fees[key] = NewMoney(0, key.currency), NewMoney(0, key.currency)
+		}
+		for _, posting := range journal.Postings {
+			switch posting.Account {
+			case AccountCash, AccountPromotions:
+				fares[key] = fares[key].Add(posting.Amount)
+			case AccountFees:
+				fees[key] = fees[key].Add(posting.Amount)
+			}
+		}
+	}
+	to := from.AddDate(0, 1, 0)
+	invoices := []Invoice{}
+	for _, key := range order {
+		driver, ok := drivers[key.driverID]
+		if !ok {
+			continue
+		}
+		invoice := newInvoice(InvoiceStatement, fmt.Sprintf("%s:%s:%s:%s", InvoiceStatement, key.driverID, from.Format("2006-01"), key.currency), driver, at,
+			InvoiceLine{Kind: InvoiceLineFares, Amount: fares[key], VAT: NewMoney(0, key.currency)},
+			InvoiceLine{Kind: InvoiceLineFeesWithheld, Amount: fees[key], VAT: vatIncluded(fees[key])},
+		)
+		invoice.PeriodStart, invoice.PeriodEnd = &from, &to
+		invoices = append(invoices, invoice)
+	}
+	return invoices
+}
+
+// issueInvoice numbers invoice and writes it within tx. The number is taken
+// in the same transaction, so that a rolled back invoice gives it back. An
+// invoice already issued for the key is returned instead, with false.
+func issueInvoice(tx *gorm.DB, invoice Invoice) (Invoice, bool, error) {
+	ctx := context.Background()
+	issued, err := gorm.G[Invoice](tx).Where("key = ?", invoice.Key).First(ctx)
+	if err == nil {
+		return issued, false, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return Invoice{}, false, fmt.Errorf("could not get invoice %s, err : %s", invoice.Key, err)
+	}
+	series := invoiceSeries(invoice.Kind, invoice.IssuedAt)
+	var last int64
+	err = tx.Raw(`INSERT INTO invoice_sequences (series, last) VALUES (?, 1)
+		ON CONFLICT (series) DO UPDATE SET last = invoice_sequences.last + 1
+		RETURNING last`, series).Scan(&last).Error
+	if err != nil {
+		return Invoice{}, false, fmt.Errorf("could not number invoice %s, err : %s", invoice.Key, err)
+	}
+	invoice.InvoiceID, invoice.Number = uuid.New(), invoiceNumber(series, last)
+	if err := gorm.G[Invoice](tx).Create(ctx, &invoice); err != nil {
+		return Invoice{}, false, fmt.Errorf("could not issue invoice %s, err : %s", invoice.Key, err)
+	}
+	return invoice, true, nil
+}
+
+// issuePaymentInvoices issues within tx the receipts and the credit notes of
+// the journals of a payment.
+func issuePaymentInvoices(tx *gorm.DB, journals ...Journal) error {
+	ctx := context.Background()
+	for _, journal := range journals {
+		if journal.Type != JournalCharge && journal.Type != JournalRefund {
+			continue
+		}
+		payment, err := gorm.G[Payment](tx).Where("payment_id = ?", journal.Reference).First(ctx)
+		if err != nil {
+			return fmt.Errorf("Payment %v not found, err : %s", journal.Reference, err)
+		}
+		passenger, err := gorm.G[User](tx).Scopes(unscoped).Where("user_id = ?", payment.UserID).First(ctx)
+		if err != nil {
+			return fmt.Errorf("User %v not found, err : %s", payment.UserID, err)
+		}
+		booking, err := gorm.G[Booking](tx).Scopes(unscoped).Where("booking_id = ?", payment.BookingID).First(ctx)
+		if err != nil {
+			return fmt.Errorf("Booking %v not found, err : %s", payment.BookingID, err)
+		}
+		ride, err := gorm.G[Ride](tx).Scopes(unscoped).Where("ride_id = ?", booking.RideID).First(ctx)
+		if err != nil {
+			return fmt.Errorf("Ride %v not found, err : %s", booking.RideID, err)
+		}
+		invoice, _ := journalInvoice(journal, passenger, booking, ride)
+		if invoice.Kind == InvoiceCreditNote {
+			receipt, err := gorm.G[Invoice](tx).Where("key = ?", fmt.Sprintf("%s:%s", InvoiceReceipt, payment.PaymentID)).First(ctx)
+			if err != nil {
+				return fmt.Errorf("receipt of payment %s not found, err : %s", payment.PaymentID, err)
+			}
+			invoice.CreditedInvoiceID, invoice.CreditedNumber = &receipt.InvoiceID, receipt.Number
+		}
+		if _, _, err := issueInvoice(tx, invoice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type InvoiceRepository interface {
+	// IssueInvoice numbers and writes invoice, unless its key was invoiced
+	// already, and returns the invoice issued for the key and whether it is
+	// the one just issued.
+	IssueInvoice(invoice Invoice) (Invoice, bool, error)
+	GetInvoiceById(invoiceID uuid.UUID) (Invoice, error)
+	GetInvoicesByUser(userID uuid.UUID) ([]Invoice, error)
+	// GetJournals returns the journals recorded between from and to, to
+	// excluded, with their postings.
+	GetJournals(from time.Time, to time.Time) ([]Journal, error)
+}
+
+func (repository *CovoitRepository) IssueInvoice(invoice Invoice) (Invoice, bool, error) {
+	created := false
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		invoice, created, err = issueInvoice(tx, invoice)
+		return err
+	})
+	if err != nil {
+		return Invoice{}, false, err
+	}
+	return invoice, created, nil
+}
+
+func (repository *CovoitRepository) GetInvoiceById(invoiceID uuid.UUID) (Invoice, error) {
+	invoice, err := gorm.G[Invoice](repository.db).Where("invoice_id = ?", invoiceID).First(context.Background())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Invoice{}, ErrInvoiceNotFound
+	} else if err != nil {
+		return Invoice{}, fmt.Errorf("could not get invoice %s, err : %s", invoiceID, err)
+	}
+	return invoice, nil
+}
+
+func (repository *CovoitRepository) GetInvoicesByUser(userID uuid.UUID) ([]Invoice, error) {
+	invoices, err := gorm.G[Invoice](repository.db).Where("user_id = ?", userID).Order("issued_at DESC").Find(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not get invoices of user %s, err : %s", userID, err)
+	}
+	return invoices, nil
+}
+
+func (repository *CovoitRepository) GetJournals(from time.Time, to time.Time) ([]Journal, error) {
+	journals, err := gorm.G[Journal](repository.db).
+		Preload("Postings", nil).
+		Where("created_at >= ? AND created_at < ?", from, to).
+		Order("created_at").
+		Find(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not get journals, err : %s", err)
+	}
+	return journals, nil
+}
+
+func init() {
+	registerPersonalData("invoices", []string{"invoices"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.invoices.GetInvoicesByUser(userID)
+	})
+	registerImpersonalTables("invoice_sequences")
+	registerPeriodicJob("invoices.statements", StatementInterval, func(service *CovoitService, job Job) error {
+		_, err := service.IssueStatements()
+		return err
+	})
+}
+
+func (service *CovoitService) GetInvoicesForUser(userID uuid.UUID) ([]Invoice, error) {
+	return service.invoices.GetInvoicesByUser(userID)
+}
+
+func (service *CovoitService) GetInvoice(invoiceID uuid.UUID) (Invoice, error) {
+	return service.invoices.GetInvoiceById(invoiceID)
+}
+
+// IssueStatements issues the statements of the month before, to the drivers
+// who earned something and got none yet. It returns how many it issued.
+func (service *CovoitService) IssueStatements() (int, error) {
+	now := service.clock().UTC()
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, -1, 0)
+	journals, err := service.invoices.GetJournals(from, to)
+	if err != nil {
+		return 0, err
+	}
+	drivers := map[uuid.UUID]User{}
+	for _, journal := range journals {
+		for _, posting := range journal.Postings {
+			if posting.Account != AccountWallet || posting.UserID == nil {
+				continue
+			}
+			if _, ok := drivers[*posting.UserID]; ok {
+				continue
+			}
+			driver, err := service.repository.GetUserById(*posting.UserID)
+			if err != nil {
+				log.Printf("could not get driver %s of statement : %s", *posting.UserID, err)
+				continue
+			}
+			drivers[driver.UserID] = driver
+		}
+	}
+	issued := 0
+	for _, statement := range statementInvoices(journals, drivers, from, now) {
+		_, created, err := service.invoices.IssueInvoice(statement)
+		if err != nil {
+			return issued, err
+		}
+		if created {
+			issued++
+		}
+	}
+	return issued, nil
+}
+
+// invoiceTemplates holds per locale the plain text rendering of an invoice,
+// which is also set in its PDF, and its HTML rendering.
+type invoiceTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var invoiceTemplateSet = mustParseInvoiceTemplates()
+
+func mustParseInvoiceTemplates() map[string]invoiceTemplates {
+	parsed := map[string]invoiceTemplates{}
+	for _, locale := range Locales {
+		name := fmt.Sprintf("templates/%s/invoice", locale)
+		text, err := texttemplate.New("invoice").Funcs(templateFuncs).ParseFS(templateFiles, name+".txt")
+		if err != nil {
+			panic(fmt.Sprintf("could not parse %s.txt, err : %s", name, err))
+		}
+		html, err := htmltemplate.New("invoice").Funcs(templateFuncs).ParseFS(templateFiles, name+".html")
+		if err != nil {
+			panic(fmt.Sprintf("could not parse %s.html, err : %s", name, err))
+		}
+		parsed[locale] = invoiceTemplates{text: text, html: html}
+	}
+	return parsed
+}
+
+// RenderInvoice renders invoice as text, html or pdf, in its locale. It
+// returns the document and its content type.
+func RenderInvoice(invoice Invoice, format string) ([]byte, string, error) {
+	templates, ok := invoiceTemplateSet[invoice.Locale]
+	if !ok {
+		templates = invoiceTemplateSet[defaultLocale]
+	}
+	document := &bytes.Buffer{}
+	switch format {
+	case "html":
+		if err := templates.html.ExecuteTemplate(document, "invoice.html", invoice); err != nil {
+			return nil, "", fmt.Errorf("could not render invoice %s, err : %s", invoice.Number, err)
+		}
+		return document.Bytes(), "text/html; charset=utf-8", nil
+	case "text", "pdf":
+		if err := templates.text.ExecuteTemplate(document, "invoice.txt", invoice); err != nil {
+			return nil, "", fmt.Errorf("could not render invoice %s, err : %s", invoice.Number, err)
+		}
+		if format == "text" {
+			return document.Bytes(), "text/plain; charset=utf-8", nil
+		}
+		pdf, err := renderPDF(invoice.Number, document.String())
+		if err != nil {
+			return nil, "", fmt.Errorf("could not render invoice %s as pdf, err : %s", invoice.Number, err)
+		}
+		return pdf, "application/pdf", nil
+	}
+	return nil, "", fmt.Errorf("unknown invoice format %s", format)
+}
+
+// InvoicesHandler lists the invoices of the actor, or of ?user_id= for the
+// admins.
+func (h *Handler) InvoicesHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := ownerFromQuery(r, actor)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !Authorize(actor, ActionViewInvoice, Resource{OwnerID: userID}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	invoices, err := h.Service.GetInvoicesForUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoices)
+}
+
+// InvoiceDownloadHandler renders ?invoice_id= as ?format=pdf, the default,
+// html or text.
+func (h *Handler) InvoiceDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	invoiceID, err := uuid.Parse(r.URL.Query().Get("invoice_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "pdf"
+	}
+	if !slices.Contains([]string{"pdf", "html", "text"}, format) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	invoice, err := h.Service.GetInvoice(invoiceID)
+	if errors.Is(err, ErrInvoiceNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !Authorize(actor, ActionViewInvoice, Resource{OwnerID: invoice.UserID}) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	document, contentType, err := RenderInvoice(invoice, format)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if format == "pdf" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", invoice.Number+".pdf"))
+	}
+	w.Write(document)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// issue numbers and adds invoice unless its key is taken, like issueInvoice.
+func (m *MockRepository) issue(invoice Invoice) (Invoice, bool) {
+	if i := slices.IndexFunc(m.DB.Invoices, func(issued Invoice) bool { return issued.Key == invoice.Key }); i >= 0 {
+		return m.DB.Invoices[i], false
+	}
+	if m.DB.InvoiceSequences == nil {
+		m.DB.InvoiceSequences = map[string]int64{}
+	}
+	series := invoiceSeries(invoice.Kind, invoice.IssuedAt)
+	m.DB.InvoiceSequences[series]++
+	invoice.InvoiceID, invoice.Number = uuid.New(), invoiceNumber(series, m.DB.InvoiceSequences[series])
+	m.DB.Invoices = append(m.DB.Invoices, invoice)
+	return invoice, true
+}
+
+func (m *MockRepository) issuePaymentInvoices(journals ...Journal) error {
+	for _, journal := range journals {
+		if journal.Type != JournalCharge && journal.Type != JournalRefund {
+			continue
+		}
+		i := slices.IndexFunc(m.DB.Payments, func(p Payment) bool { return p.PaymentID == journal.Reference })
+		if i < 0 {
+			return ErrPaymentNotFound
+		}
+		payment := m.DB.Payments[i]
+		users := append(slices.Clone(m.DB.Users), m.DB.DeletedUsers...)
+		u := slices.IndexFunc(users, func(user User) bool { return user.UserID == payment.UserID })
+		bookings := append(slices.Clone(m.DB.Bookings), m.DB.DeletedBookings...)
+		b := slices.IndexFunc(bookings, func(booking Booking) bool { return booking.BookingID == payment.BookingID })
+		if u < 0 || b < 0 {
+			return fmt.Errorf("payment %s has no passenger or booking", payment.PaymentID)
+		}
+		rides := append(slices.Clone(m.DB.Rides), m.DB.DeletedRides...)
+		r := slices.IndexFunc(rides, func(ride Ride) bool { return ride.RideID == bookings[b].RideID })
+		if r < 0 {
+			return ErrRideNotFound
+		}
+		invoice, _ := journalInvoice(journal, users[u], bookings[b], rides[r])
+		if invoice.Kind == InvoiceCreditNote {
+			receipt := slices.IndexFunc(m.DB.Invoices, func(issued Invoice) bool {
+				return issued.Key == fmt.Sprintf("%s:%s", InvoiceReceipt, payment.PaymentID)
+			})
+			if receipt < 0 {
+				return ErrInvoiceNotFound
+			}
+			invoice.CreditedInvoiceID, invoice.CreditedNumber = &m.DB.Invoices[receipt].InvoiceID, m.DB.Invoices[receipt].Number
+		}
+		m.issue(invoice)
+	}
+	return nil
+}
+
+func (m *MockRepository) IssueInvoice(invoice Invoice) (Invoice, bool, error) {
+	issued, created := m.issue(invoice)
+	return issued, created, nil
+}
+
+func (m *MockRepository) GetInvoiceById(invoiceID uuid.UUID) (Invoice, error) {
+	for _, invoice := range m.DB.Invoices {
+		if invoice.InvoiceID == invoiceID {
+			return invoice, nil
+		}
+	}
+	return Invoice{}, ErrInvoiceNotFound
+}
+
+func (m *MockRepository) GetInvoicesByUser(userID uuid.UUID) ([]Invoice, error) {
+	invoices := []Invoice{}
+	for _, invoice := range m.DB.Invoices {
+		if invoice.UserID == userID {
+			invoices = append(invoices, invoice)
+		}
+	}
+	slices.Reverse(invoices)
+	return invoices, nil
+}
+
+func (m *MockRepository) GetJournals(from time.Time, to time.Time) ([]Journal, error) {
+	journals := []Journal{}
+	for _, journal := range m.DB.Journals {
+		if !journal.CreatedAt.Before(from) && journal.CreatedAt.Before(to) {
+			journals = append(journals, journal)
+		}
+	}
+	return journals, nil
+}
+
+func TestInvoiceReceiptAndCreditNote(t *testing.T) {
+	f := newPaymentFixture(t)
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	require.Empty(t, f.db.Invoices, "an authorization is not invoiced")
+
+	*f.now = f.ride.DepartureTime
+	require.NoError(t, f.service.CompleteRide(f.ride.RideID, nil))
+	require.Len(t, f.db.Invoices, 1)
+	receipt := f.db.Invoices[0]
+	require.Equal(t, InvoiceReceipt, receipt.Kind)
+	require.Equal(t, "R-2025-000001", receipt.Number)
+	require.Equal(t, f.passengerID, receipt.UserID)
+	require.Equal(t, f.ride.DepartureTime, receipt.IssuedAt)
+	require.Equal(t, &InvoiceTrip{Origin: "Lyon", Destination: "Paris", DepartureTime: f.ride.DepartureTime, Seats: booking.NumberOfSeats}, receipt.Trip)
+	require.Equal(t, []InvoiceLine{
+		{Kind: InvoiceLineContribution, Amount: eur(4500), VAT: eur(0)},
+		{Kind: InvoiceLineFee, Amount: eur(500), VAT: eur(83)},
+	}, receipt.Lines)
+	require.Equal(t, eur(5000), receipt.Total)
+	require.Equal(t, eur(83), receipt.VAT)
+
+	payment := f.payment(t, booking.BookingID)
+	_, err = f.service.RefundPayment(payment.PaymentID, eur(1000))
+	require.NoError(t, err)
+	require.Len(t, f.db.Invoices, 2)
+	creditNote := f.db.Invoices[1]
+	require.Equal(t, InvoiceCreditNote, creditNote.Kind)
+	require.Equal(t, "C-2025-000001", creditNote.Number)
+	require.Equal(t, receipt.Number, creditNote.CreditedNumber)
+	require.Equal(t, receipt.InvoiceID, *creditNote.CreditedInvoiceID)
+	require.Equal(t, []InvoiceLine{
+		{Kind: InvoiceLineContribution, Amount: eur(-900), VAT: eur(0)},
+		{Kind: InvoiceLineFee, Amount: eur(-100), VAT: eur(-17)},
+	}, creditNote.Lines)
+	require.Equal(t, eur(-1000), creditNote.Total)
+	require.Equal(t, receipt, f.db.Invoices[0], "the receipt is left as issued")
+
+	charge := f.db.Journals[0]
+	require.NoError(t, f.service.payments.(*MockRepository).issuePaymentInvoices(charge))
+	require.Len(t, f.db.Invoices, 2, "a payment is invoiced once")
+
+	next, created, err := f.service.invoices.IssueInvoice(newInvoice(InvoiceReceipt, "receipt:other", User{UserID: f.passengerID}, *f.now))
+	require.NoError(t, err)
+	require.True(t, created)
+	require.Equal(t, "R-2025-000002", next.Number, "the numbers follow each other")
+}
+
+func TestInvoiceImmutable(t *testing.T) {
+	invoice := &Invoice{}
+	require.ErrorIs(t, invoice.BeforeUpdate(nil), ErrInvoiceImmutable)
+	require.ErrorIs(t, invoice.BeforeDelete(nil), ErrInvoiceImmutable)
+}
+
+func TestIssueStatements(t *testing.T) {
+	f := newPaymentFixture(t)
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	*f.now = f.ride.DepartureTime
+	require.NoError(t, f.service.CompleteRide(f.ride.RideID, nil))
+	_, err = f.service.RefundPayment(f.payment(t, booking.BookingID).PaymentID, eur(1000))
+	require.NoError(t, err)
+
+	issued, err := f.service.IssueStatements()
+	require.NoError(t, err)
+	require.Zero(t, issued, "September is not over")
+
+	*f.now = time.Date(2025, 10, 1, 3, 0, 0, 0, time.UTC)
+	issued, err = f.service.IssueStatements()
+	require.NoError(t, err)
+	require.Equal(t, 1, issued)
+	statement := f.db.Invoices[len(f.db.Invoices)-1]
+	require.Equal(t, InvoiceStatement, statement.Kind)
+	require.Equal(t, "S-2025-000001", statement.Number)
+	require.Equal(t, f.driverID, statement.UserID)
+	require.Equal(t, time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC), *statement.PeriodStart)
+	require.Equal(t, time.Date(2025, 9, 30, 0, 0, 0, 0, time.UTC), statement.PeriodLastDay())
+	require.Equal(t, []InvoiceLine{
+		{Kind: InvoiceLineFares, Amount: eur(4000), VAT: eur(0)},
+		{Kind: InvoiceLineFeesWithheld, Amount: eur(-400), VAT: eur(-67)},
+	}, statement.Lines)
+	wallet, err := f.service.GetWallet(f.driverID)
+	require.NoError(t, err)
+	require.Equal(t, wallet.Balance, statement.Total, "the statement adds up to what the driver earned")
+
+	*f.now = f.now.Add(StatementInterval)
+	issued, err = f.service.IssueStatements()
+	require.NoError(t, err)
+	require.Zero(t, issued, "a month is stated once")
+}
+
+func TestRenderInvoice(t *testing.T) {
+	issuedAt := time.Date(2025, 9, 3, 12, 0, 0, 0, time.UTC)
+	passenger := User{UserID: uuid.New(), FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}
+	invoice := newInvoice(InvoiceReceipt, "receipt:render", passenger, issuedAt,
+		InvoiceLine{Kind: InvoiceLineContribution, Amount: eur(4500), VAT: eur(0)},
+		InvoiceLine{Kind: InvoiceLineFee, Amount: eur(500), VAT: eur(83)},
+	)
+	invoice.Number = "R-2025-000001"
+	invoice.Trip = &InvoiceTrip{Origin: "Lyon", Destination: "Paris", DepartureTime: issuedAt, Seats: 2}
+
+	text, contentType, err := RenderInvoice(invoice, "text")
+	require.NoError(t, err)
+	require.Equal(t, "text/plain; charset=utf-8", contentType)
+	require.Contains(t, string(text), "RECEIPT R-2025-000001")
+	require.Contains(t, string(text), "Service fee")
+	require.Contains(t, string(text), "50.00 €")
+	require.Contains(t, string(text), "0.83 €")
+
+	html, contentType, err := RenderInvoice(invoice, "html")
+	require.NoError(t, err)
+	require.Equal(t, "text/html; charset=utf-8", contentType)
+	require.Contains(t, string(html), "<title>R-2025-000001</title>")
+	require.Contains(t, string(html), "Ada Lovelace &lt;ada@example.com&gt;")
+
+	pdf, contentType, err := RenderInvoice(invoice, "pdf")
+	require.NoError(t, err)
+	require.Equal(t, "application/pdf", contentType)
+	require.True(t, bytes.HasPrefix(pdf, []byte("%PDF-")))
+	require.True(t, bytes.HasSuffix(pdf, []byte("%%EOF\n")))
+	require.Contains(t, string(pdf), "(RECEIPT R-2025-000001) '")
+
+	invoice.Locale = "fr"
+	text, _, err = RenderInvoice(invoice, "text")
+	require.NoError(t, err)
+	require.Contains(t, string(text), "Frais de service")
+
+	_, _, err = RenderInvoice(invoice, "docx")
+	require.Error(t, err)
+}
+
+func TestRenderPDFPages(t *testing.T) {
+	lines := make([]string, 2*pdfPageLines+1)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line (%d) \\", i)
+	}
+	pdf, err := renderPDF("pages", strings.Join(lines, "\n"))
+	require.NoError(t, err)
+	require.Contains(t, string(pdf), "/Count 3")
+	require.Contains(t, string(pdf), `(line \(0\) \\) '`)
+}
+
+func TestInvoiceHandlers(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	passenger := Actor{UserID: uuid.New(), Role: RolePassenger}
+	invoice := newInvoice(InvoiceReceipt, "receipt:handler", User{UserID: passenger.UserID}, time.Date(2025, 9, 3, 12, 0, 0, 0, time.UTC),
+		InvoiceLine{Kind: InvoiceLineFee, Amount: eur(500), VAT: eur(83)},
+	)
+	invoice.InvoiceID, invoice.Number = uuid.New(), "R-2025-000001"
+	mockSvc.On("GetInvoicesForUser", passenger.UserID).Return([]Invoice{invoice}, nil)
+	mockSvc.On("GetInvoice", invoice.InvoiceID).Return(invoice, nil)
+	mockSvc.On("GetInvoice", mock.Anything).Return(Invoice{}, ErrInvoiceNotFound)
+	someone := Actor{UserID: uuid.New(), Role: RolePassenger}
+
+	for _, tc := range []struct {
+		name   string
+		actor  Actor
+		query  string
+		status int
+	}{
+		{"own invoices", passenger, "", http.StatusOK},
+		{"someone else's invoices", someone, "?user_id=" + passenger.UserID.String(), http.StatusForbidden},
+		{"as an admin", admin, "?user_id=" + passenger.UserID.String(), http.StatusOK},
+		{"bad user", admin, "?user_id=nope", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.InvoicesHandler(w, asActor(httptest.NewRequest(http.MethodGet, "/invoices"+tc.query, nil), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+		if tc.status == http.StatusOK {
+			var invoices []Invoice
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&invoices))
+			require.Len(t, invoices, 1, tc.name)
+			require.Equal(t, invoice.Number, invoices[0].Number, tc.name)
+		}
+	}
+
+	for _, tc := range []struct {
+		name        string
+		actor       Actor
+		query       string
+		status      int
+		contentType string
+	}{
+		{"pdf by default", passenger, "?invoice_id=" + invoice.InvoiceID.String(), http.StatusOK, "application/pdf"},
+		{"html", passenger, "?format=html&invoice_id=" + invoice.InvoiceID.String(), http.StatusOK, "text/html; charset=utf-8"},
+		{"as an admin", admin, "?invoice_id=" + invoice.InvoiceID.String(), http.StatusOK, "application/pdf"},
+		{"someone else's invoice", someone, "?invoice_id=" + invoice.InvoiceID.String(), http.StatusNotFound, ""},
+		{"unknown invoice", passenger, "?invoice_id=" + uuid.NewString(), http.StatusNotFound, ""},
+		{"unknown format", passenger, "?format=docx&invoice_id=" + invoice.InvoiceID.String(), http.StatusBadRequest, ""},
+		{"bad invoice", passenger, "?invoice_id=nope", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		h.InvoiceDownloadHandler(w, asActor(httptest.NewRequest(http.MethodGet, "/invoices/download"+tc.query, nil), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+		if tc.contentType != "" {
+			require.Equal(t, tc.contentType, w.Result().Header.Get("Content-Type"), tc.name)
+		}
+	}
+}
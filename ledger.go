@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	JournalCharge = "charge"
+	JournalRefund = "refund"
+	JournalPayout = "payout"
+)
+
+// The accounts of the ledger. Cash is the money held at the payment provider,
+// fees the commission of the platform, promotions the discounts it funds and
+// a wallet what the platform owes to its user.
+const (
+	AccountCash       = "cash"
+	AccountFees       = "fees"
+	AccountPromotions = "promotions"
+	AccountWallet     = "wallet"
+)
+
+// The movements a posting stands for.
+const (
+	PostingCharge   = "charge"
+	PostingFee      = "fee"
+	PostingEarning  = "earning"
+	PostingRefund   = "refund"
+	PostingPayout   = "payout"
+	PostingDiscount = "discount"
+)
+
+// PlatformFeePercent is the share of a charge kept by the platform, rounded
+// like Money.Percent, the rest is earned by the driver.
+const PlatformFeePercent = 10
+
+var (
+	ErrUnbalancedJournal = errors.New("unbalanced journal")
+)
+
+// Journal records one monetary movement as postings summing to zero. Key
+// identifies the movement, a movement recorded twice is recorded once.
+type Journal struct {
+	JournalID uuid.UUID `gorm:"type:uuid;primaryKey" json:"journal_id"`
+	Key       string    `gorm:"uniqueIndex" json:"key"`
+	Type      string    `json:"type"`
+	// Reference is the payment or the payout the journal comes from.
+	Reference uuid.UUID `gorm:"type:uuid;index" json:"reference"`
+	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	Postings  []Posting `gorm:"foreignKey:JournalID" json:"postings"`
+}
+
+// Posting moves Amount on an account, a debit when positive and a credit when
+// negative. UserID is the owner of a wallet, or the passenger charged or
+// refunded on cash.
+type Posting struct {
+	PostingID uuid.UUID  `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"posting_id"`
+	JournalID uuid.UUID  `gorm:"type:uuid;index" json:"journal_id"`
+	Account   string     `gorm:"index:idx_posting_account,priority:1" json:"account"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index:idx_posting_account,priority:2" json:"user_id,omitempty"`
+	Kind      string     `json:"kind"`
+	Amount    Money      `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// Wallet is the balance the platform owes to a user.
+type Wallet struct {
+	UserID  uuid.UUID `json:"user_id"`
+	Balance Money     `json:"balance"`
+}
+
+// WalletTransaction is a posting on a wallet, Amount being positive when it
+// credits the wallet.
+type WalletTransaction struct {
+	JournalID uuid.UUID `json:"journal_id"`
+	Type      string    `json:"type"`
+	Kind      string    `json:"kind"`
+	Reference uuid.UUID `json:"reference"`
+	Amount    Money     `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type JournalImbalance struct {
+	JournalID uuid.UUID `json:"journal_id"`
+	Key       string    `json:"key"`
+	// Currencies counts the currencies of the postings, a journal moves one.
+	Currencies int   `json:"currencies"`
+	Sum        int64 `json:"sum_minor"`
+}
+
+// LedgerReport is the outcome of the invariant check of the ledger.
+type LedgerReport struct {
+	Journals   int64              `json:"journals"`
+	Unbalanced []JournalImbalance `json:"unbalanced"`
+}
+
+// journalSum returns the sum of the postings in minor units, and how many
+// currencies they are in.
+func journalSum(journal Journal) (int64, int) {
+	sum, currencies := int64(0), map[string]bool{}
+	for _, posting := range journal.Postings {
+		sum += posting.Amount.Minor
+		currencies[posting.Amount.Currency] = true
+	}
+	return sum, len(currencies)
+}
+
+func newJournal(journalType string, key string, reference uuid.UUID, at time.Time, postings ...Posting) Journal {
+	journal := Journal{JournalID: uuid.New(), Key: key, Type: journalType, Reference: reference, CreatedAt: at, Postings: postings}
+	for i := range journal.Postings {
+		journal.Postings[i].JournalID, journal.Postings[i].CreatedAt = journal.JournalID, at
+	}
+	return journal
+}
+
+// capturedDiscount is the part of the discount of payment that goes with
+// what it captured, all of it unless the capture is partial.
+func capturedDiscount(payment Payment) Money {
+	if payment.Discount.IsZero() || payment.Amount.IsZero() {
+		return NewMoney(0, payment.CapturedAmount.Currency)
+	}
+	return payment.Discount.Share(payment.CapturedAmount.Minor, payment.Amount.Minor)
+}
+
+// paymentFee is the commission of the platform on what payment captured,
+// discount included.
+func paymentFee(payment Payment) Money {
+	return payment.CapturedAmount.Add(capturedDiscount(payment)).Percent(PlatformFeePercent)
+}
+
+// refundedShare is the part of amount given back once refunded is refunded.
+// It is computed on the running total so that the parts given back by
+// successive refunds add up to amount.
+func refundedShare(payment Payment, amount Money, refunded Money) Money {
+	if payment.CapturedAmount.IsZero() {
+		return Money{Currency: payment.CapturedAmount.Currency}
+	}
+	return amount.Share(refunded.Minor, payment.CapturedAmount.Minor)
+}
+
+// refundedFee is the part of the fee given back once refunded is refunded.
+func refundedFee(payment Payment, refunded Money) Money {
+	return refundedShare(payment, paymentFee(payment), refunded)
+}
+
+// paymentJournals returns the journals of the money moved by payment going
+// from before to after at at : the charge of its capture, split between the
+// fee and the earning of the driver, and its refunds. The discount of a
+// promotion is charged to the platform along with the capture, and given back
+// along with the refunds.
+func paymentJournals(before Payment, after Payment, at time.Time) []Journal {
+	journals := []Journal{}
+	passengerID, payeeID := after.UserID, after.PayeeID
+	if before.CapturedAmount.IsZero() && after.CapturedAmount.Minor > 0 {
+		fee, discount := paymentFee(after), capturedDiscount(after)
+		journal := newJournal(JournalCharge, fmt.Sprintf("%s:%s", JournalCharge, after.PaymentID), after.PaymentID, at,
+			Posting{Account: AccountCash, UserID: &passengerID, Kind: PostingCharge, Amount: after.CapturedAmount},
+			Posting{Account: AccountFees, Kind: PostingFee, Amount: fee.Neg()},
+			Posting{Account: AccountWallet, UserID: &payeeID, Kind: PostingEarning, Amount: after.CapturedAmount.Add(discount).Sub(fee).Neg()},
+		)
+		journals = append(journals, withDiscount(journal, discount))
+	}
+	if after.RefundedAmount.Minor > before.RefundedAmount.Minor {
+		refund := after.RefundedAmount.Sub(before.RefundedAmount)
+		fee := refundedFee(after, after.RefundedAmount).Sub(refundedFee(after, before.RefundedAmount))
+		discount := refundedShare(after, capturedDiscount(after), after.RefundedAmount).Sub(refundedShare(after, capturedDiscount(after), before.RefundedAmount))
+		journal := newJournal(JournalRefund, fmt.Sprintf("%s:%s:%d", JournalRefund, after.PaymentID, after.RefundedAmount.Minor), after.PaymentID, at,
+			Posting{Account: AccountCash, UserID: &passengerID, Kind: PostingRefund, Amount: refund.Neg()},
+			Posting{Account: AccountFees, Kind: PostingFee, Amount: fee},
+			Posting{Account: AccountWallet, UserID: &payeeID, Kind: PostingEarning, Amount: refund.Add(discount).Sub(fee)},
+		)
+		journals = append(journals, withDiscount(journal, discount.Neg()))
+	}
+	return journals
+}
+
+// withDiscount adds to journal the posting of the discount the platform
+// funds, if any.
+func withDiscount(journal Journal, discount Money) Journal {
+	if discount.IsZero() {
+		return journal
+	}
+	posting := Posting{JournalID: journal.JournalID, Account: AccountPromotions, Kind: PostingDiscount, Amount: discount, CreatedAt: journal.CreatedAt}
+	journal.Postings = append(journal.Postings, posting)
+	return journal
+}
+
+// payoutJournal records amount paid out of the wallet of the user.
+func payoutJournal(userID uuid.UUID, amount Money, reference uuid.UUID, at time.Time) Journal {
+	return newJournal(JournalPayout, fmt.Sprintf("%s:%s", JournalPayout, reference), reference, at,
+		Posting{Account: AccountWallet, UserID: &userID, Kind: PostingPayout, Amount: amount},
+		Posting{Account: AccountCash, Kind: PostingPayout, Amount: amount.Neg()},
+	)
+}
+
+// payoutFailureJournal credits back to the wallet of the user a payout the
+// bank did not carry out.
+func payoutFailureJournal(userID uuid.UUID, amount Money, reference uuid.UUID, at time.Time) Journal {
+	return newJournal(JournalPayout, fmt.Sprintf("%s:%s:%s", JournalPayout, reference, PayoutFailed), reference, at,
+		Posting{Account: AccountWallet, UserID: &userID, Kind: PostingPayout, Amount: amount.Neg()},
+		Posting{Account: AccountCash, Kind: PostingPayout, Amount: amount},
+	)
+}
+
+// checkJournal tells whether the postings of journal are in a single
+// currency and sum to zero, exactly.
+func checkJournal(journal Journal) error {
+	sum, currencies := journalSum(journal)
+	if currencies > 1 {
+		return fmt.Errorf("%w : %s mixes %d currencies", ErrUnbalancedJournal, journal.Key, currencies)
+	}
+	if sum != 0 {
+		return fmt.Errorf("%w : %s sums to %d minor units", ErrUnbalancedJournal, journal.Key, sum)
+	}
+	return nil
+}
+
+// recordJournals writes the journals within tx, refusing any that does not
+// balance. A journal whose key is already recorded is skipped.
+func recordJournals(tx *gorm.DB, journals ...Journal) error {
+	for _, journal := range journals {
+		if err := checkJournal(journal); err != nil {
+			return err
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Omit(clause.Associations).Create(&journal)
+		if result.Error != nil {
+			return fmt.Errorf("could not record journal %s, err : %s", journal.Key, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		if err := gorm.G[Posting](tx).CreateInBatches(context.Background(), &journal.Postings, len(journal.Postings)); err != nil {
+			return fmt.Errorf("could not record postings of journal %s, err : %s", journal.Key, err)
+		}
+	}
+	return nil
+}
+
+type LedgerRepository interface {
+	GetWalletBalance(userID uuid.UUID, currency string) (Money, error)
+	// GetWalletTransactions returns the postings on the wallet of the user,
+	// the latest first.
+	GetWalletTransactions(userID uuid.UUID) ([]WalletTransaction, error)
+	CountJournals() (int64, error)
+	// GetUnbalancedJournals returns the journals whose postings do not sum to
+	// zero.
+	GetUnbalancedJournals() ([]JournalImbalance, error)
+}
+
+func (repository *CovoitRepository) GetWalletBalance(userID uuid.UUID, currency string) (Money, error) {
+	var balance int64
+	err := repository.db.Model(&Posting{}).
+		Select("COALESCE(-SUM(amount_minor), 0)").
+		Where("account = ? AND user_id = ? AND amount_currency = ?", AccountWallet, userID, currency).
+		Scan(&balance).Error
+	if err != nil {
+		return Money{}, fmt.Errorf("could not get wallet balance of user %s, err : %s", userID, err)
+	}
+	return NewMoney(balance, currency), nil
+}
+
+func (repository *CovoitRepository) GetWalletTransactions(userID uuid.UUID) ([]WalletTransaction, error) {
+	transactions := []WalletTransaction{}
+	err := repository.db.Model(&Posting{}).
+		Select("postings.journal_id, journals.type, postings.kind, journals.reference, -postings.amount_minor AS amount_minor, postings.amount_currency, postings.created_at").
+		Joins("JOIN journals ON journals.journal_id = postings.journal_id").
+		Where("postings.account = ? AND postings.user_id = ?", AccountWallet, userID).
+		Order("postings.created_at DESC").
+		Scan(&transactions).Error
+	if err != nil {
+		return nil, fmt.Errorf("could not get wallet transactions of user %s, err : %s", userID, err)
+	}
+	return transactions, nil
+}
+
+func (repository *CovoitRepository) CountJournals() (int64, error) {
+	count, err := gorm.G[Journal](repository.db).Count(context.Background(), "*")
+	if err != nil {
+		return 0, fmt.Errorf("could not count journals, err : %s", err)
+	}
+	return count, nil
+}
+
+func (repository *CovoitRepository) GetUnbalancedJournals() ([]JournalImbalance, error) {
+	imbalances := []JournalImbalance{}
+	err := repository.db.Model(&Posting{}).
+		Select("postings.journal_id, journals.key, COUNT(DISTINCT postings.amount_currency) AS currencies, SUM(postings.amount_minor) AS sum").
+		Joins("JOIN journals ON journals.journal_id = postings.journal_id").
+		Group("postings.journal_id, journals.key").
+		Having("SUM(postings.amount_minor) <> 0 OR COUNT(DISTINCT postings.amount_currency) > 1").
+		Scan(&imbalances).Error
+	if err != nil {
+		return nil, fmt.Errorf("could not check journals, err : %s", err)
+	}
+	return imbalances, nil
+}
+
+func init() {
+	registerPersonalData("wallet", []string{"postings"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.GetWalletTransactions(userID)
+	})
+	// Journals only group postings, which are exported with the wallet.
+	registerImpersonalTables("journals")
+}
+
+func (service *CovoitService) GetWallet(userID uuid.UUID) (Wallet, error) {
+	balance, err := service.ledger.GetWalletBalance(userID, PaymentCurrency)
+	if err != nil {
+		return Wallet{}, err
+	}
+	return Wallet{UserID: userID, Balance: balance}, nil
+}
+
+func (service *CovoitService) GetWalletTransactions(userID uuid.UUID) ([]WalletTransaction, error) {
+	return service.ledger.GetWalletTransactions(userID)
+}
+
+// CheckLedger verifies that every journal balances.
+func (service *CovoitService) CheckLedger() (LedgerReport, error) {
+	journals, err := service.ledger.CountJournals()
+	if err != nil {
+		return LedgerReport{}, err
+	}
+	unbalanced, err := service.ledger.GetUnbalancedJournals()
+	if err != nil {
+		return LedgerReport{}, err
+	}
+	return LedgerReport{Journals: journals, Unbalanced: unbalanced}, nil
+}
+
+// checkLedgerCommand runs the invariant check of the ledger for
+// "covoit check-ledger", its exit code is 1 when a journal does not balance.
+func checkLedgerCommand(service Service, w io.Writer) int {
+	report, err := service.CheckLedger()
+	if err != nil {
+		fmt.Fprintln(w, "could not check the ledger :", err)
+		return 2
+	}
+	for _, imbalance := range report.Unbalanced {
+		fmt.Fprintf(w, "journal %s (%s) sums to %d minor units in %d currencies\n", imbalance.JournalID, imbalance.Key, imbalance.Sum, imbalance.Currencies)
+	}
+	fmt.Fprintf(w, "%d journals, %d unbalanced\n", report.Journals, len(report.Unbalanced))
+	if len(report.Unbalanced) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// ownerFromQuery returns the user whose wallet or invoices the request is
+// about, the actor unless user_id names someone else.
+func ownerFromQuery(r *http.Request, actor Actor) (uuid.UUID, error) {
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		return uuid.Parse(userID)
+	}
+	return actor.UserID, nil
+}
+
+// WalletHandler shows the balance of a wallet.
+func (h *Handler) WalletHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := ownerFromQuery(r, actor)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !Authorize(actor, ActionViewWallet, Resource{OwnerID: userID}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	wallet, err := h.Service.GetWallet(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wallet)
+}
+
+// WalletTransactionsHandler shows the history of a wallet.
+func (h *Handler) WalletTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := ownerFromQuery(r, actor)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !Authorize(actor, ActionViewWallet, Resource{OwnerID: userID}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	transactions, err := h.Service.GetWalletTransactions(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transactions)
+}
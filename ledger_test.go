@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// record adds the journals whose key is not taken yet, like the unique key of
+// the journals table.
+func (m *MockRepository) record(journals ...Journal) error {
+	for _, journal := range journals {
+		if err := checkJournal(journal); err != nil {
+			return err
+		}
+	}
+	for _, journal := range journals {
+		if slices.ContainsFunc(m.DB.Journals, func(j Journal) bool { return j.Key == journal.Key }) {
+			continue
+		}
+		m.DB.Journals = append(m.DB.Journals, journal)
+	}
+	return nil
+}
+
+func (m *MockRepository) walletPostings(userID uuid.UUID, do func(journal Journal, posting Posting)) {
+	for _, journal := range m.DB.Journals {
+		for _, posting := range journal.Postings {
+			if posting.Account == AccountWallet && posting.UserID != nil && *posting.UserID == userID {
+				do(journal, posting)
+			}
+		}
+	}
+}
+
+func (m *MockRepository) GetWalletBalance(userID uuid.UUID, currency string) (Money, error) {
+	balance := NewMoney(0, currency)
+	m.walletPostings(userID, func(journal Journal, posting Posting) {
+		if posting.Amount.Currency == currency {
+			balance = balance.Sub(posting.Amount)
+		}
+	})
+	return balance, nil
+}
+
+func (m *MockRepository) GetWalletTransactions(userID uuid.UUID) ([]WalletTransaction, error) {
+	transactions := []WalletTransaction{}
+	m.walletPostings(userID, func(journal Journal, posting Posting) {
+		transactions = append(transactions, WalletTransaction{JournalID: journal.JournalID, Type: journal.Type, Kind: posting.Kind, Reference: journal.Reference, Amount: posting.Amount.Neg(), CreatedAt: posting.CreatedAt})
+	})
+	slices.Reverse(transactions)
+	return transactions, nil
+}
+
+func (m *MockRepository) CountJournals() (int64, error) {
+	return int64(len(m.DB.Journals)), nil
+}
+
+func (m *MockRepository) GetUnbalancedJournals() ([]JournalImbalance, error) {
+	imbalances := []JournalImbalance{}
+	for _, journal := range m.DB.Journals {
+		if checkJournal(journal) != nil {
+			sum, currencies := journalSum(journal)
+			imbalances = append(imbalances, JournalImbalance{JournalID: journal.JournalID, Key: journal.Key, Currencies: currencies, Sum: sum})
+		}
+	}
+	return imbalances, nil
+}
+
+func accountBalance(db *MockDB, account string) Money {
+	balance := Money{}
+	for _, journal := range db.Journals {
+		for _, posting := range journal.Postings {
+			if posting.Account == account {
+				balance = balance.Add(posting.Amount)
+			}
+		}
+	}
+	return balance
+}
+
+func TestLedgerCharge(t *testing.T) {
+	f := newPaymentFixture(t)
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	require.Empty(t, f.db.Journals, "an authorization moves no money")
+
+	*f.now = f.ride.DepartureTime
+	require.NoError(t, f.service.CompleteRide(f.ride.RideID, nil))
+	require.Len(t, f.db.Journals, 1)
+	charge := f.db.Journals[0]
+	require.Equal(t, JournalCharge, charge.Type)
+	require.Equal(t, f.payment(t, booking.BookingID).PaymentID, charge.Reference)
+	require.Equal(t, eur(5000), accountBalance(f.db, AccountCash))
+	require.Equal(t, eur(-500), accountBalance(f.db, AccountFees))
+
+	wallet, err := f.service.GetWallet(f.driverID)
+	require.NoError(t, err)
+	require.Equal(t, eur(4500), wallet.Balance)
+	transactions, err := f.service.GetWalletTransactions(f.driverID)
+	require.NoError(t, err)
+	require.Len(t, transactions, 1)
+	require.Equal(t, PostingEarning, transactions[0].Kind)
+	require.Equal(t, eur(4500), transactions[0].Amount)
+	passengerWallet, err := f.service.GetWallet(f.passengerID)
+	require.NoError(t, err)
+	require.True(t, passengerWallet.Balance.IsZero(), "a passenger earns nothing")
+}
+
+func TestLedgerRefunds(t *testing.T) {
+	f := newPaymentFixture(t)
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	*f.now = f.ride.DepartureTime
+	require.NoError(t, f.service.CompleteRide(f.ride.RideID, nil))
+	payment := f.payment(t, booking.BookingID)
+	for _, amount := range []Money{eur(1001), eur(2033), eur(1966)} {
+		_, err = f.service.RefundPayment(payment.PaymentID, amount)
+		require.NoError(t, err)
+	}
+	require.Len(t, f.db.Journals, 4)
+	for _, journal := range f.db.Journals {
+		require.NoError(t, checkJournal(journal), journal.Key)
+	}
+	require.True(t, accountBalance(f.db, AccountCash).IsZero(), "the charge is fully refunded")
+	require.True(t, accountBalance(f.db, AccountFees).IsZero(), "the fees given back add up to the fee")
+	wallet, err := f.service.GetWallet(f.driverID)
+	require.NoError(t, err)
+	require.True(t, wallet.Balance.IsZero())
+	transactions, err := f.service.GetWalletTransactions(f.driverID)
+	require.NoError(t, err)
+	require.Len(t, transactions, 4)
+	require.Equal(t, JournalRefund, transactions[0].Type, "the latest first")
+}
+
+func TestRecordJournals(t *testing.T) {
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	before := Payment{PaymentID: uuid.New(), UserID: uuid.New(), PayeeID: uuid.New(), Amount: eur(3333)}
+	after := before
+	after.CapturedAmount = eur(3333)
+	journals := paymentJournals(before, after, time.Time{})
+	require.Len(t, journals, 1)
+	require.NoError(t, checkJournal(journals[0]))
+	require.NoError(t, s.payments.(*MockRepository).record(journals...))
+	require.NoError(t, s.payments.(*MockRepository).record(paymentJournals(before, after, time.Time{})...), "a movement recorded twice is recorded once")
+	require.Len(t, db.Journals, 1)
+
+	userID := uuid.New()
+	unbalanced := newJournal(JournalPayout, "payout:broken", uuid.New(), time.Time{},
+		Posting{Account: AccountWallet, UserID: &userID, Kind: PostingPayout, Amount: eur(1000)},
+		Posting{Account: AccountCash, Kind: PostingPayout, Amount: eur(-999)},
+	)
+	require.ErrorIs(t, s.payments.(*MockRepository).record(unbalanced), ErrUnbalancedJournal)
+	mixed := newJournal(JournalPayout, "payout:mixed", uuid.New(), time.Time{},
+		Posting{Account: AccountWallet, UserID: &userID, Kind: PostingPayout, Amount: eur(1000)},
+		Posting{Account: AccountCash, Kind: PostingPayout, Amount: NewMoney(-1000, "CHF")},
+	)
+	require.ErrorIs(t, s.payments.(*MockRepository).record(mixed), ErrUnbalancedJournal, "a journal moves a single currency")
+	require.Len(t, db.Journals, 1)
+}
+
+func TestCheckLedgerCommand(t *testing.T) {
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	var out bytes.Buffer
+	require.Equal(t, 0, checkLedgerCommand(s, &out))
+	require.Contains(t, out.String(), "0 journals, 0 unbalanced")
+
+	userID := uuid.New()
+	db.Journals = append(db.Journals,
+		payoutJournal(userID, eur(2000), uuid.New(), time.Time{}),
+		newJournal(JournalPayout, "payout:broken", uuid.New(), time.Time{},
+			Posting{Account: AccountWallet, UserID: &userID, Kind: PostingPayout, Amount: eur(1000)},
+		),
+	)
+	out.Reset()
+	require.Equal(t, 1, checkLedgerCommand(s, &out))
+	require.Contains(t, out.String(), "payout:broken")
+	require.Contains(t, out.String(), "2 journals, 1 unbalanced")
+}
+
+func TestWalletHandlers(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	driver := Actor{UserID: uuid.New(), Role: RoleDriver}
+	mockSvc.On("GetWallet", driver.UserID).Return(Wallet{UserID: driver.UserID, Balance: eur(4500)}, nil)
+	mockSvc.On("GetWalletTransactions", driver.UserID).Return([]WalletTransaction{{Type: JournalCharge, Kind: PostingEarning, Amount: eur(4500)}}, nil)
+	for _, tc := range []struct {
+		name   string
+		actor  Actor
+		query  string
+		status int
+	}{
+		{"own wallet", driver, "", http.StatusOK},
+		{"someone else's wallet", Actor{UserID: uuid.New(), Role: RolePassenger}, "?user_id=" + driver.UserID.String(), http.StatusForbidden},
+		{"as an admin", admin, "?user_id=" + driver.UserID.String(), http.StatusOK},
+		{"bad user", admin, "?user_id=nope", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.WalletHandler(w, asActor(httptest.NewRequest(http.MethodGet, "/wallet"+tc.query, nil), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+		if tc.status == http.StatusOK {
+			var wallet Wallet
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&wallet))
+			require.Equal(t, eur(4500), wallet.Balance, tc.name)
+		}
+
+		w = httptest.NewRecorder()
+		h.WalletTransactionsHandler(w, asActor(httptest.NewRequest(http.MethodGet, "/wallet/transactions"+tc.query, nil), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	// Body is the plain text of the mail, HTML its optional HTML version.
+	Body string
+	HTML string
+}
+
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// SMTPMailer delivers mails through an SMTP relay.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(mail Mail) error {
+	err := smtp.SendMail(m.Addr, m.Auth, m.From, []string{mail.To}, m.message(mail))
+	if err != nil {
+		return fmt.Errorf("could not send mail to %s, err : %s", mail.To, err)
+	}
+	return nil
+}
+
+// message formats mail, as multipart/alternative when it has an HTML version.
+func (m *SMTPMailer) message(mail Mail) []byte {
+	headers := []string{
+		"From: " + m.From,
+		"To: " + mail.To,
+		"Subject: " + mime.QEncoding.Encode("utf-8", mail.Subject),
+		"MIME-Version: 1.0",
+	}
+	if mail.HTML == "" {
+		return []byte(strings.Join(append(headers, "Content-Type: text/plain; charset=UTF-8", "", mail.Body), "\r\n"))
+	}
+	buf := &bytes.Buffer{}
+	parts := multipart.NewWriter(buf)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", mail.Body},
+		{"text/html; charset=UTF-8", mail.HTML},
+	} {
+		w, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		w.Write([]byte(part.content))
+	}
+	parts.Close()
+	headers = append(headers, "Content-Type: multipart/alternative; boundary="+parts.Boundary(), "", buf.String())
+	return []byte(strings.Join(headers, "\r\n"))
+}
+
+// FileMailer writes every mail to its own file in Dir, for local development.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(mail Mail) error {
+	err := os.MkdirAll(m.Dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("could not create mail directory %s, err : %s", m.Dir, err)
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(mail.To, "@", "_at_"))
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", mail.To, mail.Subject, mail.Body)
+	err = os.WriteFile(filepath.Join(m.Dir, name), []byte(content), 0o644)
+	if err != nil {
+		return fmt.Errorf("could not write mail to %s, err : %s", mail.To, err)
+	}
+	return nil
+}
+
+// MemoryMailer keeps sent mails in memory, for tests.
+type MemoryMailer struct {
+	mu    sync.Mutex
+	Sent  []Mail
+	Error error
+}
+
+func (m *MemoryMailer) Send(mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Error != nil {
+		return m.Error
+	}
+	m.Sent = append(m.Sent, mail)
+	return nil
+}
+
+func (m *MemoryMailer) Last() (Mail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.Sent) == 0 {
+		return Mail{}, false
+	}
+	return m.Sent[len(m.Sent)-1], true
+}
+
+// newMailer uses the SMTP relay configured in the environment and falls back
+// to writing mails on disk.
+func newMailer() Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return &FileMailer{Dir: filepath.Join(os.TempDir(), "covoit-mails")}
+	}
+	host := strings.Split(addr, ":")[0]
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return &SMTPMailer{Addr: addr, From: os.Getenv("SMTP_FROM"), Auth: auth}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := &FileMailer{Dir: dir}
+	require.NoError(t, mailer.Send(Mail{To: "a@test.com", Subject: "Hi", Body: "Hello"}))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	content, err := os.ReadFile(dir + "/" + entries[0].Name())
+	require.NoError(t, err)
+	require.True(t, strings.Contains(string(content), "Subject: Hi"))
+	require.True(t, strings.HasSuffix(entries[0].Name(), "a_at_test.com.eml"))
+}
+
+func TestSMTPMailerMessage(t *testing.T) {
+	mailer := &SMTPMailer{From: "covoit@example.com"}
+	plain := string(mailer.message(Mail{To: "a@test.com", Subject: "Hi", Body: "Hello"}))
+	require.Contains(t, plain, "Content-Type: text/plain; charset=UTF-8\r\n\r\nHello")
+
+	msg, err := mail.ReadMessage(bytes.NewReader(mailer.message(Mail{To: "a@test.com", Subject: "Votre trajet a été annulé", Body: "Bonjour", HTML: "<p>Bonjour</p>"})))
+	require.NoError(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	require.Equal(t, "Votre trajet a été annulé", subject)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", "Bonjour"},
+		{"text/html; charset=UTF-8", "<p>Bonjour</p>"},
+	} {
+		part, err := parts.NextPart()
+		require.NoError(t, err)
+		content, err := io.ReadAll(part)
+		require.NoError(t, err)
+		require.Equal(t, want.contentType, part.Header.Get("Content-Type"))
+		require.Equal(t, want.content, string(content))
+	}
+}
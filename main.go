@@ -2,8 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -13,21 +18,79 @@ func helloHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type Handler struct {
-	Service Service
+	Service       Service
+	Authenticator Authenticator
 }
 
+const appURL = "http://localhost:8080"
+
 func NewHandler() *Handler {
 	repository := NewCovoitRepository()
-	return &Handler{Service: &CovoitService{repository: repository}}
+	pricing, err := pricingFromEnv()
+	if err != nil {
+		log.Fatal("Pricing tables failed:", err)
+	}
+	payoutSettings, err := payoutSettingsFromEnv()
+	if err != nil {
+		log.Fatal("Payout settings failed:", err)
+	}
+	paymentProvider, err := newPaymentProvider()
+	if err != nil {
+		log.Fatal("Payment provider failed:", err)
+	}
+	phoneCodeSecret, err := phoneCodeSecretFromEnv()
+	if err != nil {
+		log.Fatal("Phone verification failed:", err)
+	}
+	service := &CovoitService{
+		repository:    repository,
+		verifications: repository,
+		mailer:        newMailer(),
+		sms:           &LogSMSSender{},
+		push:          &LogPushSender{},
+		auth:          repository,
+		audits:        repository,
+		reviews:       repository,
+		reputations:   repository,
+		vehicles:      repository,
+		exports:       repository,
+		erasures:      repository,
+		trash:         repository,
+		blocks:        repository,
+		messages:      repository,
+		notifications: repository,
+		webhooks:      repository,
+		jobs:          repository,
+		payments:      repository,
+		ledger:        repository,
+		invoices:      repository,
+		promotions:    repository,
+		payouts:       repository,
+		availability:  NewAvailabilityBus(),
+
+		paymentProvider: paymentProvider,
+
+		trashRetention: trashRetentionFromEnv(),
+		pricing:        pricing,
+		payoutSettings: payoutSettings,
+
+		phoneCodeSecret: phoneCodeSecret,
+	}
+	return &Handler{Service: service, Authenticator: &SessionAuthenticator{Service: service}}
 }
 
 func (h *Handler) UsersHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		{
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 			if email := r.URL.Query().Get("email"); email != "" {
 				user, err := h.Service.GetUserByEmail(email)
-				if err != nil {
+				if err != nil || !Authorize(actor, ActionViewUserPII, UserResource(user, false)) {
 					w.WriteHeader(http.StatusNotFound)
 				} else {
 					w.Header().Set("Content-Type", "application/json")
@@ -46,11 +109,20 @@ func (h *Handler) UsersHandler(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					w.WriteHeader(http.StatusNotFound)
 					return
-				} else {
-					w.Header().Set("Content-Type", "application/json")
-					json.NewEncoder(w).Encode(user)
-					w.WriteHeader(http.StatusOK)
 				}
+				if !Authorize(actor, ActionViewUserPII, UserResource(user, false)) {
+					counterpart, err := h.Service.AreCounterparts(actor.UserID, user.UserID)
+					if err != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					if !Authorize(actor, ActionViewUserPII, UserResource(user, counterpart)) {
+						user = user.PublicProfile()
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(user)
+				w.WriteHeader(http.StatusOK)
 
 				return
 			}
@@ -58,6 +130,11 @@ func (h *Handler) UsersHandler(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				w.WriteHeader(http.StatusNotFound)
 			} else {
+				for i, user := range users {
+					if !Authorize(actor, ActionViewUserPII, UserResource(user, false)) {
+						users[i] = user.PublicProfile()
+					}
+				}
 				w.Header().Set("Content-Type", "application/json")
 				json.NewEncoder(w).Encode(users)
 				w.WriteHeader(http.StatusOK)
@@ -72,8 +149,18 @@ func (h *Handler) UsersHandler(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+			if newUser.Role == "" {
+				newUser.Role = RolePassenger
+			}
+			actor, _ := ActorFromContext(r.Context())
+			if !Authorize(actor, ActionCreateUser, UserResource(newUser, false)) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
 			user, err := h.Service.CreateNewUser(newUser)
-			if err != nil {
+			if errors.Is(err, ErrInvalidEmail) || errors.Is(err, ErrInvalidPhone) || errors.Is(err, ErrInvalidPassword) {
+				w.WriteHeader(http.StatusBadRequest)
+			} else if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 			} else {
 				w.Header().Set("Content-Type", "application/json")
@@ -83,21 +170,63 @@ func (h *Handler) UsersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	case http.MethodPatch:
 		{
-
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			idStr := r.URL.Query().Get("user_id")
+			userID, err := uuid.Parse(idStr)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !Authorize(actor, ActionEditUser, Resource{OwnerID: userID}) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			patch, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			user, err := h.Service.PatchUser(userID, patch)
+			if errors.Is(err, ErrInvalidPatch) || errors.Is(err, ErrInvalidEmail) || errors.Is(err, ErrInvalidPhone) {
+				w.WriteHeader(http.StatusBadRequest)
+			} else if errors.Is(err, ErrEmailTaken) {
+				w.WriteHeader(http.StatusConflict)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(user)
+			}
 		}
 	case http.MethodDelete:
 		{
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 			idStr := r.URL.Query().Get("user_id")
 			userID, err := uuid.Parse(idStr)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			err = h.Service.DeleteUser(userID)
-			if err != nil {
+			if !Authorize(actor, ActionDeleteUser, Resource{OwnerID: userID}) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			erasure, err := h.Service.EraseUser(userID)
+			if errors.Is(err, ErrUserErased) {
+				w.WriteHeader(http.StatusGone)
+			} else if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 			} else {
-				w.WriteHeader(http.StatusNoContent)
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(erasure)
 			}
 		}
 	}
@@ -107,10 +236,20 @@ func (h *Handler) RidesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		{
-			rides, err := h.Service.GetAllRides()
+			// Rides are listed to signed in users only, so that the rides
+			// hidden from a blocked user are not shown to it signed out.
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			rides, err := h.Service.GetRidesFor(actor.UserID)
 			if err != nil {
 				w.WriteHeader(http.StatusNotFound)
 			}
+			if r.URL.Query().Get("sort") == "driver_reputation" {
+				SortByDriverReputation(rides)
+			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(rides)
 			w.WriteHeader(http.StatusOK)
@@ -118,14 +257,30 @@ func (h *Handler) RidesHandler(w http.ResponseWriter, r *http.Request) {
 
 	case http.MethodPost:
 		{
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 			newRide := Ride{}
 			err := json.NewDecoder(r.Body).Decode(&newRide)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+			if !Authorize(actor, ActionCreateRide, RideResource(newRide)) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
 			ride, err := h.Service.CreateRide(newRide)
-			if err != nil {
+			if errors.Is(err, ErrEmailNotVerified) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			} else if errors.Is(err, ErrInvalidVehicle) || errors.Is(err, ErrTooManySeats) ||
+				errors.Is(err, ErrPriceAboveCap) || errors.Is(err, ErrInvalidRideDistance) || errors.Is(err, ErrInvalidMoney) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			} else if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
@@ -135,17 +290,72 @@ func (h *Handler) RidesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	case http.MethodPatch:
 		{
-
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			rideID, err := uuid.Parse(r.URL.Query().Get("ride_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ride, err := h.Service.GetRideById(rideID)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if !Authorize(actor, ActionEditRide, RideResource(ride)) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			// The fields left out of the body keep their value.
+			if err := json.NewDecoder(r.Body).Decode(&ride); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ride.RideID = rideID
+			ride, err = h.Service.UpdateRide(ride)
+			if errors.Is(err, ErrRideNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if errors.Is(err, ErrRideNotEditable) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if errors.Is(err, ErrInvalidVehicle) || errors.Is(err, ErrTooManySeats) ||
+				errors.Is(err, ErrPriceAboveCap) || errors.Is(err, ErrInvalidRideDistance) || errors.Is(err, ErrInvalidMoney) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ride)
 		}
 	case http.MethodDelete:
 		{
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 			idStr := r.URL.Query().Get("ride_id")
-			rodeID, err := uuid.Parse(idStr)
+			rideID, err := uuid.Parse(idStr)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			err = h.Service.DeleteBooking(rodeID)
+			ride, err := h.Service.GetRideById(rideID)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if !Authorize(actor, ActionCancelRide, RideResource(ride)) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			err = h.Service.DeleteRide(rideID, actor.UserID)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
@@ -159,9 +369,21 @@ func (h *Handler) BookingsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		{
-			bookings, err := h.Service.GetAllBookings()
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var bookings []Booking
+			var err error
+			if actor.IsAdmin() {
+				bookings, err = h.Service.GetAllBookings()
+			} else {
+				bookings, err = h.Service.GetBookingsForUser(actor.UserID)
+			}
 			if err != nil {
 				w.WriteHeader(http.StatusNotFound)
+				return
 			}
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
@@ -169,14 +391,41 @@ func (h *Handler) BookingsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	case http.MethodPost:
 		{
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 			newBooking := Booking{}
 			err := json.NewDecoder(r.Body).Decode(&newBooking)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+			if !Authorize(actor, ActionCreateBooking, Resource{OwnerID: newBooking.UserID}) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
 			booking, err := h.Service.CreateBooking(newBooking)
-			if err != nil {
+			if errors.Is(err, ErrEmailNotVerified) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			} else if errors.Is(err, ErrRideNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if errors.Is(err, ErrUserBlocked) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if errors.Is(err, ErrPaymentDeclined) {
+				w.WriteHeader(http.StatusPaymentRequired)
+				return
+			} else if errors.Is(err, ErrPromotionNotApplicable) || errors.Is(err, ErrInvalidBooking) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if errors.Is(err, ErrPromotionExhausted) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			} else {
@@ -191,27 +440,147 @@ func (h *Handler) BookingsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	case http.MethodDelete:
 		{
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 			idStr := r.URL.Query().Get("booking_id")
 			bookingID, err := uuid.Parse(idStr)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			err = h.Service.DeleteBooking(bookingID)
+			booking, err := h.Service.GetBookingById(bookingID)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			ride, err := h.Service.GetRideById(booking.RideID)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if !Authorize(actor, ActionCancelBooking, BookingResource(booking, ride)) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			err = h.Service.DeleteBooking(bookingID, actor.UserID)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
+				return
 			}
 			w.WriteHeader(http.StatusNoContent)
 		}
 	}
 }
 
+// ApproveBookingHandler lets the driver of the ride confirm a pending booking.
+func (h *Handler) ApproveBookingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	bookingID, err := uuid.Parse(r.URL.Query().Get("booking_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	booking, err := h.Service.GetBookingById(bookingID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	ride, err := h.Service.GetRideById(booking.RideID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !Authorize(actor, ActionEditRide, RideResource(ride)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	booking, err = h.Service.ApproveBooking(bookingID)
+	if errors.Is(err, ErrBookingNotPending) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if errors.Is(err, ErrInvalidBooking) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, ErrRideNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(booking)
+}
+
 func main() {
 	h := NewHandler()
+	if len(os.Args) > 1 && os.Args[1] == "check-ledger" {
+		os.Exit(checkLedgerCommand(h.Service, os.Stdout))
+	}
 	http.HandleFunc("/", helloHandler)
-	http.HandleFunc("/users", h.UsersHandler)
-	http.HandleFunc("/rides", h.RidesHandler)
-	http.HandleFunc("/bookings", h.BookingsHandler)
+	http.HandleFunc("/users", h.authenticate(h.UsersHandler))
+	http.HandleFunc("/rides", h.authenticate(h.RidesHandler))
+	http.HandleFunc("/bookings", h.authenticate(h.BookingsHandler))
+	http.HandleFunc("/users/verify-email", h.EmailVerificationHandler)
+	http.HandleFunc("/users/verify-email/resend", h.ResendEmailVerificationHandler)
+	http.HandleFunc("/users/verify-phone", h.authenticate(h.PhoneVerificationHandler))
+	http.HandleFunc("/users/verify-phone/confirm", h.authenticate(h.ConfirmPhoneHandler))
+	http.HandleFunc("/sessions", h.SessionsHandler)
+	http.HandleFunc("/password-reset", h.PasswordResetRequestHandler)
+	http.HandleFunc("/password-reset/confirm", h.PasswordResetHandler)
+	http.HandleFunc("/reviews", h.authenticate(h.ReviewsHandler))
+	http.HandleFunc("/rides/complete", h.authenticate(h.CompleteRideHandler))
+	http.HandleFunc("/vehicles", h.authenticate(h.VehiclesHandler))
+	http.HandleFunc("/exports", h.authenticate(h.DataExportsHandler))
+	http.HandleFunc("/exports/download", h.DataExportDownloadHandler)
+	http.HandleFunc("/users/deactivate", h.authenticate(h.DeactivateUserHandler))
+	http.HandleFunc("/admin/trash", h.authenticate(h.TrashHandler))
+	http.HandleFunc("/admin/trash/restore", h.authenticate(h.RestoreHandler))
+	http.HandleFunc("/blocks", h.authenticate(h.BlocksHandler))
+	http.HandleFunc("/messages", h.authenticate(h.MessagesHandler))
+	http.HandleFunc("/messages/read", h.authenticate(h.MessagesReadHandler))
+	http.HandleFunc("/bookings/approve", h.authenticate(h.ApproveBookingHandler))
+	http.HandleFunc("/notifications", h.authenticate(h.NotificationsHandler))
+	http.HandleFunc("/admin/notifications", h.authenticate(h.DeadNotificationsHandler))
+	http.HandleFunc("/admin/webhooks", h.authenticate(h.WebhooksHandler))
+	http.HandleFunc("/admin/webhooks/deliveries", h.authenticate(h.WebhookDeliveriesHandler))
+	http.HandleFunc("/rides/availability", h.AvailabilityHandler)
+	http.HandleFunc("/rides/price-suggestion", h.authenticate(h.PriceSuggestionHandler))
+	http.HandleFunc("/admin/templates/preview", h.authenticate(h.TemplatePreviewHandler))
+	http.HandleFunc("/payments", h.authenticate(h.PaymentsHandler))
+	http.HandleFunc("/payments/webhook", h.PaymentWebhookHandler)
+	http.HandleFunc("/admin/payments/refund", h.authenticate(h.RefundHandler))
+	http.HandleFunc("/wallet", h.authenticate(h.WalletHandler))
+	http.HandleFunc("/wallet/transactions", h.authenticate(h.WalletTransactionsHandler))
+	http.HandleFunc("/invoices", h.authenticate(h.InvoicesHandler))
+	http.HandleFunc("/invoices/download", h.authenticate(h.InvoiceDownloadHandler))
+	http.HandleFunc("/admin/promotions", h.authenticate(h.PromotionsHandler))
+	http.HandleFunc("/payouts", h.authenticate(h.PayoutsHandler))
+	http.HandleFunc("/payouts/account", h.authenticate(h.PayoutAccountHandler))
+	http.HandleFunc("/admin/payouts", h.authenticate(h.AdminPayoutsHandler))
+	http.HandleFunc("/admin/payouts/batches", h.authenticate(h.PayoutBatchesHandler))
+	http.HandleFunc("/admin/payouts/batches/export", h.authenticate(h.PayoutBatchExportHandler))
+	if err := h.Service.SchedulePeriodicJobs(); err != nil {
+		log.Println("could not schedule periodic jobs :", err)
+	}
+	go func() {
+		for range time.Tick(SchedulerInterval) {
+			if _, err := h.Service.RunDueJobs(); err != nil {
+				log.Println("could not run due jobs :", err)
+			}
+		}
+	}()
 	fmt.Println("Server is running on port 8080...")
 	http.ListenAndServe(":8080", nil)
 }
@@ -37,9 +37,9 @@ func (m *MockService) CreateNewUser(u User) (User, error) {
 	return args.Get(0).(User), args.Error(1)
 }
 
-func (m *MockService) DeleteUser(id uuid.UUID) error {
+func (m *MockService) EraseUser(id uuid.UUID) (Erasure, error) {
 	args := m.Called(id)
-	return args.Error(0)
+	return args.Get(0).(Erasure), args.Error(1)
 }
 
 func (m *MockService) GetAllRides() ([]Ride, error) {
@@ -52,13 +52,13 @@ func (m *MockService) CreateRide(r Ride) (Ride, error) {
 	return args.Get(0).(Ride), args.Error(1)
 }
 
-func (m *MockService) DeleteBooking(id uuid.UUID) error {
-	args := m.Called(id)
+func (m *MockService) DeleteBooking(id uuid.UUID, actorID uuid.UUID) error {
+	args := m.Called(id, actorID)
 	return args.Error(0)
 }
 
-func (m *MockService) DeleteRide(id uuid.UUID) error {
-	args := m.Called(id)
+func (m *MockService) DeleteRide(id uuid.UUID, actorID uuid.UUID) error {
+	args := m.Called(id, actorID)
 	return args.Error(0)
 }
 
@@ -87,6 +87,11 @@ func (m *MockService) UpdateBooking(b Booking) (Booking, error) {
 	return args.Get(0).(Booking), args.Error(1)
 }
 
+func (m *MockService) ApproveBooking(id uuid.UUID) (Booking, error) {
+	args := m.Called(id)
+	return args.Get(0).(Booking), args.Error(1)
+}
+
 func (m *MockService) UpdateRide(r Ride) (Ride, error) {
 	args := m.Called(r)
 	return args.Get(0).(Ride), args.Error(1)
@@ -97,6 +102,378 @@ func (m *MockService) UpdateUser(u User) (User, error) {
 	return args.Get(0).(User), args.Error(1)
 }
 
+func (m *MockService) GetBookingsForUser(id uuid.UUID) ([]Booking, error) {
+	args := m.Called(id)
+	return args.Get(0).([]Booking), args.Error(1)
+}
+
+func (m *MockService) AreCounterparts(id uuid.UUID, otherID uuid.UUID) (bool, error) {
+	args := m.Called(id, otherID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockService) VerifyEmail(token string) error {
+	args := m.Called(token)
+	return args.Error(0)
+}
+
+func (m *MockService) ResendEmailVerification(email string) error {
+	args := m.Called(email)
+	return args.Error(0)
+}
+
+func (m *MockService) RequestPhoneVerification(id uuid.UUID, phone string) error {
+	args := m.Called(id, phone)
+	return args.Error(0)
+}
+
+func (m *MockService) VerifyPhone(id uuid.UUID, code string) error {
+	args := m.Called(id, code)
+	return args.Error(0)
+}
+
+func (m *MockService) Login(email string, password string) (string, error) {
+	args := m.Called(email, password)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockService) AuthenticateSession(token string) (Actor, error) {
+	args := m.Called(token)
+	return args.Get(0).(Actor), args.Error(1)
+}
+
+func (m *MockService) RequestPasswordReset(email string, ip string) error {
+	args := m.Called(email, ip)
+	return args.Error(0)
+}
+
+func (m *MockService) ResetPassword(token string, password string, ip string) error {
+	args := m.Called(token, password, ip)
+	return args.Error(0)
+}
+
+func (m *MockService) PatchUser(id uuid.UUID, patch []byte) (User, error) {
+	args := m.Called(id, patch)
+	return args.Get(0).(User), args.Error(1)
+}
+
+func (m *MockService) CreateReview(authorID uuid.UUID, review Review) (Review, error) {
+	args := m.Called(authorID, review)
+	return args.Get(0).(Review), args.Error(1)
+}
+
+func (m *MockService) GetReviewsReceived(userID uuid.UUID) ([]Review, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]Review), args.Error(1)
+}
+
+func (m *MockService) CloseReviewWindows() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockService) CreateVehicle(ownerID uuid.UUID, vehicle Vehicle) (Vehicle, error) {
+	args := m.Called(ownerID, vehicle)
+	return args.Get(0).(Vehicle), args.Error(1)
+}
+
+func (m *MockService) GetVehicleById(vehicleID uuid.UUID) (Vehicle, error) {
+	args := m.Called(vehicleID)
+	return args.Get(0).(Vehicle), args.Error(1)
+}
+
+func (m *MockService) GetVehiclesByOwner(ownerID uuid.UUID) ([]Vehicle, error) {
+	args := m.Called(ownerID)
+	return args.Get(0).([]Vehicle), args.Error(1)
+}
+
+func (m *MockService) DeleteVehicle(vehicleID uuid.UUID) error {
+	args := m.Called(vehicleID)
+	return args.Error(0)
+}
+
+func (m *MockService) RequestDataExport(userID uuid.UUID) (DataExport, error) {
+	args := m.Called(userID)
+	return args.Get(0).(DataExport), args.Error(1)
+}
+
+func (m *MockService) GetDataExports(userID uuid.UUID) ([]DataExport, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]DataExport), args.Error(1)
+}
+
+func (m *MockService) DownloadDataExport(token string) ([]byte, error) {
+	args := m.Called(token)
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *MockService) DeactivateUser(userID uuid.UUID, actorID uuid.UUID) error {
+	args := m.Called(userID, actorID)
+	return args.Error(0)
+}
+
+func (m *MockService) GetDeletedRides() ([]Ride, error) {
+	args := m.Called()
+	return args.Get(0).([]Ride), args.Error(1)
+}
+
+func (m *MockService) GetDeletedBookings() ([]Booking, error) {
+	args := m.Called()
+	return args.Get(0).([]Booking), args.Error(1)
+}
+
+func (m *MockService) GetDeactivatedUsers() ([]User, error) {
+	args := m.Called()
+	return args.Get(0).([]User), args.Error(1)
+}
+
+func (m *MockService) RestoreRide(rideID uuid.UUID) (Ride, error) {
+	args := m.Called(rideID)
+	return args.Get(0).(Ride), args.Error(1)
+}
+
+func (m *MockService) RestoreBooking(bookingID uuid.UUID) (Booking, error) {
+	args := m.Called(bookingID)
+	return args.Get(0).(Booking), args.Error(1)
+}
+
+func (m *MockService) RestoreUser(userID uuid.UUID) (User, error) {
+	args := m.Called(userID)
+	return args.Get(0).(User), args.Error(1)
+}
+
+func (m *MockService) PurgeDeleted() (PurgeSummary, error) {
+	args := m.Called()
+	return args.Get(0).(PurgeSummary), args.Error(1)
+}
+
+func (m *MockService) BlockUser(blockerID uuid.UUID, blockedID uuid.UUID) error {
+	args := m.Called(blockerID, blockedID)
+	return args.Error(0)
+}
+
+func (m *MockService) UnblockUser(blockerID uuid.UUID, blockedID uuid.UUID) error {
+	args := m.Called(blockerID, blockedID)
+	return args.Error(0)
+}
+
+func (m *MockService) GetBlockedUsers(blockerID uuid.UUID) ([]Block, error) {
+	args := m.Called(blockerID)
+	return args.Get(0).([]Block), args.Error(1)
+}
+
+func (m *MockService) GetRidesFor(viewerID uuid.UUID) ([]Ride, error) {
+	args := m.Called(viewerID)
+	return args.Get(0).([]Ride), args.Error(1)
+}
+
+func (m *MockService) SendMessage(senderID uuid.UUID, conversation Conversation, body string) (Message, error) {
+	args := m.Called(senderID, conversation, body)
+	return args.Get(0).(Message), args.Error(1)
+}
+
+func (m *MockService) GetMessages(userID uuid.UUID, conversation Conversation, before *uuid.UUID, limit int) ([]Message, error) {
+	args := m.Called(userID, conversation, before, limit)
+	return args.Get(0).([]Message), args.Error(1)
+}
+
+func (m *MockService) MarkConversationRead(userID uuid.UUID, conversation Conversation) error {
+	args := m.Called(userID, conversation)
+	return args.Error(0)
+}
+
+func (m *MockService) DispatchNotifications() (int, error) {
+	args := m.Called()
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockService) GetNotifications(userID uuid.UUID) ([]Notification, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]Notification), args.Error(1)
+}
+
+func (m *MockService) MarkNotificationRead(userID uuid.UUID, notificationID uuid.UUID) error {
+	args := m.Called(userID, notificationID)
+	return args.Error(0)
+}
+
+func (m *MockService) GetDeadNotifications() ([]Notification, error) {
+	args := m.Called()
+	return args.Get(0).([]Notification), args.Error(1)
+}
+
+func (m *MockService) RequeueNotification(notificationID uuid.UUID) error {
+	args := m.Called(notificationID)
+	return args.Error(0)
+}
+
+func (m *MockService) CreateWebhook(webhook Webhook) (Webhook, error) {
+	args := m.Called(webhook)
+	return args.Get(0).(Webhook), args.Error(1)
+}
+
+func (m *MockService) GetWebhooks() ([]Webhook, error) {
+	args := m.Called()
+	return args.Get(0).([]Webhook), args.Error(1)
+}
+
+func (m *MockService) DeleteWebhook(webhookID uuid.UUID) error {
+	args := m.Called(webhookID)
+	return args.Error(0)
+}
+
+func (m *MockService) GetWebhookDeliveries(webhookID uuid.UUID) ([]WebhookDelivery, error) {
+	args := m.Called(webhookID)
+	return args.Get(0).([]WebhookDelivery), args.Error(1)
+}
+
+func (m *MockService) RedeliverWebhook(deliveryID uuid.UUID) error {
+	args := m.Called(deliveryID)
+	return args.Error(0)
+}
+
+func (m *MockService) DispatchWebhooks() (int, error) {
+	args := m.Called()
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockService) SubscribeAvailability(rideIDs []uuid.UUID, lastEventID *uint64) (*AvailabilitySubscription, []AvailabilityEvent, error) {
+	args := m.Called(rideIDs, lastEventID)
+	subscription, _ := args.Get(0).(*AvailabilitySubscription)
+	return subscription, args.Get(1).([]AvailabilityEvent), args.Error(2)
+}
+
+func (m *MockService) GetPaymentsForUser(userID uuid.UUID) ([]Payment, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]Payment), args.Error(1)
+}
+
+func (m *MockService) RefundPayment(paymentID uuid.UUID, amount Money) (Payment, error) {
+	args := m.Called(paymentID, amount)
+	return args.Get(0).(Payment), args.Error(1)
+}
+
+func (m *MockService) ApplyPaymentWebhook(header http.Header, body []byte) error {
+	args := m.Called(header, body)
+	return args.Error(0)
+}
+
+func (m *MockService) ReconcilePayments() (int, error) {
+	args := m.Called()
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockService) GetWallet(userID uuid.UUID) (Wallet, error) {
+	args := m.Called(userID)
+	return args.Get(0).(Wallet), args.Error(1)
+}
+
+func (m *MockService) GetWalletTransactions(userID uuid.UUID) ([]WalletTransaction, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]WalletTransaction), args.Error(1)
+}
+
+func (m *MockService) CheckLedger() (LedgerReport, error) {
+	args := m.Called()
+	return args.Get(0).(LedgerReport), args.Error(1)
+}
+
+func (m *MockService) SuggestRidePrice(ride Ride) (PriceSuggestion, error) {
+	args := m.Called(ride)
+	return args.Get(0).(PriceSuggestion), args.Error(1)
+}
+
+func (m *MockService) GetInvoicesForUser(userID uuid.UUID) ([]Invoice, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]Invoice), args.Error(1)
+}
+
+func (m *MockService) GetInvoice(invoiceID uuid.UUID) (Invoice, error) {
+	args := m.Called(invoiceID)
+	return args.Get(0).(Invoice), args.Error(1)
+}
+
+func (m *MockService) GetPromotions() ([]Promotion, error) {
+	args := m.Called()
+	return args.Get(0).([]Promotion), args.Error(1)
+}
+
+func (m *MockService) CreatePromotion(promotion Promotion) (Promotion, error) {
+	args := m.Called(promotion)
+	return args.Get(0).(Promotion), args.Error(1)
+}
+
+func (m *MockService) UpdatePromotion(promotion Promotion) (Promotion, error) {
+	args := m.Called(promotion)
+	return args.Get(0).(Promotion), args.Error(1)
+}
+
+func (m *MockService) DeletePromotion(promotionID uuid.UUID) error {
+	args := m.Called(promotionID)
+	return args.Error(0)
+}
+
+func (m *MockService) GetPayoutAccount(userID uuid.UUID) (PayoutAccount, error) {
+	args := m.Called(userID)
+	return args.Get(0).(PayoutAccount), args.Error(1)
+}
+
+func (m *MockService) SavePayoutAccount(account PayoutAccount) (PayoutAccount, error) {
+	args := m.Called(account)
+	return args.Get(0).(PayoutAccount), args.Error(1)
+}
+
+func (m *MockService) GetPayoutsForUser(userID uuid.UUID) ([]Payout, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]Payout), args.Error(1)
+}
+
+func (m *MockService) GetPayoutBatches() ([]PayoutBatch, error) {
+	args := m.Called()
+	return args.Get(0).([]PayoutBatch), args.Error(1)
+}
+
+func (m *MockService) GetPayoutsByBatch(batchID uuid.UUID) ([]Payout, error) {
+	args := m.Called(batchID)
+	return args.Get(0).([]Payout), args.Error(1)
+}
+
+func (m *MockService) BatchPayouts() (PayoutBatch, error) {
+	args := m.Called()
+	return args.Get(0).(PayoutBatch), args.Error(1)
+}
+
+func (m *MockService) ExportPayoutBatch(batchID uuid.UUID) ([]byte, error) {
+	args := m.Called(batchID)
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *MockService) UpdatePayoutStatus(payoutID uuid.UUID, status string, reason string) (Payout, error) {
+	args := m.Called(payoutID, status, reason)
+	return args.Get(0).(Payout), args.Error(1)
+}
+
+func (m *MockService) SchedulePeriodicJobs() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockService) RunDueJobs() (int, error) {
+	args := m.Called()
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockService) CompleteRide(rideID uuid.UUID, noShows []uuid.UUID) error {
+	args := m.Called(rideID, noShows)
+	return args.Error(0)
+}
+
+var admin = Actor{UserID: uuid.New(), Role: RoleAdmin}
+
+func asActor(req *http.Request, actor Actor) *http.Request {
+	return req.WithContext(WithActor(req.Context(), actor))
+}
+
 // -------- Tests --------
 
 func TestHelloHandler(t *testing.T) {
@@ -115,7 +492,7 @@ func TestUsersHandler_GetByEmail(t *testing.T) {
 	user := User{Email: "a@test.com"}
 	mockSvc.On("GetUserByEmail", "a@test.com").Return(user, nil)
 
-	req := httptest.NewRequest(http.MethodGet, "/users?email=a@test.com", nil)
+	req := asActor(httptest.NewRequest(http.MethodGet, "/users?email=a@test.com", nil), admin)
 	w := httptest.NewRecorder()
 	h.UsersHandler(w, req)
 
@@ -125,7 +502,7 @@ func TestUsersHandler_GetByEmail(t *testing.T) {
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
 	mockSvc.On("GetUserByEmail", "notfound@test.com").Return(User{}, errors.New("not found"))
-	req = httptest.NewRequest(http.MethodGet, "/users?email=notfound@test.com", nil)
+	req = asActor(httptest.NewRequest(http.MethodGet, "/users?email=notfound@test.com", nil), admin)
 	w = httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
@@ -139,13 +516,13 @@ func TestUsersHandler_GetByID(t *testing.T) {
 	user := User{Email: "id@test.com"}
 	mockSvc.On("GetUserById", uid).Return(user, nil)
 
-	req := httptest.NewRequest(http.MethodGet, "/users?user_id="+uid.String(), nil)
+	req := asActor(httptest.NewRequest(http.MethodGet, "/users?user_id="+uid.String(), nil), admin)
 	w := httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusOK, w.Result().StatusCode)
 
 	// invalid UUID
-	req = httptest.NewRequest(http.MethodGet, "/users?user_id=bad_uid", nil)
+	req = asActor(httptest.NewRequest(http.MethodGet, "/users?user_id=bad_uid", nil), admin)
 	w = httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
@@ -154,7 +531,7 @@ func TestUsersHandler_GetByID(t *testing.T) {
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
 	mockSvc.On("GetUserById", uid).Return(User{}, errors.New("not found"))
-	req = httptest.NewRequest(http.MethodGet, "/users?user_id="+uid.String(), nil)
+	req = asActor(httptest.NewRequest(http.MethodGet, "/users?user_id="+uid.String(), nil), admin)
 	w = httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
@@ -166,7 +543,7 @@ func TestUsersHandler_GetAll(t *testing.T) {
 	users := []User{{Email: "u1"}, {Email: "u2"}}
 	mockSvc.On("GetAllUsers").Return(users, nil)
 
-	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req := asActor(httptest.NewRequest(http.MethodGet, "/users", nil), admin)
 	w := httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusOK, w.Result().StatusCode)
@@ -175,7 +552,7 @@ func TestUsersHandler_GetAll(t *testing.T) {
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
 	mockSvc.On("GetAllUsers").Return([]User{}, errors.New("db error"))
-	req = httptest.NewRequest(http.MethodGet, "/users", nil)
+	req = asActor(httptest.NewRequest(http.MethodGet, "/users", nil), admin)
 	w = httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
@@ -184,17 +561,17 @@ func TestUsersHandler_GetAll(t *testing.T) {
 func TestUsersHandler_Post(t *testing.T) {
 	mockSvc := new(MockService)
 	h := &Handler{Service: mockSvc}
-	user := User{Email: "post@test.com"}
+	user := User{Email: "post@test.com", Role: RolePassenger}
 	mockSvc.On("CreateNewUser", user).Return(user, nil)
 
 	body, _ := json.Marshal(user)
-	req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(body))
+	req := asActor(httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(body)), admin)
 	w := httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusOK, w.Result().StatusCode)
 
 	// bad JSON
-	req = httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer([]byte("bad")))
+	req = asActor(httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer([]byte("bad"))), admin)
 	w = httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
@@ -203,10 +580,19 @@ func TestUsersHandler_Post(t *testing.T) {
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
 	mockSvc.On("CreateNewUser", user).Return(User{}, errors.New("fail"))
-	req = httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(body))
+	req = asActor(httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(body)), admin)
 	w = httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+
+	// invalid email
+	mockSvc = new(MockService)
+	h = &Handler{Service: mockSvc}
+	mockSvc.On("CreateNewUser", user).Return(User{}, ErrInvalidEmail)
+	req = asActor(httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(body)), admin)
+	w = httptest.NewRecorder()
+	h.UsersHandler(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
 }
 
 func TestUsersHandler_Delete(t *testing.T) {
@@ -214,14 +600,17 @@ func TestUsersHandler_Delete(t *testing.T) {
 	h := &Handler{Service: mockSvc}
 	uid := uuid.New()
 
-	mockSvc.On("DeleteUser", uid).Return(nil)
-	req := httptest.NewRequest(http.MethodDelete, "/users?user_id="+uid.String(), nil)
+	mockSvc.On("EraseUser", uid).Return(Erasure{UserID: uid, RidesCancelled: []uuid.UUID{}, BookingsCancelled: []uuid.UUID{}}, nil)
+	req := asActor(httptest.NewRequest(http.MethodDelete, "/users?user_id="+uid.String(), nil), admin)
 	w := httptest.NewRecorder()
 	h.UsersHandler(w, req)
-	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	erasure := Erasure{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&erasure))
+	require.Equal(t, uid, erasure.UserID)
 
 	// invalid UUID
-	req = httptest.NewRequest(http.MethodDelete, "/users?user_id=bad", nil)
+	req = asActor(httptest.NewRequest(http.MethodDelete, "/users?user_id=bad", nil), admin)
 	w = httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
@@ -229,11 +618,20 @@ func TestUsersHandler_Delete(t *testing.T) {
 	// error
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
-	mockSvc.On("DeleteUser", uid).Return(errors.New("fail"))
-	req = httptest.NewRequest(http.MethodDelete, "/users?user_id="+uid.String(), nil)
+	mockSvc.On("EraseUser", uid).Return(Erasure{}, errors.New("fail"))
+	req = asActor(httptest.NewRequest(http.MethodDelete, "/users?user_id="+uid.String(), nil), admin)
 	w = httptest.NewRecorder()
 	h.UsersHandler(w, req)
 	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+
+	// already erased
+	mockSvc = new(MockService)
+	h = &Handler{Service: mockSvc}
+	mockSvc.On("EraseUser", uid).Return(Erasure{}, ErrUserErased)
+	req = asActor(httptest.NewRequest(http.MethodDelete, "/users?user_id="+uid.String(), nil), admin)
+	w = httptest.NewRecorder()
+	h.UsersHandler(w, req)
+	require.Equal(t, http.StatusGone, w.Result().StatusCode)
 }
 
 // ---- RidesHandler ----
@@ -242,9 +640,9 @@ func TestRidesHandler_Get(t *testing.T) {
 	mockSvc := new(MockService)
 	h := &Handler{Service: mockSvc}
 	rides := []Ride{{RideID: uuid.New()}}
-	mockSvc.On("GetAllRides").Return(rides, nil)
+	mockSvc.On("GetRidesFor", admin.UserID).Return(rides, nil)
 
-	req := httptest.NewRequest(http.MethodGet, "/rides", nil)
+	req := asActor(httptest.NewRequest(http.MethodGet, "/rides", nil), admin)
 	w := httptest.NewRecorder()
 	h.RidesHandler(w, req)
 	require.Equal(t, http.StatusOK, w.Result().StatusCode)
@@ -252,11 +650,20 @@ func TestRidesHandler_Get(t *testing.T) {
 	// error
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
-	mockSvc.On("GetAllRides").Return([]Ride{}, errors.New("fail"))
-	req = httptest.NewRequest(http.MethodGet, "/rides", nil)
+	mockSvc.On("GetRidesFor", admin.UserID).Return([]Ride{}, errors.New("fail"))
+	req = asActor(httptest.NewRequest(http.MethodGet, "/rides", nil), admin)
 	w = httptest.NewRecorder()
 	h.RidesHandler(w, req)
 	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	// anonymous visitors see no ride, blocked users could not book them
+	mockSvc = new(MockService)
+	h = &Handler{Service: mockSvc}
+	req = httptest.NewRequest(http.MethodGet, "/rides", nil)
+	w = httptest.NewRecorder()
+	h.RidesHandler(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	mockSvc.AssertNotCalled(t, "GetAllRides")
 }
 
 func TestRidesHandler_Post(t *testing.T) {
@@ -266,13 +673,13 @@ func TestRidesHandler_Post(t *testing.T) {
 	mockSvc.On("CreateRide", ride).Return(ride, nil)
 
 	body, _ := json.Marshal(ride)
-	req := httptest.NewRequest(http.MethodPost, "/rides", bytes.NewBuffer(body))
+	req := asActor(httptest.NewRequest(http.MethodPost, "/rides", bytes.NewBuffer(body)), admin)
 	w := httptest.NewRecorder()
 	h.RidesHandler(w, req)
 	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
 
 	// bad JSON
-	req = httptest.NewRequest(http.MethodPost, "/rides", bytes.NewBuffer([]byte("bad")))
+	req = asActor(httptest.NewRequest(http.MethodPost, "/rides", bytes.NewBuffer([]byte("bad"))), admin)
 	w = httptest.NewRecorder()
 	h.RidesHandler(w, req)
 	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
@@ -281,25 +688,55 @@ func TestRidesHandler_Post(t *testing.T) {
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
 	mockSvc.On("CreateRide", ride).Return(Ride{}, errors.New("fail"))
-	req = httptest.NewRequest(http.MethodPost, "/rides", bytes.NewBuffer(body))
+	req = asActor(httptest.NewRequest(http.MethodPost, "/rides", bytes.NewBuffer(body)), admin)
 	w = httptest.NewRecorder()
 	h.RidesHandler(w, req)
 	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
 }
 
+func TestRidesHandler_Patch(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	driver := Actor{UserID: uuid.New(), Role: RoleDriver}
+	ride := Ride{RideID: uuid.New(), DriverID: driver.UserID, Origin: "Lyon", Destination: "Paris", NumberOfSeats: 3}
+	edited := ride
+	edited.NumberOfSeats = 2
+	mockSvc.On("GetRideById", ride.RideID).Return(ride, nil)
+	mockSvc.On("UpdateRide", edited).Return(edited, nil).Once()
+	mockSvc.On("UpdateRide", edited).Return(Ride{}, ErrRideNotEditable).Once()
+	url := "/rides?ride_id=" + ride.RideID.String()
+
+	for _, tc := range []struct {
+		actor  Actor
+		status int
+	}{
+		{driver, http.StatusOK},
+		{driver, http.StatusConflict},
+		{Actor{UserID: uuid.New(), Role: RolePassenger}, http.StatusForbidden},
+	} {
+		req := asActor(httptest.NewRequest(http.MethodPatch, url, bytes.NewBufferString(`{"number_of_seats":2}`)), tc.actor)
+		w := httptest.NewRecorder()
+		h.RidesHandler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode)
+	}
+	mockSvc.AssertNumberOfCalls(t, "UpdateRide", 2)
+}
+
 func TestRidesHandler_Delete(t *testing.T) {
 	mockSvc := new(MockService)
 	h := &Handler{Service: mockSvc}
 	uid := uuid.New()
-	mockSvc.On("DeleteBooking", uid).Return(nil)
+	ride := Ride{RideID: uid, DriverID: uuid.New()}
+	mockSvc.On("GetRideById", uid).Return(ride, nil)
+	mockSvc.On("DeleteRide", uid, admin.UserID).Return(nil)
 
-	req := httptest.NewRequest(http.MethodDelete, "/rides?ride_id="+uid.String(), nil)
+	req := asActor(httptest.NewRequest(http.MethodDelete, "/rides?ride_id="+uid.String(), nil), admin)
 	w := httptest.NewRecorder()
 	h.RidesHandler(w, req)
 	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
 
 	// invalid UUID
-	req = httptest.NewRequest(http.MethodDelete, "/rides?ride_id=bad", nil)
+	req = asActor(httptest.NewRequest(http.MethodDelete, "/rides?ride_id=bad", nil), admin)
 	w = httptest.NewRecorder()
 	h.RidesHandler(w, req)
 	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
@@ -307,8 +744,9 @@ func TestRidesHandler_Delete(t *testing.T) {
 	// error
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
-	mockSvc.On("DeleteBooking", uid).Return(errors.New("fail"))
-	req = httptest.NewRequest(http.MethodDelete, "/rides?ride_id="+uid.String(), nil)
+	mockSvc.On("GetRideById", uid).Return(ride, nil)
+	mockSvc.On("DeleteRide", uid, admin.UserID).Return(errors.New("fail"))
+	req = asActor(httptest.NewRequest(http.MethodDelete, "/rides?ride_id="+uid.String(), nil), admin)
 	w = httptest.NewRecorder()
 	h.RidesHandler(w, req)
 	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
@@ -322,7 +760,7 @@ func TestBookingsHandler_Get(t *testing.T) {
 	bookings := []Booking{{BookingID: uuid.New()}}
 	mockSvc.On("GetAllBookings").Return(bookings, nil)
 
-	req := httptest.NewRequest(http.MethodGet, "/bookings", nil)
+	req := asActor(httptest.NewRequest(http.MethodGet, "/bookings", nil), admin)
 	w := httptest.NewRecorder()
 	h.BookingsHandler(w, req)
 	require.Equal(t, http.StatusOK, w.Result().StatusCode)
@@ -331,7 +769,7 @@ func TestBookingsHandler_Get(t *testing.T) {
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
 	mockSvc.On("GetAllBookings").Return([]Booking{}, errors.New("fail"))
-	req = httptest.NewRequest(http.MethodGet, "/bookings", nil)
+	req = asActor(httptest.NewRequest(http.MethodGet, "/bookings", nil), admin)
 	w = httptest.NewRecorder()
 	h.BookingsHandler(w, req)
 	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
@@ -344,13 +782,13 @@ func TestBookingsHandler_Post(t *testing.T) {
 	mockSvc.On("CreateBooking", booking).Return(booking, nil)
 
 	body, _ := json.Marshal(booking)
-	req := httptest.NewRequest(http.MethodPost, "/bookings", bytes.NewBuffer(body))
+	req := asActor(httptest.NewRequest(http.MethodPost, "/bookings", bytes.NewBuffer(body)), admin)
 	w := httptest.NewRecorder()
 	h.BookingsHandler(w, req)
 	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
 
 	// bad JSON
-	req = httptest.NewRequest(http.MethodPost, "/bookings", bytes.NewBuffer([]byte("bad")))
+	req = asActor(httptest.NewRequest(http.MethodPost, "/bookings", bytes.NewBuffer([]byte("bad"))), admin)
 	w = httptest.NewRecorder()
 	h.BookingsHandler(w, req)
 	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
@@ -359,7 +797,7 @@ func TestBookingsHandler_Post(t *testing.T) {
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
 	mockSvc.On("CreateBooking", booking).Return(Booking{}, errors.New("fail"))
-	req = httptest.NewRequest(http.MethodPost, "/bookings", bytes.NewBuffer(body))
+	req = asActor(httptest.NewRequest(http.MethodPost, "/bookings", bytes.NewBuffer(body)), admin)
 	w = httptest.NewRecorder()
 	h.BookingsHandler(w, req)
 	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
@@ -369,15 +807,19 @@ func TestBookingsHandler_Delete(t *testing.T) {
 	mockSvc := new(MockService)
 	h := &Handler{Service: mockSvc}
 	uid := uuid.New()
-	mockSvc.On("DeleteBooking", uid).Return(nil)
+	ride := Ride{RideID: uuid.New(), DriverID: uuid.New()}
+	booking := Booking{BookingID: uid, RideID: ride.RideID, UserID: uuid.New()}
+	mockSvc.On("GetBookingById", uid).Return(booking, nil)
+	mockSvc.On("GetRideById", ride.RideID).Return(ride, nil)
+	mockSvc.On("DeleteBooking", uid, admin.UserID).Return(nil)
 
-	req := httptest.NewRequest(http.MethodDelete, "/bookings?booking_id="+uid.String(), nil)
+	req := asActor(httptest.NewRequest(http.MethodDelete, "/bookings?booking_id="+uid.String(), nil), admin)
 	w := httptest.NewRecorder()
 	h.BookingsHandler(w, req)
 	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
 
 	// invalid UUID
-	req = httptest.NewRequest(http.MethodDelete, "/bookings?booking_id=bad", nil)
+	req = asActor(httptest.NewRequest(http.MethodDelete, "/bookings?booking_id=bad", nil), admin)
 	w = httptest.NewRecorder()
 	h.BookingsHandler(w, req)
 	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
@@ -385,9 +827,117 @@ func TestBookingsHandler_Delete(t *testing.T) {
 	// error
 	mockSvc = new(MockService)
 	h = &Handler{Service: mockSvc}
-	mockSvc.On("DeleteBooking", uid).Return(errors.New("fail"))
-	req = httptest.NewRequest(http.MethodDelete, "/bookings?booking_id="+uid.String(), nil)
+	mockSvc.On("GetBookingById", uid).Return(booking, nil)
+	mockSvc.On("GetRideById", ride.RideID).Return(ride, nil)
+	mockSvc.On("DeleteBooking", uid, admin.UserID).Return(errors.New("fail"))
+	req = asActor(httptest.NewRequest(http.MethodDelete, "/bookings?booking_id="+uid.String(), nil), admin)
 	w = httptest.NewRecorder()
 	h.BookingsHandler(w, req)
 	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
 }
+
+// ---- Authorization ----
+
+func TestHandlers_Unauthenticated(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	uid := uuid.New()
+
+	for _, tc := range []struct {
+		method  string
+		target  string
+		handler http.HandlerFunc
+	}{
+		{http.MethodGet, "/users", h.UsersHandler},
+		{http.MethodDelete, "/users?user_id=" + uid.String(), h.UsersHandler},
+		{http.MethodGet, "/rides", h.RidesHandler},
+		{http.MethodPost, "/rides", h.RidesHandler},
+		{http.MethodDelete, "/rides?ride_id=" + uid.String(), h.RidesHandler},
+		{http.MethodGet, "/bookings", h.BookingsHandler},
+		{http.MethodPost, "/bookings", h.BookingsHandler},
+		{http.MethodDelete, "/bookings?booking_id=" + uid.String(), h.BookingsHandler},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		w := httptest.NewRecorder()
+		tc.handler(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode, "%s %s", tc.method, tc.target)
+	}
+}
+
+func TestUsersHandler_PIIVisibility(t *testing.T) {
+	viewer := Actor{UserID: uuid.New(), Role: RolePassenger}
+	user := User{UserID: uuid.New(), FirstName: "Faten", Email: "faten@test.com", Phone: "0600000000"}
+
+	// strangers only see the public profile
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("GetUserById", user.UserID).Return(user, nil)
+	mockSvc.On("AreCounterparts", viewer.UserID, user.UserID).Return(false, nil)
+	req := asActor(httptest.NewRequest(http.MethodGet, "/users?user_id="+user.UserID.String(), nil), viewer)
+	w := httptest.NewRecorder()
+	h.UsersHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	got := User{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, user.PublicProfile(), got)
+
+	// counterparts with a confirmed booking see everything
+	mockSvc = new(MockService)
+	h = &Handler{Service: mockSvc}
+	mockSvc.On("GetUserById", user.UserID).Return(user, nil)
+	mockSvc.On("AreCounterparts", viewer.UserID, user.UserID).Return(true, nil)
+	req = asActor(httptest.NewRequest(http.MethodGet, "/users?user_id="+user.UserID.String(), nil), viewer)
+	w = httptest.NewRecorder()
+	h.UsersHandler(w, req)
+	got = User{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, user, got)
+
+	// email lookups are reserved to the user and admins
+	mockSvc = new(MockService)
+	h = &Handler{Service: mockSvc}
+	mockSvc.On("GetUserByEmail", user.Email).Return(user, nil)
+	req = asActor(httptest.NewRequest(http.MethodGet, "/users?email="+user.Email, nil), viewer)
+	w = httptest.NewRecorder()
+	h.UsersHandler(w, req)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestUsersHandler_PostAdminForbidden(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	body, _ := json.Marshal(User{Email: "evil@test.com", Role: RoleAdmin})
+
+	req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	h.UsersHandler(w, req)
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	mockSvc.AssertNotCalled(t, "CreateNewUser", mock.Anything)
+}
+
+func TestRidesHandler_DeleteNotDriver(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	ride := Ride{RideID: uuid.New(), DriverID: uuid.New()}
+	mockSvc.On("GetRideById", ride.RideID).Return(ride, nil)
+
+	passenger := Actor{UserID: uuid.New(), Role: RolePassenger}
+	req := asActor(httptest.NewRequest(http.MethodDelete, "/rides?ride_id="+ride.RideID.String(), nil), passenger)
+	w := httptest.NewRecorder()
+	h.RidesHandler(w, req)
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	mockSvc.AssertNotCalled(t, "DeleteRide", ride.RideID, passenger.UserID)
+}
+
+func TestBookingsHandler_GetOwnBookings(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	passenger := Actor{UserID: uuid.New(), Role: RolePassenger}
+	mockSvc.On("GetBookingsForUser", passenger.UserID).Return([]Booking{{UserID: passenger.UserID}}, nil)
+
+	req := asActor(httptest.NewRequest(http.MethodGet, "/bookings", nil), passenger)
+	w := httptest.NewRecorder()
+	h.BookingsHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	mockSvc.AssertNotCalled(t, "GetAllBookings")
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	messageMaxLength       = 2000
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 100
+)
+
+var (
+	ErrInvalidMessage       = errors.New("invalid message")
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrNotInConversation    = errors.New("not part of the conversation")
+)
+
+const maskedContactDetail = "[hidden]"
+
+// contactDetailPatterns match the email addresses and phone numbers masked
+// in messages sent before a booking is confirmed.
+var contactDetailPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	regexp.MustCompile(`\+?\d(?:[\s.\-()]*\d){7,}`),
+}
+
+// Conversation is the group conversation of a ride when BookingID is nil,
+// and the one-to-one conversation between the driver and the passenger of
+// the booking otherwise. Only confirmed passengers are part of the group, a
+// passenger awaiting confirmation talks to the driver alone.
+type Conversation struct {
+	RideID    uuid.UUID  `json:"ride_id"`
+	BookingID *uuid.UUID `json:"booking_id,omitempty"`
+}
+
+func (conversation Conversation) where() (string, []any) {
+	if conversation.BookingID == nil {
+		return "ride_id = ? AND booking_id IS NULL", []any{conversation.RideID}
+	}
+	return "ride_id = ? AND booking_id = ?", []any{conversation.RideID, *conversation.BookingID}
+}
+
+type Message struct {
+	MessageID uuid.UUID  `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"message_id"`
+	RideID    uuid.UUID  `gorm:"type:uuid;index:idx_message_conversation,priority:1" json:"ride_id"`
+	BookingID *uuid.UUID `gorm:"type:uuid;index:idx_message_conversation,priority:2" json:"booking_id,omitempty"`
+	SenderID  uuid.UUID  `gorm:"type:uuid;index" json:"sender_id"`
+	// Body is stored as shown, contact details masked when the message was
+	// sent before the booking of the conversation was confirmed.
+	Body   string    `json:"body"`
+	SentAt time.Time `gorm:"index:idx_message_conversation,priority:3" json:"sent_at"`
+
+	ReadBy []MessageReceipt `gorm:"foreignKey:MessageID" json:"read_by"`
+}
+
+// MessageReceipt records that a user read a message.
+type MessageReceipt struct {
+	MessageID uuid.UUID `gorm:"type:uuid;primaryKey" json:"message_id"`
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey;index" json:"user_id"`
+	ReadAt    time.Time `json:"read_at"`
+}
+
+type MessageRepository interface {
+	// GetConversationBookings returns the bookings of the ride that are not
+	// cancelled.
+	GetConversationBookings(rideID uuid.UUID) ([]Booking, error)
+	CreateMessage(message Message) (Message, error)
+	// GetMessages returns up to limit messages of the conversation sent
+	// before the message before, newest first. The messages and receipts of
+	// hiddenUsers are left out.
+	GetMessages(conversation Conversation, hiddenUsers []uuid.UUID, before *uuid.UUID, limit int) ([]Message, error)
+	// MarkMessagesRead records that userID read every message of the
+	// conversation sent by others up to at, but those of hiddenUsers.
+	MarkMessagesRead(conversation Conversation, userID uuid.UUID, hiddenUsers []uuid.UUID, at time.Time) error
+	GetMessagesBySender(senderID uuid.UUID) ([]Message, error)
+	GetReceiptsByUser(userID uuid.UUID) ([]MessageReceipt, error)
+}
+
+func (repository *CovoitRepository) GetConversationBookings(rideID uuid.UUID) ([]Booking, error) {
+	ctx := context.Background()
+	bookings, err := gorm.G[Booking](repository.db).Where("ride_id = ? AND status <> ?", rideID, BookingCancelled).Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get bookings of ride %s, err : %s", rideID, err)
+	}
+	return bookings, nil
+}
+
+func (repository *CovoitRepository) CreateMessage(message Message) (Message, error) {
+	ctx := context.Background()
+	if err := gorm.G[Message](repository.db).Create(ctx, &message); err != nil {
+		return Message{}, fmt.Errorf("could not create message, err : %s", err)
+	}
+	message.ReadBy = []MessageReceipt{}
+	return message, nil
+}
+
+func (repository *CovoitRepository) GetMessages(conversation Conversation, hiddenUsers []uuid.UUID, before *uuid.UUID, limit int) ([]Message, error) {
+	ctx := context.Background()
+	where, args := conversation.where()
+	query := gorm.G[Message](repository.db).
+		Where(where, args...).
+		Preload("ReadBy", func(db gorm.PreloadBuilder) error {
+			if len(hiddenUsers) > 0 {
+				db.Where("user_id NOT IN ?", hiddenUsers)
+			}
+			return nil
+		})
+	if len(hiddenUsers) > 0 {
+		query = query.Where("sender_id NOT IN ?", hiddenUsers)
+	}
+	if before != nil {
+		query = query.Where("(sent_at, message_id) < (SELECT sent_at, message_id FROM messages WHERE message_id = ?)", *before)
+	}
+	messages, err := query.Order("sent_at DESC, message_id DESC").Limit(limit).Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get messages of ride %s, err : %s", conversation.RideID, err)
+	}
+	return messages, nil
+}
+
+func (repository *CovoitRepository) MarkMessagesRead(conversation Conversation, userID uuid.UUID, hiddenUsers []uuid.UUID, at time.Time) error {
+	where, args := conversation.where()
+	unread := repository.db.Model(&Message{}).
+		Select("message_id, ?, ?", userID, at).
+		Where(where, args...).
+		Where("sender_id <> ? AND sent_at <= ?", userID, at)
+	if len(hiddenUsers) > 0 {
+		unread = unread.Where("sender_id NOT IN ?", hiddenUsers)
+	}
+	err := repository.db.Exec("INSERT INTO message_receipts (message_id, user_id, read_at) ? ON CONFLICT DO NOTHING", unread).Error
+	if err != nil {
+		return fmt.Errorf("could not mark messages of ride %s read, err : %s", conversation.RideID, err)
+	}
+	return nil
+}
+
+func (repository *CovoitRepository) GetMessagesBySender(senderID uuid.UUID) ([]Message, error) {
+	ctx := context.Background()
+	messages, err := gorm.G[Message](repository.db).Where("sender_id = ?", senderID).Order("sent_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get messages of user %s, err : %s", senderID, err)
+	}
+	return messages, nil
+}
+
+func (repository *CovoitRepository) GetReceiptsByUser(userID uuid.UUID) ([]MessageReceipt, error) {
+	ctx := context.Background()
+	receipts, err := gorm.G[MessageReceipt](repository.db).Where("user_id = ?", userID).Order("read_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get message receipts of user %s, err : %s", userID, err)
+	}
+	return receipts, nil
+}
+
+func init() {
+	// Only the messages the user wrote are theirs, not the whole conversation.
+	registerPersonalData("messages", []string{"messages", "message_receipts"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		sent, err := service.messages.GetMessagesBySender(userID)
+		if err != nil {
+			return nil, err
+		}
+		receipts, err := service.messages.GetReceiptsByUser(userID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"sent": sent, "read_receipts": receipts}, nil
+	})
+}
+
+// maskContactDetails hides the email addresses and phone numbers of text.
+func maskContactDetails(text string) string {
+	for _, pattern := range contactDetailPatterns {
+		text = pattern.ReplaceAllString(text, maskedContactDetail)
+	}
+	return text
+}
+
+// conversationMembers returns the driver and the passengers of the
+// conversation, and whether the booking of a one-to-one conversation still
+// awaits confirmation.
+func (service *CovoitService) conversationMembers(conversation Conversation) (Ride, []uuid.UUID, bool, error) {
+	ride, err := service.repository.GetRideById(conversation.RideID)
+	if err != nil {
+		return Ride{}, nil, false, ErrConversationNotFound
+	}
+	bookings, err := service.messages.GetConversationBookings(ride.RideID)
+	if err != nil {
+		return Ride{}, nil, false, err
+	}
+	if conversation.BookingID != nil {
+		bookings = slices.DeleteFunc(bookings, func(booking Booking) bool { return booking.BookingID != *conversation.BookingID })
+		if len(bookings) == 0 {
+			return Ride{}, nil, false, ErrConversationNotFound
+		}
+	} else {
+		bookings = slices.DeleteFunc(bookings, func(booking Booking) bool { return booking.Status != BookingConfirmed })
+	}
+	members := []uuid.UUID{ride.DriverID}
+	pending := false
+	for _, booking := range bookings {
+		members = append(members, booking.UserID)
+		pending = pending || booking.Status == BookingPending
+	}
+	return ride, members, pending, nil
+}
+
+// hiddenUsers returns the users whose messages userID does not see in the
+// conversation. In a one-to-one conversation those are the ones it blocked,
+// the messages of a blocker stay visible so that the block does not show. In
+// the group the two sides of a block do not see each other, which the
+// blocked user cannot tell from silence.
+func (service *CovoitService) hiddenUsers(userID uuid.UUID, conversation Conversation) ([]uuid.UUID, error) {
+	if conversation.BookingID != nil {
+		blocks, err := service.blocks.GetBlocksByBlocker(userID)
+		if err != nil {
+			return nil, err
+		}
+		hidden := []uuid.UUID{}
+		for _, block := range blocks {
+			hidden = append(hidden, block.BlockedID)
+		}
+		return hidden, nil
+	}
+	blocks, err := service.blocks.GetBlocksInvolving(userID)
+	if err != nil {
+		return nil, err
+	}
+	hidden := []uuid.UUID{}
+	for _, block := range blocks {
+		if block.BlockerID == userID {
+			hidden = append(hidden, block.BlockedID)
+		} else {
+			hidden = append(hidden, block.BlockerID)
+		}
+	}
+	return hidden, nil
+}
+
+// SendMessage posts body to the conversation as senderID. A user cannot
+// write to someone it blocked, while a message to someone who blocked the
+// sender is kept but never shown to them.
+func (service *CovoitService) SendMessage(senderID uuid.UUID, conversation Conversation, body string) (Message, error) {
+	body = strings.TrimSpace(body)
+	if body == "" || len(body) > messageMaxLength {
+		return Message{}, fmt.Errorf("%w : body must be between 1 and %d characters", ErrInvalidMessage, messageMaxLength)
+	}
+	ride, members, pending, err := service.conversationMembers(conversation)
+	if err != nil {
+		return Message{}, err
+	}
+	if !slices.Contains(members, senderID) {
+		return Message{}, ErrNotInConversation
+	}
+	if conversation.BookingID != nil {
+		other := members[1]
+		if senderID == other {
+			other = ride.DriverID
+		}
+		blocks, err := service.blocks.GetBlocksInvolving(senderID)
+		if err != nil {
+			return Message{}, err
+		}
+		if _, ok := findBlock(blocks, senderID, other); ok {
+			return Message{}, ErrUserBlocked
+		}
+	}
+	if pending {
+		body = maskContactDetails(body)
+	}
+	return service.messages.CreateMessage(Message{
+		RideID:    conversation.RideID,
+		BookingID: conversation.BookingID,
+		SenderID:  senderID,
+		Body:      body,
+		SentAt:    service.clock(),
+	})
+}
+
+// GetMessages returns a page of the conversation as seen by userID, newest
+// first. before is the oldest message of the previous page.
+func (service *CovoitService) GetMessages(userID uuid.UUID, conversation Conversation, before *uuid.UUID, limit int) ([]Message, error) {
+	if limit <= 0 || limit > maxMessagePageSize {
+		limit = defaultMessagePageSize
+	}
+	_, members, _, err := service.conversationMembers(conversation)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(members, userID) {
+		return nil, ErrNotInConversation
+	}
+	hidden, err := service.hiddenUsers(userID, conversation)
+	if err != nil {
+		return nil, err
+	}
+	return service.messages.GetMessages(conversation, hidden, before, limit)
+}
+
+// MarkConversationRead records that userID read the conversation up to now.
+func (service *CovoitService) MarkConversationRead(userID uuid.UUID, conversation Conversation) error {
+	_, members, _, err := service.conversationMembers(conversation)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(members, userID) {
+		return ErrNotInConversation
+	}
+	hidden, err := service.hiddenUsers(userID, conversation)
+	if err != nil {
+		return err
+	}
+	return service.messages.MarkMessagesRead(conversation, userID, hidden, service.clock())
+}
+
+// conversationFromQuery reads the conversation from the ride_id and
+// booking_id parameters, the ride of a booking is looked up when missing.
+func (h *Handler) conversationFromQuery(r *http.Request) (Conversation, error) {
+	if idStr := r.URL.Query().Get("booking_id"); idStr != "" {
+		bookingID, err := uuid.Parse(idStr)
+		if err != nil {
+			return Conversation{}, err
+		}
+		booking, err := h.Service.GetBookingById(bookingID)
+		if err != nil {
+			return Conversation{}, ErrConversationNotFound
+		}
+		return Conversation{RideID: booking.RideID, BookingID: &bookingID}, nil
+	}
+	rideID, err := uuid.Parse(r.URL.Query().Get("ride_id"))
+	if err != nil {
+		return Conversation{}, err
+	}
+	return Conversation{RideID: rideID}, nil
+}
+
+func writeMessagingError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidMessage) {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if errors.Is(err, ErrConversationNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, ErrNotInConversation) {
+		w.WriteHeader(http.StatusForbidden)
+	} else if errors.Is(err, ErrUserBlocked) {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) MessagesHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	conversation, err := h.conversationFromQuery(r)
+	if errors.Is(err, ErrConversationNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			var before *uuid.UUID
+			if idStr := r.URL.Query().Get("before"); idStr != "" {
+				messageID, err := uuid.Parse(idStr)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				before = &messageID
+			}
+			limit := 0
+			if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+				if limit, err = strconv.Atoi(limitStr); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			messages, err := h.Service.GetMessages(actor.UserID, conversation, before, limit)
+			if err != nil {
+				writeMessagingError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(messages)
+		}
+	case http.MethodPost:
+		{
+			body := struct {
+				Body string `json:"body"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			message, err := h.Service.SendMessage(actor.UserID, conversation, body.Body)
+			if err != nil {
+				writeMessagingError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(message)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) MessagesReadHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	conversation, err := h.conversationFromQuery(r)
+	if errors.Is(err, ErrConversationNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := h.Service.MarkConversationRead(actor.UserID, conversation); err != nil {
+		writeMessagingError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) GetConversationBookings(rideID uuid.UUID) ([]Booking, error) {
+	bookings := []Booking{}
+	for _, booking := range m.DB.Bookings {
+		if booking.RideID == rideID && booking.Status != BookingCancelled {
+			bookings = append(bookings, booking)
+		}
+	}
+	return bookings, nil
+}
+
+func (m *MockRepository) CreateMessage(message Message) (Message, error) {
+	message.MessageID = uuid.New()
+	message.ReadBy = []MessageReceipt{}
+	m.DB.Messages = append(m.DB.Messages, message)
+	return message, nil
+}
+
+func inConversation(message Message, conversation Conversation) bool {
+	if message.RideID != conversation.RideID {
+		return false
+	}
+	if conversation.BookingID == nil {
+		return message.BookingID == nil
+	}
+	return message.BookingID != nil && *message.BookingID == *conversation.BookingID
+}
+
+func (m *MockRepository) GetMessages(conversation Conversation, hiddenUsers []uuid.UUID, before *uuid.UUID, limit int) ([]Message, error) {
+	messages := []Message{}
+	for i := len(m.DB.Messages) - 1; i >= 0; i-- {
+		message := m.DB.Messages[i]
+		if !inConversation(message, conversation) || slices.Contains(hiddenUsers, message.SenderID) {
+			continue
+		}
+		message.ReadBy = slices.DeleteFunc(slices.Clone(message.ReadBy), func(receipt MessageReceipt) bool {
+			return slices.Contains(hiddenUsers, receipt.UserID)
+		})
+		messages = append(messages, message)
+	}
+	if before != nil {
+		i := slices.IndexFunc(messages, func(message Message) bool { return message.MessageID == *before })
+		messages = messages[i+1:]
+	}
+	return messages[:min(limit, len(messages))], nil
+}
+
+func (m *MockRepository) MarkMessagesRead(conversation Conversation, userID uuid.UUID, hiddenUsers []uuid.UUID, at time.Time) error {
+	for i, message := range m.DB.Messages {
+		if !inConversation(message, conversation) || message.SenderID == userID || slices.Contains(hiddenUsers, message.SenderID) || message.SentAt.After(at) {
+			continue
+		}
+		if !slices.ContainsFunc(message.ReadBy, func(receipt MessageReceipt) bool { return receipt.UserID == userID }) {
+			m.DB.Messages[i].ReadBy = append(message.ReadBy, MessageReceipt{MessageID: message.MessageID, UserID: userID, ReadAt: at})
+		}
+	}
+	return nil
+}
+
+func (m *MockRepository) GetMessagesBySender(senderID uuid.UUID) ([]Message, error) {
+	messages := []Message{}
+	for _, message := range m.DB.Messages {
+		if message.SenderID == senderID {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (m *MockRepository) GetReceiptsByUser(userID uuid.UUID) ([]MessageReceipt, error) {
+	receipts := []MessageReceipt{}
+	for _, message := range m.DB.Messages {
+		for _, receipt := range message.ReadBy {
+			if receipt.UserID == userID {
+				receipts = append(receipts, receipt)
+			}
+		}
+	}
+	return receipts, nil
+}
+
+func TestMaskContactDetails(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{"see you at the station", "see you at the station"},
+		{"call me on 06 12 34 56 78", "call me on [hidden]"},
+		{"or +33 6.12.34.56.78 tonight", "or [hidden] tonight"},
+		{"mail faten.sayeh@example.com", "mail [hidden]"},
+		{"leaving at 18:30 with 2 bags", "leaving at 18:30 with 2 bags"},
+		{"meet at 12 rue de Lyon, 69001", "meet at 12 rue de Lyon, 69001"},
+	} {
+		require.Equal(t, tc.want, maskContactDetails(tc.text), tc.text)
+	}
+}
+
+func TestMessaging(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	passengerID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	pendingID, leftID, strangerID := uuid.New(), uuid.New(), uuid.New()
+
+	ride := Ride{RideID: uuid.New(), DriverID: driverID, DepartureTime: now.Add(24 * time.Hour), Status: RideScheduled}
+	seat := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, Status: BookingConfirmed}
+	pendingSeat := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: pendingID, Status: BookingPending}
+	cancelledSeat := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: leftID, Status: BookingCancelled}
+	db.Rides = append(db.Rides, ride)
+	db.Bookings = append(db.Bookings, seat, pendingSeat, cancelledSeat)
+	group := Conversation{RideID: ride.RideID}
+	direct := Conversation{RideID: ride.RideID, BookingID: &seat.BookingID}
+	pendingDirect := Conversation{RideID: ride.RideID, BookingID: &pendingSeat.BookingID}
+
+	message, err := s.SendMessage(driverID, direct, "  call me on 06 12 34 56 78 ")
+	require.NoError(t, err)
+	require.Equal(t, "call me on 06 12 34 56 78", message.Body, "the booking is confirmed")
+	message, err = s.SendMessage(pendingID, pendingDirect, "my mail is pending@example.com")
+	require.NoError(t, err)
+	require.Equal(t, "my mail is [hidden]", message.Body)
+	message, err = s.SendMessage(passengerID, group, "text me on 0612345678")
+	require.NoError(t, err)
+	require.Equal(t, "text me on 0612345678", message.Body, "the group only has confirmed passengers")
+
+	_, err = s.SendMessage(passengerID, group, "   ")
+	require.ErrorIs(t, err, ErrInvalidMessage)
+	_, err = s.SendMessage(passengerID, group, strings.Repeat("a", messageMaxLength+1))
+	require.ErrorIs(t, err, ErrInvalidMessage)
+	_, err = s.SendMessage(passengerID, pendingDirect, "hello")
+	require.ErrorIs(t, err, ErrNotInConversation, "one-to-one conversations are private")
+	_, err = s.GetMessages(leftID, group, nil, 0)
+	require.ErrorIs(t, err, ErrNotInConversation, "cancelled bookings lose access")
+	_, err = s.GetMessages(pendingID, group, nil, 0)
+	require.ErrorIs(t, err, ErrNotInConversation, "the group is shown once the booking is confirmed")
+	_, err = s.SendMessage(pendingID, group, "hello")
+	require.ErrorIs(t, err, ErrNotInConversation)
+	_, err = s.GetMessages(strangerID, group, nil, 0)
+	require.ErrorIs(t, err, ErrNotInConversation)
+	_, err = s.GetMessages(driverID, Conversation{RideID: uuid.New()}, nil, 0)
+	require.ErrorIs(t, err, ErrConversationNotFound)
+
+	for i := range 4 {
+		now = now.Add(time.Minute)
+		_, err := s.SendMessage(driverID, group, strings.Repeat("!", i+1))
+		require.NoError(t, err)
+	}
+	page, err := s.GetMessages(passengerID, group, nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"!!!!", "!!!"}, []string{page[0].Body, page[1].Body}, "newest first")
+	page, err = s.GetMessages(passengerID, group, &page[1].MessageID, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"!!", "!"}, []string{page[0].Body, page[1].Body})
+	page, err = s.GetMessages(passengerID, group, &page[1].MessageID, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Empty(t, page[0].ReadBy)
+
+	require.NoError(t, s.MarkConversationRead(driverID, group))
+	page, err = s.GetMessages(passengerID, group, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, page, 5)
+	require.Empty(t, page[0].ReadBy, "own messages are not marked read")
+	require.Len(t, page[4].ReadBy, 1)
+	require.Equal(t, driverID, page[4].ReadBy[0].UserID)
+
+	require.NoError(t, s.BlockUser(driverID, passengerID))
+	_, err = s.SendMessage(driverID, direct, "hello?")
+	require.ErrorIs(t, err, ErrUserBlocked)
+	_, err = s.SendMessage(passengerID, direct, "are we still on?")
+	require.NoError(t, err, "the blocked user does not learn of the block")
+	page, err = s.GetMessages(passengerID, direct, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	page, err = s.GetMessages(driverID, direct, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	page, err = s.GetMessages(driverID, group, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, page, 4, "the blocker no longer sees the blocked user in the group")
+	page, err = s.GetMessages(passengerID, group, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, page, 1, "nor the blocked user the blocker")
+	require.Equal(t, passengerID, page[0].SenderID)
+}
+
+func TestMessagesHandler(t *testing.T) {
+	owner := Actor{UserID: uuid.New(), Role: RolePassenger}
+	rideID, bookingID, messageID := uuid.New(), uuid.New(), uuid.New()
+	group := Conversation{RideID: rideID}
+	direct := Conversation{RideID: rideID, BookingID: &bookingID}
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("GetBookingById", bookingID).Return(Booking{BookingID: bookingID, RideID: rideID}, nil)
+	mockSvc.On("GetMessages", owner.UserID, group, (*uuid.UUID)(nil), 0).Return([]Message{}, nil)
+	mockSvc.On("GetMessages", owner.UserID, group, &messageID, 10).Return([]Message{}, nil)
+	mockSvc.On("GetMessages", owner.UserID, direct, (*uuid.UUID)(nil), 0).Return([]Message(nil), ErrNotInConversation)
+	mockSvc.On("SendMessage", owner.UserID, group, "hello").Return(Message{}, nil)
+	mockSvc.On("SendMessage", owner.UserID, direct, "hello").Return(Message{}, ErrUserBlocked)
+	mockSvc.On("SendMessage", owner.UserID, group, "").Return(Message{}, ErrInvalidMessage)
+	mockSvc.On("MarkConversationRead", owner.UserID, group).Return(nil)
+	mockSvc.On("MarkConversationRead", owner.UserID, mock.Anything).Return(ErrConversationNotFound)
+
+	body := func(text string) *bytes.Buffer {
+		body, _ := json.Marshal(map[string]string{"body": text})
+		return bytes.NewBuffer(body)
+	}
+	groupURL := "/messages?ride_id=" + rideID.String()
+	directURL := "/messages?booking_id=" + bookingID.String()
+	for _, tc := range []struct {
+		name    string
+		req     *http.Request
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"list", httptest.NewRequest(http.MethodGet, groupURL, nil), h.MessagesHandler, http.StatusOK},
+		{"next page", httptest.NewRequest(http.MethodGet, groupURL+"&limit=10&before="+messageID.String(), nil), h.MessagesHandler, http.StatusOK},
+		{"bad cursor", httptest.NewRequest(http.MethodGet, groupURL+"&before=last", nil), h.MessagesHandler, http.StatusBadRequest},
+		{"not a member", httptest.NewRequest(http.MethodGet, directURL, nil), h.MessagesHandler, http.StatusForbidden},
+		{"no conversation", httptest.NewRequest(http.MethodGet, "/messages", nil), h.MessagesHandler, http.StatusBadRequest},
+		{"send", httptest.NewRequest(http.MethodPost, groupURL, body("hello")), h.MessagesHandler, http.StatusCreated},
+		{"send to a blocked user", httptest.NewRequest(http.MethodPost, directURL, body("hello")), h.MessagesHandler, http.StatusConflict},
+		{"send nothing", httptest.NewRequest(http.MethodPost, groupURL, body("")), h.MessagesHandler, http.StatusBadRequest},
+		{"read", httptest.NewRequest(http.MethodPost, "/messages/read?ride_id="+rideID.String(), nil), h.MessagesReadHandler, http.StatusNoContent},
+		{"read unknown ride", httptest.NewRequest(http.MethodPost, "/messages/read?ride_id="+uuid.NewString(), nil), h.MessagesReadHandler, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		tc.handler(w, asActor(tc.req, owner))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+	w := httptest.NewRecorder()
+	h.MessagesHandler(w, httptest.NewRequest(http.MethodGet, groupURL, nil))
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
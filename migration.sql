@@ -9,7 +9,32 @@ CREATE TABLE IF NOT EXISTS users (
     last_name TEXT NOT NULL,
     email TEXT UNIQUE NOT NULL,
     phone TEXT,
-    address TEXT
+    address TEXT,
+    bio TEXT,
+    preferences JSONB,
+    role TEXT NOT NULL DEFAULT 'passenger',
+    email_verified_at TIMESTAMP,
+    phone_verified_at TIMESTAMP,
+    password_hash TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    erased_at TIMESTAMP,
+    deleted_at TIMESTAMP,
+    deleted_by UUID
+);
+
+-- Vehicles registered by users, seats include the driver's
+CREATE TABLE IF NOT EXISTS vehicles (
+    vehicle_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    owner_id UUID NOT NULL REFERENCES users(user_id),
+    make TEXT NOT NULL,
+    model TEXT NOT NULL,
+    color TEXT,
+    plate TEXT NOT NULL,
+    seats INT NOT NULL CHECK (seats BETWEEN 2 AND 9),
+    comfort JSONB,
+    fuel VARCHAR(20) NOT NULL DEFAULT '' CHECK (fuel IN ('', 'petrol', 'diesel', 'lpg', 'electric')),
+    consumption FLOAT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL
 );
 
 -- Rides table
@@ -18,11 +43,36 @@ CREATE TABLE IF NOT EXISTS rides (
     origin TEXT NOT NULL,
     destination TEXT NOT NULL,
     driver_id UUID NOT NULL REFERENCES users(user_id),
+    vehicle_id UUID REFERENCES vehicles(vehicle_id),
     departure_time TIMESTAMP NOT NULL,
     arrival_time TIMESTAMP NOT NULL,
     distance FLOAT,
-    price FLOAT,
-    number_of_seats INT
+    price_minor BIGINT,
+    price_currency CHAR(3),
+    number_of_seats INT,
+    status TEXT NOT NULL DEFAULT 'scheduled',
+    deleted_at TIMESTAMP,
+    deleted_by UUID,
+    purged_at TIMESTAMP
+);
+
+-- Promotion codes, their discount is funded by the platform
+CREATE TABLE IF NOT EXISTS promotions (
+    promotion_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    code TEXT NOT NULL UNIQUE,
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('percent', 'amount')),
+    percent BIGINT NOT NULL DEFAULT 0,
+    amount_minor BIGINT NOT NULL DEFAULT 0,
+    amount_currency CHAR(3) NOT NULL DEFAULT '',
+    minimum_amount_minor BIGINT NOT NULL DEFAULT 0,
+    minimum_amount_currency CHAR(3) NOT NULL DEFAULT '',
+    first_ride_only BOOLEAN NOT NULL DEFAULT FALSE,
+    max_redemptions BIGINT NOT NULL DEFAULT 0,
+    max_per_user BIGINT NOT NULL DEFAULT 0,
+    redemptions BIGINT NOT NULL DEFAULT 0 CHECK (max_redemptions = 0 OR redemptions <= max_redemptions),
+    starts_at TIMESTAMP,
+    ends_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL
 );
 
 -- Bookings table
@@ -31,6 +81,375 @@ CREATE TABLE IF NOT EXISTS bookings (
     ride_id UUID NOT NULL REFERENCES rides(ride_id),
     user_id UUID NOT NULL REFERENCES users(user_id),
     number_of_seats INT,
-    total_price FLOAT,
-    booking_time TIMESTAMP NOT NULL
+    total_price_minor BIGINT,
+    total_price_currency CHAR(3),
+    booking_time TIMESTAMP NOT NULL,
+    status TEXT NOT NULL DEFAULT 'confirmed',
+    deleted_at TIMESTAMP,
+    deleted_by UUID,
+    purged_at TIMESTAMP,
+    free_cancellation_for UUID REFERENCES users(user_id),
+    promotion_id UUID REFERENCES promotions(promotion_id),
+    discount_minor BIGINT NOT NULL DEFAULT 0,
+    discount_currency CHAR(3) NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_bookings_promotion_id ON bookings(promotion_id);
+
+-- Email verification tokens, only the SHA-256 of the token is stored
+CREATE TABLE IF NOT EXISTS email_verifications (
+    verification_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- Phone verification one-time codes, only the SHA-256 of the code is stored
+CREATE TABLE IF NOT EXISTS phone_verifications (
+    verification_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    phone TEXT NOT NULL,
+    code_hash TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- Login sessions, only the SHA-256 of the bearer token is stored
+CREATE TABLE IF NOT EXISTS sessions (
+    session_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+
+-- Password reset tokens, only the SHA-256 of the token is stored
+CREATE TABLE IF NOT EXISTS password_resets (
+    reset_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- Security audit trail
+CREATE TABLE IF NOT EXISTS audit_events (
+    event_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(user_id),
+    action TEXT NOT NULL,
+    subject TEXT,
+    ip TEXT,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- Reviews between drivers and passengers, one per booking and author
+CREATE TABLE IF NOT EXISTS reviews (
+    review_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    booking_id UUID NOT NULL REFERENCES bookings(booking_id),
+    author_id UUID NOT NULL REFERENCES users(user_id),
+    subject_id UUID NOT NULL REFERENCES users(user_id),
+    ride_id UUID NOT NULL REFERENCES rides(ride_id),
+    stars INT NOT NULL CHECK (stars BETWEEN 1 AND 5),
+    comment TEXT,
+    tags JSONB,
+    created_at TIMESTAMP NOT NULL,
+    window_closes_at TIMESTAMP NOT NULL,
+    revealed_at TIMESTAMP,
+    UNIQUE (booking_id, author_id)
+);
+
+-- Reputation counters, bumped as rides, bookings and reviews happen
+CREATE TABLE IF NOT EXISTS reputations (
+    user_id UUID PRIMARY KEY REFERENCES users(user_id),
+    rating_sum INT NOT NULL DEFAULT 0,
+    rating_count INT NOT NULL DEFAULT 0,
+    rides_driven INT NOT NULL DEFAULT 0,
+    rides_taken INT NOT NULL DEFAULT 0,
+    commitments INT NOT NULL DEFAULT 0,
+    cancellations INT NOT NULL DEFAULT 0,
+    no_shows INT NOT NULL DEFAULT 0
+);
+
+-- Personal data exports, only the SHA-256 of the download token is stored
+CREATE TABLE IF NOT EXISTS data_exports (
+    export_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    status TEXT NOT NULL,
+    token_hash TEXT,
+    archive BYTEA,
+    created_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+-- Account erasures, the user row is anonymized rather than deleted
+CREATE TABLE IF NOT EXISTS erasures (
+    erasure_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID UNIQUE NOT NULL REFERENCES users(user_id),
+    rides_cancelled JSONB,
+    bookings_cancelled JSONB,
+    erased_at TIMESTAMP NOT NULL
+);
+
+-- Blocks between users, only the blocker ever sees them
+CREATE TABLE IF NOT EXISTS blocks (
+    blocker_id UUID NOT NULL REFERENCES users(user_id),
+    blocked_id UUID NOT NULL REFERENCES users(user_id),
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id)
+);
+CREATE INDEX IF NOT EXISTS idx_blocks_blocked_id ON blocks(blocked_id);
+
+-- Messages of the group conversation of a ride, or of the one-to-one
+-- conversation of a booking when booking_id is set
+CREATE TABLE IF NOT EXISTS messages (
+    message_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    ride_id UUID NOT NULL REFERENCES rides(ride_id) ON DELETE CASCADE,
+    booking_id UUID REFERENCES bookings(booking_id) ON DELETE CASCADE,
+    sender_id UUID NOT NULL REFERENCES users(user_id),
+    body TEXT NOT NULL,
+    sent_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_message_conversation ON messages(ride_id, booking_id, sent_at);
+CREATE INDEX IF NOT EXISTS idx_messages_sender_id ON messages(sender_id);
+
+CREATE TABLE IF NOT EXISTS message_receipts (
+    message_id UUID NOT NULL REFERENCES messages(message_id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    read_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (message_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS idx_message_receipts_user_id ON message_receipts(user_id);
+
+-- Notification outbox, written with the change that triggers it and
+-- delivered by the dispatcher
+CREATE TABLE IF NOT EXISTS notifications (
+    notification_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    data JSONB,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    delivered_channels JSONB,
+    skipped_channels JSONB,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP,
+    read_at TIMESTAMP,
+    dedup_key TEXT UNIQUE
+);
+CREATE INDEX IF NOT EXISTS idx_notifications_due ON notifications(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id);
+
+-- Webhooks of partners and the log of what was posted to them
+CREATE TABLE IF NOT EXISTS webhooks (
+    webhook_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    url TEXT NOT NULL,
+    events JSONB NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    delivery_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    webhook_id UUID NOT NULL REFERENCES webhooks(webhook_id) ON DELETE CASCADE,
+    event VARCHAR(50) NOT NULL,
+    data JSONB,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_status_code INT,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id);
+
+CREATE TABLE IF NOT EXISTS jobs (
+    job_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(50) NOT NULL,
+    key TEXT NOT NULL UNIQUE,
+    payload JSONB,
+    run_at TIMESTAMP NOT NULL,
+    every BIGINT NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_job_due ON jobs(status, run_at);
+
+CREATE TABLE IF NOT EXISTS payments (
+    payment_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    booking_id UUID NOT NULL UNIQUE,
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    payee_id UUID NOT NULL REFERENCES users(user_id),
+    amount_minor BIGINT NOT NULL,
+    amount_currency CHAR(3) NOT NULL,
+    discount_minor BIGINT NOT NULL DEFAULT 0,
+    discount_currency CHAR(3) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    reference TEXT,
+    captured_amount_minor BIGINT NOT NULL DEFAULT 0,
+    captured_amount_currency CHAR(3) NOT NULL DEFAULT '',
+    refunded_amount_minor BIGINT NOT NULL DEFAULT 0,
+    refunded_amount_currency CHAR(3) NOT NULL DEFAULT '',
+    settlement VARCHAR(20) NOT NULL DEFAULT '',
+    settlement_amount_minor BIGINT NOT NULL DEFAULT 0,
+    settlement_amount_currency CHAR(3) NOT NULL DEFAULT '',
+    action VARCHAR(20) NOT NULL DEFAULT '',
+    action_amount_minor BIGINT NOT NULL DEFAULT 0,
+    action_amount_currency CHAR(3) NOT NULL DEFAULT '',
+    action_key TEXT NOT NULL DEFAULT '',
+    attempted_at TIMESTAMP,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_payments_user_id ON payments(user_id);
+CREATE INDEX IF NOT EXISTS idx_payments_reference ON payments(reference);
+
+CREATE TABLE IF NOT EXISTS journals (
+    journal_id UUID PRIMARY KEY,
+    key TEXT NOT NULL UNIQUE,
+    type VARCHAR(20) NOT NULL,
+    reference UUID NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_journals_reference ON journals(reference);
+
+CREATE TABLE IF NOT EXISTS postings (
+    posting_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    journal_id UUID NOT NULL REFERENCES journals(journal_id),
+    account VARCHAR(20) NOT NULL,
+    user_id UUID REFERENCES users(user_id),
+    kind VARCHAR(20) NOT NULL,
+    amount_minor BIGINT NOT NULL,
+    amount_currency CHAR(3) NOT NULL,
+    created_at TIMESTAMP NOT NULL
 );
+CREATE INDEX IF NOT EXISTS idx_postings_journal_id ON postings(journal_id);
+CREATE INDEX IF NOT EXISTS idx_posting_account ON postings(account, user_id);
+
+-- Invoices are numbered without gaps in one series per kind and year, and
+-- are never changed or deleted once issued.
+CREATE TABLE IF NOT EXISTS invoice_sequences (
+    series TEXT PRIMARY KEY,
+    last BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS invoices (
+    invoice_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    number TEXT NOT NULL UNIQUE,
+    kind VARCHAR(20) NOT NULL,
+    key TEXT NOT NULL UNIQUE,
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    locale VARCHAR(10) NOT NULL DEFAULT '',
+    recipient_name TEXT NOT NULL DEFAULT '',
+    recipient_email TEXT NOT NULL DEFAULT '',
+    reference UUID,
+    credited_invoice_id UUID REFERENCES invoices(invoice_id),
+    credited_number TEXT NOT NULL DEFAULT '',
+    trip JSONB,
+    period_start TIMESTAMP,
+    period_end TIMESTAMP,
+    lines JSONB NOT NULL,
+    total_minor BIGINT NOT NULL,
+    total_currency CHAR(3) NOT NULL,
+    vat_minor BIGINT NOT NULL,
+    vat_currency CHAR(3) NOT NULL,
+    issued_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_invoices_user_id ON invoices(user_id);
+CREATE INDEX IF NOT EXISTS idx_invoices_reference ON invoices(reference);
+
+CREATE OR REPLACE FUNCTION forbid_invoice_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'an issued invoice cannot be changed';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS invoices_immutable ON invoices;
+CREATE TRIGGER invoices_immutable BEFORE UPDATE OR DELETE ON invoices
+    FOR EACH ROW EXECUTE FUNCTION forbid_invoice_change();
+
+-- The bank accounts drivers are paid out to, and the payouts batched into
+-- SEPA credit transfers.
+CREATE TABLE IF NOT EXISTS payout_accounts (
+    user_id UUID PRIMARY KEY REFERENCES users(user_id),
+    holder_name TEXT NOT NULL,
+    iban VARCHAR(34) NOT NULL,
+    bic VARCHAR(11) NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS payout_batches (
+    batch_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    count BIGINT NOT NULL,
+    total_minor BIGINT NOT NULL,
+    total_currency CHAR(3) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    exported_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS payouts (
+    payout_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    batch_id UUID NOT NULL REFERENCES payout_batches(batch_id),
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    amount_minor BIGINT NOT NULL CHECK (amount_minor > 0),
+    amount_currency CHAR(3) NOT NULL,
+    holder_name TEXT NOT NULL,
+    iban VARCHAR(34) NOT NULL,
+    bic VARCHAR(11) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'paid', 'failed')),
+    failure_reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_payouts_batch_id ON payouts(batch_id);
+CREATE INDEX IF NOT EXISTS idx_payouts_user_id ON payouts(user_id);
+
+-- Amounts used to be FLOAT columns in euros. On a database created before,
+-- they move to the minor unit columns, rounded half away from zero to the
+-- cent, and the FLOAT columns are dropped.
+DO $$
+DECLARE
+    money RECORD;
+BEGIN
+    FOR money IN SELECT * FROM (VALUES
+        ('rides', 'price'), ('bookings', 'total_price'),
+        ('payments', 'amount'), ('payments', 'captured_amount'), ('payments', 'refunded_amount'),
+        ('payments', 'settlement_amount'), ('payments', 'action_amount'),
+        ('postings', 'amount')
+    ) AS columns(table_name, column_name) LOOP
+        IF EXISTS (SELECT 1 FROM information_schema.columns
+                   WHERE table_name = money.table_name AND column_name = money.column_name) THEN
+            EXECUTE format('ALTER TABLE %I ADD COLUMN IF NOT EXISTS %I BIGINT, ADD COLUMN IF NOT EXISTS %I CHAR(3)',
+                money.table_name, money.column_name || '_minor', money.column_name || '_currency');
+            EXECUTE format('UPDATE %I SET %I = COALESCE(ROUND(%I::numeric * 100), 0), %I = ''EUR''',
+                money.table_name, money.column_name || '_minor', money.column_name, money.column_name || '_currency');
+            EXECUTE format('ALTER TABLE %I DROP COLUMN %I', money.table_name, money.column_name);
+        END IF;
+    END LOOP;
+    ALTER TABLE payments DROP COLUMN IF EXISTS currency;
+END $$;
+
+-- Soft deleted rows are hidden from normal queries until purged
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users(deleted_at);
+CREATE INDEX IF NOT EXISTS idx_rides_deleted_at ON rides(deleted_at);
+CREATE INDEX IF NOT EXISTS idx_bookings_deleted_at ON bookings(deleted_at);
+
+-- Deleted rows past the retention period that accounting records or reviews
+-- still refer to are archived rather than purged
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS purged_at TIMESTAMP;
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS purged_at TIMESTAMP;
+
+-- Channels a notification could not reach its recipient through
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS skipped_channels JSONB;
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrInvalidMoney = errors.New("invalid money")
+
+// currencyExponents are the ISO 4217 currencies accepted, with the number of
+// digits of their minor unit.
+var currencyExponents = map[string]int{
+	"EUR": 2,
+	"CHF": 2,
+	"GBP": 2,
+	"USD": 2,
+	"SEK": 2,
+	"DKK": 2,
+	"NOK": 2,
+	"PLN": 2,
+	"CZK": 2,
+	"HUF": 2,
+	"RON": 2,
+	"JPY": 0,
+	"KWD": 3,
+}
+
+// Money is an exact amount, counted in the minor unit of its currency : 21.30
+// EUR is 2130. Entities store it as two columns, <prefix>minor and
+// <prefix>currency, and JSON carries it as {"amount": "21.30", "currency":
+// "EUR"} so that no float ever holds it.
+//
+// Adding or subtracting amounts of different currencies is a programming
+// error and panics, amounts are checked at the edges. The zero Money adopts
+// the currency of the amount it is combined with.
+type Money struct {
+	Minor    int64
+	Currency string `gorm:"type:varchar(3)"`
+}
+
+func NewMoney(minor int64, currency string) Money {
+	return Money{Minor: minor, Currency: currency}
+}
+
+func exponent(currency string) int {
+	if e, ok := currencyExponents[currency]; ok {
+		return e
+	}
+	return 2
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for range n {
+		p *= 10
+	}
+	return p
+}
+
+// ParseMoney reads a decimal amount such as "21.30" in currency. An amount
+// more precise than the minor unit of the currency is refused, not rounded.
+func ParseMoney(amount string, currency string) (Money, error) {
+	e, ok := currencyExponents[currency]
+	if !ok {
+		return Money{}, fmt.Errorf("%w : unknown currency %q", ErrInvalidMoney, currency)
+	}
+	minor, err := parseDecimal(amount, e)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w : %q is not an amount in %s", ErrInvalidMoney, amount, currency)
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+// parseDecimal reads a decimal such as "21.30" as an integer count of
+// 10^-digits, 2130 for 2 digits. More digits than that are refused.
+func parseDecimal(decimal string, digits int) (int64, error) {
+	unsigned, negative := strings.CutPrefix(decimal, "-")
+	whole, fraction, _ := strings.Cut(unsigned, ".")
+	if whole == "" || len(fraction) > digits || strings.Trim(whole+fraction, "0123456789") != "" {
+		return 0, fmt.Errorf("%q is not a decimal with at most %d digits", decimal, digits)
+	}
+	fraction += strings.Repeat("0", digits-len(fraction))
+	n, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is out of range", decimal)
+	}
+	if negative {
+		n = -n
+	}
+	return n, nil
+}
+
+// Decimal writes the amount in the major unit, "21.30" for 2130 EUR.
+func (m Money) Decimal() string {
+	e := exponent(m.Currency)
+	minor, sign := m.Minor, ""
+	if minor < 0 {
+		minor, sign = -minor, "-"
+	}
+	if e == 0 {
+		return sign + strconv.FormatInt(minor, 10)
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/pow10(e), e, minor%pow10(e))
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+// currencyWith returns the currency of an operation between m and other.
+func (m Money) currencyWith(other Money) string {
+	switch {
+	case m.Currency == other.Currency:
+		return m.Currency
+	case m.Currency == "" && m.Minor == 0:
+		return other.Currency
+	case other.Currency == "" && other.Minor == 0:
+		return m.Currency
+	}
+	panic(fmt.Sprintf("money : cannot combine %s with %s", m, other))
+}
+
+func (m Money) Add(other Money) Money {
+	return Money{Minor: m.Minor + other.Minor, Currency: m.currencyWith(other)}
+}
+
+func (m Money) Sub(other Money) Money {
+	return Money{Minor: m.Minor - other.Minor, Currency: m.currencyWith(other)}
+}
+
+func (m Money) Neg() Money {
+	return Money{Minor: -m.Minor, Currency: m.Currency}
+}
+
+func (m Money) Times(n int64) Money {
+	return Money{Minor: m.Minor * n, Currency: m.Currency}
+}
+
+// Share returns numerator / denominator of m, rounded half away from zero to
+// the minor unit. Splitting an amount takes the share of one side and gives
+// the rest to the other, so that nothing is lost to rounding.
+func (m Money) Share(numerator int64, denominator int64) Money {
+	product := m.Minor * numerator
+	quotient, remainder := product/denominator, product%denominator
+	if remainder < 0 {
+		remainder = -remainder
+	}
+	if 2*remainder >= denominator {
+		if product < 0 {
+			quotient--
+		} else {
+			quotient++
+		}
+	}
+	return Money{Minor: quotient, Currency: m.Currency}
+}
+
+// Percent returns percent % of m, rounded like Share.
+func (m Money) Percent(percent int64) Money {
+	return m.Share(percent, 100)
+}
+
+type moneyJSON struct {
+	Amount   json.RawMessage `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.Decimal(), m.Currency})
+}
+
+// UnmarshalJSON reads {"amount": "21.30", "currency": "EUR"}. The amount may
+// also be a JSON number, read from its text and not as a float, and a bare
+// amount is in PaymentCurrency, as prices were before they had one. A zero
+// amount without currency is the zero Money, as MarshalJSON writes it.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	value := moneyJSON{Currency: PaymentCurrency}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+	} else {
+		value.Amount = data
+	}
+	amount := string(bytes.TrimSpace(value.Amount))
+	if unquoted, err := strconv.Unquote(amount); err == nil {
+		amount = unquoted
+	}
+	if value.Currency == "" {
+		if zero, err := ParseMoney(amount, PaymentCurrency); err == nil && zero.IsZero() {
+			*m = Money{}
+			return nil
+		}
+	}
+	parsed, err := ParseMoney(amount, value.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// moneyColumns are the FLOAT columns, in euros, that Money replaced with
+// their <column>_minor and <column>_currency.
+var moneyColumns = []struct {
+	model  any
+	column string
+}{
+	{&Ride{}, "price"},
+	{&Booking{}, "total_price"},
+	{&Payment{}, "amount"},
+	{&Payment{}, "captured_amount"},
+	{&Payment{}, "refunded_amount"},
+	{&Payment{}, "settlement_amount"},
+	{&Payment{}, "action_amount"},
+	{&Posting{}, "amount"},
+}
+
+// migrateMoney moves the amounts of the FLOAT columns into the columns of
+// Money, rounded half away from zero to the cent, then drops them. It runs
+// after the auto migration created the new columns and does nothing once the
+// old ones are gone.
+func migrateMoney(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		for _, money := range moneyColumns {
+			if !migrator.HasColumn(money.model, money.column) {
+				continue
+			}
+			err := tx.Unscoped().Model(money.model).
+				Where("1 = 1").
+				Updates(map[string]any{
+					money.column + "_minor":    gorm.Expr(fmt.Sprintf("COALESCE(ROUND(%s::numeric * 100), 0)", money.column)),
+					money.column + "_currency": PaymentCurrency,
+				}).Error
+			if err != nil {
+				return fmt.Errorf("could not migrate %s to money, err : %s", money.column, err)
+			}
+			if err := migrator.DropColumn(money.model, money.column); err != nil {
+				return fmt.Errorf("could not drop %s, err : %s", money.column, err)
+			}
+		}
+		if migrator.HasColumn(&Payment{}, "currency") {
+			if err := migrator.DropColumn(&Payment{}, "currency"); err != nil {
+				return fmt.Errorf("could not drop currency of payments, err : %s", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func eur(cents int64) Money {
+	return NewMoney(cents, "EUR")
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	price, seats := 7.10, 3.0
+	require.NotEqual(t, 21.30, seats*price, "what float prices came to")
+	require.Equal(t, eur(2130), eur(710).Times(3))
+	require.Equal(t, "21.30 EUR", eur(710).Times(3).String())
+	require.Equal(t, eur(-5), eur(10).Sub(eur(15)))
+	require.Equal(t, eur(10), Money{}.Add(eur(10)), "the zero Money takes the currency of the other")
+	require.Panics(t, func() { eur(10).Add(NewMoney(10, "CHF")) })
+}
+
+func TestParseMoney(t *testing.T) {
+	for _, tc := range []struct {
+		amount   string
+		currency string
+		want     Money
+		valid    bool
+	}{
+		{"21.30", "EUR", eur(2130), true},
+		{"21.3", "EUR", eur(2130), true},
+		{"21", "EUR", eur(2100), true},
+		{"-0.05", "EUR", eur(-5), true},
+		{"1500", "JPY", NewMoney(1500, "JPY"), true},
+		{"1.234", "KWD", NewMoney(1234, "KWD"), true},
+		{"7.105", "EUR", Money{}, false},
+		{"15.5", "JPY", Money{}, false},
+		{"1e3", "EUR", Money{}, false},
+		{".50", "EUR", Money{}, false},
+		{"", "EUR", Money{}, false},
+		{"10", "XXX", Money{}, false},
+		{"99999999999999999999", "EUR", Money{}, false},
+	} {
+		got, err := ParseMoney(tc.amount, tc.currency)
+		if !tc.valid {
+			require.ErrorIs(t, err, ErrInvalidMoney, tc.amount)
+			continue
+		}
+		require.NoError(t, err, tc.amount)
+		require.Equal(t, tc.want, got, tc.amount)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	body, err := json.Marshal(Ride{Price: eur(710)})
+	require.NoError(t, err)
+	require.Contains(t, string(body), `"price":{"amount":"7.10","currency":"EUR"}`)
+	body, err = json.Marshal(NewMoney(1500, "JPY"))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"amount":"1500","currency":"JPY"}`, string(body))
+
+	for _, tc := range []struct {
+		body  string
+		want  Money
+		valid bool
+	}{
+		{`{"amount":"7.10","currency":"EUR"}`, eur(710), true},
+		{`{"amount":7.10,"currency":"EUR"}`, eur(710), true},
+		{`{"amount":"7.10"}`, eur(710), true},
+		{`"7.10"`, eur(710), true},
+		{`7.1`, eur(710), true},
+		{`{"amount":"7.10","currency":"CHF"}`, NewMoney(710, "CHF"), true},
+		{`{"amount":"7.101","currency":"EUR"}`, Money{}, false},
+		{`{"amount":"7.10","currency":"eur"}`, Money{}, false},
+		{`{"amount":"0.00","currency":""}`, Money{}, true},
+		{`{"amount":"7.10","currency":""}`, Money{}, false},
+		{`true`, Money{}, false},
+	} {
+		var got Money
+		err := json.Unmarshal([]byte(tc.body), &got)
+		if !tc.valid {
+			require.Error(t, err, tc.body)
+			continue
+		}
+		require.NoError(t, err, tc.body)
+		require.Equal(t, tc.want, got, tc.body)
+	}
+}
+
+// TestFeeSplitRounding documents how amounts are split. A share is rounded
+// half away from zero to the cent, and the other side of the split gets the
+// rest, so that the parts always add up to the whole.
+func TestFeeSplitRounding(t *testing.T) {
+	t.Run("platform fee", func(t *testing.T) {
+		for _, tc := range []struct {
+			captured Money
+			fee      Money
+			earning  Money
+		}{
+			{eur(5000), eur(500), eur(4500)},
+			{eur(3333), eur(333), eur(3000)},
+			// 0.5 cent of fee is rounded up, the driver gets the rest.
+			{eur(5), eur(1), eur(4)},
+			{eur(4), eur(0), eur(4)},
+			{eur(15), eur(2), eur(13)},
+			{eur(1995), eur(200), eur(1795)},
+		} {
+			payment := Payment{CapturedAmount: tc.captured}
+			fee := paymentFee(payment)
+			require.Equal(t, tc.fee, fee, tc.captured.String())
+			journals := paymentJournals(Payment{}, payment, time.Time{})
+			require.Len(t, journals, 1)
+			require.Equal(t, tc.earning.Neg(), journals[0].Postings[2].Amount, tc.captured.String())
+			require.NoError(t, checkJournal(journals[0]))
+		}
+	})
+
+	t.Run("late cancellation", func(t *testing.T) {
+		for _, tc := range []struct {
+			price Money
+			fee   Money
+		}{
+			{eur(5000), eur(2500)},
+			{eur(15), eur(8)},
+			{eur(1), eur(1)},
+		} {
+			require.Equal(t, tc.fee, tc.price.Percent(LateCancellationFeePercent), tc.price.String())
+		}
+	})
+
+	t.Run("refunded fee", func(t *testing.T) {
+		// The fee given back is rounded on the running total of the refunds,
+		// the parts given back add up to the fee once all is refunded.
+		payment := Payment{Amount: eur(1000), CapturedAmount: eur(1000)}
+		feeBack := Money{}
+		for _, tc := range []struct {
+			refund  Money
+			feeBack Money
+		}{
+			{eur(333), eur(33)},
+			{eur(333), eur(34)},
+			{eur(334), eur(33)},
+		} {
+			before := payment
+			payment.RefundedAmount = payment.RefundedAmount.Add(tc.refund)
+			journals := paymentJournals(before, payment, time.Time{})
+			require.Len(t, journals, 1)
+			require.Equal(t, tc.feeBack, journals[0].Postings[1].Amount, tc.refund.String())
+			require.NoError(t, checkJournal(journals[0]))
+			feeBack = feeBack.Add(journals[0].Postings[1].Amount)
+		}
+		require.Equal(t, paymentFee(payment), feeBack)
+	})
+
+	t.Run("negative amounts", func(t *testing.T) {
+		require.Equal(t, eur(-1), eur(-5).Percent(PlatformFeePercent), "half away from zero")
+		require.Equal(t, eur(-8), eur(-15).Percent(LateCancellationFeePercent))
+	})
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	NotificationBookingCreated   = "booking.created"
+	NotificationBookingApproved  = "booking.approved"
+	NotificationBookingCancelled = "booking.cancelled"
+	NotificationRideCancelled    = "ride.cancelled"
+	NotificationRideReminder     = "ride.reminder"
+)
+
+var NotificationTypes = []string{NotificationBookingCreated, NotificationBookingApproved, NotificationBookingCancelled, NotificationRideCancelled, NotificationRideReminder}
+
+const (
+	NotificationPending   = "pending"
+	NotificationDelivered = "delivered"
+	// NotificationDead is a notification given up on after too many failed
+	// attempts, it waits for an admin to requeue it.
+	NotificationDead = "dead"
+)
+
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+	ChannelPush  = "push"
+	ChannelInApp = "in_app"
+)
+
+var NotificationChannels = []string{ChannelEmail, ChannelSMS, ChannelPush, ChannelInApp}
+
+// defaultNotificationChannels are used for users who did not choose.
+var defaultNotificationChannels = []string{ChannelEmail, ChannelInApp}
+
+const (
+	notificationBatchSize   = 50
+	notificationMaxAttempts = 8
+	// notificationBackoff is the wait after the first failed attempt, it
+	// doubles with every attempt.
+	notificationBackoff = time.Minute
+	// notificationLease is how long a claimed notification is kept from the
+	// other dispatchers.
+	notificationLease = 5 * time.Minute
+	// NotificationDispatchInterval is how often the outbox is polled.
+	NotificationDispatchInterval = 10 * time.Second
+)
+
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// ErrChannelSkipped is returned by a channel that cannot reach the recipient,
+// the notification is recorded as skipped on it rather than delivered.
+var ErrChannelSkipped = errors.New("channel skipped")
+
+// Notification is an entry of the outbox. It is written in the transaction of
+// the operation it tells about and delivered afterwards by the dispatcher,
+// through every channel the recipient chose.
+type Notification struct {
+	NotificationID    uuid.UUID        `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"notification_id"`
+	UserID            uuid.UUID        `gorm:"type:uuid;index" json:"user_id"`
+	Type              string           `json:"type"`
+	Data              NotificationData `gorm:"type:jsonb;serializer:json" json:"data"`
+	Status            string           `gorm:"default:pending;index:idx_notification_due,priority:1" json:"status"`
+	Attempts          int              `json:"attempts"`
+	NextAttemptAt     time.Time        `gorm:"default:CURRENT_TIMESTAMP;index:idx_notification_due,priority:2" json:"-"`
+	DeliveredChannels []string         `gorm:"type:jsonb;serializer:json" json:"-"`
+	// SkippedChannels are the channels of the last attempt that could not
+	// reach the recipient, such as SMS without a verified phone number.
+	SkippedChannels []string   `gorm:"type:jsonb;serializer:json" json:"-"`
+	LastError       string     `json:"last_error,omitempty"`
+	CreatedAt       time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	DeliveredAt     *time.Time `json:"delivered_at,omitempty"`
+	ReadAt          *time.Time `json:"read_at,omitempty"`
+	// DedupKey, when set, keeps the same notification from being enqueued
+	// twice.
+	DedupKey *string `gorm:"uniqueIndex" json:"-"`
+}
+
+// NotificationData is what a notification needs to be rendered, copied when
+// it is written so that it survives the ride being deleted.
+type NotificationData struct {
+	RideID        uuid.UUID  `json:"ride_id"`
+	BookingID     *uuid.UUID `json:"booking_id,omitempty"`
+	Origin        string     `json:"origin"`
+	Destination   string     `json:"destination"`
+	DepartureTime time.Time  `json:"departure_time"`
+	// HoursBefore is how long before the departure a reminder is sent.
+	HoursBefore int `json:"hours_before,omitempty"`
+}
+
+func rideNotification(notificationType string, userID uuid.UUID, ride Ride, booking *Booking) Notification {
+	data := NotificationData{RideID: ride.RideID, Origin: ride.Origin, Destination: ride.Destination, DepartureTime: ride.DepartureTime}
+	if booking != nil {
+		data.BookingID = &booking.BookingID
+	}
+	return Notification{UserID: userID, Type: notificationType, Data: data}
+}
+
+// enqueueNotifications writes notifications to the outbox within tx, they are
+// delivered only if tx commits. The ones already enqueued under their
+// DedupKey are skipped.
+func enqueueNotifications(tx *gorm.DB, notifications ...Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+	for i := range notifications {
+		notifications[i].Status = NotificationPending
+	}
+	if err := gorm.G[Notification](tx, clause.OnConflict{DoNothing: true}).CreateInBatches(context.Background(), &notifications, len(notifications)); err != nil {
+		return fmt.Errorf("could not enqueue notifications, err : %s", err)
+	}
+	return nil
+}
+
+type NotificationRepository interface {
+	// EnqueueNotifications writes notifications to the outbox, for the ones
+	// not triggered by a change of the database.
+	EnqueueNotifications(notifications ...Notification) error
+	// ClaimNotifications returns up to limit pending notifications due at at,
+	// and keeps them from the other dispatchers for lease.
+	ClaimNotifications(at time.Time, limit int, lease time.Duration) ([]Notification, error)
+	// SaveNotificationAttempt records the outcome of a delivery attempt.
+	SaveNotificationAttempt(notification Notification) error
+	// GetInbox returns the notifications delivered in-app to the user, newest
+	// first.
+	GetInbox(userID uuid.UUID) ([]Notification, error)
+	MarkNotificationRead(userID uuid.UUID, notificationID uuid.UUID, at time.Time) error
+	GetDeadNotifications() ([]Notification, error)
+	// RequeueNotification gives a dead notification a fresh set of attempts.
+	RequeueNotification(notificationID uuid.UUID, at time.Time) error
+	GetNotificationsByUser(userID uuid.UUID) ([]Notification, error)
+}
+
+func (repository *CovoitRepository) EnqueueNotifications(notifications ...Notification) error {
+	return enqueueNotifications(repository.db, notifications...)
+}
+
+func (repository *CovoitRepository) ClaimNotifications(at time.Time, limit int, lease time.Duration) ([]Notification, error) {
+	notifications := []Notification{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		notifications, err = gorm.G[Notification](tx, clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", NotificationPending, at).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not claim notifications, err : %s", err)
+		}
+		if len(notifications) == 0 {
+			return nil
+		}
+		ids := make([]uuid.UUID, len(notifications))
+		for i, notification := range notifications {
+			ids[i] = notification.NotificationID
+		}
+		_, err = gorm.G[Notification](tx).Where("notification_id IN ?", ids).Update(ctx, "next_attempt_at", at.Add(lease))
+		if err != nil {
+			return fmt.Errorf("could not claim notifications, err : %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+func (repository *CovoitRepository) SaveNotificationAttempt(notification Notification) error {
+	ctx := context.Background()
+	_, err := gorm.G[Notification](repository.db).
+		Where("notification_id = ?", notification.NotificationID).
+		Select("status", "attempts", "next_attempt_at", "delivered_channels", "skipped_channels", "last_error", "delivered_at").
+		Updates(ctx, notification)
+	if err != nil {
+		return fmt.Errorf("could not save notification %s, err : %s", notification.NotificationID, err)
+	}
+	return nil
+}
+
+func (repository *CovoitRepository) GetInbox(userID uuid.UUID) ([]Notification, error) {
+	ctx := context.Background()
+	notifications, err := gorm.G[Notification](repository.db).
+		Where("user_id = ? AND delivered_channels @> ?", userID, fmt.Sprintf("[%q]", ChannelInApp)).
+		Order("created_at DESC").
+		Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get notifications of user %s, err : %s", userID, err)
+	}
+	return notifications, nil
+}
+
+func (repository *CovoitRepository) MarkNotificationRead(userID uuid.UUID, notificationID uuid.UUID, at time.Time) error {
+	ctx := context.Background()
+	rows, err := gorm.G[Notification](repository.db).
+		Where("notification_id = ? AND user_id = ? AND read_at IS NULL", notificationID, userID).
+		Update(ctx, "read_at", at)
+	if err != nil {
+		return fmt.Errorf("could not mark notification %s read, err : %s", notificationID, err)
+	}
+	if rows == 0 {
+		return ErrNotificationNotFound
+	}
+	return nil
+}
+
+func (repository *CovoitRepository) GetDeadNotifications() ([]Notification, error) {
+	ctx := context.Background()
+	notifications, err := gorm.G[Notification](repository.db).Where("status = ?", NotificationDead).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get dead notifications, err : %s", err)
+	}
+	return notifications, nil
+}
+
+func (repository *CovoitRepository) RequeueNotification(notificationID uuid.UUID, at time.Time) error {
+	ctx := context.Background()
+	rows, err := gorm.G[Notification](repository.db).
+		Where("notification_id = ? AND status = ?", notificationID, NotificationDead).
+		Select("status", "attempts", "next_attempt_at").
+		Updates(ctx, Notification{Status: NotificationPending, NextAttemptAt: at})
+	if err != nil {
+		return fmt.Errorf("could not requeue notification %s, err : %s", notificationID, err)
+	}
+	if rows == 0 {
+		return ErrNotificationNotFound
+	}
+	return nil
+}
+
+func (repository *CovoitRepository) GetNotificationsByUser(userID uuid.UUID) ([]Notification, error) {
+	ctx := context.Background()
+	notifications, err := gorm.G[Notification](repository.db).Where("user_id = ?", userID).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get notifications of user %s, err : %s", userID, err)
+	}
+	return notifications, nil
+}
+
+func init() {
+	registerPersonalData("notifications", []string{"notifications"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.notifications.GetNotificationsByUser(userID)
+	})
+	registerPeriodicJob("notifications.dispatch", NotificationDispatchInterval, func(service *CovoitService, job Job) error {
+		_, err := service.DispatchNotifications()
+		return err
+	})
+}
+
+// channels returns the notification channels the user chose.
+func (p Preferences) channels() []string {
+	if p.NotificationChannels == nil {
+		return defaultNotificationChannels
+	}
+	return p.NotificationChannels
+}
+
+func validateNotificationChannels(channels []string) error {
+	for _, channel := range channels {
+		if !slices.Contains(NotificationChannels, channel) {
+			return fmt.Errorf("unknown notification channel %s", channel)
+		}
+	}
+	return nil
+}
+
+// NotificationChannel delivers a notification to its recipient through one
+// medium.
+type NotificationChannel interface {
+	// Deliver returns ErrChannelSkipped when the recipient cannot be reached
+	// through the channel.
+	Deliver(recipient User, notification Notification) error
+}
+
+// NotificationRenderer renders the mail telling recipient about
+// notification, the other channels send its subject and its text.
+type NotificationRenderer func(recipient User, notification Notification) (Mail, error)
+
+type EmailChannel struct {
+	Mailer Mailer
+	Render NotificationRenderer
+}
+
+func (c *EmailChannel) Deliver(recipient User, notification Notification) error {
+	mail, err := c.Render(recipient, notification)
+	if err != nil {
+		return err
+	}
+	return c.Mailer.Send(mail)
+}
+
+// SMSChannel texts the recipient, provided its phone number is verified.
+type SMSChannel struct {
+	Sender SMSSender
+	Render NotificationRenderer
+}
+
+func (c *SMSChannel) Deliver(recipient User, notification Notification) error {
+	if recipient.PhoneVerifiedAt == nil {
+		return fmt.Errorf("%w : no verified phone number", ErrChannelSkipped)
+	}
+	mail, err := c.Render(recipient, notification)
+	if err != nil {
+		return err
+	}
+	return c.Sender.Send(recipient.Phone, mail.Subject)
+}
+
+type PushSender interface {
+	Send(userID uuid.UUID, title string, body string) error
+}
+
+// LogPushSender prints push notifications instead of sending them, for local
+// development.
+type LogPushSender struct{}
+
+func (s *LogPushSender) Send(userID uuid.UUID, title string, body string) error {
+	log.Printf("push to %s : %s", userID, title)
+	return nil
+}
+
+type PushChannel struct {
+	Sender PushSender
+	Render NotificationRenderer
+}
+
+func (c *PushChannel) Deliver(recipient User, notification Notification) error {
+	mail, err := c.Render(recipient, notification)
+	if err != nil {
+		return err
+	}
+	return c.Sender.Send(recipient.UserID, mail.Subject, mail.Body)
+}
+
+// InAppChannel has nothing to send, the notification shows in the inbox of
+// the recipient once delivered through it.
+type InAppChannel struct{}
+
+func (c InAppChannel) Deliver(recipient User, notification Notification) error {
+	return nil
+}
+
+func (service *CovoitService) notificationChannels() map[string]NotificationChannel {
+	return map[string]NotificationChannel{
+		ChannelEmail: &EmailChannel{Mailer: service.mailer, Render: service.renderNotification},
+		ChannelSMS:   &SMSChannel{Sender: service.sms, Render: service.renderNotification},
+		ChannelPush:  &PushChannel{Sender: service.push, Render: service.renderNotification},
+		ChannelInApp: InAppChannel{},
+	}
+}
+
+// deliverNotification attempts the channels of notification that did not
+// succeed yet. A failed attempt is retried with an exponential backoff until
+// the notification is dead.
+func (service *CovoitService) deliverNotification(notification Notification, channels map[string]NotificationChannel, now time.Time) Notification {
+	notification.Attempts++
+	recipient, err := service.repository.GetUserById(notification.UserID)
+	if err != nil {
+		notification.Status = NotificationDead
+		notification.LastError = fmt.Sprintf("recipient not found : %s", err)
+		return notification
+	}
+	failures := []string{}
+	notification.SkippedChannels = nil
+	for _, name := range recipient.Preferences.channels() {
+		if slices.Contains(notification.DeliveredChannels, name) {
+			continue
+		}
+		channel, ok := channels[name]
+		if !ok {
+			continue
+		}
+		if err := channel.Deliver(recipient, notification); errors.Is(err, ErrChannelSkipped) {
+			notification.SkippedChannels = append(notification.SkippedChannels, name)
+			continue
+		} else if err != nil {
+			failures = append(failures, fmt.Sprintf("%s : %s", name, err))
+			continue
+		}
+		notification.DeliveredChannels = append(notification.DeliveredChannels, name)
+	}
+	if len(failures) == 0 {
+		notification.Status = NotificationDelivered
+		notification.LastError = ""
+		notification.DeliveredAt = &now
+		return notification
+	}
+	notification.LastError = strings.Join(failures, ", ")
+	if notification.Attempts >= notificationMaxAttempts {
+		notification.Status = NotificationDead
+		log.Printf("giving up on notification %s after %d attempts : %s", notification.NotificationID, notification.Attempts, notification.LastError)
+		return notification
+	}
+	notification.NextAttemptAt = now.Add(notificationBackoff << (notification.Attempts - 1))
+	return notification
+}
+
+// DispatchNotifications delivers the due notifications of the outbox and
+// returns how many were fully delivered.
+func (service *CovoitService) DispatchNotifications() (int, error) {
+	now := service.clock()
+	notifications, err := service.notifications.ClaimNotifications(now, notificationBatchSize, notificationLease)
+	if err != nil {
+		return 0, err
+	}
+	channels := service.notificationChannels()
+	delivered := 0
+	for _, notification := range notifications {
+		notification = service.deliverNotification(notification, channels, now)
+		if err := service.notifications.SaveNotificationAttempt(notification); err != nil {
+			return delivered, err
+		}
+		if notification.Status == NotificationDelivered {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+func (service *CovoitService) GetNotifications(userID uuid.UUID) ([]Notification, error) {
+	return service.notifications.GetInbox(userID)
+}
+
+func (service *CovoitService) MarkNotificationRead(userID uuid.UUID, notificationID uuid.UUID) error {
+	return service.notifications.MarkNotificationRead(userID, notificationID, service.clock())
+}
+
+func (service *CovoitService) GetDeadNotifications() ([]Notification, error) {
+	return service.notifications.GetDeadNotifications()
+}
+
+func (service *CovoitService) RequeueNotification(notificationID uuid.UUID) error {
+	return service.notifications.RequeueNotification(notificationID, service.clock())
+}
+
+func (h *Handler) NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			notifications, err := h.Service.GetNotifications(actor.UserID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(notifications)
+		}
+	case http.MethodPost:
+		{
+			notificationID, err := uuid.Parse(r.URL.Query().Get("notification_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err = h.Service.MarkNotificationRead(actor.UserID, notificationID)
+			if errors.Is(err, ErrNotificationNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) DeadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManageNotifications, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			notifications, err := h.Service.GetDeadNotifications()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(notifications)
+		}
+	case http.MethodPost:
+		{
+			notificationID, err := uuid.Parse(r.URL.Query().Get("notification_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err = h.Service.RequeueNotification(notificationID)
+			if errors.Is(err, ErrNotificationNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) enqueue(notifications ...Notification) {
+	for _, notification := range notifications {
+		if notification.DedupKey != nil && slices.ContainsFunc(m.DB.Notifications, func(n Notification) bool {
+			return n.DedupKey != nil && *n.DedupKey == *notification.DedupKey
+		}) {
+			continue
+		}
+		notification.NotificationID = uuid.New()
+		notification.Status = NotificationPending
+		m.DB.Notifications = append(m.DB.Notifications, notification)
+	}
+}
+
+func (m *MockRepository) EnqueueNotifications(notifications ...Notification) error {
+	m.enqueue(notifications...)
+	return nil
+}
+
+func (m *MockRepository) ClaimNotifications(at time.Time, limit int, lease time.Duration) ([]Notification, error) {
+	notifications := []Notification{}
+	for i, notification := range m.DB.Notifications {
+		if len(notifications) == limit {
+			break
+		}
+		if notification.Status != NotificationPending || notification.NextAttemptAt.After(at) {
+			continue
+		}
+		notifications = append(notifications, notification)
+		m.DB.Notifications[i].NextAttemptAt = at.Add(lease)
+	}
+	return notifications, nil
+}
+
+func (m *MockRepository) SaveNotificationAttempt(notification Notification) error {
+	i := slices.IndexFunc(m.DB.Notifications, func(n Notification) bool { return n.NotificationID == notification.NotificationID })
+	if i < 0 {
+		return ErrNotificationNotFound
+	}
+	m.DB.Notifications[i] = notification
+	return nil
+}
+
+func (m *MockRepository) GetInbox(userID uuid.UUID) ([]Notification, error) {
+	notifications := []Notification{}
+	for _, notification := range m.DB.Notifications {
+		if notification.UserID == userID && slices.Contains(notification.DeliveredChannels, ChannelInApp) {
+			notifications = append(notifications, notification)
+		}
+	}
+	slices.Reverse(notifications)
+	return notifications, nil
+}
+
+func (m *MockRepository) MarkNotificationRead(userID uuid.UUID, notificationID uuid.UUID, at time.Time) error {
+	for i, notification := range m.DB.Notifications {
+		if notification.NotificationID == notificationID && notification.UserID == userID && notification.ReadAt == nil {
+			m.DB.Notifications[i].ReadAt = &at
+			return nil
+		}
+	}
+	return ErrNotificationNotFound
+}
+
+func (m *MockRepository) GetDeadNotifications() ([]Notification, error) {
+	notifications := []Notification{}
+	for _, notification := range m.DB.Notifications {
+		if notification.Status == NotificationDead {
+			notifications = append(notifications, notification)
+		}
+	}
+	return notifications, nil
+}
+
+func (m *MockRepository) RequeueNotification(notificationID uuid.UUID, at time.Time) error {
+	for i, notification := range m.DB.Notifications {
+		if notification.NotificationID == notificationID && notification.Status == NotificationDead {
+			m.DB.Notifications[i].Status = NotificationPending
+			m.DB.Notifications[i].Attempts = 0
+			m.DB.Notifications[i].NextAttemptAt = at
+			return nil
+		}
+	}
+	return ErrNotificationNotFound
+}
+
+func (m *MockRepository) GetNotificationsByUser(userID uuid.UUID) ([]Notification, error) {
+	notifications := []Notification{}
+	for _, notification := range m.DB.Notifications {
+		if notification.UserID == userID {
+			notifications = append(notifications, notification)
+		}
+	}
+	return notifications, nil
+}
+
+type memoryPushSender struct {
+	titles []string
+}
+
+func (s *memoryPushSender) Send(userID uuid.UUID, title string, body string) error {
+	s.titles = append(s.titles, title)
+	return nil
+}
+
+func TestNotificationOutbox(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	push := &memoryPushSender{}
+	s := NewMockService(db)
+	s.mailer, s.push = mailer, push
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	passengerID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	ride := Ride{RideID: uuid.New(), DriverID: driverID, Origin: "Lyon", Destination: "Paris", DepartureTime: now.Add(24 * time.Hour), NumberOfSeats: 3, Status: RideScheduled}
+	db.Rides = append(db.Rides, ride)
+
+	booking, err := s.CreateBooking(Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1})
+	require.NoError(t, err)
+	require.Len(t, db.Notifications, 1)
+	require.Equal(t, NotificationBookingCreated, db.Notifications[0].Type)
+	require.Empty(t, mailer.Sent, "nothing leaves before the dispatcher runs")
+
+	delivered, err := s.DispatchNotifications()
+	require.NoError(t, err)
+	require.Equal(t, 1, delivered)
+	mail, ok := mailer.Last()
+	require.True(t, ok)
+	require.Equal(t, "mehdibenfredj3@gmail.com", mail.To)
+	require.Equal(t, "New booking on your ride", mail.Subject)
+	require.Contains(t, mail.Body, "Lyon to Paris")
+	inbox, err := s.GetNotifications(driverID)
+	require.NoError(t, err)
+	require.Len(t, inbox, 1)
+	require.NoError(t, s.MarkNotificationRead(driverID, inbox[0].NotificationID))
+	require.ErrorIs(t, s.MarkNotificationRead(driverID, inbox[0].NotificationID), ErrNotificationNotFound)
+	require.ErrorIs(t, s.MarkNotificationRead(passengerID, inbox[0].NotificationID), ErrNotificationNotFound)
+
+	_, err = s.ApproveBooking(booking.BookingID)
+	require.NoError(t, err)
+	_, err = s.ApproveBooking(booking.BookingID)
+	require.ErrorIs(t, err, ErrBookingNotPending)
+	_, err = s.DispatchNotifications()
+	require.NoError(t, err)
+	mail, _ = mailer.Last()
+	require.Equal(t, "sayehfaten1195@gmail.com", mail.To)
+	require.Equal(t, "Your booking is confirmed", mail.Subject)
+
+	db.Users[0].Preferences.NotificationChannels = []string{ChannelSMS, ChannelPush}
+	require.NoError(t, s.DeleteBooking(booking.BookingID, passengerID))
+	_, err = s.DispatchNotifications()
+	require.NoError(t, err)
+	require.Len(t, mailer.Sent, 2, "the driver turned email off")
+	require.Equal(t, []string{"A booking has been cancelled"}, push.titles)
+	cancelled := db.Notifications[len(db.Notifications)-1]
+	require.Equal(t, NotificationDelivered, cancelled.Status)
+	require.Equal(t, []string{ChannelPush}, cancelled.DeliveredChannels)
+	require.Equal(t, []string{ChannelSMS}, cancelled.SkippedChannels, "the driver has no verified phone number")
+	inbox, err = s.GetNotifications(driverID)
+	require.NoError(t, err)
+	require.Len(t, inbox, 1, "nor in-app")
+
+	_, err = s.PatchUser(driverID, []byte(`{"preferences":{"notification_channels":["pigeon"]}}`))
+	require.ErrorIs(t, err, ErrInvalidPatch)
+}
+
+func TestNotificationRetries(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{Error: errors.New("smtp relay down")}
+	s := NewMockService(db)
+	s.mailer = mailer
+	s.now = func() time.Time { return now }
+	passengerID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	repository := s.notifications.(*MockRepository)
+	repository.enqueue(Notification{UserID: passengerID, Type: NotificationRideCancelled, NextAttemptAt: now})
+	repository.enqueue(Notification{UserID: uuid.New(), Type: NotificationRideCancelled, NextAttemptAt: now})
+
+	delivered, err := s.DispatchNotifications()
+	require.NoError(t, err)
+	require.Zero(t, delivered)
+	notification := db.Notifications[0]
+	require.Equal(t, NotificationPending, notification.Status)
+	require.Equal(t, 1, notification.Attempts)
+	require.Equal(t, []string{ChannelInApp}, notification.DeliveredChannels)
+	require.Contains(t, notification.LastError, "smtp relay down")
+	require.Equal(t, now.Add(time.Minute), notification.NextAttemptAt)
+	require.Equal(t, NotificationDead, db.Notifications[1].Status, "nobody to deliver to")
+
+	_, err = s.DispatchNotifications()
+	require.NoError(t, err)
+	require.Equal(t, 1, db.Notifications[0].Attempts, "not due yet")
+	for attempt := 2; attempt <= notificationMaxAttempts; attempt++ {
+		now = db.Notifications[0].NextAttemptAt
+		_, err = s.DispatchNotifications()
+		require.NoError(t, err)
+		require.Equal(t, attempt, db.Notifications[0].Attempts)
+		if attempt == 2 {
+			require.Equal(t, now.Add(2*time.Minute), db.Notifications[0].NextAttemptAt, "the backoff doubles")
+		}
+	}
+	require.Equal(t, NotificationDead, db.Notifications[0].Status)
+	dead, err := s.GetDeadNotifications()
+	require.NoError(t, err)
+	require.Len(t, dead, 2)
+
+	mailer.Error = nil
+	require.NoError(t, s.RequeueNotification(notification.NotificationID))
+	require.ErrorIs(t, s.RequeueNotification(notification.NotificationID), ErrNotificationNotFound)
+	delivered, err = s.DispatchNotifications()
+	require.NoError(t, err)
+	require.Equal(t, 1, delivered)
+	require.Len(t, mailer.Sent, 1)
+	require.Equal(t, []string{ChannelInApp, ChannelEmail}, db.Notifications[0].DeliveredChannels, "in-app is not delivered twice")
+}
+
+func TestNotificationHandlers(t *testing.T) {
+	owner := Actor{UserID: uuid.New(), Role: RolePassenger}
+	notificationID, unknownID := uuid.New(), uuid.New()
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("GetNotifications", owner.UserID).Return([]Notification{{NotificationID: notificationID}}, nil)
+	mockSvc.On("MarkNotificationRead", owner.UserID, notificationID).Return(nil)
+	mockSvc.On("MarkNotificationRead", owner.UserID, unknownID).Return(ErrNotificationNotFound)
+	mockSvc.On("GetDeadNotifications").Return([]Notification{}, nil)
+	mockSvc.On("RequeueNotification", notificationID).Return(nil)
+	mockSvc.On("RequeueNotification", unknownID).Return(ErrNotificationNotFound)
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		url     string
+		actor   Actor
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"inbox", http.MethodGet, "/notifications", owner, h.NotificationsHandler, http.StatusOK},
+		{"read", http.MethodPost, "/notifications?notification_id=" + notificationID.String(), owner, h.NotificationsHandler, http.StatusNoContent},
+		{"read unknown", http.MethodPost, "/notifications?notification_id=" + unknownID.String(), owner, h.NotificationsHandler, http.StatusNotFound},
+		{"dead letters", http.MethodGet, "/admin/notifications", admin, h.DeadNotificationsHandler, http.StatusOK},
+		{"dead letters as a user", http.MethodGet, "/admin/notifications", owner, h.DeadNotificationsHandler, http.StatusForbidden},
+		{"requeue", http.MethodPost, "/admin/notifications?notification_id=" + notificationID.String(), admin, h.DeadNotificationsHandler, http.StatusNoContent},
+		{"requeue unknown", http.MethodPost, "/admin/notifications?notification_id=" + unknownID.String(), admin, h.DeadNotificationsHandler, http.StatusNotFound},
+	} {
+		req := asActor(httptest.NewRequest(tc.method, tc.url, nil), tc.actor)
+		w := httptest.NewRecorder()
+		tc.handler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
+
+func TestApproveBookingHandler(t *testing.T) {
+	driver := Actor{UserID: uuid.New(), Role: RoleDriver}
+	passenger := Actor{UserID: uuid.New(), Role: RolePassenger}
+	ride := Ride{RideID: uuid.New(), DriverID: driver.UserID}
+	pending := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passenger.UserID, Status: BookingPending}
+	confirmed := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passenger.UserID, Status: BookingConfirmed}
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("GetRideById", ride.RideID).Return(ride, nil)
+	mockSvc.On("GetBookingById", pending.BookingID).Return(pending, nil)
+	mockSvc.On("GetBookingById", confirmed.BookingID).Return(confirmed, nil)
+	mockSvc.On("ApproveBooking", pending.BookingID).Return(pending, nil)
+	mockSvc.On("ApproveBooking", confirmed.BookingID).Return(Booking{}, ErrBookingNotPending)
+	full := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passenger.UserID, Status: BookingPending}
+	mockSvc.On("GetBookingById", full.BookingID).Return(full, nil)
+	mockSvc.On("ApproveBooking", full.BookingID).Return(Booking{}, ErrInvalidBooking)
+
+	for _, tc := range []struct {
+		name    string
+		booking Booking
+		actor   Actor
+		status  int
+	}{
+		{"driver approves", pending, driver, http.StatusOK},
+		{"passenger approves", pending, passenger, http.StatusForbidden},
+		{"already confirmed", confirmed, driver, http.StatusConflict},
+		{"ride full", full, driver, http.StatusConflict},
+	} {
+		req := asActor(httptest.NewRequest(http.MethodPost, "/bookings/approve?booking_id="+tc.booking.BookingID.String(), nil), tc.actor)
+		w := httptest.NewRecorder()
+		h.ApproveBookingHandler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	passwordResetTTL        = 30 * time.Minute
+	passwordResetEmailLimit = 3
+	passwordResetIPLimit    = 10
+)
+
+type PasswordReset struct {
+	ResetID   uuid.UUID  `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"reset_id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	TokenHash string     `gorm:"uniqueIndex" json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+func (repository *CovoitRepository) CreatePasswordReset(reset PasswordReset) (PasswordReset, error) {
+	ctx := context.Background()
+	err := gorm.G[PasswordReset](repository.db).Create(ctx, &reset)
+	if err != nil {
+		return PasswordReset{}, fmt.Errorf("could not create password reset for user %s, err : %s", reset.UserID, err)
+	}
+	return reset, nil
+}
+
+func (repository *CovoitRepository) GetPasswordResetByTokenHash(tokenHash string) (PasswordReset, error) {
+	ctx := context.Background()
+	reset, err := gorm.G[PasswordReset](repository.db).Where("token_hash = ?", tokenHash).First(ctx)
+	if err != nil {
+		return PasswordReset{}, fmt.Errorf("could not retrieve password reset, err : %s", err)
+	}
+	return reset, nil
+}
+
+func (repository *CovoitRepository) GetPasswordResetsByUser(userID uuid.UUID) ([]PasswordReset, error) {
+	ctx := context.Background()
+	resets, err := gorm.G[PasswordReset](repository.db).Where("user_id = ?", userID).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get password resets of user %s, err : %s", userID, err)
+	}
+	return resets, nil
+}
+
+func init() {
+	registerPersonalData("password_resets", []string{"password_resets"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.auth.GetPasswordResetsByUser(userID)
+	})
+}
+
+// CompletePasswordReset consumes the reset, replaces the password and revokes
+// every session of the user. It fails with ErrInvalidToken when the reset was
+// consumed in the meantime.
+func (repository *CovoitRepository) CompletePasswordReset(reset PasswordReset, passwordHash string, at time.Time) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		rows, err := gorm.G[PasswordReset](tx).Where("reset_id = ? AND used_at IS NULL", reset.ResetID).Update(ctx, "used_at", at)
+		if err != nil {
+			return fmt.Errorf("could not consume password reset %s, err : %s", reset.ResetID, err)
+		}
+		if rows != 1 {
+			return ErrInvalidToken
+		}
+		_, err = gorm.G[PasswordReset](tx).Where("user_id = ? AND used_at IS NULL", reset.UserID).Update(ctx, "used_at", at)
+		if err != nil {
+			return fmt.Errorf("could not consume password resets of user %s, err : %s", reset.UserID, err)
+		}
+		_, err = gorm.G[User](tx).Where("user_id = ?", reset.UserID).Update(ctx, "password_hash", passwordHash)
+		if err != nil {
+			return fmt.Errorf("could not update password of user %s, err : %s", reset.UserID, err)
+		}
+		_, err = gorm.G[Session](tx).Where("user_id = ? AND revoked_at IS NULL", reset.UserID).Update(ctx, "revoked_at", at)
+		if err != nil {
+			return fmt.Errorf("could not revoke sessions of user %s, err : %s", reset.UserID, err)
+		}
+		return nil
+	})
+}
+
+// RequestPasswordReset mails a reset link when email belongs to a user. The
+// outcome is the same whether the email exists or not, and so is the time it
+// takes : the link is made and mailed in the background.
+func (service *CovoitService) RequestPasswordReset(email string, ip string) error {
+	subject := strings.ToLower(strings.TrimSpace(email))
+	now := service.clock()
+	since := now.Add(-time.Hour)
+	byEmail, err := service.audits.CountAuditEventsBySubject(AuditPasswordResetRequested, subject, since)
+	if err != nil {
+		return err
+	}
+	byIP, err := service.audits.CountAuditEventsByIP(AuditPasswordResetRequested, ip, since)
+	if err != nil {
+		return err
+	}
+	if byEmail >= passwordResetEmailLimit || byIP >= passwordResetIPLimit {
+		return ErrTooManyRequests
+	}
+
+	user, err := service.repository.GetUserByEmail(email)
+	if err != nil {
+		service.audit(nil, AuditPasswordResetRequested, subject, ip)
+		return nil
+	}
+	service.audit(&user.UserID, AuditPasswordResetRequested, subject, ip)
+	service.goJob(func() {
+		if err := service.sendPasswordReset(user, now); err != nil {
+			log.Printf("could not send password reset to user %s : %s", user.UserID, err)
+		}
+	})
+	return nil
+}
+
+func (service *CovoitService) sendPasswordReset(user User, now time.Time) error {
+	token, tokenHash, err := generateToken()
+	if err != nil {
+		return err
+	}
+	_, err = service.auth.CreatePasswordReset(PasswordReset{
+		UserID:    user.UserID,
+		TokenHash: tokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return service.mailer.Send(Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nSomeone asked to reset the password of your covoit account. If it was you, open the following link :\n%s/password-reset/confirm?token=%s\n\nThis link expires in 30 minutes. If you did not ask for it, you can ignore this email.",
+			user.FirstName, appURL, token),
+	})
+}
+
+func (service *CovoitService) ResetPassword(token string, password string, ip string) error {
+	now := service.clock()
+	rejected, err := service.audits.CountAuditEventsByIP(AuditPasswordResetRejected, ip, now.Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	if rejected >= passwordResetIPLimit {
+		return ErrTooManyRequests
+	}
+
+	reset, err := service.auth.GetPasswordResetByTokenHash(hashToken(token))
+	if err != nil || reset.UsedAt != nil || !now.Before(reset.ExpiresAt) {
+		service.audit(nil, AuditPasswordResetRejected, "", ip)
+		return ErrInvalidToken
+	}
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = service.auth.CompletePasswordReset(reset, passwordHash, now)
+	if errors.Is(err, ErrInvalidToken) {
+		service.audit(&reset.UserID, AuditPasswordResetRejected, "", ip)
+		return err
+	} else if err != nil {
+		return err
+	}
+	service.audit(&reset.UserID, AuditPasswordResetCompleted, "", ip)
+	return nil
+}
+
+func (h *Handler) PasswordResetRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body := struct {
+		Email string `json:"email"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = h.Service.RequestPasswordReset(body.Email, clientIP(r))
+	if errors.Is(err, ErrTooManyRequests) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// passwordResetPage is what the link of the reset email opens. Opening it
+// leaves the token untouched, the form posts it with the new password.
+var passwordResetPage = htmltemplate.Must(htmltemplate.New("password-reset").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Reset your password</title></head>
+<body>
+<h1>Reset your password</h1>
+<form id="reset">
+<input type="hidden" name="token" value="{{.}}">
+<label>New password <input type="password" name="password" minlength="8" maxlength="72" required></label>
+<button type="submit">Reset</button>
+</form>
+<p id="outcome"></p>
+<script>
+document.getElementById("reset").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const form = new FormData(event.target);
+  const response = await fetch("/password-reset/confirm", {
+    method: "POST",
+    headers: {"Content-Type": "application/json"},
+    body: JSON.stringify({token: form.get("token"), password: form.get("password")}),
+  });
+  document.getElementById("outcome").textContent = response.ok
+    ? "Your password is reset, you can log in with it."
+    : "Your password could not be reset, the link may have expired.";
+});
+</script>
+</body>
+</html>
+`))
+
+func (h *Handler) PasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "This link is incomplete.", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		passwordResetPage.Execute(w, token)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body := struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = h.Service.ResetPassword(body.Token, body.Password, clientIP(r))
+	if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrInvalidPassword) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if errors.Is(err, ErrTooManyRequests) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) CreatePasswordReset(reset PasswordReset) (PasswordReset, error) {
+	reset.ResetID = uuid.New()
+	m.DB.PasswordResets = append(m.DB.PasswordResets, reset)
+	return reset, nil
+}
+
+func (m *MockRepository) GetPasswordResetByTokenHash(tokenHash string) (PasswordReset, error) {
+	for _, reset := range m.DB.PasswordResets {
+		if reset.TokenHash == tokenHash {
+			return reset, nil
+		}
+	}
+	return PasswordReset{}, fmt.Errorf("password reset not found")
+}
+
+func (m *MockRepository) CompletePasswordReset(reset PasswordReset, passwordHash string, at time.Time) error {
+	for i := range m.DB.PasswordResets {
+		if m.DB.PasswordResets[i].ResetID == reset.ResetID && m.DB.PasswordResets[i].UsedAt != nil {
+			return ErrInvalidToken
+		}
+	}
+	for i := range m.DB.PasswordResets {
+		if m.DB.PasswordResets[i].UserID == reset.UserID && m.DB.PasswordResets[i].UsedAt == nil {
+			m.DB.PasswordResets[i].UsedAt = &at
+		}
+	}
+	for i := range m.DB.Users {
+		if m.DB.Users[i].UserID == reset.UserID {
+			m.DB.Users[i].PasswordHash = passwordHash
+		}
+	}
+	for i := range m.DB.Sessions {
+		if m.DB.Sessions[i].UserID == reset.UserID && m.DB.Sessions[i].RevokedAt == nil {
+			m.DB.Sessions[i].RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+func (m *MockRepository) CreateAuditEvent(event AuditEvent) (AuditEvent, error) {
+	event.EventID = uuid.New()
+	m.DB.AuditEvents = append(m.DB.AuditEvents, event)
+	return event, nil
+}
+
+func (m *MockRepository) CountAuditEventsBySubject(action string, subject string, since time.Time) (int64, error) {
+	var count int64
+	for _, event := range m.DB.AuditEvents {
+		if event.Action == action && event.Subject == subject && !event.CreatedAt.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MockRepository) CountAuditEventsByIP(action string, ip string, since time.Time) (int64, error) {
+	var count int64
+	for _, event := range m.DB.AuditEvents {
+		if event.Action == action && event.IP == ip && !event.CreatedAt.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MockRepository) GetPasswordResetsByUser(userID uuid.UUID) ([]PasswordReset, error) {
+	found := []PasswordReset{}
+	for _, passwordReset := range m.DB.PasswordResets {
+		if passwordReset.UserID == userID {
+			found = append(found, passwordReset)
+		}
+	}
+	return found, nil
+}
+
+func (m *MockRepository) GetAuditEventsByUser(userID uuid.UUID) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	for _, event := range m.DB.AuditEvents {
+		if event.UserID != nil && *event.UserID == userID {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func auditActions(db *MockDB) []string {
+	actions := []string{}
+	for _, event := range db.AuditEvents {
+		actions = append(actions, event.Action)
+	}
+	return actions
+}
+
+func TestPasswordReset(t *testing.T) {
+	now := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	s := NewMockService(db)
+	s.mailer = mailer
+	s.now = func() time.Time { return now }
+
+	user, err := s.CreateNewUser(User{UserID: uuid.New(), Email: "forgot@test.com", Password: "old password"})
+	require.NoError(t, err)
+	sentAtSignup := len(mailer.Sent)
+	session, err := s.Login("forgot@test.com", "old password")
+	require.NoError(t, err)
+
+	t.Run("unknown email sends nothing but looks the same", func(t *testing.T) {
+		require.NoError(t, s.RequestPasswordReset("nobody@test.com", "10.0.0.1"))
+		require.Len(t, mailer.Sent, sentAtSignup)
+	})
+
+	jobs := []func(){}
+	s.runJob = func(job func()) { jobs = append(jobs, job) }
+	require.NoError(t, s.RequestPasswordReset("forgot@test.com", "10.0.0.1"))
+	require.Len(t, mailer.Sent, sentAtSignup, "the link is mailed in the background")
+	require.Len(t, jobs, 1)
+	jobs[0]()
+	require.Len(t, mailer.Sent, sentAtSignup+1)
+	mail, _ := mailer.Last()
+	require.Contains(t, mail.Body, appURL+"/password-reset/confirm?token=", "the link opens PasswordResetHandler")
+	token := tokenFromMail(t, mail)
+
+	t.Run("weak password keeps the token", func(t *testing.T) {
+		require.ErrorIs(t, s.ResetPassword(token, "short", "10.0.0.1"), ErrInvalidPassword)
+	})
+
+	t.Run("reset changes password and revokes sessions", func(t *testing.T) {
+		require.NoError(t, s.ResetPassword(token, "new password", "10.0.0.1"))
+
+		_, err := s.Login("forgot@test.com", "old password")
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+		_, err = s.Login("forgot@test.com", "new password")
+		require.NoError(t, err)
+		_, err = s.AuthenticateSession(session)
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("token is single use", func(t *testing.T) {
+		require.ErrorIs(t, s.ResetPassword(token, "another password", "10.0.0.1"), ErrInvalidToken)
+	})
+
+	t.Run("every step is audited", func(t *testing.T) {
+		require.Equal(t, []string{
+			AuditPasswordResetRequested,
+			AuditPasswordResetRequested,
+			AuditPasswordResetCompleted,
+			AuditPasswordResetRejected,
+		}, auditActions(db))
+		require.Equal(t, user.UserID, *db.AuditEvents[2].UserID)
+	})
+}
+
+func TestPasswordResetExpiry(t *testing.T) {
+	now := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	s := NewMockService(db)
+	s.mailer = mailer
+	s.now = func() time.Time { return now }
+
+	require.NoError(t, s.RequestPasswordReset("mehdibenfredj3@gmail.com", "10.0.0.1"))
+	mail, _ := mailer.Last()
+	now = now.Add(passwordResetTTL)
+	require.ErrorIs(t, s.ResetPassword(tokenFromMail(t, mail), "new password", "10.0.0.1"), ErrInvalidToken)
+}
+
+func TestPasswordResetRateLimits(t *testing.T) {
+	now := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	s := NewMockService(CreateNewMockDB(t))
+	s.now = func() time.Time { return now }
+
+	t.Run("per email", func(t *testing.T) {
+		for i := range passwordResetEmailLimit {
+			require.NoError(t, s.RequestPasswordReset("Target@test.com", fmt.Sprintf("10.0.1.%d", i)))
+		}
+		require.ErrorIs(t, s.RequestPasswordReset("target@test.com", "10.0.1.99"), ErrTooManyRequests)
+	})
+
+	t.Run("per ip", func(t *testing.T) {
+		for i := range passwordResetIPLimit {
+			require.NoError(t, s.RequestPasswordReset(fmt.Sprintf("user%d@test.com", i), "10.0.2.1"))
+		}
+		require.ErrorIs(t, s.RequestPasswordReset("other@test.com", "10.0.2.1"), ErrTooManyRequests)
+	})
+
+	t.Run("rejected tokens per ip", func(t *testing.T) {
+		for range passwordResetIPLimit {
+			require.ErrorIs(t, s.ResetPassword("guess", "new password", "10.0.3.1"), ErrInvalidToken)
+		}
+		require.ErrorIs(t, s.ResetPassword("guess", "new password", "10.0.3.1"), ErrTooManyRequests)
+	})
+
+	t.Run("limits slide with time", func(t *testing.T) {
+		now = now.Add(time.Hour + time.Minute)
+		require.NoError(t, s.RequestPasswordReset("target@test.com", "10.0.2.1"))
+	})
+}
+
+func TestPasswordResetHandlers(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("RequestPasswordReset", "a@test.com", "192.0.2.1").Return(nil)
+	mockSvc.On("RequestPasswordReset", "b@test.com", "192.0.2.1").Return(ErrTooManyRequests)
+	mockSvc.On("ResetPassword", "good", "new password", "192.0.2.1").Return(nil)
+	mockSvc.On("ResetPassword", "bad", "new password", "192.0.2.1").Return(ErrInvalidToken)
+	mockSvc.On("ResetPassword", "good", "short", "192.0.2.1").Return(ErrInvalidPassword)
+
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		body    string
+		status  int
+	}{
+		{h.PasswordResetRequestHandler, `{"email":"a@test.com"}`, http.StatusAccepted},
+		{h.PasswordResetRequestHandler, `{"email":"b@test.com"}`, http.StatusTooManyRequests},
+		{h.PasswordResetRequestHandler, `{}`, http.StatusBadRequest},
+		{h.PasswordResetHandler, `{"token":"good","password":"new password"}`, http.StatusNoContent},
+		{h.PasswordResetHandler, `{"token":"bad","password":"new password"}`, http.StatusBadRequest},
+		{h.PasswordResetHandler, `{"token":"good","password":"short"}`, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/password-reset", bytes.NewBufferString(tc.body))
+		w := httptest.NewRecorder()
+		tc.handler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.body)
+	}
+
+	w := httptest.NewRecorder()
+	h.PasswordResetHandler(w, httptest.NewRequest(http.MethodGet, "/password-reset/confirm?token=<good>", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Contains(t, w.Body.String(), `value="&lt;good&gt;"`)
+	mockSvc.AssertNumberOfCalls(t, "ResetPassword", 3)
+	w = httptest.NewRecorder()
+	h.PasswordResetHandler(w, httptest.NewRequest(http.MethodGet, "/password-reset/confirm", nil))
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
@@ -0,0 +1,807 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// PaymentPending is a payment whose authorization is not confirmed yet.
+	PaymentPending    = "pending"
+	PaymentAuthorized = "authorized"
+	PaymentCaptured   = "captured"
+	// PaymentReleased is an authorization cancelled without capture.
+	PaymentReleased = "released"
+	PaymentRefunded = "refunded"
+	// PaymentFailed is an authorization the provider declined.
+	PaymentFailed = "failed"
+)
+
+// The calls made to the payment provider. Capture and release also name the
+// escrow decision taken for a payment.
+const (
+	PaymentAuthorize = "authorize"
+	PaymentCapture   = "capture"
+	PaymentRelease   = "release"
+	PaymentRefund    = "refund"
+)
+
+const PaymentCurrency = "EUR"
+
+const (
+	// LateCancellationWindow is how long before the departure a passenger
+	// cancelling a confirmed booking pays LateCancellationFeePercent of the
+	// price, kept for the driver.
+	LateCancellationWindow     = 24 * time.Hour
+	LateCancellationFeePercent = 50
+
+	paymentBatchSize = 50
+	// paymentRetryDelay is how long a provider call is left to complete
+	// before it is made again.
+	paymentRetryDelay = time.Minute
+	// PaymentReconcileInterval is how often the unsettled payments are
+	// polled.
+	PaymentReconcileInterval = time.Minute
+	// paymentWebhookSize caps the body of the notifications of the provider.
+	paymentWebhookSize = 1 << 20
+)
+
+var (
+	ErrPaymentDeclined            = errors.New("payment declined")
+	ErrPaymentNotFound            = errors.New("payment not found")
+	ErrInvalidRefund              = errors.New("invalid refund")
+	ErrInvalidPaymentWebhook      = errors.New("invalid payment webhook")
+	ErrPaymentProviderUnavailable = errors.New("payment provider unavailable")
+)
+
+// Payment holds the price of a booking in escrow : it is authorized when the
+// booking is made, captured once the ride is completed and released, or
+// partly captured, when the booking is cancelled.
+//
+// The escrow decision is written in the transaction of the operation taking
+// it, and the provider call it leads to is written before it is made, with
+// its idempotency key. Calls interrupted are made again with the same key by
+// ReconcilePayments, so that every decision is carried out exactly once.
+type Payment struct {
+	PaymentID uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"payment_id"`
+	BookingID uuid.UUID `gorm:"type:uuid;uniqueIndex" json:"booking_id"`
+	// UserID is the passenger paying, PayeeID the driver earning it.
+	UserID  uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	PayeeID uuid.UUID `gorm:"type:uuid" json:"payee_id"`
+	Amount  Money     `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	// Discount is the promotion the platform funds on top of Amount, the
+	// driver earns on both.
+	Discount Money  `gorm:"embedded;embeddedPrefix:discount_" json:"discount,omitzero"`
+	Status   string `gorm:"default:pending" json:"status"`
+	// Reference identifies the payment at the provider.
+	Reference      string `gorm:"index" json:"-"`
+	CapturedAmount Money  `gorm:"embedded;embeddedPrefix:captured_amount_" json:"captured_amount"`
+	RefundedAmount Money  `gorm:"embedded;embeddedPrefix:refunded_amount_" json:"refunded_amount"`
+
+	// Settlement is the escrow decision, capture or release, and
+	// SettlementAmount what is captured.
+	Settlement       string `json:"settlement,omitempty"`
+	SettlementAmount Money  `gorm:"embedded;embeddedPrefix:settlement_amount_" json:"settlement_amount,omitzero"`
+
+	// Action is the provider call in flight, made with ActionKey as its
+	// idempotency key.
+	Action       string     `json:"-"`
+	ActionAmount Money      `gorm:"embedded;embeddedPrefix:action_amount_" json:"-"`
+	ActionKey    string     `json:"-"`
+	AttemptedAt  *time.Time `json:"-"`
+	LastError    string     `json:"-"`
+	CreatedAt    time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// ProviderPayment is the state of a payment at the provider.
+type ProviderPayment struct {
+	Reference  string `json:"reference"`
+	Status     string `json:"status"`
+	Authorized Money  `json:"authorized"`
+	Captured   Money  `json:"captured"`
+	Refunded   Money  `json:"refunded"`
+}
+
+type PaymentRequest struct {
+	// IdempotencyKey makes the provider answer a retried authorization with
+	// the payment it already authorized.
+	IdempotencyKey string
+	PayerID        uuid.UUID
+	BookingID      uuid.UUID
+	Amount         Money
+}
+
+// PaymentProvider moves the money. Every call taking an idempotency key may
+// be made again with the same key, the provider then answers with the state
+// of the payment without acting twice.
+type PaymentProvider interface {
+	// Authorize holds the amount on the payment method of the payer, it
+	// returns ErrPaymentDeclined when the provider refuses.
+	Authorize(request PaymentRequest) (ProviderPayment, error)
+	// Capture takes amount out of an authorization, the rest is released.
+	Capture(reference string, amount Money, idempotencyKey string) (ProviderPayment, error)
+	// Release cancels an authorization.
+	Release(reference string, idempotencyKey string) (ProviderPayment, error)
+	Refund(reference string, amount Money, idempotencyKey string) (ProviderPayment, error)
+	// ParseWebhook authenticates a notification of the provider and returns
+	// the state of the payment it tells about.
+	ParseWebhook(header http.Header, body []byte) (ProviderPayment, error)
+}
+
+// paymentProgress orders the statuses, a payment never goes back to an
+// earlier one.
+var paymentProgress = map[string]int{
+	PaymentPending:    0,
+	PaymentAuthorized: 1,
+	PaymentCaptured:   2,
+	PaymentReleased:   2,
+	PaymentFailed:     2,
+	PaymentRefunded:   3,
+}
+
+// applyProviderPayment copies the state of the provider into payment, unless
+// it is older than what payment already knows, as a notification delivered
+// late would be.
+func applyProviderPayment(payment *Payment, state ProviderPayment) {
+	if paymentProgress[state.Status] < paymentProgress[payment.Status] {
+		return
+	}
+	if state.Status == payment.Status && state.Refunded.Minor < payment.RefundedAmount.Minor {
+		return
+	}
+	payment.Reference = state.Reference
+	payment.Status = state.Status
+	payment.CapturedAmount = state.Captured
+	payment.RefundedAmount = state.Refunded
+}
+
+// cancellationSettlement returns the escrow decision for booking when actorID
+// cancels it at at. Drivers and admins cancel for free, and so do passengers
+// cancelling a request, a booking with a user they blocked or a ride far
+// enough ahead.
+func cancellationSettlement(booking Booking, ride Ride, actorID uuid.UUID, at time.Time) (string, int64) {
+	if actorID != booking.UserID || booking.Status != BookingConfirmed {
+		return PaymentRelease, 0
+	}
+	if booking.FreeCancellationFor != nil && *booking.FreeCancellationFor == actorID {
+		return PaymentRelease, 0
+	}
+	if ride.DepartureTime.Sub(at) >= LateCancellationWindow {
+		return PaymentRelease, 0
+	}
+	return PaymentCapture, LateCancellationFeePercent
+}
+
+// createPayment writes the payment of booking within tx, its authorization
+// is made once the transaction commits. Free bookings have no payment.
+func createPayment(tx *gorm.DB, booking Booking, driverID uuid.UUID) error {
+	if booking.TotalPrice.IsZero() {
+		return nil
+	}
+	payment := newPayment(booking, driverID)
+	if err := gorm.G[Payment](tx).Create(context.Background(), &payment); err != nil {
+		return fmt.Errorf("could not create payment of booking %s, err : %s", booking.BookingID, err)
+	}
+	return nil
+}
+
+func newPayment(booking Booking, driverID uuid.UUID) Payment {
+	return Payment{
+		PaymentID: uuid.New(),
+		BookingID: booking.BookingID,
+		UserID:    booking.UserID,
+		PayeeID:   driverID,
+		Amount:    booking.TotalPrice,
+		Discount:  booking.Discount,
+		Status:    PaymentPending,
+		Action:    PaymentAuthorize,
+		ActionKey: uuid.NewString(),
+	}
+}
+
+// settlePayments records the escrow decision for the payments of the
+// bookings within tx, percent being the part of their amount captured,
+// rounded like Money.Percent. The first decision taken for a payment stands.
+func settlePayments(tx *gorm.DB, settlement string, percent int64, bookingIDs ...uuid.UUID) error {
+	if len(bookingIDs) == 0 {
+		return nil
+	}
+	err := tx.Model(&Payment{}).
+		Where("booking_id IN ? AND settlement = ''", bookingIDs).
+		Updates(map[string]any{
+			"settlement":                 settlement,
+			"settlement_amount_minor":    gorm.Expr("ROUND(amount_minor * ? / 100.0)", percent),
+			"settlement_amount_currency": gorm.Expr("amount_currency"),
+		}).Error
+	if err != nil {
+		return fmt.Errorf("could not settle payments, err : %s", err)
+	}
+	return nil
+}
+
+func bookingIDs(bookings []Booking) []uuid.UUID {
+	ids := make([]uuid.UUID, len(bookings))
+	for i, booking := range bookings {
+		ids[i] = booking.BookingID
+	}
+	return ids
+}
+
+type PaymentRepository interface {
+	GetPaymentById(paymentID uuid.UUID) (Payment, error)
+	GetPaymentByBooking(bookingID uuid.UUID) (Payment, error)
+	GetPaymentByReference(reference string) (Payment, error)
+	GetPaymentsByUser(userID uuid.UUID) ([]Payment, error)
+	// GetUnsettledPayments returns the payments with a provider call to make,
+	// last attempted before before.
+	GetUnsettledPayments(before time.Time, limit int) ([]Payment, error)
+	// SavePayment updates payment and records the journals of the money it
+	// moved, together.
+	SavePayment(payment Payment, journals ...Journal) error
+}
+
+func (repository *CovoitRepository) getPayment(query string, args ...any) (Payment, error) {
+	payment, err := gorm.G[Payment](repository.db).Where(query, args...).First(context.Background())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Payment{}, ErrPaymentNotFound
+	} else if err != nil {
+		return Payment{}, fmt.Errorf("could not get payment, err : %s", err)
+	}
+	return payment, nil
+}
+
+func (repository *CovoitRepository) GetPaymentById(paymentID uuid.UUID) (Payment, error) {
+	return repository.getPayment("payment_id = ?", paymentID)
+}
+
+func (repository *CovoitRepository) GetPaymentByBooking(bookingID uuid.UUID) (Payment, error) {
+	return repository.getPayment("booking_id = ?", bookingID)
+}
+
+func (repository *CovoitRepository) GetPaymentByReference(reference string) (Payment, error) {
+	return repository.getPayment("reference = ?", reference)
+}
+
+func (repository *CovoitRepository) GetPaymentsByUser(userID uuid.UUID) ([]Payment, error) {
+	payments, err := gorm.G[Payment](repository.db).Where("user_id = ?", userID).Order("created_at").Find(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not get payments of user %s, err : %s", userID, err)
+	}
+	return payments, nil
+}
+
+func (repository *CovoitRepository) GetUnsettledPayments(before time.Time, limit int) ([]Payment, error) {
+	payments, err := gorm.G[Payment](repository.db).
+		Where("(action <> '' OR (status = ? AND settlement <> '')) AND (attempted_at IS NULL OR attempted_at <= ?)", PaymentAuthorized, before).
+		Order("created_at").
+		Limit(limit).
+		Find(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not get unsettled payments, err : %s", err)
+	}
+	return payments, nil
+}
+
+func (repository *CovoitRepository) SavePayment(payment Payment, journals ...Journal) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		_, err := gorm.G[Payment](tx).
+			Where("payment_id = ?", payment.PaymentID).
+			Select("status", "reference", "captured_amount_minor", "captured_amount_currency", "refunded_amount_minor", "refunded_amount_currency",
+				"action", "action_amount_minor", "action_amount_currency", "action_key", "attempted_at", "last_error").
+			Updates(context.Background(), payment)
+		if err != nil {
+			return fmt.Errorf("could not save payment %s, err : %s", payment.PaymentID, err)
+		}
+		if err := recordJournals(tx, journals...); err != nil {
+			return err
+		}
+		return issuePaymentInvoices(tx, journals...)
+	})
+}
+
+func init() {
+	registerPersonalData("payments", []string{"payments"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.payments.GetPaymentsByUser(userID)
+	})
+	registerPeriodicJob("payments.reconcile", PaymentReconcileInterval, func(service *CovoitService, job Job) error {
+		_, err := service.ReconcilePayments()
+		return err
+	})
+}
+
+// nextPaymentAction returns the provider call carrying out the escrow
+// decision of an authorized payment.
+func nextPaymentAction(payment Payment) (string, Money) {
+	if payment.Status != PaymentAuthorized {
+		return "", Money{}
+	}
+	switch payment.Settlement {
+	case PaymentCapture:
+		if payment.SettlementAmount.Minor > 0 {
+			return PaymentCapture, payment.SettlementAmount
+		}
+		return PaymentRelease, Money{}
+	case PaymentRelease:
+		return PaymentRelease, Money{}
+	}
+	return "", Money{}
+}
+
+// callPaymentProvider makes the call in flight of payment, written first so
+// that it is made again should it be interrupted.
+func (service *CovoitService) callPaymentProvider(payment Payment) (Payment, error) {
+	now := service.clock()
+	payment.AttemptedAt = &now
+	if err := service.payments.SavePayment(payment); err != nil {
+		return payment, err
+	}
+	var state ProviderPayment
+	var err error
+	switch payment.Action {
+	case PaymentAuthorize:
+		state, err = service.paymentProvider.Authorize(PaymentRequest{
+			IdempotencyKey: payment.ActionKey,
+			PayerID:        payment.UserID,
+			BookingID:      payment.BookingID,
+			Amount:         payment.Amount,
+		})
+	case PaymentCapture:
+		state, err = service.paymentProvider.Capture(payment.Reference, payment.ActionAmount, payment.ActionKey)
+	case PaymentRelease:
+		state, err = service.paymentProvider.Release(payment.Reference, payment.ActionKey)
+	case PaymentRefund:
+		state, err = service.paymentProvider.Refund(payment.Reference, payment.ActionAmount, payment.ActionKey)
+	default:
+		err = fmt.Errorf("unknown payment action %s", payment.Action)
+	}
+	if err != nil && !errors.Is(err, ErrPaymentDeclined) {
+		payment.LastError = err.Error()
+		if saveErr := service.payments.SavePayment(payment); saveErr != nil {
+			return payment, saveErr
+		}
+		return payment, err
+	}
+	before := payment
+	if err != nil {
+		payment.Status = PaymentFailed
+		payment.LastError = err.Error()
+	} else {
+		applyProviderPayment(&payment, state)
+		payment.LastError = ""
+	}
+	payment.Action, payment.ActionAmount, payment.ActionKey = "", Money{}, ""
+	if saveErr := service.payments.SavePayment(payment, paymentJournals(before, payment, now)...); saveErr != nil {
+		return payment, saveErr
+	}
+	return payment, err
+}
+
+// processPayment makes the call in flight of payment, then the ones its
+// escrow decision leads to. A booking whose payment is declined is cancelled.
+func (service *CovoitService) processPayment(payment Payment) (Payment, error) {
+	for {
+		if payment.Action == "" {
+			action, amount := nextPaymentAction(payment)
+			if action == "" {
+				return payment, nil
+			}
+			payment.Action, payment.ActionAmount, payment.ActionKey = action, amount, uuid.NewString()
+		}
+		var err error
+		payment, err = service.callPaymentProvider(payment)
+		if errors.Is(err, ErrPaymentDeclined) {
+			service.cancelUnpaidBooking(payment)
+			return payment, err
+		} else if err != nil {
+			return payment, err
+		}
+	}
+}
+
+func (service *CovoitService) cancelUnpaidBooking(payment Payment) {
+	booking, err := service.repository.GetBookingById(payment.BookingID)
+	if err != nil {
+		return
+	}
+	if err := service.repository.DeleteBooking(booking.BookingID, booking.UserID, service.clock()); err != nil {
+		log.Printf("could not cancel unpaid booking %s : %s", booking.BookingID, err)
+		return
+	}
+	service.publishAvailability(booking.RideID)
+}
+
+// processBookingPayment settles the payment of the booking as far as the
+// provider lets it, the rest is left to ReconcilePayments.
+func (service *CovoitService) processBookingPayment(bookingID uuid.UUID) error {
+	payment, err := service.payments.GetPaymentByBooking(bookingID)
+	if errors.Is(err, ErrPaymentNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = service.processPayment(payment)
+	return err
+}
+
+// authorizeBooking authorizes the payment of a new booking, it only fails
+// when the provider declines it. A provider out of reach leaves the
+// authorization to ReconcilePayments.
+func (service *CovoitService) authorizeBooking(booking Booking) error {
+	err := service.processBookingPayment(booking.BookingID)
+	if errors.Is(err, ErrPaymentDeclined) {
+		return err
+	} else if err != nil {
+		log.Printf("could not authorize payment of booking %s : %s", booking.BookingID, err)
+	}
+	return nil
+}
+
+// processBookingPayments is processBookingPayment for operations that already
+// succeeded, failures are only logged.
+func (service *CovoitService) processBookingPayments(bookings []Booking) {
+	for _, booking := range bookings {
+		if err := service.processBookingPayment(booking.BookingID); err != nil {
+			log.Printf("could not settle payment of booking %s : %s", booking.BookingID, err)
+		}
+	}
+}
+
+// ReconcilePayments makes again the provider calls interrupted, and carries
+// out the escrow decisions not acted upon yet. It returns how many payments
+// were brought up to date.
+func (service *CovoitService) ReconcilePayments() (int, error) {
+	payments, err := service.payments.GetUnsettledPayments(service.clock().Add(-paymentRetryDelay), paymentBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	reconciled := 0
+	for _, payment := range payments {
+		if _, err := service.processPayment(payment); err != nil && !errors.Is(err, ErrPaymentDeclined) {
+			log.Printf("could not reconcile payment %s : %s", payment.PaymentID, err)
+			continue
+		}
+		reconciled++
+	}
+	return reconciled, nil
+}
+
+// ApplyPaymentWebhook records the state of a payment the provider notified.
+func (service *CovoitService) ApplyPaymentWebhook(header http.Header, body []byte) error {
+	state, err := service.paymentProvider.ParseWebhook(header, body)
+	if err != nil {
+		return err
+	}
+	payment, err := service.payments.GetPaymentByReference(state.Reference)
+	if err != nil {
+		return err
+	}
+	before := payment
+	applyProviderPayment(&payment, state)
+	if err := service.payments.SavePayment(payment, paymentJournals(before, payment, service.clock())...); err != nil {
+		return err
+	}
+	if payment.Action == "" {
+		if _, err := service.processPayment(payment); err != nil {
+			log.Printf("could not settle payment %s : %s", payment.PaymentID, err)
+		}
+	}
+	return nil
+}
+
+func (service *CovoitService) GetPaymentsForUser(userID uuid.UUID) ([]Payment, error) {
+	return service.payments.GetPaymentsByUser(userID)
+}
+
+// RefundPayment gives amount of a captured payment back to the passenger.
+func (service *CovoitService) RefundPayment(paymentID uuid.UUID, amount Money) (Payment, error) {
+	payment, err := service.payments.GetPaymentById(paymentID)
+	if err != nil {
+		return Payment{}, err
+	}
+	if payment.Status != PaymentCaptured || payment.Action != "" {
+		return Payment{}, fmt.Errorf("%w : payment is %s", ErrInvalidRefund, payment.Status)
+	}
+	refundable := payment.CapturedAmount.Sub(payment.RefundedAmount)
+	if amount.Currency != refundable.Currency || amount.Minor <= 0 || amount.Minor > refundable.Minor {
+		return Payment{}, fmt.Errorf("%w : at most %s can be refunded", ErrInvalidRefund, refundable)
+	}
+	payment.Action, payment.ActionAmount, payment.ActionKey = PaymentRefund, amount, uuid.NewString()
+	return service.callPaymentProvider(payment)
+}
+
+// PaymentsHandler lists the payments of the actor.
+func (h *Handler) PaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	payments, err := h.Service.GetPaymentsForUser(actor.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payments)
+}
+
+// PaymentWebhookHandler receives the notifications of the payment provider.
+// An unknown payment is answered with a 404, so that the provider tries again
+// once its authorization is recorded.
+func (h *Handler) PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, paymentWebhookSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = h.Service.ApplyPaymentWebhook(r.Header, body)
+	if errors.Is(err, ErrInvalidPaymentWebhook) {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if errors.Is(err, ErrPaymentNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type RefundRequest struct {
+	PaymentID uuid.UUID `json:"payment_id"`
+	Amount    Money     `json:"amount"`
+}
+
+// RefundHandler lets admins refund a captured payment, in part or in full.
+func (h *Handler) RefundHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionRefundPayment, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	payment, err := h.Service.RefundPayment(request.PaymentID, request.Amount)
+	if errors.Is(err, ErrPaymentNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrInvalidRefund) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
+// FakePaymentSignatureHeader carries the hex encoded HMAC-SHA256 of the
+// timestamp and the body of a notification of FakePaymentProvider.
+const FakePaymentSignatureHeader = "X-Fake-Payments-Signature"
+
+// FakePaymentTimestampHeader carries the Unix time a notification of
+// FakePaymentProvider was signed at.
+const FakePaymentTimestampHeader = "X-Fake-Payments-Timestamp"
+
+// paymentWebhookTolerance is how far the timestamp of a notification may be
+// from now, a notification signed earlier is a replay.
+const paymentWebhookTolerance = 5 * time.Minute
+
+// FakePaymentProvider moves no money, it keeps its payments in memory. It
+// stands in for a real provider in local development and tests.
+type FakePaymentProvider struct {
+	// Secret signs the notifications.
+	Secret string
+	// Decline tells whether to decline an authorization, none is when nil.
+	Decline func(request PaymentRequest) bool
+	// Unavailable fails every call, as an outage of the provider would.
+	Unavailable bool
+	// Now is the clock the notifications are signed and checked with,
+	// time.Now when nil.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	payments map[string]*ProviderPayment
+	// calls maps the idempotency keys used to the payment they acted on.
+	calls map[string]string
+}
+
+// newPaymentProvider returns the provider named by PAYMENT_PROVIDER. The fake
+// one moves no money, it must be asked for explicitly and only serves local
+// development. PAYMENT_WEBHOOK_SECRET signs its notifications and must be
+// set : anyone could sign them with an empty key.
+func newPaymentProvider() (PaymentProvider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "fake":
+		secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+		if secret == "" {
+			return nil, errors.New("PAYMENT_WEBHOOK_SECRET is not set")
+		}
+		return NewFakePaymentProvider(secret), nil
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is not set")
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", name)
+	}
+}
+
+func NewFakePaymentProvider(secret string) *FakePaymentProvider {
+	return &FakePaymentProvider{Secret: secret, payments: map[string]*ProviderPayment{}, calls: map[string]string{}}
+}
+
+// call runs operation on the payment reference once per idempotency key.
+func (p *FakePaymentProvider) call(reference string, idempotencyKey string, operation func(payment *ProviderPayment) error) (ProviderPayment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Unavailable {
+		return ProviderPayment{}, ErrPaymentProviderUnavailable
+	}
+	if done, ok := p.calls[idempotencyKey]; ok {
+		return *p.payments[done], nil
+	}
+	payment, ok := p.payments[reference]
+	if !ok {
+		return ProviderPayment{}, fmt.Errorf("unknown payment %s", reference)
+	}
+	if err := operation(payment); err != nil {
+		return ProviderPayment{}, err
+	}
+	p.calls[idempotencyKey] = reference
+	return *payment, nil
+}
+
+func (p *FakePaymentProvider) Authorize(request PaymentRequest) (ProviderPayment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Unavailable {
+		return ProviderPayment{}, ErrPaymentProviderUnavailable
+	}
+	if reference, ok := p.calls[request.IdempotencyKey]; ok {
+		if p.payments[reference].Status == PaymentFailed {
+			return *p.payments[reference], ErrPaymentDeclined
+		}
+		return *p.payments[reference], nil
+	}
+	payment := &ProviderPayment{Reference: "fake_" + uuid.NewString(), Status: PaymentAuthorized, Authorized: request.Amount}
+	p.payments[payment.Reference] = payment
+	p.calls[request.IdempotencyKey] = payment.Reference
+	if p.Decline != nil && p.Decline(request) {
+		payment.Status, payment.Authorized = PaymentFailed, Money{}
+		return *payment, ErrPaymentDeclined
+	}
+	return *payment, nil
+}
+
+func (p *FakePaymentProvider) Capture(reference string, amount Money, idempotencyKey string) (ProviderPayment, error) {
+	return p.call(reference, idempotencyKey, func(payment *ProviderPayment) error {
+		if payment.Status != PaymentAuthorized || amount.Currency != payment.Authorized.Currency || amount.Minor > payment.Authorized.Minor {
+			return fmt.Errorf("cannot capture %s of %s payment %s", amount, payment.Status, reference)
+		}
+		payment.Status, payment.Captured = PaymentCaptured, amount
+		return nil
+	})
+}
+
+func (p *FakePaymentProvider) Release(reference string, idempotencyKey string) (ProviderPayment, error) {
+	return p.call(reference, idempotencyKey, func(payment *ProviderPayment) error {
+		if payment.Status != PaymentAuthorized {
+			return fmt.Errorf("cannot release %s payment %s", payment.Status, reference)
+		}
+		payment.Status = PaymentReleased
+		return nil
+	})
+}
+
+func (p *FakePaymentProvider) Refund(reference string, amount Money, idempotencyKey string) (ProviderPayment, error) {
+	return p.call(reference, idempotencyKey, func(payment *ProviderPayment) error {
+		if payment.Status != PaymentCaptured || amount.Currency != payment.Captured.Currency || payment.Refunded.Minor+amount.Minor > payment.Captured.Minor {
+			return fmt.Errorf("cannot refund %s of %s payment %s", amount, payment.Status, reference)
+		}
+		payment.Refunded = payment.Refunded.Add(amount)
+		if payment.Refunded == payment.Captured {
+			payment.Status = PaymentRefunded
+		}
+		return nil
+	})
+}
+
+// Payment returns the state of the payment reference.
+func (p *FakePaymentProvider) Payment(reference string) (ProviderPayment, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, ok := p.payments[reference]
+	if !ok {
+		return ProviderPayment{}, false
+	}
+	return *payment, true
+}
+
+// Notification returns the signed notification the provider would send about
+// the payment reference.
+func (p *FakePaymentProvider) Notification(reference string) (http.Header, []byte, error) {
+	payment, ok := p.Payment(reference)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown payment %s", reference)
+	}
+	body, err := json.Marshal(payment)
+	if err != nil {
+		return nil, nil, err
+	}
+	timestamp := strconv.FormatInt(p.now().Unix(), 10)
+	header := http.Header{}
+	header.Set(FakePaymentTimestampHeader, timestamp)
+	header.Set(FakePaymentSignatureHeader, p.sign(timestamp, body))
+	return header, body, nil
+}
+
+func (p *FakePaymentProvider) now() time.Time {
+	if p.Now != nil {
+		return p.Now()
+	}
+	return time.Now()
+}
+
+// sign covers the timestamp along with the body, so that a notification
+// cannot be sent again under a fresh timestamp.
+func (p *FakePaymentProvider) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(p.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *FakePaymentProvider) ParseWebhook(header http.Header, body []byte) (ProviderPayment, error) {
+	if p.Secret == "" {
+		return ProviderPayment{}, fmt.Errorf("%w : no secret to check the signature", ErrInvalidPaymentWebhook)
+	}
+	timestamp := header.Get(FakePaymentTimestampHeader)
+	if !hmac.Equal([]byte(header.Get(FakePaymentSignatureHeader)), []byte(p.sign(timestamp, body))) {
+		return ProviderPayment{}, fmt.Errorf("%w : bad signature", ErrInvalidPaymentWebhook)
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ProviderPayment{}, fmt.Errorf("%w : bad timestamp", ErrInvalidPaymentWebhook)
+	}
+	if age := p.now().Sub(time.Unix(signedAt, 0)); age > paymentWebhookTolerance || age < -paymentWebhookTolerance {
+		return ProviderPayment{}, fmt.Errorf("%w : stale timestamp", ErrInvalidPaymentWebhook)
+	}
+	var payment ProviderPayment
+	if err := json.Unmarshal(body, &payment); err != nil || payment.Reference == "" {
+		return ProviderPayment{}, fmt.Errorf("%w : bad payload", ErrInvalidPaymentWebhook)
+	}
+	return payment, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) createPayment(booking Booking, driverID uuid.UUID) {
+	if !booking.TotalPrice.IsZero() {
+		m.DB.Payments = append(m.DB.Payments, newPayment(booking, driverID))
+	}
+}
+
+func (m *MockRepository) settle(settlement string, percent int64, bookingIDs ...uuid.UUID) {
+	for i, payment := range m.DB.Payments {
+		if payment.Settlement == "" && slices.Contains(bookingIDs, payment.BookingID) {
+			m.DB.Payments[i].Settlement, m.DB.Payments[i].SettlementAmount = settlement, payment.Amount.Percent(percent)
+		}
+	}
+}
+
+func (m *MockRepository) getPayment(match func(payment Payment) bool) (Payment, error) {
+	i := slices.IndexFunc(m.DB.Payments, match)
+	if i < 0 {
+		return Payment{}, ErrPaymentNotFound
+	}
+	return m.DB.Payments[i], nil
+}
+
+func (m *MockRepository) GetPaymentById(paymentID uuid.UUID) (Payment, error) {
+	return m.getPayment(func(payment Payment) bool { return payment.PaymentID == paymentID })
+}
+
+func (m *MockRepository) GetPaymentByBooking(bookingID uuid.UUID) (Payment, error) {
+	return m.getPayment(func(payment Payment) bool { return payment.BookingID == bookingID })
+}
+
+func (m *MockRepository) GetPaymentByReference(reference string) (Payment, error) {
+	return m.getPayment(func(payment Payment) bool { return payment.Reference != "" && payment.Reference == reference })
+}
+
+func (m *MockRepository) GetPaymentsByUser(userID uuid.UUID) ([]Payment, error) {
+	payments := []Payment{}
+	for _, payment := range m.DB.Payments {
+		if payment.UserID == userID {
+			payments = append(payments, payment)
+		}
+	}
+	return payments, nil
+}
+
+func (m *MockRepository) GetUnsettledPayments(before time.Time, limit int) ([]Payment, error) {
+	payments := []Payment{}
+	for _, payment := range m.DB.Payments {
+		if len(payments) == limit {
+			break
+		}
+		unsettled := payment.Action != "" || (payment.Status == PaymentAuthorized && payment.Settlement != "")
+		if unsettled && (payment.AttemptedAt == nil || !payment.AttemptedAt.After(before)) {
+			payments = append(payments, payment)
+		}
+	}
+	return payments, nil
+}
+
+func (m *MockRepository) SavePayment(payment Payment, journals ...Journal) error {
+	i := slices.IndexFunc(m.DB.Payments, func(p Payment) bool { return p.PaymentID == payment.PaymentID })
+	if i < 0 {
+		return ErrPaymentNotFound
+	}
+	m.DB.Payments[i] = payment
+	if err := m.record(journals...); err != nil {
+		return err
+	}
+	return m.issuePaymentInvoices(journals...)
+}
+
+type paymentFixture struct {
+	db          *MockDB
+	service     *CovoitService
+	provider    *FakePaymentProvider
+	now         *time.Time
+	ride        Ride
+	driverID    uuid.UUID
+	passengerID uuid.UUID
+}
+
+func newPaymentFixture(t *testing.T) *paymentFixture {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	f := &paymentFixture{
+		db:          CreateNewMockDB(t),
+		provider:    NewFakePaymentProvider("secret"),
+		now:         &now,
+		driverID:    StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7"),
+		passengerID: StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2"),
+	}
+	f.service = NewMockService(f.db)
+	f.service.paymentProvider = f.provider
+	f.service.now = func() time.Time { return *f.now }
+	f.ride = Ride{RideID: uuid.New(), DriverID: f.driverID, Origin: "Lyon", Destination: "Paris", DepartureTime: now.Add(48 * time.Hour), Price: eur(2500), NumberOfSeats: 3, Status: RideScheduled}
+	f.db.Rides = append(f.db.Rides, f.ride)
+	return f
+}
+
+func (f *paymentFixture) book(t *testing.T, status string) (Booking, error) {
+	t.Helper()
+	booking, err := f.service.CreateBooking(Booking{BookingID: uuid.New(), RideID: f.ride.RideID, UserID: f.passengerID, NumberOfSeats: 2})
+	if err != nil || status == BookingPending {
+		return booking, err
+	}
+	return f.service.ApproveBooking(booking.BookingID)
+}
+
+func (f *paymentFixture) payment(t *testing.T, bookingID uuid.UUID) Payment {
+	t.Helper()
+	payment, err := f.service.payments.GetPaymentByBooking(bookingID)
+	require.NoError(t, err)
+	return payment
+}
+
+func TestPaymentEscrow(t *testing.T) {
+	f := newPaymentFixture(t)
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	payment := f.payment(t, booking.BookingID)
+	require.Equal(t, PaymentAuthorized, payment.Status)
+	require.Equal(t, eur(5000), payment.Amount)
+	held, ok := f.provider.Payment(payment.Reference)
+	require.True(t, ok)
+	require.Equal(t, eur(5000), held.Authorized)
+
+	freeRide := Ride{RideID: uuid.New(), DriverID: f.driverID, DepartureTime: f.ride.DepartureTime, NumberOfSeats: 3, Status: RideScheduled}
+	f.db.Rides = append(f.db.Rides, freeRide)
+	free, err := f.service.CreateBooking(Booking{BookingID: uuid.New(), RideID: freeRide.RideID, UserID: f.passengerID, NumberOfSeats: 1, TotalPrice: eur(2500)})
+	require.NoError(t, err)
+	require.True(t, free.TotalPrice.IsZero(), "the price is the ride's")
+	_, err = f.service.payments.GetPaymentByBooking(free.BookingID)
+	require.ErrorIs(t, err, ErrPaymentNotFound, "a free booking has no payment")
+
+	*f.now = f.ride.DepartureTime.Add(time.Hour)
+	require.NoError(t, f.service.CompleteRide(f.ride.RideID, nil))
+	payment = f.payment(t, booking.BookingID)
+	require.Equal(t, PaymentCaptured, payment.Status)
+	require.Equal(t, eur(5000), payment.CapturedAmount)
+	require.Empty(t, payment.Action)
+}
+
+func TestBookingPrice(t *testing.T) {
+	f := newPaymentFixture(t)
+	booking, err := f.service.CreateBooking(Booking{BookingID: uuid.New(), RideID: f.ride.RideID, UserID: f.passengerID, NumberOfSeats: 3, TotalPrice: NewMoney(1, "USD")})
+	require.NoError(t, err)
+	require.Equal(t, eur(7500), booking.TotalPrice, "the seats are paid the ride's price")
+	require.Equal(t, eur(7500), f.payment(t, booking.BookingID).Amount)
+
+	for _, seats := range []int{0, -2} {
+		_, err = f.service.CreateBooking(Booking{BookingID: uuid.New(), RideID: f.ride.RideID, UserID: f.passengerID, NumberOfSeats: seats})
+		require.ErrorIs(t, err, ErrInvalidBooking)
+	}
+}
+
+func TestPaymentCancellation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		status   string
+		before   time.Duration
+		byDriver bool
+		ride     bool
+		want     string
+		captured Money
+	}{
+		{"passenger ahead", BookingConfirmed, 48 * time.Hour, false, false, PaymentReleased, Money{}},
+		{"passenger late", BookingConfirmed, 2 * time.Hour, false, false, PaymentCaptured, eur(2500)},
+		{"driver late", BookingConfirmed, 2 * time.Hour, true, false, PaymentReleased, Money{}},
+		{"request late", BookingPending, 2 * time.Hour, false, false, PaymentReleased, Money{}},
+		{"ride cancelled", BookingConfirmed, 2 * time.Hour, true, true, PaymentReleased, Money{}},
+	} {
+		f := newPaymentFixture(t)
+		booking, err := f.book(t, tc.status)
+		require.NoError(t, err, tc.name)
+		*f.now = f.ride.DepartureTime.Add(-tc.before)
+		actorID := f.passengerID
+		if tc.byDriver {
+			actorID = f.driverID
+		}
+		if tc.ride {
+			require.NoError(t, f.service.DeleteRide(f.ride.RideID, actorID), tc.name)
+		} else {
+			require.NoError(t, f.service.DeleteBooking(booking.BookingID, actorID), tc.name)
+		}
+		payment := f.payment(t, booking.BookingID)
+		require.Equal(t, tc.want, payment.Status, tc.name)
+		require.Equal(t, tc.captured, payment.CapturedAmount, tc.name)
+	}
+}
+
+func TestPaymentDeclined(t *testing.T) {
+	f := newPaymentFixture(t)
+	f.provider.Decline = func(request PaymentRequest) bool { return request.Amount.Minor > 4000 }
+	_, err := f.book(t, BookingConfirmed)
+	require.ErrorIs(t, err, ErrPaymentDeclined)
+	require.Len(t, f.db.DeletedBookings, 1, "the unpaid booking is cancelled")
+	require.Equal(t, PaymentFailed, f.payment(t, f.db.DeletedBookings[0].BookingID).Status)
+}
+
+func TestPaymentReconciliation(t *testing.T) {
+	f := newPaymentFixture(t)
+	f.provider.Unavailable = true
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err, "the authorization is left for later")
+	payment := f.payment(t, booking.BookingID)
+	require.Equal(t, PaymentPending, payment.Status)
+	require.Equal(t, PaymentAuthorize, payment.Action)
+	require.NotEmpty(t, payment.LastError)
+
+	// The provider authorized the payment but the answer was lost.
+	f.provider.Unavailable = false
+	authorized, err := f.provider.Authorize(PaymentRequest{IdempotencyKey: payment.ActionKey, Amount: payment.Amount})
+	require.NoError(t, err)
+	reconciled, err := f.service.ReconcilePayments()
+	require.NoError(t, err)
+	require.Zero(t, reconciled, "a call is left time to complete")
+	*f.now = f.now.Add(paymentRetryDelay)
+	reconciled, err = f.service.ReconcilePayments()
+	require.NoError(t, err)
+	require.Equal(t, 1, reconciled)
+	payment = f.payment(t, booking.BookingID)
+	require.Equal(t, PaymentAuthorized, payment.Status)
+	require.Equal(t, authorized.Reference, payment.Reference, "the authorization is not made twice")
+
+	f.provider.Unavailable = true
+	require.NoError(t, f.service.DeleteBooking(booking.BookingID, f.passengerID))
+	require.Equal(t, PaymentRelease, f.payment(t, booking.BookingID).Action)
+	f.provider.Unavailable = false
+	*f.now = f.now.Add(paymentRetryDelay)
+	_, err = f.service.ReconcilePayments()
+	require.NoError(t, err)
+	payment = f.payment(t, booking.BookingID)
+	require.Equal(t, PaymentReleased, payment.Status)
+	require.Empty(t, payment.Action)
+	reconciled, err = f.service.ReconcilePayments()
+	require.NoError(t, err)
+	require.Zero(t, reconciled)
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	f := newPaymentFixture(t)
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	payment := f.payment(t, booking.BookingID)
+	staleHeader, staleBody, err := f.provider.Notification(payment.Reference)
+	require.NoError(t, err)
+
+	_, err = f.provider.Capture(payment.Reference, eur(5000), "captured from the dashboard")
+	require.NoError(t, err)
+	header, body, err := f.provider.Notification(payment.Reference)
+	require.NoError(t, err)
+	require.NoError(t, f.service.ApplyPaymentWebhook(header, body))
+	require.NoError(t, f.service.ApplyPaymentWebhook(header, body), "a notification may be delivered twice")
+	require.NoError(t, f.service.ApplyPaymentWebhook(staleHeader, staleBody))
+	payment = f.payment(t, booking.BookingID)
+	require.Equal(t, PaymentCaptured, payment.Status, "a notification delivered late is ignored")
+	require.Equal(t, eur(5000), payment.CapturedAmount)
+
+	body = bytes.Replace(body, []byte("50"), []byte("5"), 1)
+	require.ErrorIs(t, f.service.ApplyPaymentWebhook(header, body), ErrInvalidPaymentWebhook)
+
+	unsigned := NewFakePaymentProvider("")
+	header.Set(FakePaymentSignatureHeader, unsigned.sign(header.Get(FakePaymentTimestampHeader), body))
+	_, err = unsigned.ParseWebhook(header, body)
+	require.ErrorIs(t, err, ErrInvalidPaymentWebhook, "an empty secret signs nothing")
+}
+
+func TestPaymentWebhookReplay(t *testing.T) {
+	f := newPaymentFixture(t)
+	f.provider.Now = func() time.Time { return *f.now }
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	payment := f.payment(t, booking.BookingID)
+	header, body, err := f.provider.Notification(payment.Reference)
+	require.NoError(t, err)
+	require.NoError(t, f.service.ApplyPaymentWebhook(header, body))
+
+	*f.now = f.now.Add(paymentWebhookTolerance + time.Second)
+	require.ErrorIs(t, f.service.ApplyPaymentWebhook(header, body), ErrInvalidPaymentWebhook, "a notification signed long ago is a replay")
+
+	replayed := header.Clone()
+	replayed.Set(FakePaymentTimestampHeader, strconv.FormatInt(f.now.Unix(), 10))
+	require.ErrorIs(t, f.service.ApplyPaymentWebhook(replayed, body), ErrInvalidPaymentWebhook, "the timestamp is signed")
+
+	replayed.Del(FakePaymentTimestampHeader)
+	require.ErrorIs(t, f.service.ApplyPaymentWebhook(replayed, body), ErrInvalidPaymentWebhook)
+}
+
+func TestRefundPayment(t *testing.T) {
+	f := newPaymentFixture(t)
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	payment := f.payment(t, booking.BookingID)
+	_, err = f.service.RefundPayment(payment.PaymentID, eur(1000))
+	require.ErrorIs(t, err, ErrInvalidRefund, "nothing is captured yet")
+
+	*f.now = f.ride.DepartureTime
+	require.NoError(t, f.service.CompleteRide(f.ride.RideID, nil))
+	payment, err = f.service.RefundPayment(payment.PaymentID, eur(2000))
+	require.NoError(t, err)
+	require.Equal(t, PaymentCaptured, payment.Status)
+	require.Equal(t, eur(2000), payment.RefundedAmount)
+	_, err = f.service.RefundPayment(payment.PaymentID, eur(4000))
+	require.ErrorIs(t, err, ErrInvalidRefund)
+	payment, err = f.service.RefundPayment(payment.PaymentID, eur(3000))
+	require.NoError(t, err)
+	require.Equal(t, PaymentRefunded, payment.Status)
+}
+
+func TestPaymentHandlers(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("ApplyPaymentWebhook", mock.Anything, []byte("forged")).Return(ErrInvalidPaymentWebhook)
+	mockSvc.On("ApplyPaymentWebhook", mock.Anything, []byte("early")).Return(ErrPaymentNotFound)
+	mockSvc.On("ApplyPaymentWebhook", mock.Anything, []byte("ok")).Return(nil)
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{"forged", http.StatusBadRequest},
+		{"early", http.StatusNotFound},
+		{"ok", http.StatusNoContent},
+	} {
+		w := httptest.NewRecorder()
+		h.PaymentWebhookHandler(w, httptest.NewRequest(http.MethodPost, "/payments/webhook", bytes.NewBufferString(tc.body)))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.body)
+	}
+
+	paymentID := uuid.New()
+	mockSvc.On("RefundPayment", paymentID, eur(6000)).Return(Payment{}, ErrInvalidRefund)
+	mockSvc.On("RefundPayment", paymentID, eur(1000)).Return(Payment{PaymentID: paymentID, RefundedAmount: eur(1000)}, nil)
+	for _, tc := range []struct {
+		name   string
+		actor  Actor
+		body   string
+		status int
+	}{
+		{"as a passenger", Actor{UserID: uuid.New(), Role: RolePassenger}, `{"payment_id":"` + paymentID.String() + `","amount":10}`, http.StatusForbidden},
+		{"too much", admin, `{"payment_id":"` + paymentID.String() + `","amount":{"amount":"60.00","currency":"EUR"}}`, http.StatusConflict},
+		{"refunded", admin, `{"payment_id":"` + paymentID.String() + `","amount":{"amount":"10.00","currency":"EUR"}}`, http.StatusOK},
+		{"bare amount", admin, `{"payment_id":"` + paymentID.String() + `","amount":10}`, http.StatusOK},
+		{"sub cent", admin, `{"payment_id":"` + paymentID.String() + `","amount":"10.001"}`, http.StatusBadRequest},
+		{"bad body", admin, `{`, http.StatusBadRequest},
+	} {
+		req := asActor(httptest.NewRequest(http.MethodPost, "/admin/payments/refund", bytes.NewBufferString(tc.body)), tc.actor)
+		w := httptest.NewRecorder()
+		h.RefundHandler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
@@ -0,0 +1,894 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A payout is pending in its batch until the batch is exported for the bank,
+// sent then, and paid or failed once the bank says so.
+const (
+	PayoutPending = "pending"
+	PayoutSent    = "sent"
+	PayoutPaid    = "paid"
+	PayoutFailed  = "failed"
+)
+
+const (
+	// DefaultPayoutHoldingPeriod is how long the earnings of a ride stay in
+	// the wallet before they are paid out, so that a dispute can still be
+	// refunded from them.
+	DefaultPayoutHoldingPeriod = 7 * 24 * time.Hour
+	// defaultPayoutMinimum is the smallest payout, in minor units, smaller
+	// balances wait for the next batch.
+	defaultPayoutMinimum = 1000
+	// PayoutInterval is how often the eligible earnings are batched.
+	PayoutInterval = 24 * time.Hour
+)
+
+// payoutTransitions are the statuses a payout may move to from each status.
+// A paid payout may still fail, when the bank returns the transfer.
+var payoutTransitions = map[string][]string{
+	PayoutPending: {PayoutSent, PayoutFailed},
+	PayoutSent:    {PayoutPaid, PayoutFailed},
+	PayoutPaid:    {PayoutFailed},
+}
+
+var (
+	ibanPattern     = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+	bicPattern      = regexp.MustCompile(`^[A-Z]{6}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+	sepaUnsupported = regexp.MustCompile(`[^A-Za-z0-9/?:().,'+ -]`)
+	// sepaLatin strips the accents the SEPA character set lacks.
+	sepaLatin = transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+)
+
+var (
+	ErrPayoutNotFound        = errors.New("payout not found")
+	ErrPayoutBatchNotFound   = errors.New("payout batch not found")
+	ErrPayoutAccountNotFound = errors.New("payout account not found")
+	ErrInvalidPayoutAccount  = errors.New("invalid payout account")
+	ErrInvalidPayoutStatus   = errors.New("invalid payout status")
+	// ErrPayoutTransition is a payout asked to move to a status it cannot
+	// reach from its own.
+	ErrPayoutTransition      = errors.New("payout cannot move to that status")
+	ErrPayoutsNotConfigured  = errors.New("the account payouts are made from is not configured")
+	ErrInvalidPayoutSettings = errors.New("invalid payout settings")
+)
+
+// PayoutAccount is the bank account the earnings of a user are paid out to.
+type PayoutAccount struct {
+	UserID     uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	HolderName string    `json:"holder_name"`
+	IBAN       string    `gorm:"column:iban" json:"iban"`
+	// BIC is optional, SEPA banks find the bank from the IBAN.
+	BIC       string    `gorm:"column:bic" json:"bic,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PayoutBatch groups the payouts made together, exported as one credit
+// transfer file.
+type PayoutBatch struct {
+	BatchID uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"batch_id"`
+	Count   int       `json:"count"`
+	Total   Money     `gorm:"embedded;embeddedPrefix:total_" json:"total"`
+	// ExportedAt is when the file was first exported for the bank.
+	ExportedAt *time.Time `json:"exported_at,omitempty"`
+	CreatedAt  time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// Payout pays Amount out of the wallet of a user. The bank account is copied
+// from the payout account of the user when the payout is made.
+type Payout struct {
+	PayoutID      uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"payout_id"`
+	BatchID       uuid.UUID `gorm:"type:uuid;index" json:"batch_id"`
+	UserID        uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	Amount        Money     `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	HolderName    string    `json:"holder_name"`
+	IBAN          string    `gorm:"column:iban" json:"iban"`
+	BIC           string    `gorm:"column:bic" json:"bic,omitempty"`
+	Status        string    `gorm:"default:pending" json:"status"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	CreatedAt     time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// PayoutBalance is what the wallet of a user holds, and the part of it
+// earned before the holding period.
+type PayoutBalance struct {
+	UserID   uuid.UUID
+	Eligible Money
+	Balance  Money
+}
+
+// PayoutSettings tell which earnings are paid out, and from which account.
+type PayoutSettings struct {
+	HoldingPeriod time.Duration
+	Minimum       Money
+	// Debtor is the account of the platform the transfers are made from.
+	Debtor PayoutAccount
+}
+
+// payoutSettingsFromEnv reads PAYOUT_HOLDING_DAYS, PAYOUT_MINIMUM, such as
+// "10.00", and the account of the platform from PAYOUT_DEBTOR_NAME,
+// PAYOUT_DEBTOR_IBAN and PAYOUT_DEBTOR_BIC. Without the account the payouts
+// are batched but cannot be exported.
+func payoutSettingsFromEnv() (*PayoutSettings, error) {
+	settings := &PayoutSettings{HoldingPeriod: DefaultPayoutHoldingPeriod, Minimum: NewMoney(defaultPayoutMinimum, PaymentCurrency)}
+	if days := os.Getenv("PAYOUT_HOLDING_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w : bad PAYOUT_HOLDING_DAYS %q", ErrInvalidPayoutSettings, days)
+		}
+		settings.HoldingPeriod = time.Duration(n) * 24 * time.Hour
+	}
+	if minimum := os.Getenv("PAYOUT_MINIMUM"); minimum != "" {
+		var err error
+		if settings.Minimum, err = ParseMoney(minimum, PaymentCurrency); err != nil || settings.Minimum.Minor <= 0 {
+			return nil, fmt.Errorf("%w : bad PAYOUT_MINIMUM %q", ErrInvalidPayoutSettings, minimum)
+		}
+	}
+	settings.Debtor = normalizePayoutAccount(PayoutAccount{
+		HolderName: os.Getenv("PAYOUT_DEBTOR_NAME"),
+		IBAN:       os.Getenv("PAYOUT_DEBTOR_IBAN"),
+		BIC:        os.Getenv("PAYOUT_DEBTOR_BIC"),
+	})
+	if settings.Debtor.IBAN != "" {
+		if err := validatePayoutAccount(settings.Debtor); err != nil {
+			return nil, fmt.Errorf("%w : PAYOUT_DEBTOR_* : %s", ErrInvalidPayoutSettings, err)
+		}
+	}
+	return settings, nil
+}
+
+func normalizePayoutAccount(account PayoutAccount) PayoutAccount {
+	account.HolderName = strings.TrimSpace(account.HolderName)
+	account.IBAN = strings.ToUpper(strings.ReplaceAll(account.IBAN, " ", ""))
+	account.BIC = strings.ToUpper(strings.TrimSpace(account.BIC))
+	return account
+}
+
+// validIBAN checks the format of iban and its check digits.
+func validIBAN(iban string) bool {
+	if !ibanPattern.MatchString(iban) {
+		return false
+	}
+	remainder := 0
+	for _, c := range iban[4:] + iban[:4] {
+		if c >= 'A' && c <= 'Z' {
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		} else {
+			remainder = (remainder*10 + int(c-'0')) % 97
+		}
+	}
+	return remainder == 1
+}
+
+func validatePayoutAccount(account PayoutAccount) error {
+	if sepaText(account.HolderName, 70) == "" {
+		return fmt.Errorf("%w : the holder name is required", ErrInvalidPayoutAccount)
+	}
+	if !validIBAN(account.IBAN) {
+		return fmt.Errorf("%w : %q is not a valid IBAN", ErrInvalidPayoutAccount, account.IBAN)
+	}
+	if account.BIC != "" && !bicPattern.MatchString(account.BIC) {
+		return fmt.Errorf("%w : %q is not a valid BIC", ErrInvalidPayoutAccount, account.BIC)
+	}
+	return nil
+}
+
+// payoutBatch returns the payouts of the users with an account whose
+// eligible earnings reach minimum. A refund since may have taken the balance
+// below the eligible earnings, only the balance is paid out then.
+func payoutBatch(accounts []PayoutAccount, balances []PayoutBalance, minimum Money, at time.Time) (PayoutBatch, []Payout) {
+	batch := PayoutBatch{BatchID: uuid.New(), Total: NewMoney(0, minimum.Currency), CreatedAt: at}
+	payouts := []Payout{}
+	for _, balance := range balances {
+		i := slices.IndexFunc(accounts, func(account PayoutAccount) bool { return account.UserID == balance.UserID })
+		if i < 0 || balance.Eligible.Currency != minimum.Currency {
+			continue
+		}
+		amount := balance.Eligible
+		if balance.Balance.Minor < amount.Minor {
+			amount = balance.Balance
+		}
+		if amount.Minor < minimum.Minor {
+			continue
+		}
+		payouts = append(payouts, Payout{
+			PayoutID:   uuid.New(),
+			BatchID:    batch.BatchID,
+			UserID:     balance.UserID,
+			Amount:     amount,
+			HolderName: accounts[i].HolderName,
+			IBAN:       accounts[i].IBAN,
+			BIC:        accounts[i].BIC,
+			Status:     PayoutPending,
+			CreatedAt:  at,
+			UpdatedAt:  at,
+		})
+		batch.Total = batch.Total.Add(amount)
+	}
+	batch.Count = len(payouts)
+	return batch, payouts
+}
+
+func payoutJournals(payouts []Payout) []Journal {
+	journals := make([]Journal, len(payouts))
+	for i, payout := range payouts {
+		journals[i] = payoutJournal(payout.UserID, payout.Amount, payout.PayoutID, payout.CreatedAt)
+	}
+	return journals
+}
+
+func checkPayoutTransition(payout Payout, status string) error {
+	if !slices.Contains(payoutTransitions[payout.Status], status) {
+		return fmt.Errorf("%w : %s payout %s cannot become %s", ErrPayoutTransition, payout.Status, payout.PayoutID, status)
+	}
+	return nil
+}
+
+// payoutBalances returns the wallet balances in currency, what was earned
+// before eligibleBefore less what was paid out being eligible.
+func payoutBalances(tx *gorm.DB, eligibleBefore time.Time, currency string) ([]PayoutBalance, error) {
+	rows := []struct {
+		UserID   uuid.UUID
+		Eligible int64
+		Balance  int64
+	}{}
+	err := tx.Model(&Posting{}).
+		Select("user_id, -SUM(CASE WHEN kind = ? OR created_at < ? THEN amount_minor ELSE 0 END) AS eligible, -SUM(amount_minor) AS balance", PostingPayout, eligibleBefore).
+		Where("account = ? AND user_id IS NOT NULL AND amount_currency = ?", AccountWallet, currency).
+		Group("user_id").
+		Order("user_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("could not get wallet balances, err : %s", err)
+	}
+	balances := make([]PayoutBalance, len(rows))
+	for i, row := range rows {
+		balances[i] = PayoutBalance{UserID: row.UserID, Eligible: NewMoney(row.Eligible, currency), Balance: NewMoney(row.Balance, currency)}
+	}
+	return balances, nil
+}
+
+type PayoutRepository interface {
+	GetPayoutAccount(userID uuid.UUID) (PayoutAccount, error)
+	SavePayoutAccount(account PayoutAccount) (PayoutAccount, error)
+	// CreatePayoutBatch pays out the earnings recorded before eligibleBefore
+	// that reach minimum, debiting the wallets in the same transaction. A
+	// batch without payouts is not created.
+	CreatePayoutBatch(eligibleBefore time.Time, minimum Money, at time.Time) (PayoutBatch, []Payout, error)
+	// GetPayoutBatches returns the batches, the latest first.
+	GetPayoutBatches() ([]PayoutBatch, error)
+	GetPayoutsByBatch(batchID uuid.UUID) ([]Payout, error)
+	// GetPayoutsByUser returns the payouts of the user, the latest first.
+	GetPayoutsByUser(userID uuid.UUID) ([]Payout, error)
+	// SendPayoutBatch records the export of the batch at at, its pending
+	// payouts are sent, and returns it with its payouts.
+	SendPayoutBatch(batchID uuid.UUID, at time.Time) (PayoutBatch, []Payout, error)
+	// UpdatePayoutStatus moves the payout to status, a failed payout is
+	// credited back to the wallet.
+	UpdatePayoutStatus(payoutID uuid.UUID, status string, reason string, at time.Time) (Payout, error)
+}
+
+func (repository *CovoitRepository) GetPayoutAccount(userID uuid.UUID) (PayoutAccount, error) {
+	account, err := gorm.G[PayoutAccount](repository.db).Where("user_id = ?", userID).First(context.Background())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return PayoutAccount{}, ErrPayoutAccountNotFound
+	} else if err != nil {
+		return PayoutAccount{}, fmt.Errorf("could not get payout account of user %s, err : %s", userID, err)
+	}
+	return account, nil
+}
+
+func (repository *CovoitRepository) SavePayoutAccount(account PayoutAccount) (PayoutAccount, error) {
+	err := gorm.G[PayoutAccount](repository.db, clause.OnConflict{UpdateAll: true}).Create(context.Background(), &account)
+	if err != nil {
+		return PayoutAccount{}, fmt.Errorf("could not save payout account of user %s, err : %s", account.UserID, err)
+	}
+	return account, nil
+}
+
+func (repository *CovoitRepository) CreatePayoutBatch(eligibleBefore time.Time, minimum Money, at time.Time) (PayoutBatch, []Payout, error) {
+	batch, payouts := PayoutBatch{}, []Payout{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		// The accounts stay locked until the wallets are debited, so that
+		// concurrent batches pay each balance once.
+		accounts, err := gorm.G[PayoutAccount](tx, clause.Locking{Strength: "UPDATE"}).Order("user_id").Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get payout accounts, err : %s", err)
+		}
+		balances, err := payoutBalances(tx, eligibleBefore, minimum.Currency)
+		if err != nil {
+			return err
+		}
+		batch, payouts = payoutBatch(accounts, balances, minimum, at)
+		if len(payouts) == 0 {
+			return nil
+		}
+		if err := gorm.G[PayoutBatch](tx).Create(ctx, &batch); err != nil {
+			return fmt.Errorf("could not create payout batch, err : %s", err)
+		}
+		if err := gorm.G[Payout](tx).CreateInBatches(ctx, &payouts, len(payouts)); err != nil {
+			return fmt.Errorf("could not create payouts of batch %s, err : %s", batch.BatchID, err)
+		}
+		return recordJournals(tx, payoutJournals(payouts)...)
+	})
+	if err != nil {
+		return PayoutBatch{}, nil, err
+	}
+	return batch, payouts, nil
+}
+
+func (repository *CovoitRepository) GetPayoutBatches() ([]PayoutBatch, error) {
+	batches, err := gorm.G[PayoutBatch](repository.db).Order("created_at DESC").Find(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not get payout batches, err : %s", err)
+	}
+	return batches, nil
+}
+
+func (repository *CovoitRepository) GetPayoutsByBatch(batchID uuid.UUID) ([]Payout, error) {
+	payouts, err := gorm.G[Payout](repository.db).Where("batch_id = ?", batchID).Order("user_id").Find(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not get payouts of batch %s, err : %s", batchID, err)
+	}
+	return payouts, nil
+}
+
+func (repository *CovoitRepository) GetPayoutsByUser(userID uuid.UUID) ([]Payout, error) {
+	payouts, err := gorm.G[Payout](repository.db).Where("user_id = ?", userID).Order("created_at DESC").Find(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not get payouts of user %s, err : %s", userID, err)
+	}
+	return payouts, nil
+}
+
+func (repository *CovoitRepository) SendPayoutBatch(batchID uuid.UUID, at time.Time) (PayoutBatch, []Payout, error) {
+	batch, payouts := PayoutBatch{}, []Payout{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		batch, err = gorm.G[PayoutBatch](tx, clause.Locking{Strength: "UPDATE"}).Where("batch_id = ?", batchID).First(ctx)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPayoutBatchNotFound
+		} else if err != nil {
+			return fmt.Errorf("could not get payout batch %s, err : %s", batchID, err)
+		}
+		if batch.ExportedAt == nil {
+			batch.ExportedAt = &at
+			if _, err := gorm.G[PayoutBatch](tx).Where("batch_id = ?", batchID).Update(ctx, "exported_at", at); err != nil {
+				return fmt.Errorf("could not export payout batch %s, err : %s", batchID, err)
+			}
+		}
+		_, err = gorm.G[Payout](tx).
+			Where("batch_id = ? AND status = ?", batchID, PayoutPending).
+			Updates(ctx, Payout{Status: PayoutSent, UpdatedAt: at})
+		if err != nil {
+			return fmt.Errorf("could not send payouts of batch %s, err : %s", batchID, err)
+		}
+		payouts, err = gorm.G[Payout](tx).Where("batch_id = ?", batchID).Order("user_id").Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get payouts of batch %s, err : %s", batchID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return PayoutBatch{}, nil, err
+	}
+	return batch, payouts, nil
+}
+
+func (repository *CovoitRepository) UpdatePayoutStatus(payoutID uuid.UUID, status string, reason string, at time.Time) (Payout, error) {
+	payout := Payout{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		payout, err = gorm.G[Payout](tx, clause.Locking{Strength: "UPDATE"}).Where("payout_id = ?", payoutID).First(ctx)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPayoutNotFound
+		} else if err != nil {
+			return fmt.Errorf("could not get payout %s, err : %s", payoutID, err)
+		}
+		if err := checkPayoutTransition(payout, status); err != nil {
+			return err
+		}
+		payout.Status, payout.FailureReason, payout.UpdatedAt = status, reason, at
+		_, err = gorm.G[Payout](tx).
+			Where("payout_id = ?", payoutID).
+			Select("status", "failure_reason", "updated_at").
+			Updates(ctx, payout)
+		if err != nil {
+			return fmt.Errorf("could not update payout %s, err : %s", payoutID, err)
+		}
+		if status == PayoutFailed {
+			return recordJournals(tx, payoutFailureJournal(payout.UserID, payout.Amount, payout.PayoutID, at))
+		}
+		return nil
+	})
+	if err != nil {
+		return Payout{}, err
+	}
+	return payout, nil
+}
+
+// payoutData is the export of the payouts of a user.
+type payoutData struct {
+	Account *PayoutAccount `json:"account"`
+	Payouts []Payout       `json:"payouts"`
+}
+
+func init() {
+	registerPersonalData("payouts", []string{"payout_accounts", "payouts"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		data := payoutData{}
+		account, err := service.payouts.GetPayoutAccount(userID)
+		if err == nil {
+			data.Account = &account
+		} else if !errors.Is(err, ErrPayoutAccountNotFound) {
+			return nil, err
+		}
+		data.Payouts, err = service.payouts.GetPayoutsByUser(userID)
+		return data, err
+	})
+	registerImpersonalTables("payout_batches")
+	registerPeriodicJob("payouts.batch", PayoutInterval, func(service *CovoitService, job Job) error {
+		_, err := service.BatchPayouts()
+		return err
+	})
+}
+
+func (service *CovoitService) GetPayoutAccount(userID uuid.UUID) (PayoutAccount, error) {
+	return service.payouts.GetPayoutAccount(userID)
+}
+
+func (service *CovoitService) SavePayoutAccount(account PayoutAccount) (PayoutAccount, error) {
+	account = normalizePayoutAccount(account)
+	if err := validatePayoutAccount(account); err != nil {
+		return PayoutAccount{}, err
+	}
+	account.UpdatedAt = service.clock()
+	return service.payouts.SavePayoutAccount(account)
+}
+
+func (service *CovoitService) GetPayoutsForUser(userID uuid.UUID) ([]Payout, error) {
+	return service.payouts.GetPayoutsByUser(userID)
+}
+
+func (service *CovoitService) GetPayoutBatches() ([]PayoutBatch, error) {
+	return service.payouts.GetPayoutBatches()
+}
+
+func (service *CovoitService) GetPayoutsByBatch(batchID uuid.UUID) ([]Payout, error) {
+	return service.payouts.GetPayoutsByBatch(batchID)
+}
+
+// BatchPayouts pays out the earnings past the holding period to the users
+// with a payout account. The batch returned has no payouts when nobody was
+// due anything.
+func (service *CovoitService) BatchPayouts() (PayoutBatch, error) {
+	now := service.clock()
+	batch, _, err := service.payouts.CreatePayoutBatch(now.Add(-service.payoutSettings.HoldingPeriod), service.payoutSettings.Minimum, now)
+	return batch, err
+}
+
+// ExportPayoutBatch renders the batch as a SEPA credit transfer file for the
+// bank, its pending payouts are sent. Exporting it again renders the same
+// file, with the same message id, which the bank refuses to process twice.
+func (service *CovoitService) ExportPayoutBatch(batchID uuid.UUID) ([]byte, error) {
+	if service.payoutSettings.Debtor.IBAN == "" {
+		return nil, ErrPayoutsNotConfigured
+	}
+	batch, payouts, err := service.payouts.SendPayoutBatch(batchID, service.clock())
+	if err != nil {
+		return nil, err
+	}
+	return renderPain001(service.payoutSettings.Debtor, batch, payouts)
+}
+
+// UpdatePayoutStatus records what the bank did with a payout sent, paid or
+// failed for reason.
+func (service *CovoitService) UpdatePayoutStatus(payoutID uuid.UUID, status string, reason string) (Payout, error) {
+	if status != PayoutPaid && status != PayoutFailed {
+		return Payout{}, fmt.Errorf("%w : a payout is set %s or %s", ErrInvalidPayoutStatus, PayoutPaid, PayoutFailed)
+	}
+	if status == PayoutPaid {
+		reason = ""
+	}
+	return service.payouts.UpdatePayoutStatus(payoutID, status, strings.TrimSpace(reason), service.clock())
+}
+
+// The elements of a pain.001.001.03 customer credit transfer initiation, the
+// version of the SEPA files banks take, in the order of its schema.
+type pain001Document struct {
+	XMLName    xml.Name          `xml:"urn:iso:std:iso:20022:tech:xsd:pain.001.001.03 Document"`
+	Initiation pain001Initiation `xml:"CstmrCdtTrfInitn"`
+}
+
+type pain001Initiation struct {
+	GroupHeader pain001GroupHeader `xml:"GrpHdr"`
+	Payment     pain001Payment     `xml:"PmtInf"`
+}
+
+type pain001GroupHeader struct {
+	MessageID       string      `xml:"MsgId"`
+	CreatedAt       string      `xml:"CreDtTm"`
+	Transactions    int         `xml:"NbOfTxs"`
+	ControlSum      string      `xml:"CtrlSum"`
+	InitiatingParty pain001Name `xml:"InitgPty"`
+}
+
+type pain001Payment struct {
+	PaymentID     string               `xml:"PmtInfId"`
+	Method        string               `xml:"PmtMtd"`
+	BatchBooking  bool                 `xml:"BtchBookg"`
+	Transactions  int                  `xml:"NbOfTxs"`
+	ControlSum    string               `xml:"CtrlSum"`
+	ServiceLevel  string               `xml:"PmtTpInf>SvcLvl>Cd"`
+	ExecutionDate string               `xml:"ReqdExctnDt"`
+	Debtor        pain001Name          `xml:"Dbtr"`
+	DebtorIBAN    string               `xml:"DbtrAcct>Id>IBAN"`
+	DebtorAgent   pain001Agent         `xml:"DbtrAgt"`
+	ChargeBearer  string               `xml:"ChrgBr"`
+	Transfers     []pain001Transaction `xml:"CdtTrfTxInf"`
+}
+
+type pain001Transaction struct {
+	EndToEndID    string        `xml:"PmtId>EndToEndId"`
+	Amount        pain001Amount `xml:"Amt>InstdAmt"`
+	CreditorAgent *pain001Agent `xml:"CdtrAgt,omitempty"`
+	Creditor      pain001Name   `xml:"Cdtr"`
+	CreditorIBAN  string        `xml:"CdtrAcct>Id>IBAN"`
+	Remittance    string        `xml:"RmtInf>Ustrd"`
+}
+
+type pain001Name struct {
+	Name string `xml:"Nm"`
+}
+
+type pain001Agent struct {
+	BIC string `xml:"FinInstnId>BIC,omitempty"`
+	// Other is NOTPROVIDED when the BIC is not known.
+	Other string `xml:"FinInstnId>Othr>Id,omitempty"`
+}
+
+type pain001Amount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// sepaText keeps of text the characters the SEPA files may carry, the
+// accents stripped, within size characters.
+func sepaText(text string, size int) string {
+	latin, _, err := transform.String(sepaLatin, text)
+	if err != nil {
+		latin = text
+	}
+	latin = strings.Join(strings.Fields(sepaUnsupported.ReplaceAllString(latin, " ")), " ")
+	if len(latin) > size {
+		latin = strings.TrimSpace(latin[:size])
+	}
+	return latin
+}
+
+// sepaID turns a uuid into an identifier of the file, 35 characters at most.
+func sepaID(id uuid.UUID) string {
+	return strings.ReplaceAll(id.String(), "-", "")
+}
+
+func pain001AgentOf(bic string) pain001Agent {
+	if bic == "" {
+		return pain001Agent{Other: "NOTPROVIDED"}
+	}
+	return pain001Agent{BIC: bic}
+}
+
+// renderPain001 renders the payouts of batch not failed as a SEPA credit
+// transfer initiation from the account of debtor, executed on the day of the
+// export.
+func renderPain001(debtor PayoutAccount, batch PayoutBatch, payouts []Payout) ([]byte, error) {
+	exportedAt := batch.CreatedAt
+	if batch.ExportedAt != nil {
+		exportedAt = *batch.ExportedAt
+	}
+	transfers, total := []pain001Transaction{}, NewMoney(0, batch.Total.Currency)
+	for _, payout := range payouts {
+		if payout.Status == PayoutFailed {
+			continue
+		}
+		transfer := pain001Transaction{
+			EndToEndID:   sepaID(payout.PayoutID),
+			Amount:       pain001Amount{Currency: payout.Amount.Currency, Value: payout.Amount.Decimal()},
+			Creditor:     pain001Name{Name: sepaText(payout.HolderName, 70)},
+			CreditorIBAN: payout.IBAN,
+			Remittance:   sepaText(fmt.Sprintf("Covoit payout %s", payout.CreatedAt.Format("2006-01-02")), 140),
+		}
+		if payout.BIC != "" {
+			transfer.CreditorAgent = &pain001Agent{BIC: payout.BIC}
+		}
+		transfers = append(transfers, transfer)
+		total = total.Add(payout.Amount)
+	}
+	if len(transfers) == 0 {
+		return nil, fmt.Errorf("%w : every payout of batch %s failed", ErrPayoutTransition, batch.BatchID)
+	}
+	document := pain001Document{Initiation: pain001Initiation{
+		GroupHeader: pain001GroupHeader{
+			MessageID:       sepaID(batch.BatchID),
+			CreatedAt:       exportedAt.UTC().Format("2006-01-02T15:04:05"),
+			Transactions:    len(transfers),
+			ControlSum:      total.Decimal(),
+			InitiatingParty: pain001Name{Name: sepaText(debtor.HolderName, 70)},
+		},
+		Payment: pain001Payment{
+			PaymentID:     sepaID(batch.BatchID),
+			Method:        "TRF",
+			BatchBooking:  true,
+			Transactions:  len(transfers),
+			ControlSum:    total.Decimal(),
+			ServiceLevel:  "SEPA",
+			ExecutionDate: exportedAt.UTC().Format("2006-01-02"),
+			Debtor:        pain001Name{Name: sepaText(debtor.HolderName, 70)},
+			DebtorIBAN:    debtor.IBAN,
+			DebtorAgent:   pain001AgentOf(debtor.BIC),
+			ChargeBearer:  "SLEV",
+			Transfers:     transfers,
+		},
+	}}
+	body, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("could not render payout batch %s, err : %s", batch.BatchID, err)
+	}
+	return append([]byte(xml.Header), append(body, '\n')...), nil
+}
+
+// PayoutAccountHandler shows and saves with PUT the bank account the actor,
+// or ?user_id= for the admins, is paid out to.
+func (h *Handler) PayoutAccountHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	userID, err := ownerFromQuery(r, actor)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !Authorize(actor, ActionManagePayoutAccount, Resource{OwnerID: userID}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			account, err := h.Service.GetPayoutAccount(userID)
+			if errors.Is(err, ErrPayoutAccountNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(account)
+		}
+	case http.MethodPut:
+		{
+			var account PayoutAccount
+			if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			account.UserID = userID
+			account, err := h.Service.SavePayoutAccount(account)
+			if errors.Is(err, ErrInvalidPayoutAccount) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(account)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// PayoutsHandler lists the payouts of the actor, or of ?user_id= for the
+// admins.
+func (h *Handler) PayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := ownerFromQuery(r, actor)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !Authorize(actor, ActionViewPayouts, Resource{OwnerID: userID}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	payouts, err := h.Service.GetPayoutsForUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payouts)
+}
+
+// PayoutBatchesHandler lets the admins list the batches, and batch the
+// payouts due without waiting for the periodic job with POST.
+func (h *Handler) PayoutBatchesHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManagePayouts, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			batches, err := h.Service.GetPayoutBatches()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(batches)
+		}
+	case http.MethodPost:
+		{
+			batch, err := h.Service.BatchPayouts()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if batch.Count == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(batch)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// PayoutBatchExportHandler downloads ?batch_id= as a pain.001 file for the
+// bank.
+func (h *Handler) PayoutBatchExportHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManagePayouts, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	batchID, err := uuid.Parse(r.URL.Query().Get("batch_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	document, err := h.Service.ExportPayoutBatch(batchID)
+	if errors.Is(err, ErrPayoutBatchNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrPayoutTransition) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, ErrPayoutsNotConfigured) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "payouts-"+sepaID(batchID)+".xml"))
+	w.Write(document)
+}
+
+// AdminPayoutsHandler lets the admins list the payouts of ?batch_id=, and
+// record with PATCH ?payout_id= whether the bank paid a payout.
+func (h *Handler) AdminPayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManagePayouts, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			batchID, err := uuid.Parse(r.URL.Query().Get("batch_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			payouts, err := h.Service.GetPayoutsByBatch(batchID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(payouts)
+		}
+	case http.MethodPatch:
+		{
+			payoutID, err := uuid.Parse(r.URL.Query().Get("payout_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var update struct {
+				Status        string `json:"status"`
+				FailureReason string `json:"failure_reason"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			payout, err := h.Service.UpdatePayoutStatus(payoutID, update.Status, update.FailureReason)
+			if errors.Is(err, ErrInvalidPayoutStatus) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if errors.Is(err, ErrPayoutNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if errors.Is(err, ErrPayoutTransition) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(payout)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
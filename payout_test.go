@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) GetPayoutAccount(userID uuid.UUID) (PayoutAccount, error) {
+	for _, account := range m.DB.PayoutAccounts {
+		if account.UserID == userID {
+			return account, nil
+		}
+	}
+	return PayoutAccount{}, ErrPayoutAccountNotFound
+}
+
+func (m *MockRepository) SavePayoutAccount(account PayoutAccount) (PayoutAccount, error) {
+	i := slices.IndexFunc(m.DB.PayoutAccounts, func(a PayoutAccount) bool { return a.UserID == account.UserID })
+	if i < 0 {
+		m.DB.PayoutAccounts = append(m.DB.PayoutAccounts, account)
+	} else {
+		m.DB.PayoutAccounts[i] = account
+	}
+	return account, nil
+}
+
+// payoutBalances sums the wallet postings the way the SQL query does.
+func (m *MockRepository) payoutBalances(eligibleBefore time.Time, currency string) []PayoutBalance {
+	balances := []PayoutBalance{}
+	for _, journal := range m.DB.Journals {
+		for _, posting := range journal.Postings {
+			if posting.Account != AccountWallet || posting.UserID == nil || posting.Amount.Currency != currency {
+				continue
+			}
+			i := slices.IndexFunc(balances, func(balance PayoutBalance) bool { return balance.UserID == *posting.UserID })
+			if i < 0 {
+				balances = append(balances, PayoutBalance{UserID: *posting.UserID, Eligible: NewMoney(0, currency), Balance: NewMoney(0, currency)})
+				i = len(balances) - 1
+			}
+			balances[i].Balance = balances[i].Balance.Sub(posting.Amount)
+			if posting.Kind == PostingPayout || posting.CreatedAt.Before(eligibleBefore) {
+				balances[i].Eligible = balances[i].Eligible.Sub(posting.Amount)
+			}
+		}
+	}
+	return balances
+}
+
+func (m *MockRepository) CreatePayoutBatch(eligibleBefore time.Time, minimum Money, at time.Time) (PayoutBatch, []Payout, error) {
+	batch, payouts := payoutBatch(m.DB.PayoutAccounts, m.payoutBalances(eligibleBefore, minimum.Currency), minimum, at)
+	if len(payouts) == 0 {
+		return batch, payouts, nil
+	}
+	if err := m.record(payoutJournals(payouts)...); err != nil {
+		return PayoutBatch{}, nil, err
+	}
+	m.DB.PayoutBatches = append(m.DB.PayoutBatches, batch)
+	m.DB.Payouts = append(m.DB.Payouts, payouts...)
+	return batch, payouts, nil
+}
+
+func (m *MockRepository) GetPayoutBatches() ([]PayoutBatch, error) {
+	batches := slices.Clone(m.DB.PayoutBatches)
+	slices.Reverse(batches)
+	return batches, nil
+}
+
+func (m *MockRepository) GetPayoutsByBatch(batchID uuid.UUID) ([]Payout, error) {
+	payouts := []Payout{}
+	for _, payout := range m.DB.Payouts {
+		if payout.BatchID == batchID {
+			payouts = append(payouts, payout)
+		}
+	}
+	return payouts, nil
+}
+
+func (m *MockRepository) GetPayoutsByUser(userID uuid.UUID) ([]Payout, error) {
+	payouts := []Payout{}
+	for _, payout := range m.DB.Payouts {
+		if payout.UserID == userID {
+			payouts = append(payouts, payout)
+		}
+	}
+	slices.Reverse(payouts)
+	return payouts, nil
+}
+
+func (m *MockRepository) SendPayoutBatch(batchID uuid.UUID, at time.Time) (PayoutBatch, []Payout, error) {
+	i := slices.IndexFunc(m.DB.PayoutBatches, func(batch PayoutBatch) bool { return batch.BatchID == batchID })
+	if i < 0 {
+		return PayoutBatch{}, nil, ErrPayoutBatchNotFound
+	}
+	if m.DB.PayoutBatches[i].ExportedAt == nil {
+		m.DB.PayoutBatches[i].ExportedAt = &at
+	}
+	for j, payout := range m.DB.Payouts {
+		if payout.BatchID == batchID && payout.Status == PayoutPending {
+			m.DB.Payouts[j].Status, m.DB.Payouts[j].UpdatedAt = PayoutSent, at
+		}
+	}
+	payouts, _ := m.GetPayoutsByBatch(batchID)
+	return m.DB.PayoutBatches[i], payouts, nil
+}
+
+func (m *MockRepository) UpdatePayoutStatus(payoutID uuid.UUID, status string, reason string, at time.Time) (Payout, error) {
+	i := slices.IndexFunc(m.DB.Payouts, func(payout Payout) bool { return payout.PayoutID == payoutID })
+	if i < 0 {
+		return Payout{}, ErrPayoutNotFound
+	}
+	payout := m.DB.Payouts[i]
+	if err := checkPayoutTransition(payout, status); err != nil {
+		return Payout{}, err
+	}
+	payout.Status, payout.FailureReason, payout.UpdatedAt = status, reason, at
+	if status == PayoutFailed {
+		if err := m.record(payoutFailureJournal(payout.UserID, payout.Amount, payout.PayoutID, at)); err != nil {
+			return Payout{}, err
+		}
+	}
+	m.DB.Payouts[i] = payout
+	return payout, nil
+}
+
+func TestValidatePayoutAccount(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		account PayoutAccount
+		valid   bool
+	}{
+		{"french iban", PayoutAccount{HolderName: "Jérôme Müller", IBAN: "FR1420041010050500013M02606"}, true},
+		{"spaced and lowercase", PayoutAccount{HolderName: "Jerome", IBAN: "de89 3704 0044 0532 0130 00", BIC: "cobadeffxxx"}, true},
+		{"eight letter bic", PayoutAccount{HolderName: "Jerome", IBAN: "GB82WEST12345698765432", BIC: "NWBKGB2L"}, true},
+		{"bad check digits", PayoutAccount{HolderName: "Jerome", IBAN: "FR1520041010050500013M02606"}, false},
+		{"too short", PayoutAccount{HolderName: "Jerome", IBAN: "FR14200410"}, false},
+		{"bad bic", PayoutAccount{HolderName: "Jerome", IBAN: "FR1420041010050500013M02606", BIC: "COBA"}, false},
+		{"no holder", PayoutAccount{HolderName: " ", IBAN: "FR1420041010050500013M02606"}, false},
+		{"holder without latin letters", PayoutAccount{HolderName: "李雷", IBAN: "FR1420041010050500013M02606"}, false},
+	} {
+		err := validatePayoutAccount(normalizePayoutAccount(tc.account))
+		if tc.valid {
+			require.NoError(t, err, tc.name)
+		} else {
+			require.ErrorIs(t, err, ErrInvalidPayoutAccount, tc.name)
+		}
+	}
+}
+
+func TestSepaText(t *testing.T) {
+	require.Equal(t, "Jerome Muller", sepaText("  Jérôme   Müller ", 70))
+	require.Equal(t, "Francois O'Neil Co", sepaText("François O'Neil & Co", 70))
+	require.Equal(t, "Jero", sepaText("Jérôme", 4))
+}
+
+// newPayoutFixture completes a ride whose driver has a payout account.
+func newPayoutFixture(t *testing.T) (*paymentFixture, Booking) {
+	t.Helper()
+	f := newPaymentFixture(t)
+	_, err := f.service.SavePayoutAccount(PayoutAccount{UserID: f.driverID, HolderName: "Mehdi Benfredj", IBAN: "FR14 2004 1010 0505 0001 3M02 606"})
+	require.NoError(t, err)
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	*f.now = f.ride.DepartureTime
+	require.NoError(t, f.service.CompleteRide(f.ride.RideID, nil))
+	return f, booking
+}
+
+func TestBatchPayouts(t *testing.T) {
+	f, _ := newPayoutFixture(t)
+	*f.now = f.ride.DepartureTime.Add(DefaultPayoutHoldingPeriod - time.Hour)
+	batch, err := f.service.BatchPayouts()
+	require.NoError(t, err)
+	require.Zero(t, batch.Count, "the earnings are held")
+	require.Empty(t, f.db.PayoutBatches)
+
+	*f.now = f.ride.DepartureTime.Add(DefaultPayoutHoldingPeriod + time.Hour)
+	batch, err = f.service.BatchPayouts()
+	require.NoError(t, err)
+	require.Equal(t, 1, batch.Count)
+	require.Equal(t, eur(4500), batch.Total)
+	payouts, err := f.service.GetPayoutsForUser(f.driverID)
+	require.NoError(t, err)
+	require.Len(t, payouts, 1)
+	require.Equal(t, PayoutPending, payouts[0].Status)
+	require.Equal(t, eur(4500), payouts[0].Amount)
+	require.Equal(t, "FR1420041010050500013M02606", payouts[0].IBAN)
+	wallet, err := f.service.GetWallet(f.driverID)
+	require.NoError(t, err)
+	require.True(t, wallet.Balance.IsZero(), "the payout empties the wallet")
+	for _, journal := range f.db.Journals {
+		require.NoError(t, checkJournal(journal), journal.Key)
+	}
+
+	batch, err = f.service.BatchPayouts()
+	require.NoError(t, err)
+	require.Zero(t, batch.Count, "a balance is paid out once")
+}
+
+func TestBatchPayoutsLimits(t *testing.T) {
+	f, booking := newPayoutFixture(t)
+	payment := f.payment(t, booking.BookingID)
+	*f.now = f.ride.DepartureTime.Add(DefaultPayoutHoldingPeriod + time.Hour)
+	_, err := f.service.RefundPayment(payment.PaymentID, eur(1000))
+	require.NoError(t, err)
+	batch, err := f.service.BatchPayouts()
+	require.NoError(t, err)
+	require.Equal(t, eur(3600), batch.Total, "a recent refund comes off the eligible earnings")
+
+	f, _ = newPayoutFixture(t)
+	f.db.PayoutAccounts = nil
+	*f.now = f.ride.DepartureTime.Add(DefaultPayoutHoldingPeriod + time.Hour)
+	batch, err = f.service.BatchPayouts()
+	require.NoError(t, err)
+	require.Zero(t, batch.Count, "a driver without a payout account is not paid out")
+
+	f, _ = newPayoutFixture(t)
+	f.service.payoutSettings.Minimum = eur(4501)
+	*f.now = f.ride.DepartureTime.Add(DefaultPayoutHoldingPeriod + time.Hour)
+	batch, err = f.service.BatchPayouts()
+	require.NoError(t, err)
+	require.Zero(t, batch.Count, "a balance below the minimum waits")
+}
+
+func TestExportPayoutBatch(t *testing.T) {
+	f, _ := newPayoutFixture(t)
+	f.db.PayoutAccounts[0].HolderName = "Jérôme Müller & fils"
+	*f.now = f.ride.DepartureTime.Add(DefaultPayoutHoldingPeriod + time.Hour)
+	batch, err := f.service.BatchPayouts()
+	require.NoError(t, err)
+
+	exportedAt := *f.now
+	document, err := f.service.ExportPayoutBatch(batch.BatchID)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(document), xml.Header))
+	var parsed pain001Document
+	require.NoError(t, xml.Unmarshal(document, &parsed))
+	require.Equal(t, "urn:iso:std:iso:20022:tech:xsd:pain.001.001.03", parsed.XMLName.Space)
+	header, payment := parsed.Initiation.GroupHeader, parsed.Initiation.Payment
+	require.Equal(t, sepaID(batch.BatchID), header.MessageID)
+	require.Equal(t, exportedAt.Format("2006-01-02T15:04:05"), header.CreatedAt)
+	require.Equal(t, 1, header.Transactions)
+	require.Equal(t, "45.00", header.ControlSum)
+	require.Equal(t, "Covoit SAS", header.InitiatingParty.Name)
+	require.Equal(t, "FR7630006000011234567890189", payment.DebtorIBAN)
+	require.Equal(t, "AGRIFRPPXXX", payment.DebtorAgent.BIC)
+	require.Equal(t, "SEPA", payment.ServiceLevel)
+	require.Equal(t, exportedAt.Format("2006-01-02"), payment.ExecutionDate)
+	require.Len(t, payment.Transfers, 1)
+	transfer := payment.Transfers[0]
+	require.Equal(t, sepaID(f.db.Payouts[0].PayoutID), transfer.EndToEndID)
+	require.Equal(t, pain001Amount{Currency: "EUR", Value: "45.00"}, transfer.Amount)
+	require.Equal(t, "Jerome Muller fils", transfer.Creditor.Name, "the bank details are copied when the payout is made")
+	require.Equal(t, "FR1420041010050500013M02606", transfer.CreditorIBAN)
+	require.Nil(t, transfer.CreditorAgent)
+	require.Equal(t, PayoutSent, f.db.Payouts[0].Status)
+
+	*f.now = f.now.Add(time.Hour)
+	again, err := f.service.ExportPayoutBatch(batch.BatchID)
+	require.NoError(t, err)
+	require.Equal(t, document, again, "an export is repeated as is")
+
+	_, err = f.service.ExportPayoutBatch(uuid.New())
+	require.ErrorIs(t, err, ErrPayoutBatchNotFound)
+	f.service.payoutSettings.Debtor = PayoutAccount{}
+	_, err = f.service.ExportPayoutBatch(batch.BatchID)
+	require.ErrorIs(t, err, ErrPayoutsNotConfigured)
+}
+
+func TestUpdatePayoutStatus(t *testing.T) {
+	f, _ := newPayoutFixture(t)
+	*f.now = f.ride.DepartureTime.Add(DefaultPayoutHoldingPeriod + time.Hour)
+	batch, err := f.service.BatchPayouts()
+	require.NoError(t, err)
+	payoutID := f.db.Payouts[0].PayoutID
+
+	_, err = f.service.UpdatePayoutStatus(payoutID, PayoutPaid, "")
+	require.ErrorIs(t, err, ErrPayoutTransition, "a payout is paid once sent")
+	_, err = f.service.UpdatePayoutStatus(payoutID, PayoutSent, "")
+	require.ErrorIs(t, err, ErrInvalidPayoutStatus, "a payout is sent by the export")
+	_, err = f.service.UpdatePayoutStatus(uuid.New(), PayoutPaid, "")
+	require.ErrorIs(t, err, ErrPayoutNotFound)
+
+	_, err = f.service.ExportPayoutBatch(batch.BatchID)
+	require.NoError(t, err)
+	payout, err := f.service.UpdatePayoutStatus(payoutID, PayoutPaid, "ignored")
+	require.NoError(t, err)
+	require.Equal(t, PayoutPaid, payout.Status)
+	require.Empty(t, payout.FailureReason)
+
+	payout, err = f.service.UpdatePayoutStatus(payoutID, PayoutFailed, " account closed ")
+	require.NoError(t, err, "the bank may return a transfer")
+	require.Equal(t, "account closed", payout.FailureReason)
+	wallet, err := f.service.GetWallet(f.driverID)
+	require.NoError(t, err)
+	require.Equal(t, eur(4500), wallet.Balance, "a failed payout is credited back")
+	for _, journal := range f.db.Journals {
+		require.NoError(t, checkJournal(journal), journal.Key)
+	}
+	_, err = f.service.UpdatePayoutStatus(payoutID, PayoutFailed, "")
+	require.ErrorIs(t, err, ErrPayoutTransition)
+
+	_, err = f.service.ExportPayoutBatch(batch.BatchID)
+	require.ErrorIs(t, err, ErrPayoutTransition, "a batch whose payouts all failed has nothing to transfer")
+	batch, err = f.service.BatchPayouts()
+	require.NoError(t, err)
+	require.Equal(t, eur(4500), batch.Total, "the next batch pays it out again")
+}
+
+func TestPayoutHandlers(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	driver := Actor{UserID: uuid.New(), Role: RoleDriver}
+	account := PayoutAccount{UserID: driver.UserID, HolderName: "Mehdi Benfredj", IBAN: "FR1420041010050500013M02606"}
+	mockSvc.On("GetPayoutsForUser", driver.UserID).Return([]Payout{{PayoutID: uuid.New(), UserID: driver.UserID, Amount: eur(4500), Status: PayoutSent}}, nil)
+	mockSvc.On("GetPayoutAccount", driver.UserID).Return(account, nil)
+	mockSvc.On("SavePayoutAccount", mock.MatchedBy(func(a PayoutAccount) bool { return a.IBAN == account.IBAN && a.UserID == driver.UserID })).Return(account, nil)
+	mockSvc.On("SavePayoutAccount", mock.MatchedBy(func(a PayoutAccount) bool { return a.IBAN == "nope" })).Return(PayoutAccount{}, ErrInvalidPayoutAccount)
+
+	for _, tc := range []struct {
+		name   string
+		actor  Actor
+		query  string
+		status int
+	}{
+		{"own payouts", driver, "", http.StatusOK},
+		{"someone else's payouts", Actor{UserID: uuid.New(), Role: RoleDriver}, "?user_id=" + driver.UserID.String(), http.StatusForbidden},
+		{"as an admin", admin, "?user_id=" + driver.UserID.String(), http.StatusOK},
+		{"bad user", admin, "?user_id=nope", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.PayoutsHandler(w, asActor(httptest.NewRequest(http.MethodGet, "/payouts"+tc.query, nil), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+
+		w = httptest.NewRecorder()
+		h.PayoutAccountHandler(w, asActor(httptest.NewRequest(http.MethodGet, "/payouts/account"+tc.query, nil), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		actor  Actor
+		iban   string
+		status int
+	}{
+		{"save", driver, account.IBAN, http.StatusOK},
+		{"invalid", driver, "nope", http.StatusBadRequest},
+	} {
+		body, _ := json.Marshal(PayoutAccount{UserID: uuid.New(), HolderName: account.HolderName, IBAN: tc.iban})
+		w := httptest.NewRecorder()
+		h.PayoutAccountHandler(w, asActor(httptest.NewRequest(http.MethodPut, "/payouts/account", bytes.NewReader(body)), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
+
+func TestAdminPayoutHandlers(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	driver := Actor{UserID: uuid.New(), Role: RoleDriver}
+	batchID, missing, empty := uuid.New(), uuid.New(), uuid.New()
+	payoutID, paid := uuid.New(), uuid.New()
+	mockSvc.On("GetPayoutBatches").Return([]PayoutBatch{{BatchID: batchID, Count: 1, Total: eur(4500)}}, nil)
+	mockSvc.On("BatchPayouts").Return(PayoutBatch{BatchID: batchID, Count: 1, Total: eur(4500)}, nil).Once()
+	mockSvc.On("BatchPayouts").Return(PayoutBatch{}, nil)
+	mockSvc.On("GetPayoutsByBatch", batchID).Return([]Payout{{PayoutID: payoutID, BatchID: batchID}}, nil)
+	mockSvc.On("ExportPayoutBatch", batchID).Return([]byte(xml.Header+"<Document/>"), nil)
+	mockSvc.On("ExportPayoutBatch", missing).Return([]byte(nil), ErrPayoutBatchNotFound)
+	mockSvc.On("ExportPayoutBatch", empty).Return([]byte(nil), ErrPayoutTransition)
+	mockSvc.On("UpdatePayoutStatus", payoutID, PayoutPaid, "").Return(Payout{PayoutID: payoutID, Status: PayoutPaid}, nil)
+	mockSvc.On("UpdatePayoutStatus", payoutID, "lost", "").Return(Payout{}, ErrInvalidPayoutStatus)
+	mockSvc.On("UpdatePayoutStatus", paid, PayoutPaid, "").Return(Payout{}, ErrPayoutTransition)
+	mockSvc.On("UpdatePayoutStatus", missing, PayoutPaid, "").Return(Payout{}, ErrPayoutNotFound)
+
+	for _, tc := range []struct {
+		name    string
+		actor   Actor
+		handler http.HandlerFunc
+		method  string
+		path    string
+		body    string
+		status  int
+	}{
+		{"list batches", admin, h.PayoutBatchesHandler, http.MethodGet, "/admin/payouts/batches", "", http.StatusOK},
+		{"list batches as a driver", driver, h.PayoutBatchesHandler, http.MethodGet, "/admin/payouts/batches", "", http.StatusForbidden},
+		{"batch", admin, h.PayoutBatchesHandler, http.MethodPost, "/admin/payouts/batches", "", http.StatusCreated},
+		{"batch nothing due", admin, h.PayoutBatchesHandler, http.MethodPost, "/admin/payouts/batches", "", http.StatusNoContent},
+		{"list payouts", admin, h.AdminPayoutsHandler, http.MethodGet, "/admin/payouts?batch_id=" + batchID.String(), "", http.StatusOK},
+		{"list payouts as a driver", driver, h.AdminPayoutsHandler, http.MethodGet, "/admin/payouts?batch_id=" + batchID.String(), "", http.StatusForbidden},
+		{"list payouts bad batch", admin, h.AdminPayoutsHandler, http.MethodGet, "/admin/payouts?batch_id=nope", "", http.StatusBadRequest},
+		{"export", admin, h.PayoutBatchExportHandler, http.MethodGet, "/admin/payouts/batches/export?batch_id=" + batchID.String(), "", http.StatusOK},
+		{"export as a driver", driver, h.PayoutBatchExportHandler, http.MethodGet, "/admin/payouts/batches/export?batch_id=" + batchID.String(), "", http.StatusForbidden},
+		{"export missing", admin, h.PayoutBatchExportHandler, http.MethodGet, "/admin/payouts/batches/export?batch_id=" + missing.String(), "", http.StatusNotFound},
+		{"export all failed", admin, h.PayoutBatchExportHandler, http.MethodGet, "/admin/payouts/batches/export?batch_id=" + empty.String(), "", http.StatusConflict},
+		{"paid", admin, h.AdminPayoutsHandler, http.MethodPatch, "/admin/payouts?payout_id=" + payoutID.String(), `{"status":"paid"}`, http.StatusOK},
+		{"paid as a driver", driver, h.AdminPayoutsHandler, http.MethodPatch, "/admin/payouts?payout_id=" + payoutID.String(), `{"status":"paid"}`, http.StatusForbidden},
+		{"unknown status", admin, h.AdminPayoutsHandler, http.MethodPatch, "/admin/payouts?payout_id=" + payoutID.String(), `{"status":"lost"}`, http.StatusBadRequest},
+		{"paid twice", admin, h.AdminPayoutsHandler, http.MethodPatch, "/admin/payouts?payout_id=" + paid.String(), `{"status":"paid"}`, http.StatusConflict},
+		{"missing payout", admin, h.AdminPayoutsHandler, http.MethodPatch, "/admin/payouts?payout_id=" + missing.String(), `{"status":"paid"}`, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		tc.handler(w, asActor(httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+		if tc.name == "export" {
+			require.Equal(t, "application/xml", w.Result().Header.Get("Content-Type"))
+			require.Contains(t, w.Result().Header.Get("Content-Disposition"), sepaID(batchID)+".xml")
+		}
+	}
+}
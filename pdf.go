@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// The layout of the documents rendered as PDF : A4 pages in points, set in
+// Courier so that the text keeps the alignment of its plain text template.
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfMargin     = 56
+	pdfFontSize   = 10
+	pdfLeading    = 14
+	pdfPageLines  = (pdfPageHeight - 2*pdfMargin) / pdfLeading
+)
+
+// pdfEncoder writes text in WinAnsiEncoding, the encoding of the standard
+// fonts every PDF reader has. Characters it lacks are replaced.
+var pdfEncoder = encoding.ReplaceUnsupported(charmap.Windows1252.NewEncoder())
+
+func pdfString(text string) (string, error) {
+	encoded, err := pdfEncoder.String(text)
+	if err != nil {
+		return "", err
+	}
+	return "(" + strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`, "\r", "").Replace(encoded) + ")", nil
+}
+
+// renderPDF lays the lines of text out on as many pages as they need. It is
+// enough for text documents such as invoices and needs no font file.
+func renderPDF(title string, text string) ([]byte, error) {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	pages := [][]string{}
+	for len(lines) > pdfPageLines {
+		pages, lines = append(pages, lines[:pdfPageLines]), lines[pdfPageLines:]
+	}
+	pages = append(pages, lines)
+
+	// Objects 1 to 4 are the catalog, the page tree, the font and the
+	// document information, each page then takes a page and a content object.
+	objects := make([]string, 4, 4+2*len(pages))
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	objects[0] = "<< /Type /Catalog /Pages 2 0 R >>"
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+	objects[2] = "<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>"
+	encodedTitle, err := pdfString(title)
+	if err != nil {
+		return nil, err
+	}
+	objects[3] = fmt.Sprintf("<< /Title %s /Producer (covoit) >>", encodedTitle)
+	for i, page := range pages {
+		content := &bytes.Buffer{}
+		fmt.Fprintf(content, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", pdfFontSize, pdfLeading, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range page {
+			encoded, err := pdfString(line)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(content, "%s '\n", encoded)
+		}
+		content.WriteString("ET")
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, 6+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	document := &bytes.Buffer{}
+	document.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = document.Len()
+		fmt.Fprintf(document, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := document.Len()
+	fmt.Fprintf(document, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(document, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(document, "trailer\n<< /Size %d /Root 1 0 R /Info 4 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return document.Bytes(), nil
+}
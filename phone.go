@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// defaultCallingCode is used for national numbers written with a leading 0.
+	defaultCallingCode   = "33"
+	phoneCodeTTL         = 10 * time.Minute
+	phoneCodeMaxAttempts = 5
+	phoneResendInterval  = time.Minute
+	phoneResendLimit     = 5
+)
+
+var (
+	ErrInvalidPhone = errors.New("invalid phone number")
+	ErrInvalidCode  = errors.New("invalid or expired code")
+)
+
+type PhoneVerification struct {
+	VerificationID uuid.UUID  `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"verification_id"`
+	UserID         uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	Phone          string     `json:"phone"`
+	CodeHash       string     `json:"-"`
+	Attempts       int        `json:"attempts"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	UsedAt         *time.Time `json:"used_at"`
+}
+
+// NormalizePhone turns a phone number typed by a user into its E.164 form.
+// Numbers without an international prefix are considered national numbers of
+// defaultCallingCode.
+func NormalizePhone(raw string) (string, error) {
+	raw = strings.ReplaceAll(strings.TrimSpace(raw), "(0)", "")
+	var b strings.Builder
+	for i, c := range raw {
+		switch {
+		case c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case c == '+' && i == 0:
+			b.WriteRune(c)
+		case strings.ContainsRune(" -.()", c):
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+	number := b.String()
+	switch {
+	case strings.HasPrefix(number, "+"):
+		number = number[1:]
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	case strings.HasPrefix(number, "0"):
+		number = defaultCallingCode + number[1:]
+	default:
+		return "", ErrInvalidPhone
+	}
+	if len(number) < 8 || len(number) > 15 || number[0] == '0' {
+		return "", ErrInvalidPhone
+	}
+	return "+" + number, nil
+}
+
+func generateCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", fmt.Errorf("could not generate code, err : %s", err)
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// phoneCodeSecretFromEnv reads PHONE_CODE_SECRET, the key of the hashes of
+// the codes sent by SMS. There are a million codes : without a key kept out
+// of the database, anyone reading a hash would find its code at once.
+func phoneCodeSecretFromEnv() ([]byte, error) {
+	secret := os.Getenv("PHONE_CODE_SECRET")
+	if secret == "" {
+		return nil, errors.New("PHONE_CODE_SECRET is not set")
+	}
+	return []byte(secret), nil
+}
+
+// hashCode hashes a code sent by SMS with the secret of the service.
+func (service *CovoitService) hashCode(code string) (string, error) {
+	if len(service.phoneCodeSecret) == 0 {
+		return "", errors.New("phone codes cannot be hashed without a secret")
+	}
+	mac := hmac.New(sha256.New, service.phoneCodeSecret)
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (repository *CovoitRepository) CreatePhoneVerification(verification PhoneVerification) (PhoneVerification, error) {
+	ctx := context.Background()
+	err := gorm.G[PhoneVerification](repository.db).Create(ctx, &verification)
+	if err != nil {
+		return PhoneVerification{}, fmt.Errorf("could not create phone verification for user %s, err : %s", verification.UserID, err)
+	}
+	return verification, nil
+}
+
+func (repository *CovoitRepository) GetPhoneVerificationsSince(userID uuid.UUID, since time.Time) ([]PhoneVerification, error) {
+	ctx := context.Background()
+	verifications, err := gorm.G[PhoneVerification](repository.db).
+		Where("user_id = ? AND created_at >= ?", userID, since).
+		Order("created_at DESC").
+		Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve phone verifications of user %s, err : %s", userID, err)
+	}
+	return verifications, nil
+}
+
+func (repository *CovoitRepository) GetPhoneVerificationsByUser(userID uuid.UUID) ([]PhoneVerification, error) {
+	ctx := context.Background()
+	verifications, err := gorm.G[PhoneVerification](repository.db).Where("user_id = ?", userID).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get phone verifications of user %s, err : %s", userID, err)
+	}
+	return verifications, nil
+}
+
+func init() {
+	registerPersonalData("phone_verifications", []string{"phone_verifications"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.verifications.GetPhoneVerificationsByUser(userID)
+	})
+}
+
+// ConsumePhoneVerificationAttempt atomically counts one attempt and tells
+// whether it was still allowed.
+func (repository *CovoitRepository) ConsumePhoneVerificationAttempt(verificationID uuid.UUID, maxAttempts int) (bool, error) {
+	ctx := context.Background()
+	rows, err := gorm.G[PhoneVerification](repository.db).
+		Where("verification_id = ? AND attempts < ?", verificationID, maxAttempts).
+		Update(ctx, "attempts", gorm.Expr("attempts + 1"))
+	if err != nil {
+		return false, fmt.Errorf("could not count attempt on phone verification %s, err : %s", verificationID, err)
+	}
+	return rows == 1, nil
+}
+
+// ConfirmPhone stores the verified number on the user and burns the code.
+func (repository *CovoitRepository) ConfirmPhone(userID uuid.UUID, verificationID uuid.UUID, phone string, at time.Time) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		_, err := gorm.G[User](tx).Where("user_id = ?", userID).Updates(ctx, User{Phone: phone, PhoneVerifiedAt: &at})
+		if err != nil {
+			return fmt.Errorf("could not verify phone of user %s, err : %s", userID, err)
+		}
+		_, err = gorm.G[PhoneVerification](tx).Where("verification_id = ?", verificationID).Update(ctx, "used_at", at)
+		if err != nil {
+			return fmt.Errorf("could not consume phone verification %s, err : %s", verificationID, err)
+		}
+		return nil
+	})
+}
+
+func (service *CovoitService) RequestPhoneVerification(userID uuid.UUID, phone string) error {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return err
+	}
+	now := service.clock()
+	recent, err := service.verifications.GetPhoneVerificationsSince(userID, now.Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	if len(recent) >= phoneResendLimit {
+		return ErrTooManyRequests
+	}
+	for _, verification := range recent {
+		if now.Sub(verification.CreatedAt) < phoneResendInterval {
+			return ErrTooManyRequests
+		}
+	}
+	code, err := generateCode()
+	if err != nil {
+		return err
+	}
+	codeHash, err := service.hashCode(code)
+	if err != nil {
+		return err
+	}
+	_, err = service.verifications.CreatePhoneVerification(PhoneVerification{
+		UserID:    userID,
+		Phone:     phone,
+		CodeHash:  codeHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(phoneCodeTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return service.sms.Send(phone, fmt.Sprintf("Your covoit verification code is %s. It expires in 10 minutes.", code))
+}
+
+// VerifyPhone checks code against the last code sent to the user. Each code
+// can be tried phoneCodeMaxAttempts times.
+func (service *CovoitService) VerifyPhone(userID uuid.UUID, code string) error {
+	now := service.clock()
+	recent, err := service.verifications.GetPhoneVerificationsSince(userID, now.Add(-phoneCodeTTL))
+	if err != nil {
+		return err
+	}
+	if len(recent) == 0 {
+		return ErrInvalidCode
+	}
+	latest := recent[0]
+	if latest.UsedAt != nil || !now.Before(latest.ExpiresAt) {
+		return ErrInvalidCode
+	}
+	allowed, err := service.verifications.ConsumePhoneVerificationAttempt(latest.VerificationID, phoneCodeMaxAttempts)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrTooManyRequests
+	}
+	codeHash, err := service.hashCode(code)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(latest.CodeHash)) != 1 {
+		return ErrInvalidCode
+	}
+	return service.verifications.ConfirmPhone(userID, latest.VerificationID, latest.Phone, now)
+}
+
+func (h *Handler) PhoneVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body := struct {
+		Phone string `json:"phone"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = h.Service.RequestPhoneVerification(actor.UserID, body.Phone)
+	if errors.Is(err, ErrInvalidPhone) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if errors.Is(err, ErrTooManyRequests) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) ConfirmPhoneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body := struct {
+		Code string `json:"code"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = h.Service.VerifyPhone(actor.UserID, body.Code)
+	if errors.Is(err, ErrInvalidCode) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if errors.Is(err, ErrTooManyRequests) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
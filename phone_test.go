@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) CreatePhoneVerification(verification PhoneVerification) (PhoneVerification, error) {
+	verification.VerificationID = uuid.New()
+	m.DB.PhoneVerifications = append(m.DB.PhoneVerifications, verification)
+	return verification, nil
+}
+
+func (m *MockRepository) GetPhoneVerificationsSince(userID uuid.UUID, since time.Time) ([]PhoneVerification, error) {
+	verifications := []PhoneVerification{}
+	for i := len(m.DB.PhoneVerifications) - 1; i >= 0; i-- {
+		verification := m.DB.PhoneVerifications[i]
+		if verification.UserID == userID && !verification.CreatedAt.Before(since) {
+			verifications = append(verifications, verification)
+		}
+	}
+	return verifications, nil
+}
+
+func (m *MockRepository) ConsumePhoneVerificationAttempt(verificationID uuid.UUID, maxAttempts int) (bool, error) {
+	for i := range m.DB.PhoneVerifications {
+		verification := &m.DB.PhoneVerifications[i]
+		if verification.VerificationID == verificationID && verification.Attempts < maxAttempts {
+			verification.Attempts++
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockRepository) ConfirmPhone(userID uuid.UUID, verificationID uuid.UUID, phone string, at time.Time) error {
+	for i := range m.DB.Users {
+		if m.DB.Users[i].UserID == userID {
+			m.DB.Users[i].Phone = phone
+			m.DB.Users[i].PhoneVerifiedAt = &at
+		}
+	}
+	for i := range m.DB.PhoneVerifications {
+		if m.DB.PhoneVerifications[i].VerificationID == verificationID {
+			m.DB.PhoneVerifications[i].UsedAt = &at
+		}
+	}
+	return nil
+}
+
+func (m *MockRepository) GetPhoneVerificationsByUser(userID uuid.UUID) ([]PhoneVerification, error) {
+	found := []PhoneVerification{}
+	for _, phoneVerification := range m.DB.PhoneVerifications {
+		if phoneVerification.UserID == userID {
+			found = append(found, phoneVerification)
+		}
+	}
+	return found, nil
+}
+
+type MemorySMSSender struct {
+	Sent []string
+}
+
+func (s *MemorySMSSender) Send(to string, body string) error {
+	s.Sent = append(s.Sent, body)
+	return nil
+}
+
+func (s *MemorySMSSender) LastCode(t *testing.T) string {
+	t.Helper()
+	require.NotEmpty(t, s.Sent)
+	code := regexp.MustCompile(`\d{6}`).FindString(s.Sent[len(s.Sent)-1])
+	require.NotEmpty(t, code)
+	return code
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"06 12 34 56 78", "+33612345678", false},
+		{"06.12.34.56.78", "+33612345678", false},
+		{"+33 6 12 34 56 78", "+33612345678", false},
+		{"+33 (0)6 12 34 56 78", "+33612345678", false},
+		{"0033612345678", "+33612345678", false},
+		{"+213 555 12 34 56", "+213555123456", false},
+		{"612345678", "", true},
+		{"+33 6 12 34 56 78 90 12 34", "", true},
+		{"+12", "", true},
+		{"06 12 AB 56 78", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizePhone(tt.raw)
+		if tt.wantErr {
+			require.ErrorIs(t, err, ErrInvalidPhone, tt.raw)
+			continue
+		}
+		require.NoError(t, err, tt.raw)
+		require.Equal(t, tt.want, got, tt.raw)
+	}
+}
+
+func TestPhoneVerification(t *testing.T) {
+	now := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	sms := &MemorySMSSender{}
+	s := NewMockService(db)
+	s.sms = sms
+	s.now = func() time.Time { return now }
+	userID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+
+	t.Run("invalid number", func(t *testing.T) {
+		require.ErrorIs(t, s.RequestPhoneVerification(userID, "hello"), ErrInvalidPhone)
+	})
+
+	t.Run("wrong code then right code", func(t *testing.T) {
+		require.NoError(t, s.RequestPhoneVerification(userID, "06 12 34 56 78"))
+		code := sms.LastCode(t)
+		stored := db.PhoneVerifications[len(db.PhoneVerifications)-1].CodeHash
+		require.NotEqual(t, hashToken(code), stored, "the code is hashed with the secret")
+		require.ErrorIs(t, s.VerifyPhone(userID, "not-it"), ErrInvalidCode)
+		require.NoError(t, s.VerifyPhone(userID, code))
+
+		user, err := s.GetUserById(userID)
+		require.NoError(t, err)
+		require.Equal(t, "+33612345678", user.Phone)
+		require.Equal(t, now, *user.PhoneVerifiedAt)
+
+		require.ErrorIs(t, s.VerifyPhone(userID, code), ErrInvalidCode)
+	})
+
+	t.Run("resend is throttled", func(t *testing.T) {
+		require.ErrorIs(t, s.RequestPhoneVerification(userID, "06 12 34 56 78"), ErrTooManyRequests)
+	})
+
+	t.Run("attempts are limited", func(t *testing.T) {
+		now = now.Add(phoneResendInterval)
+		require.NoError(t, s.RequestPhoneVerification(userID, "07 00 00 00 00"))
+		code := sms.LastCode(t)
+		for range phoneCodeMaxAttempts {
+			require.ErrorIs(t, s.VerifyPhone(userID, "000000x"), ErrInvalidCode)
+		}
+		require.ErrorIs(t, s.VerifyPhone(userID, code), ErrTooManyRequests)
+	})
+
+	t.Run("code expires", func(t *testing.T) {
+		now = now.Add(phoneResendInterval)
+		require.NoError(t, s.RequestPhoneVerification(userID, "07 00 00 00 00"))
+		code := sms.LastCode(t)
+		now = now.Add(phoneCodeTTL)
+		require.ErrorIs(t, s.VerifyPhone(userID, code), ErrInvalidCode)
+	})
+
+	t.Run("no code without a secret", func(t *testing.T) {
+		now = now.Add(phoneResendInterval)
+		s.phoneCodeSecret = nil
+		require.ErrorContains(t, s.RequestPhoneVerification(userID, "07 00 00 00 00"), "secret")
+	})
+}
+
+func TestUpdateUserResetsPhoneVerification(t *testing.T) {
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	verifiedAt := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	db.Users[0].Phone = "+33612345678"
+	db.Users[0].PhoneVerifiedAt = &verifiedAt
+
+	user := db.Users[0]
+	user.Phone = "06 12 34 56 78"
+	got, err := s.UpdateUser(user)
+	require.NoError(t, err)
+	require.Equal(t, &verifiedAt, got.PhoneVerifiedAt)
+
+	user.Phone = "07 00 00 00 00"
+	got, err = s.UpdateUser(user)
+	require.NoError(t, err)
+	require.Equal(t, "+33700000000", got.Phone)
+	require.Nil(t, got.PhoneVerifiedAt)
+}
+
+func TestPhoneVerificationHandlers(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	actor := Actor{UserID: uuid.New(), Role: RolePassenger}
+	mockSvc.On("RequestPhoneVerification", actor.UserID, "0612345678").Return(nil)
+	mockSvc.On("RequestPhoneVerification", actor.UserID, "nope").Return(ErrInvalidPhone)
+	mockSvc.On("VerifyPhone", actor.UserID, "123456").Return(nil)
+	mockSvc.On("VerifyPhone", actor.UserID, "000000").Return(ErrInvalidCode)
+	mockSvc.On("VerifyPhone", actor.UserID, "111111").Return(ErrTooManyRequests)
+
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		body    string
+		actor   *Actor
+		status  int
+	}{
+		{h.PhoneVerificationHandler, `{"phone":"0612345678"}`, &actor, http.StatusAccepted},
+		{h.PhoneVerificationHandler, `{"phone":"nope"}`, &actor, http.StatusBadRequest},
+		{h.PhoneVerificationHandler, `{"phone":"0612345678"}`, nil, http.StatusUnauthorized},
+		{h.ConfirmPhoneHandler, `{"code":"123456"}`, &actor, http.StatusNoContent},
+		{h.ConfirmPhoneHandler, `{"code":"000000"}`, &actor, http.StatusBadRequest},
+		{h.ConfirmPhoneHandler, `{"code":"111111"}`, &actor, http.StatusTooManyRequests},
+		{h.ConfirmPhoneHandler, `{}`, &actor, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/users/verify-phone", bytes.NewBufferString(tc.body))
+		if tc.actor != nil {
+			req = asActor(req, *tc.actor)
+		}
+		w := httptest.NewRecorder()
+		tc.handler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.body)
+	}
+}
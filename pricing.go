@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Carpooling stays cost-sharing : a seat may not cost more than a share of
+// what the ride costs the driver. The tables of fuel prices and tolls are read
+// at startup from FUEL_PRICES_FILE and TOLLS_FILE, and the price of a seat is
+// capped at MAX_PRICE_PER_KM per km.
+const (
+	defaultFuelPricesFile = "pricing/fuel_prices.csv"
+	defaultTollsFile      = "pricing/tolls.csv"
+	// DefaultMaxPricePerKm is the cap of the price of a seat per km, in
+	// thousandths of the currency.
+	DefaultMaxPricePerKm = 150
+)
+
+// The consumption assumed of a ride without a vehicle, or of a vehicle that
+// did not give its own.
+const (
+	DefaultFuel        = VehicleFuelPetrol
+	DefaultConsumption = 6.5
+)
+
+var (
+	ErrPriceAboveCap       = errors.New("the price of a seat is above the cost-sharing cap")
+	ErrInvalidRideDistance = errors.New("the distance of the ride is required to price it")
+	ErrInvalidPricing      = errors.New("invalid pricing table")
+)
+
+// Toll is what the tolls between two places cost, either way.
+type Toll struct {
+	Origin      string
+	Destination string
+	Amount      Money
+}
+
+// Pricing holds the tables rides are priced from, in a single currency.
+type Pricing struct {
+	Currency string
+	// FuelPrices are the prices of a litre, of a kWh for electric cars, in
+	// thousandths of Currency.
+	FuelPrices map[string]int64
+	Tolls      []Toll
+	// MaxPerKm is the most a seat may cost per km of the ride, in thousandths
+	// of Currency.
+	MaxPerKm int64
+}
+
+// PriceSuggestion is what a ride costs its driver and the fair price of a
+// seat, the costs shared between the driver and the passengers.
+type PriceSuggestion struct {
+	Fuel  Money `json:"fuel"`
+	Tolls Money `json:"tolls"`
+	// Shares counts the seats offered and the driver's.
+	Shares     int   `json:"shares"`
+	PerSeat    Money `json:"per_seat"`
+	MaxPerSeat Money `json:"max_per_seat"`
+}
+
+// readTable reads a CSV file whose first row is header, # starts a comment.
+func readTable(path string, header []string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = len(header)
+	reader.TrimLeadingSpace = true
+	first, err := reader.Read()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w : %s : %s", ErrInvalidPricing, path, err)
+	}
+	if !slices.Equal(first, header) {
+		return nil, fmt.Errorf("%w : %s must start with %s", ErrInvalidPricing, path, strings.Join(header, ","))
+	}
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%w : %s : %s", ErrInvalidPricing, path, err)
+	}
+	return rows, nil
+}
+
+// LoadFuelPrices reads the price per litre, or per kWh, of each fuel from
+// a "fuel,price" CSV file, prices in currency with up to 3 decimals.
+func LoadFuelPrices(path string) (map[string]int64, error) {
+	rows, err := readTable(path, []string{"fuel", "price"})
+	if err != nil {
+		return nil, err
+	}
+	prices := map[string]int64{}
+	for _, row := range rows {
+		fuel := strings.ToLower(row[0])
+		if !slices.Contains(VehicleFuels, fuel) {
+			return nil, fmt.Errorf("%w : %s : unknown fuel %s", ErrInvalidPricing, path, row[0])
+		}
+		price, err := parseDecimal(row[1], 3)
+		if err != nil || price <= 0 {
+			return nil, fmt.Errorf("%w : %s : bad price %q for %s", ErrInvalidPricing, path, row[1], fuel)
+		}
+		prices[fuel] = price
+	}
+	return prices, nil
+}
+
+// LoadTolls reads the tolls from an "origin,destination,amount" CSV file,
+// amounts in currency.
+func LoadTolls(path string, currency string) ([]Toll, error) {
+	rows, err := readTable(path, []string{"origin", "destination", "amount"})
+	if err != nil {
+		return nil, err
+	}
+	tolls := []Toll{}
+	for _, row := range rows {
+		amount, err := ParseMoney(row[2], currency)
+		if err != nil || amount.Minor < 0 {
+			return nil, fmt.Errorf("%w : %s : bad toll %q from %s to %s", ErrInvalidPricing, path, row[2], row[0], row[1])
+		}
+		tolls = append(tolls, Toll{Origin: row[0], Destination: row[1], Amount: amount})
+	}
+	return tolls, nil
+}
+
+// pricingFromEnv loads the pricing tables from FUEL_PRICES_FILE and
+// TOLLS_FILE, and the cap from MAX_PRICE_PER_KM, such as "0.15".
+func pricingFromEnv() (*Pricing, error) {
+	pricing := &Pricing{Currency: PaymentCurrency, MaxPerKm: DefaultMaxPricePerKm}
+	fuelPricesFile, tollsFile := os.Getenv("FUEL_PRICES_FILE"), os.Getenv("TOLLS_FILE")
+	if fuelPricesFile == "" {
+		fuelPricesFile = defaultFuelPricesFile
+	}
+	if tollsFile == "" {
+		tollsFile = defaultTollsFile
+	}
+	var err error
+	if pricing.FuelPrices, err = LoadFuelPrices(fuelPricesFile); err != nil {
+		return nil, err
+	}
+	if pricing.Tolls, err = LoadTolls(tollsFile, pricing.Currency); err != nil {
+		return nil, err
+	}
+	if maxPerKm := os.Getenv("MAX_PRICE_PER_KM"); maxPerKm != "" {
+		pricing.MaxPerKm, err = parseDecimal(maxPerKm, 3)
+		if err != nil || pricing.MaxPerKm <= 0 {
+			return nil, fmt.Errorf("%w : bad MAX_PRICE_PER_KM %q", ErrInvalidPricing, maxPerKm)
+		}
+	}
+	return pricing, nil
+}
+
+// money rounds an amount in thousandths of the currency to its minor unit.
+func (pricing *Pricing) money(thousandths float64, round func(float64) float64) Money {
+	return NewMoney(int64(round(thousandths*float64(pow10(exponent(pricing.Currency)))/1000)), pricing.Currency)
+}
+
+// MaxPerSeat is the most a seat may cost on a ride of distance km, rounded
+// down to the minor unit.
+func (pricing *Pricing) MaxPerSeat(distance float64) Money {
+	return pricing.money(distance*float64(pricing.MaxPerKm), math.Floor)
+}
+
+// Toll returns what the tolls between origin and destination cost, nothing
+// when the table does not know the journey.
+func (pricing *Pricing) Toll(origin string, destination string) Money {
+	origin, destination = strings.TrimSpace(origin), strings.TrimSpace(destination)
+	for _, toll := range pricing.Tolls {
+		if strings.EqualFold(toll.Origin, origin) && strings.EqualFold(toll.Destination, destination) ||
+			strings.EqualFold(toll.Origin, destination) && strings.EqualFold(toll.Destination, origin) {
+			return toll.Amount
+		}
+	}
+	return NewMoney(0, pricing.Currency)
+}
+
+// Suggest prices a seat of ride, driven with vehicle when it is not nil. The
+// fuel and the tolls are shared between the driver and the seats offered, and
+// the share never exceeds the cap.
+func (pricing *Pricing) Suggest(ride Ride, vehicle *Vehicle) (PriceSuggestion, error) {
+	if ride.Distance <= 0 {
+		return PriceSuggestion{}, ErrInvalidRideDistance
+	}
+	fuel, consumption := DefaultFuel, DefaultConsumption
+	if vehicle != nil && vehicle.Fuel != "" {
+		fuel = vehicle.Fuel
+	}
+	if vehicle != nil && vehicle.Consumption > 0 {
+		consumption = vehicle.Consumption
+	}
+	price, ok := pricing.FuelPrices[fuel]
+	if !ok {
+		return PriceSuggestion{}, fmt.Errorf("%w : no price for %s", ErrInvalidPricing, fuel)
+	}
+	suggestion := PriceSuggestion{
+		Fuel:       pricing.money(ride.Distance*consumption/100*float64(price), math.Round),
+		Tolls:      pricing.Toll(ride.Origin, ride.Destination),
+		Shares:     max(ride.NumberOfSeats, 1) + 1,
+		MaxPerSeat: pricing.MaxPerSeat(ride.Distance),
+	}
+	suggestion.PerSeat = suggestion.Fuel.Add(suggestion.Tolls).Share(1, int64(suggestion.Shares))
+	if suggestion.PerSeat.Minor > suggestion.MaxPerSeat.Minor {
+		suggestion.PerSeat = suggestion.MaxPerSeat
+	}
+	return suggestion, nil
+}
+
+// Check refuses a ride whose seats cost more than the cap for its distance.
+// A free ride is always cost-sharing.
+func (pricing *Pricing) Check(ride Ride) error {
+	if ride.Price.IsZero() {
+		return nil
+	}
+	if ride.Price.Minor < 0 {
+		return fmt.Errorf("%w : the price of a seat cannot be negative", ErrInvalidMoney)
+	}
+	if ride.Price.Currency != pricing.Currency {
+		return fmt.Errorf("%w : rides are priced in %s", ErrInvalidMoney, pricing.Currency)
+	}
+	if ride.Distance <= 0 {
+		return ErrInvalidRideDistance
+	}
+	if maximum := pricing.MaxPerSeat(ride.Distance); ride.Price.Minor > maximum.Minor {
+		return fmt.Errorf("%w : %s for %.0f km, at most %s", ErrPriceAboveCap, ride.Price, ride.Distance, maximum)
+	}
+	return nil
+}
+
+// SuggestRidePrice prices a seat of a ride about to be published, with the
+// vehicle of the ride when it has one.
+func (service *CovoitService) SuggestRidePrice(ride Ride) (PriceSuggestion, error) {
+	if err := service.checkRideVehicle(ride); err != nil {
+		return PriceSuggestion{}, err
+	}
+	var vehicle *Vehicle
+	if ride.VehicleID != nil {
+		v, err := service.vehicles.GetVehicleById(*ride.VehicleID)
+		if err != nil {
+			return PriceSuggestion{}, err
+		}
+		vehicle = &v
+	}
+	return service.pricing.Suggest(ride, vehicle)
+}
+
+// PriceSuggestionHandler suggests the price of a seat for the ride posted,
+// before the driver publishes it.
+func (h *Handler) PriceSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ride := Ride{}
+	if err := json.NewDecoder(r.Body).Decode(&ride); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ride.DriverID = actor.UserID
+	if !Authorize(actor, ActionCreateRide, RideResource(ride)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	suggestion, err := h.Service.SuggestRidePrice(ride)
+	if errors.Is(err, ErrInvalidRideDistance) || errors.Is(err, ErrInvalidVehicle) || errors.Is(err, ErrTooManySeats) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestion)
+}
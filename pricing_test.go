@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPricingTables(t *testing.T) {
+	prices, err := LoadFuelPrices(defaultFuelPricesFile)
+	require.NoError(t, err)
+	require.Equal(t, int64(1799), prices[VehicleFuelPetrol], "prices have 3 decimals")
+	require.Len(t, prices, len(VehicleFuels))
+	tolls, err := LoadTolls(defaultTollsFile, "EUR")
+	require.NoError(t, err)
+	pricing := &Pricing{Currency: "EUR", Tolls: tolls}
+	require.Equal(t, eur(3650), pricing.Toll("lyon ", "Paris"), "either way, whatever the case")
+	require.True(t, pricing.Toll("Lyon", "Brest").IsZero())
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		content string
+		load    func(path string) error
+	}{
+		{"missing header", "petrol,1.799\n", func(path string) error { _, err := LoadFuelPrices(path); return err }},
+		{"unknown fuel", "fuel,price\ncoal,0.5\n", func(path string) error { _, err := LoadFuelPrices(path); return err }},
+		{"too precise", "fuel,price\npetrol,1.7999\n", func(path string) error { _, err := LoadFuelPrices(path); return err }},
+		{"missing column", "fuel,price\npetrol\n", func(path string) error { _, err := LoadFuelPrices(path); return err }},
+		{"toll in cents", "origin,destination,amount\nLyon,Paris,36.505\n", func(path string) error { _, err := LoadTolls(path, "EUR"); return err }},
+		{"negative toll", "origin,destination,amount\nLyon,Paris,-1\n", func(path string) error { _, err := LoadTolls(path, "EUR"); return err }},
+	} {
+		path := filepath.Join(dir, "table.csv")
+		require.NoError(t, os.WriteFile(path, []byte(tc.content), 0o600))
+		require.ErrorIs(t, tc.load(path), ErrInvalidPricing, tc.name)
+	}
+}
+
+func TestPricingFromEnv(t *testing.T) {
+	pricing, err := pricingFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, int64(DefaultMaxPricePerKm), pricing.MaxPerKm)
+
+	t.Setenv("MAX_PRICE_PER_KM", "0.12")
+	pricing, err = pricingFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, int64(120), pricing.MaxPerKm)
+	require.Equal(t, eur(4800), pricing.MaxPerSeat(400))
+
+	t.Setenv("MAX_PRICE_PER_KM", "free")
+	_, err = pricingFromEnv()
+	require.ErrorIs(t, err, ErrInvalidPricing)
+
+	t.Setenv("MAX_PRICE_PER_KM", "")
+	t.Setenv("TOLLS_FILE", filepath.Join(t.TempDir(), "missing.csv"))
+	_, err = pricingFromEnv()
+	require.Error(t, err)
+}
+
+func TestSuggestRidePrice(t *testing.T) {
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	vehicle, err := s.CreateVehicle(driverID, Vehicle{Make: "Peugeot", Model: "308", Plate: "EF-456-GH", Seats: 5, Fuel: VehicleFuelDiesel, Consumption: 5})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name string
+		ride Ride
+		want PriceSuggestion
+	}{
+		{
+			// 26 litres of petrol at 1.800 and the toll, shared by 4.
+			"default consumption",
+			Ride{DriverID: driverID, Origin: "Lyon", Destination: "Paris", Distance: 400, NumberOfSeats: 3},
+			PriceSuggestion{Fuel: eur(4680), Tolls: eur(3650), Shares: 4, PerSeat: eur(2083), MaxPerSeat: eur(6000)},
+		},
+		{
+			"vehicle consumption",
+			Ride{DriverID: driverID, VehicleID: &vehicle.VehicleID, Origin: "Paris", Destination: "Lyon", Distance: 400, NumberOfSeats: 3},
+			PriceSuggestion{Fuel: eur(3400), Tolls: eur(3650), Shares: 4, PerSeat: eur(1763), MaxPerSeat: eur(6000)},
+		},
+		{
+			"no toll",
+			Ride{DriverID: driverID, Origin: "Lyon", Destination: "Brest", Distance: 100, NumberOfSeats: 1},
+			PriceSuggestion{Fuel: eur(1170), Tolls: eur(0), Shares: 2, PerSeat: eur(585), MaxPerSeat: eur(1500)},
+		},
+		{
+			"capped",
+			Ride{DriverID: driverID, Origin: "Lyon", Destination: "Paris", Distance: 10, NumberOfSeats: 1},
+			PriceSuggestion{Fuel: eur(117), Tolls: eur(3650), Shares: 2, PerSeat: eur(150), MaxPerSeat: eur(150)},
+		},
+	} {
+		got, err := s.SuggestRidePrice(tc.ride)
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.want, got, tc.name)
+	}
+
+	_, err = s.SuggestRidePrice(Ride{DriverID: driverID, Origin: "Lyon", Destination: "Paris"})
+	require.ErrorIs(t, err, ErrInvalidRideDistance)
+	_, err = s.SuggestRidePrice(Ride{DriverID: uuid.New(), VehicleID: &vehicle.VehicleID, Distance: 400})
+	require.ErrorIs(t, err, ErrInvalidVehicle)
+}
+
+func TestRidePriceCap(t *testing.T) {
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+
+	for _, tc := range []struct {
+		name string
+		ride Ride
+		err  error
+	}{
+		{"at the cap", Ride{Distance: 400, Price: eur(6000)}, nil},
+		{"free", Ride{}, nil},
+		{"above the cap", Ride{Distance: 400, Price: eur(6001)}, ErrPriceAboveCap},
+		{"priced without distance", Ride{Price: eur(500)}, ErrInvalidRideDistance},
+		{"other currency", Ride{Distance: 400, Price: NewMoney(500, "CHF")}, ErrInvalidMoney},
+		{"negative", Ride{Distance: 400, Price: eur(-500)}, ErrInvalidMoney},
+	} {
+		tc.ride.RideID, tc.ride.DriverID = uuid.New(), driverID
+		_, err := s.CreateRide(tc.ride)
+		if tc.err == nil {
+			require.NoError(t, err, tc.name)
+		} else {
+			require.ErrorIs(t, err, tc.err, tc.name)
+		}
+	}
+
+	ride := Ride{RideID: uuid.New(), DriverID: driverID, Distance: 100, Price: eur(1500), Status: RideScheduled}
+	db.Rides = append(db.Rides, ride)
+	ride.Price = eur(1501)
+	_, err := s.UpdateRide(ride)
+	require.ErrorIs(t, err, ErrPriceAboveCap)
+}
+
+func TestPriceSuggestionHandler(t *testing.T) {
+	driver := Actor{UserID: uuid.New(), Role: RoleDriver}
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	suggestion := PriceSuggestion{Fuel: eur(4680), Tolls: eur(3650), Shares: 4, PerSeat: eur(2083), MaxPerSeat: eur(6000)}
+	mockSvc.On("SuggestRidePrice", mock.MatchedBy(func(ride Ride) bool { return ride.Distance > 0 })).Return(suggestion, nil)
+	mockSvc.On("SuggestRidePrice", mock.Anything).Return(PriceSuggestion{}, ErrInvalidRideDistance)
+
+	for _, tc := range []struct {
+		name   string
+		actor  Actor
+		ride   Ride
+		status int
+	}{
+		{"driver", driver, Ride{DriverID: uuid.New(), Origin: "Lyon", Destination: "Paris", Distance: 400, NumberOfSeats: 3}, http.StatusOK},
+		{"no distance", driver, Ride{Origin: "Lyon", Destination: "Paris"}, http.StatusBadRequest},
+		{"passenger", Actor{UserID: uuid.New(), Role: RolePassenger}, Ride{Distance: 400}, http.StatusForbidden},
+	} {
+		body, _ := json.Marshal(tc.ride)
+		w := httptest.NewRecorder()
+		h.PriceSuggestionHandler(w, asActor(httptest.NewRequest(http.MethodPost, "/rides/price-suggestion", bytes.NewBuffer(body)), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+		if tc.status == http.StatusOK {
+			var got PriceSuggestion
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, suggestion, got)
+		}
+	}
+	mockSvc.AssertCalled(t, "SuggestRidePrice", mock.MatchedBy(func(ride Ride) bool { return ride.DriverID == driver.UserID }))
+
+	mockSvc.On("CreateRide", mock.Anything).Return(Ride{}, ErrPriceAboveCap)
+	body, _ := json.Marshal(Ride{DriverID: driver.UserID, Distance: 10, Price: eur(5000)})
+	w := httptest.NewRecorder()
+	h.RidesHandler(w, asActor(httptest.NewRequest(http.MethodPost, "/rides", bytes.NewBuffer(body)), driver))
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
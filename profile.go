@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidPatch = errors.New("invalid merge patch")
+	ErrInvalidEmail = errors.New("invalid email")
+	ErrEmailTaken   = errors.New("email already in use")
+)
+
+type Preferences struct {
+	Smoking  bool   `json:"smoking"`
+	Pets     bool   `json:"pets"`
+	Music    bool   `json:"music"`
+	Chatty   bool   `json:"chatty"`
+	Language string `json:"language"`
+	// NotificationChannels are the channels notifications are delivered
+	// through, defaultNotificationChannels when unset.
+	NotificationChannels []string `json:"notification_channels"`
+}
+
+// profile lists the fields of a user that can be changed with a PATCH.
+type profile struct {
+	FirstName   string      `json:"first_name"`
+	LastName    string      `json:"last_name"`
+	Email       string      `json:"email"`
+	Phone       string      `json:"phone"`
+	Address     string      `json:"adress"`
+	Bio         string      `json:"bio"`
+	Preferences Preferences `json:"preferences"`
+}
+
+func profileOf(user User) profile {
+	return profile{
+		FirstName:   user.FirstName,
+		LastName:    user.LastName,
+		Email:       user.Email,
+		Phone:       user.Phone,
+		Address:     user.Address,
+		Bio:         user.Bio,
+		Preferences: user.Preferences,
+	}
+}
+
+func (p profile) applyTo(user User) User {
+	user.FirstName = p.FirstName
+	user.LastName = p.LastName
+	user.Email = p.Email
+	user.Phone = p.Phone
+	user.Address = p.Address
+	user.Bio = p.Bio
+	user.Preferences = p.Preferences
+	return user
+}
+
+// mergePatch applies an RFC 7396 merge patch to target : null removes a
+// member, objects are merged recursively and any other value replaces the
+// member.
+func mergePatch(target any, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// patchProfile applies patch to the profile of user. Removed members fall back
+// to their zero value.
+func patchProfile(user User, patch []byte) (User, error) {
+	patchObject := map[string]any{}
+	if err := json.Unmarshal(patch, &patchObject); err != nil {
+		return User{}, ErrInvalidPatch
+	}
+
+	current, err := json.Marshal(profileOf(user))
+	if err != nil {
+		return User{}, err
+	}
+	target := map[string]any{}
+	if err := json.Unmarshal(current, &target); err != nil {
+		return User{}, err
+	}
+	for key := range patchObject {
+		if _, ok := target[key]; !ok {
+			return User{}, fmt.Errorf("%w : %s cannot be changed", ErrInvalidPatch, key)
+		}
+	}
+
+	merged, err := json.Marshal(mergePatch(target, patchObject))
+	if err != nil {
+		return User{}, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(merged))
+	decoder.DisallowUnknownFields()
+	patched := profile{}
+	if err := decoder.Decode(&patched); err != nil {
+		return User{}, fmt.Errorf("%w : %s", ErrInvalidPatch, err)
+	}
+	if err := validateNotificationChannels(patched.Preferences.NotificationChannels); err != nil {
+		return User{}, fmt.Errorf("%w : %s", ErrInvalidPatch, err)
+	}
+	return patched.applyTo(user), nil
+}
+
+func (service *CovoitService) PatchUser(userID uuid.UUID, patch []byte) (User, error) {
+	user, err := service.repository.GetUserById(userID)
+	if err != nil {
+		return User{}, err
+	}
+	user, err = patchProfile(user, patch)
+	if err != nil {
+		return User{}, err
+	}
+	return service.UpdateUser(user)
+}
+
+func validateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return ErrInvalidEmail
+	}
+	return nil
+}
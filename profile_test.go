@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatch(t *testing.T) {
+	// Examples from RFC 7396, appendix A.
+	tests := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		var target, patch any
+		require.NoError(t, json.Unmarshal([]byte(tt.target), &target))
+		require.NoError(t, json.Unmarshal([]byte(tt.patch), &patch))
+		got, err := json.Marshal(mergePatch(target, patch))
+		require.NoError(t, err)
+		require.JSONEq(t, tt.want, string(got), "%s + %s", tt.target, tt.patch)
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	s := NewMockService(db)
+	s.mailer = mailer
+	fatenID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	db.Users[1].Bio = "Driving to Paris every week"
+	db.Users[1].Preferences = Preferences{Music: true, Language: "fr"}
+
+	t.Run("partial update keeps other fields", func(t *testing.T) {
+		user, err := s.PatchUser(fatenID, []byte(`{"first_name":"Fatene","preferences":{"pets":true}}`))
+		require.NoError(t, err)
+		require.Equal(t, "Fatene", user.FirstName)
+		require.Equal(t, "Sayeh", user.LastName)
+		require.Equal(t, "Driving to Paris every week", user.Bio)
+		require.Equal(t, Preferences{Music: true, Pets: true, Language: "fr"}, user.Preferences)
+		require.NotNil(t, user.EmailVerifiedAt)
+		require.Empty(t, mailer.Sent)
+	})
+
+	t.Run("null clears a field", func(t *testing.T) {
+		user, err := s.PatchUser(fatenID, []byte(`{"bio":null,"preferences":{"language":null}}`))
+		require.NoError(t, err)
+		require.Empty(t, user.Bio)
+		require.Equal(t, Preferences{Music: true, Pets: true}, user.Preferences)
+	})
+
+	t.Run("immutable and unknown fields are rejected", func(t *testing.T) {
+		for _, patch := range []string{
+			`{"role":"admin"}`,
+			`{"email_verified_at":"2025-01-01T00:00:00Z"}`,
+			`{"user_id":"652c99d0-39a5-4797-97a6-09eba33f2bd7"}`,
+			`{"preferences":{"unicorns":true}}`,
+			`{"first_name":12}`,
+			`"just a string"`,
+			`not json`,
+		} {
+			_, err := s.PatchUser(fatenID, []byte(patch))
+			require.ErrorIs(t, err, ErrInvalidPatch, patch)
+		}
+	})
+
+	t.Run("email already used by someone else", func(t *testing.T) {
+		_, err := s.PatchUser(fatenID, []byte(`{"email":"mehdibenfredj3@gmail.com"}`))
+		require.ErrorIs(t, err, ErrEmailTaken)
+	})
+
+	t.Run("invalid email", func(t *testing.T) {
+		_, err := s.PatchUser(fatenID, []byte(`{"email":"not an email"}`))
+		require.ErrorIs(t, err, ErrInvalidEmail)
+		_, err = s.PatchUser(fatenID, []byte(`{"email":null}`))
+		require.ErrorIs(t, err, ErrInvalidEmail)
+	})
+
+	t.Run("email change requires verification again", func(t *testing.T) {
+		user, err := s.PatchUser(fatenID, []byte(`{"email":"faten@test.com"}`))
+		require.NoError(t, err)
+		require.Equal(t, "faten@test.com", user.Email)
+		require.Nil(t, user.EmailVerifiedAt)
+		mail, ok := mailer.Last()
+		require.True(t, ok)
+		require.Equal(t, "faten@test.com", mail.To)
+
+		_, err = s.CreateRide(Ride{DriverID: fatenID})
+		require.ErrorIs(t, err, ErrEmailNotVerified)
+	})
+}
+
+func TestUsersHandler_Patch(t *testing.T) {
+	owner := Actor{UserID: uuid.New(), Role: RolePassenger}
+	patch := []byte(`{"bio":"hello"}`)
+
+	for _, tc := range []struct {
+		name   string
+		actor  Actor
+		err    error
+		status int
+	}{
+		{"ok", owner, nil, http.StatusOK},
+		{"invalid patch", owner, ErrInvalidPatch, http.StatusBadRequest},
+		{"invalid email", owner, ErrInvalidEmail, http.StatusBadRequest},
+		{"email taken", owner, ErrEmailTaken, http.StatusConflict},
+		{"error", owner, errors.New("fail"), http.StatusInternalServerError},
+		{"not the owner", Actor{UserID: uuid.New(), Role: RolePassenger}, nil, http.StatusForbidden},
+		{"admin", admin, nil, http.StatusOK},
+	} {
+		mockSvc := new(MockService)
+		h := &Handler{Service: mockSvc}
+		mockSvc.On("PatchUser", owner.UserID, patch).Return(User{UserID: owner.UserID, Bio: "hello"}, tc.err)
+
+		req := asActor(httptest.NewRequest(http.MethodPatch, "/users?user_id="+owner.UserID.String(), bytes.NewBuffer(patch)), tc.actor)
+		w := httptest.NewRecorder()
+		h.UsersHandler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
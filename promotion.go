@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A promotion takes a percentage or a fixed amount off the price of a
+// booking.
+const (
+	PromotionPercent = "percent"
+	PromotionAmount  = "amount"
+)
+
+var PromotionKinds = []string{PromotionPercent, PromotionAmount}
+
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+var (
+	ErrPromotionNotFound = errors.New("promotion not found")
+	ErrInvalidPromotion  = errors.New("invalid promotion")
+	ErrPromoCodeTaken    = errors.New("promotion code already taken")
+	// ErrPromotionNotApplicable is a code that does not apply to the booking
+	// it is given with.
+	ErrPromotionNotApplicable = errors.New("promotion does not apply")
+	ErrPromotionExhausted     = errors.New("promotion has no redemption left")
+	ErrPromotionRedeemed      = errors.New("a redeemed promotion cannot be deleted")
+)
+
+// Promotion is a code passengers book with to pay less. The platform funds
+// the discount, the driver earns on the full price.
+type Promotion struct {
+	PromotionID uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"promotion_id"`
+	// Code is uppercase, passengers may type it in any case.
+	Code string `gorm:"uniqueIndex" json:"code"`
+	Kind string `json:"kind"`
+	// Percent is the discount of a percent promotion, rounded like
+	// Money.Percent.
+	Percent int64 `json:"percent,omitempty"`
+	// Amount is the discount of an amount promotion.
+	Amount Money `gorm:"embedded;embeddedPrefix:amount_" json:"amount,omitzero"`
+	// MinimumAmount is the price a booking must reach for the promotion to
+	// apply.
+	MinimumAmount Money `gorm:"embedded;embeddedPrefix:minimum_amount_" json:"minimum_amount,omitzero"`
+	// FirstRideOnly promotions only apply to the first booking of a
+	// passenger.
+	FirstRideOnly bool `json:"first_ride_only"`
+	// MaxRedemptions and MaxPerUser limit how many bookings the promotion
+	// applies to, in all and for each passenger, 0 for no limit.
+	MaxRedemptions int64 `json:"max_redemptions"`
+	MaxPerUser     int64 `json:"max_per_user"`
+	// Redemptions counts the bookings the promotion was applied to. A booking
+	// cancelled afterwards does not give its redemption back.
+	Redemptions int64 `json:"redemptions"`
+	// StartsAt and EndsAt bound when the promotion applies, EndsAt excluded.
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func validatePromotion(promotion Promotion) error {
+	if !promoCodePattern.MatchString(promotion.Code) {
+		return fmt.Errorf("%w : the code must be 3 to 32 letters, digits, - or _", ErrInvalidPromotion)
+	}
+	switch promotion.Kind {
+	case PromotionPercent:
+		if promotion.Percent < 1 || promotion.Percent > 100 || !promotion.Amount.IsZero() {
+			return fmt.Errorf("%w : a percent promotion takes a percent between 1 and 100", ErrInvalidPromotion)
+		}
+	case PromotionAmount:
+		if promotion.Amount.Minor <= 0 || promotion.Percent != 0 {
+			return fmt.Errorf("%w : an amount promotion takes a positive amount", ErrInvalidPromotion)
+		}
+		if _, ok := currencyExponents[promotion.Amount.Currency]; !ok {
+			return fmt.Errorf("%w : unknown currency %q", ErrInvalidPromotion, promotion.Amount.Currency)
+		}
+	default:
+		return fmt.Errorf("%w : kind must be one of %s", ErrInvalidPromotion, strings.Join(PromotionKinds, ", "))
+	}
+	if promotion.MinimumAmount.Minor < 0 {
+		return fmt.Errorf("%w : the minimum amount cannot be negative", ErrInvalidPromotion)
+	}
+	if promotion.MaxRedemptions < 0 || promotion.MaxPerUser < 0 {
+		return fmt.Errorf("%w : limits cannot be negative", ErrInvalidPromotion)
+	}
+	if promotion.StartsAt != nil && promotion.EndsAt != nil && !promotion.EndsAt.After(*promotion.StartsAt) {
+		return fmt.Errorf("%w : the promotion must end after it starts", ErrInvalidPromotion)
+	}
+	return nil
+}
+
+// Discount returns what promotion takes off price at at. The passenger always
+// pays at least the minor unit, so that the booking has a payment to carry
+// the discount to the driver.
+func (promotion Promotion) Discount(price Money, at time.Time) (Money, error) {
+	if promotion.StartsAt != nil && at.Before(*promotion.StartsAt) {
+		return Money{}, fmt.Errorf("%w : %s has not started", ErrPromotionNotApplicable, promotion.Code)
+	}
+	if promotion.EndsAt != nil && !at.Before(*promotion.EndsAt) {
+		return Money{}, fmt.Errorf("%w : %s has ended", ErrPromotionNotApplicable, promotion.Code)
+	}
+	if price.Minor <= 0 {
+		return Money{}, fmt.Errorf("%w : the booking is free", ErrPromotionNotApplicable)
+	}
+	if !promotion.MinimumAmount.IsZero() &&
+		(promotion.MinimumAmount.Currency != price.Currency || price.Minor < promotion.MinimumAmount.Minor) {
+		return Money{}, fmt.Errorf("%w : %s applies from %s", ErrPromotionNotApplicable, promotion.Code, promotion.MinimumAmount)
+	}
+	discount := price.Percent(promotion.Percent)
+	if promotion.Kind == PromotionAmount {
+		if promotion.Amount.Currency != price.Currency {
+			return Money{}, fmt.Errorf("%w : %s applies to prices in %s", ErrPromotionNotApplicable, promotion.Code, promotion.Amount.Currency)
+		}
+		discount = promotion.Amount
+	}
+	if most := price.Sub(NewMoney(1, price.Currency)); discount.Minor > most.Minor {
+		discount = most
+	}
+	return discount, nil
+}
+
+// liveBooking tells whether booking still holds its seat and the redemption
+// of its promotion, neither deleted nor cancelled.
+func liveBooking(booking Booking) bool {
+	return !booking.DeletedAt.Valid && booking.Status != BookingCancelled
+}
+
+// checkRedemption tells whether promotion may be redeemed once more by the
+// passenger whose bookings are given. Only live bookings count.
+func (promotion Promotion) checkRedemption(bookings []Booking) error {
+	if promotion.MaxRedemptions > 0 && promotion.Redemptions >= promotion.MaxRedemptions {
+		return ErrPromotionExhausted
+	}
+	bookings = slices.DeleteFunc(slices.Clone(bookings), func(booking Booking) bool { return !liveBooking(booking) })
+	redeemed := 0
+	for _, booking := range bookings {
+		if booking.PromotionID != nil && *booking.PromotionID == promotion.PromotionID {
+			redeemed++
+		}
+	}
+	if promotion.MaxPerUser > 0 && int64(redeemed) >= promotion.MaxPerUser {
+		return fmt.Errorf("%w : %s was already used", ErrPromotionNotApplicable, promotion.Code)
+	}
+	if promotion.FirstRideOnly && len(bookings) > 0 {
+		return fmt.Errorf("%w : %s is for a first ride", ErrPromotionNotApplicable, promotion.Code)
+	}
+	return nil
+}
+
+// redemptionsOf counts the redemptions the bookings hold, by promotion.
+// Cancelled bookings gave theirs back already.
+func redemptionsOf(bookings []Booking) map[uuid.UUID]int64 {
+	redemptions := map[uuid.UUID]int64{}
+	for _, booking := range bookings {
+		if booking.PromotionID != nil && booking.Status != BookingCancelled {
+			redemptions[*booking.PromotionID]++
+		}
+	}
+	return redemptions
+}
+
+// releasePromotions gives back within tx the redemptions of the bookings
+// being deleted or cancelled.
+func releasePromotions(tx *gorm.DB, bookings ...Booking) error {
+	for promotionID, count := range redemptionsOf(bookings) {
+		err := tx.Model(&Promotion{}).
+			Where("promotion_id = ?", promotionID).
+			Update("redemptions", gorm.Expr("GREATEST(redemptions - ?, 0)", count)).Error
+		if err != nil {
+			return fmt.Errorf("could not release promotion %s, err : %s", promotionID, err)
+		}
+	}
+	return nil
+}
+
+// reclaimPromotions counts again within tx the redemptions of the bookings
+// restored. A promotion redeemed up to its limit since cannot take them back.
+func reclaimPromotions(tx *gorm.DB, bookings ...Booking) error {
+	for promotionID, count := range redemptionsOf(bookings) {
+		result := tx.Model(&Promotion{}).
+			Where("promotion_id = ? AND (max_redemptions = 0 OR redemptions + ? <= max_redemptions)", promotionID, count).
+			Update("redemptions", gorm.Expr("redemptions + ?", count))
+		if result.Error != nil {
+			return fmt.Errorf("could not redeem promotion %s, err : %s", promotionID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("%w : the promotion is exhausted", ErrNotRestorable)
+		}
+	}
+	return nil
+}
+
+// redeemPromotion counts within tx the redemption of the promotion applied
+// to booking. The promotion is locked until tx ends, so that concurrent
+// bookings cannot redeem it beyond its limits.
+func redeemPromotion(tx *gorm.DB, booking Booking) error {
+	if booking.PromotionID == nil {
+		return nil
+	}
+	ctx := context.Background()
+	promotion, err := gorm.G[Promotion](tx, clause.Locking{Strength: "UPDATE"}).Where("promotion_id = ?", *booking.PromotionID).First(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrPromotionNotFound
+	} else if err != nil {
+		return fmt.Errorf("could not get promotion %s, err : %s", *booking.PromotionID, err)
+	}
+	bookings, err := gorm.G[Booking](tx).Where("user_id = ? AND status <> ?", booking.UserID, BookingCancelled).Find(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get bookings of user %s, err : %s", booking.UserID, err)
+	}
+	if err := promotion.checkRedemption(bookings); err != nil {
+		return err
+	}
+	_, err = gorm.G[Promotion](tx).Where("promotion_id = ?", promotion.PromotionID).Update(ctx, "redemptions", gorm.Expr("redemptions + 1"))
+	if err != nil {
+		return fmt.Errorf("could not redeem promotion %s, err : %s", promotion.PromotionID, err)
+	}
+	return nil
+}
+
+type PromotionRepository interface {
+	CreatePromotion(promotion Promotion) (Promotion, error)
+	GetPromotions() ([]Promotion, error)
+	GetPromotionById(promotionID uuid.UUID) (Promotion, error)
+	GetPromotionByCode(code string) (Promotion, error)
+	// UpdatePromotion changes the terms of a promotion, not its redemptions.
+	UpdatePromotion(promotion Promotion) (Promotion, error)
+	// DeletePromotion deletes a promotion never redeemed.
+	DeletePromotion(promotionID uuid.UUID) error
+}
+
+func (repository *CovoitRepository) CreatePromotion(promotion Promotion) (Promotion, error) {
+	err := gorm.G[Promotion](repository.db).Create(context.Background(), &promotion)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return Promotion{}, ErrPromoCodeTaken
+	} else if err != nil {
+		return Promotion{}, fmt.Errorf("could not create promotion %s, err : %s", promotion.Code, err)
+	}
+	return promotion, nil
+}
+
+func (repository *CovoitRepository) GetPromotions() ([]Promotion, error) {
+	promotions, err := gorm.G[Promotion](repository.db).Order("created_at").Find(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not get promotions, err : %s", err)
+	}
+	return promotions, nil
+}
+
+func (repository *CovoitRepository) getPromotion(query string, arg any) (Promotion, error) {
+	promotion, err := gorm.G[Promotion](repository.db).Where(query, arg).First(context.Background())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Promotion{}, ErrPromotionNotFound
+	} else if err != nil {
+		return Promotion{}, fmt.Errorf("could not get promotion %v, err : %s", arg, err)
+	}
+	return promotion, nil
+}
+
+func (repository *CovoitRepository) GetPromotionById(promotionID uuid.UUID) (Promotion, error) {
+	return repository.getPromotion("promotion_id = ?", promotionID)
+}
+
+func (repository *CovoitRepository) GetPromotionByCode(code string) (Promotion, error) {
+	return repository.getPromotion("code = ?", code)
+}
+
+func (repository *CovoitRepository) UpdatePromotion(promotion Promotion) (Promotion, error) {
+	rows, err := gorm.G[Promotion](repository.db).
+		Where("promotion_id = ?", promotion.PromotionID).
+		Select("code", "kind", "percent", "amount_minor", "amount_currency", "minimum_amount_minor", "minimum_amount_currency",
+			"first_ride_only", "max_redemptions", "max_per_user", "starts_at", "ends_at").
+		Updates(context.Background(), promotion)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return Promotion{}, ErrPromoCodeTaken
+	} else if err != nil {
+		return Promotion{}, fmt.Errorf("could not update promotion %s, err : %s", promotion.PromotionID, err)
+	}
+	if rows == 0 {
+		return Promotion{}, ErrPromotionNotFound
+	}
+	return repository.GetPromotionById(promotion.PromotionID)
+}
+
+func (repository *CovoitRepository) DeletePromotion(promotionID uuid.UUID) error {
+	ctx := context.Background()
+	rows, err := gorm.G[Promotion](repository.db).Where("promotion_id = ? AND redemptions = 0", promotionID).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("could not delete promotion %s, err : %s", promotionID, err)
+	}
+	if rows == 0 {
+		if _, err := repository.GetPromotionById(promotionID); err != nil {
+			return err
+		}
+		return ErrPromotionRedeemed
+	}
+	return nil
+}
+
+func init() {
+	registerImpersonalTables("promotions")
+}
+
+// applyPromotion takes the discount of the promotion code of booking off the
+// price of its seats on ride, never off the price the client sent. The
+// redemption is counted with the booking.
+func (service *CovoitService) applyPromotion(booking *Booking, ride Ride) error {
+	promotion, err := service.promotions.GetPromotionByCode(normalizePromoCode(booking.PromoCode))
+	if errors.Is(err, ErrPromotionNotFound) {
+		return fmt.Errorf("%w : unknown code %s", ErrPromotionNotApplicable, booking.PromoCode)
+	} else if err != nil {
+		return err
+	}
+	price := ride.Price.Times(int64(booking.NumberOfSeats))
+	discount, err := promotion.Discount(price, service.clock())
+	if err != nil {
+		return err
+	}
+	booking.PromotionID, booking.Discount = &promotion.PromotionID, discount
+	booking.TotalPrice = price.Sub(discount)
+	return nil
+}
+
+func (service *CovoitService) GetPromotions() ([]Promotion, error) {
+	return service.promotions.GetPromotions()
+}
+
+func (service *CovoitService) CreatePromotion(promotion Promotion) (Promotion, error) {
+	promotion.Code = normalizePromoCode(promotion.Code)
+	if err := validatePromotion(promotion); err != nil {
+		return Promotion{}, err
+	}
+	promotion.PromotionID = uuid.Nil
+	promotion.Redemptions = 0
+	promotion.CreatedAt = service.clock()
+	return service.promotions.CreatePromotion(promotion)
+}
+
+func (service *CovoitService) UpdatePromotion(promotion Promotion) (Promotion, error) {
+	promotion.Code = normalizePromoCode(promotion.Code)
+	if err := validatePromotion(promotion); err != nil {
+		return Promotion{}, err
+	}
+	return service.promotions.UpdatePromotion(promotion)
+}
+
+func (service *CovoitService) DeletePromotion(promotionID uuid.UUID) error {
+	return service.promotions.DeletePromotion(promotionID)
+}
+
+// PromotionsHandler lets the admins list, create, change and delete the
+// promotions, ?promotion_id= naming the promotion to change or delete.
+func (h *Handler) PromotionsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManagePromotions, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			promotions, err := h.Service.GetPromotions()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(promotions)
+		}
+	case http.MethodPost, http.MethodPatch:
+		{
+			var promotion Promotion
+			if err := json.NewDecoder(r.Body).Decode(&promotion); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			status := http.StatusCreated
+			var err error
+			if r.Method == http.MethodPost {
+				promotion, err = h.Service.CreatePromotion(promotion)
+			} else {
+				status = http.StatusOK
+				if promotion.PromotionID, err = uuid.Parse(r.URL.Query().Get("promotion_id")); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				promotion, err = h.Service.UpdatePromotion(promotion)
+			}
+			if errors.Is(err, ErrInvalidPromotion) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if errors.Is(err, ErrPromoCodeTaken) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if errors.Is(err, ErrPromotionNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(promotion)
+		}
+	case http.MethodDelete:
+		{
+			promotionID, err := uuid.Parse(r.URL.Query().Get("promotion_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err = h.Service.DeletePromotion(promotionID)
+			if errors.Is(err, ErrPromotionNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+			} else if errors.Is(err, ErrPromotionRedeemed) {
+				w.WriteHeader(http.StatusConflict)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// redeem counts the redemption of the promotion of booking, like
+// redeemPromotion.
+func (m *MockRepository) redeem(booking Booking) error {
+	if booking.PromotionID == nil {
+		return nil
+	}
+	i := slices.IndexFunc(m.DB.Promotions, func(promotion Promotion) bool { return promotion.PromotionID == *booking.PromotionID })
+	if i < 0 {
+		return ErrPromotionNotFound
+	}
+	bookings := []Booking{}
+	for _, b := range append(slices.Clone(m.DB.Bookings), m.DB.DeletedBookings...) {
+		if b.UserID == booking.UserID {
+			bookings = append(bookings, b)
+		}
+	}
+	if err := m.DB.Promotions[i].checkRedemption(bookings); err != nil {
+		return err
+	}
+	m.DB.Promotions[i].Redemptions++
+	return nil
+}
+
+func (m *MockRepository) releasePromotions(bookings ...Booking) {
+	for promotionID, count := range redemptionsOf(bookings) {
+		for i, promotion := range m.DB.Promotions {
+			if promotion.PromotionID == promotionID {
+				m.DB.Promotions[i].Redemptions = max(promotion.Redemptions-count, 0)
+			}
+		}
+	}
+}
+
+func (m *MockRepository) reclaimPromotions(bookings ...Booking) error {
+	redemptions := redemptionsOf(bookings)
+	for promotionID, count := range redemptions {
+		for _, promotion := range m.DB.Promotions {
+			if promotion.PromotionID == promotionID && promotion.MaxRedemptions > 0 && promotion.Redemptions+count > promotion.MaxRedemptions {
+				return ErrNotRestorable
+			}
+		}
+	}
+	for promotionID, count := range redemptions {
+		for i, promotion := range m.DB.Promotions {
+			if promotion.PromotionID == promotionID {
+				m.DB.Promotions[i].Redemptions += count
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MockRepository) CreatePromotion(promotion Promotion) (Promotion, error) {
+	if _, err := m.GetPromotionByCode(promotion.Code); err == nil {
+		return Promotion{}, ErrPromoCodeTaken
+	}
+	promotion.PromotionID = uuid.New()
+	m.DB.Promotions = append(m.DB.Promotions, promotion)
+	return promotion, nil
+}
+
+func (m *MockRepository) GetPromotions() ([]Promotion, error) {
+	return m.DB.Promotions, nil
+}
+
+func (m *MockRepository) GetPromotionById(promotionID uuid.UUID) (Promotion, error) {
+	for _, promotion := range m.DB.Promotions {
+		if promotion.PromotionID == promotionID {
+			return promotion, nil
+		}
+	}
+	return Promotion{}, ErrPromotionNotFound
+}
+
+func (m *MockRepository) GetPromotionByCode(code string) (Promotion, error) {
+	for _, promotion := range m.DB.Promotions {
+		if promotion.Code == code {
+			return promotion, nil
+		}
+	}
+	return Promotion{}, ErrPromotionNotFound
+}
+
+func (m *MockRepository) UpdatePromotion(promotion Promotion) (Promotion, error) {
+	for i, existing := range m.DB.Promotions {
+		if existing.PromotionID == promotion.PromotionID {
+			if taken, err := m.GetPromotionByCode(promotion.Code); err == nil && taken.PromotionID != promotion.PromotionID {
+				return Promotion{}, ErrPromoCodeTaken
+			}
+			promotion.Redemptions, promotion.CreatedAt = existing.Redemptions, existing.CreatedAt
+			m.DB.Promotions[i] = promotion
+			return promotion, nil
+		}
+	}
+	return Promotion{}, ErrPromotionNotFound
+}
+
+func (m *MockRepository) DeletePromotion(promotionID uuid.UUID) error {
+	for i, promotion := range m.DB.Promotions {
+		if promotion.PromotionID == promotionID {
+			if promotion.Redemptions > 0 {
+				return ErrPromotionRedeemed
+			}
+			m.DB.Promotions = slices.Delete(m.DB.Promotions, i, i+1)
+			return nil
+		}
+	}
+	return ErrPromotionNotFound
+}
+
+func TestPromotionDiscount(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(24 * time.Hour)
+	for _, tc := range []struct {
+		name      string
+		promotion Promotion
+		price     Money
+		discount  Money
+		err       error
+	}{
+		{"percent", Promotion{Kind: PromotionPercent, Percent: 10}, eur(5000), eur(500), nil},
+		{"percent rounded", Promotion{Kind: PromotionPercent, Percent: 15}, eur(999), eur(150), nil},
+		{"amount", Promotion{Kind: PromotionAmount, Amount: eur(700)}, eur(5000), eur(700), nil},
+		{"amount above the price", Promotion{Kind: PromotionAmount, Amount: eur(7000)}, eur(5000), eur(4999), nil},
+		{"full percent", Promotion{Kind: PromotionPercent, Percent: 100}, eur(5000), eur(4999), nil},
+		{"minimum reached", Promotion{Kind: PromotionPercent, Percent: 10, MinimumAmount: eur(5000)}, eur(5000), eur(500), nil},
+		{"below the minimum", Promotion{Kind: PromotionPercent, Percent: 10, MinimumAmount: eur(5001)}, eur(5000), Money{}, ErrPromotionNotApplicable},
+		{"other currency", Promotion{Kind: PromotionAmount, Amount: NewMoney(500, "USD")}, eur(5000), Money{}, ErrPromotionNotApplicable},
+		{"free booking", Promotion{Kind: PromotionPercent, Percent: 10}, eur(0), Money{}, ErrPromotionNotApplicable},
+		{"not started", Promotion{Kind: PromotionPercent, Percent: 10, StartsAt: &later}, eur(5000), Money{}, ErrPromotionNotApplicable},
+		{"ended", Promotion{Kind: PromotionPercent, Percent: 10, EndsAt: &now}, eur(5000), Money{}, ErrPromotionNotApplicable},
+		{"within its window", Promotion{Kind: PromotionPercent, Percent: 10, StartsAt: &now, EndsAt: &later}, eur(5000), eur(500), nil},
+	} {
+		discount, err := tc.promotion.Discount(tc.price, now)
+		require.ErrorIs(t, err, tc.err, tc.name)
+		require.Equal(t, tc.discount, discount, tc.name)
+	}
+}
+
+func TestValidatePromotion(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name      string
+		promotion Promotion
+		valid     bool
+	}{
+		{"percent", Promotion{Code: "WELCOME10", Kind: PromotionPercent, Percent: 10}, true},
+		{"amount", Promotion{Code: "FIVE-OFF", Kind: PromotionAmount, Amount: eur(500), MaxRedemptions: 100, MaxPerUser: 1}, true},
+		{"short code", Promotion{Code: "AB", Kind: PromotionPercent, Percent: 10}, false},
+		{"lowercase code", Promotion{Code: "welcome", Kind: PromotionPercent, Percent: 10}, false},
+		{"no kind", Promotion{Code: "WELCOME"}, false},
+		{"percent above 100", Promotion{Code: "WELCOME", Kind: PromotionPercent, Percent: 101}, false},
+		{"percent with an amount", Promotion{Code: "WELCOME", Kind: PromotionPercent, Percent: 10, Amount: eur(500)}, false},
+		{"no amount", Promotion{Code: "WELCOME", Kind: PromotionAmount}, false},
+		{"unknown currency", Promotion{Code: "WELCOME", Kind: PromotionAmount, Amount: NewMoney(500, "XXX")}, false},
+		{"negative limit", Promotion{Code: "WELCOME", Kind: PromotionPercent, Percent: 10, MaxPerUser: -1}, false},
+		{"ends before it starts", Promotion{Code: "WELCOME", Kind: PromotionPercent, Percent: 10, StartsAt: &now, EndsAt: &now}, false},
+	} {
+		err := validatePromotion(tc.promotion)
+		if tc.valid {
+			require.NoError(t, err, tc.name)
+		} else {
+			require.ErrorIs(t, err, ErrInvalidPromotion, tc.name)
+		}
+	}
+}
+
+func (f *paymentFixture) promote(t *testing.T, promotion Promotion) Promotion {
+	t.Helper()
+	promotion, err := f.service.CreatePromotion(promotion)
+	require.NoError(t, err)
+	return promotion
+}
+
+func (f *paymentFixture) bookWithCode(t *testing.T, userID uuid.UUID, code string) (Booking, error) {
+	t.Helper()
+	booking, err := f.service.CreateBooking(Booking{BookingID: uuid.New(), RideID: f.ride.RideID, UserID: userID, NumberOfSeats: 2, PromoCode: code})
+	if err != nil {
+		return Booking{}, err
+	}
+	return f.service.ApproveBooking(booking.BookingID)
+}
+
+func TestBookingWithPromotion(t *testing.T) {
+	f := newPaymentFixture(t)
+	promotion := f.promote(t, Promotion{Code: "welcome10", Kind: PromotionPercent, Percent: 10})
+	require.Equal(t, "WELCOME10", promotion.Code)
+
+	booking, err := f.bookWithCode(t, f.passengerID, " Welcome10 ")
+	require.NoError(t, err)
+	require.Equal(t, &promotion.PromotionID, booking.PromotionID)
+	require.Equal(t, eur(500), booking.Discount)
+	require.Equal(t, eur(4500), booking.TotalPrice)
+	require.Equal(t, int64(1), f.db.Promotions[0].Redemptions)
+	payment := f.payment(t, booking.BookingID)
+	require.Equal(t, eur(4500), payment.Amount)
+	require.Equal(t, eur(500), payment.Discount)
+
+	*f.now = f.ride.DepartureTime
+	require.NoError(t, f.service.CompleteRide(f.ride.RideID, nil))
+	require.Len(t, f.db.Journals, 1)
+	require.NoError(t, checkJournal(f.db.Journals[0]))
+	require.Equal(t, eur(4500), accountBalance(f.db, AccountCash))
+	require.Equal(t, eur(500), accountBalance(f.db, AccountPromotions), "the platform funds the discount")
+	require.Equal(t, eur(-500), accountBalance(f.db, AccountFees), "the fee is on the full price")
+	wallet, err := f.service.GetWallet(f.driverID)
+	require.NoError(t, err)
+	require.Equal(t, eur(4500), wallet.Balance, "the driver earns as without the promotion")
+
+	require.Len(t, f.db.Invoices, 1)
+	require.Equal(t, []InvoiceLine{
+		{Kind: InvoiceLineContribution, Amount: eur(4500), VAT: eur(0)},
+		{Kind: InvoiceLineFee, Amount: eur(500), VAT: eur(83)},
+		{Kind: InvoiceLineDiscount, Amount: eur(-500), VAT: eur(0)},
+	}, f.db.Invoices[0].Lines)
+	require.Equal(t, eur(4500), f.db.Invoices[0].Total)
+
+	_, err = f.service.RefundPayment(payment.PaymentID, eur(4500))
+	require.NoError(t, err)
+	for _, journal := range f.db.Journals {
+		require.NoError(t, checkJournal(journal), journal.Key)
+	}
+	require.True(t, accountBalance(f.db, AccountPromotions).IsZero(), "a refund gives the discount back")
+	wallet, err = f.service.GetWallet(f.driverID)
+	require.NoError(t, err)
+	require.True(t, wallet.Balance.IsZero())
+	require.Equal(t, eur(-4500), f.db.Invoices[1].Total)
+}
+
+func TestPromotionOnRidePrice(t *testing.T) {
+	f := newPaymentFixture(t)
+	f.promote(t, Promotion{Code: "BIG", Kind: PromotionPercent, Percent: 10, MinimumAmount: eur(6000)})
+	_, err := f.service.CreateBooking(Booking{BookingID: uuid.New(), RideID: f.ride.RideID, UserID: f.passengerID, NumberOfSeats: 2, TotalPrice: eur(100000), PromoCode: "BIG"})
+	require.ErrorIs(t, err, ErrPromotionNotApplicable, "the minimum is checked against the ride's price")
+
+	booking, err := f.service.CreateBooking(Booking{BookingID: uuid.New(), RideID: f.ride.RideID, UserID: f.passengerID, NumberOfSeats: 3, TotalPrice: eur(100000), PromoCode: "BIG"})
+	require.NoError(t, err)
+	require.Equal(t, eur(750), booking.Discount)
+	require.Equal(t, eur(6750), booking.TotalPrice)
+}
+
+func TestPromotionLimits(t *testing.T) {
+	f := newPaymentFixture(t)
+	f.db.Rides[len(f.db.Rides)-1].NumberOfSeats = 20
+	f.promote(t, Promotion{Code: "ONCE", Kind: PromotionAmount, Amount: eur(500), MaxPerUser: 1})
+	f.promote(t, Promotion{Code: "TWICE", Kind: PromotionAmount, Amount: eur(500), MaxRedemptions: 2})
+	f.promote(t, Promotion{Code: "FIRST", Kind: PromotionPercent, Percent: 20, FirstRideOnly: true})
+	other := uuid.New()
+	f.db.Users = append(f.db.Users, User{UserID: other, Email: "other@test.com", EmailVerifiedAt: f.now})
+
+	_, err := f.bookWithCode(t, f.passengerID, "UNKNOWN")
+	require.ErrorIs(t, err, ErrPromotionNotApplicable)
+
+	first, err := f.bookWithCode(t, f.passengerID, "ONCE")
+	require.NoError(t, err)
+	_, err = f.bookWithCode(t, f.passengerID, "ONCE")
+	require.ErrorIs(t, err, ErrPromotionNotApplicable)
+	require.NoError(t, f.service.DeleteBooking(first.BookingID, f.passengerID))
+	_, err = f.bookWithCode(t, f.passengerID, "FIRST")
+	require.NoError(t, err, "the only booking was cancelled")
+	_, err = f.bookWithCode(t, f.passengerID, "ONCE")
+	require.NoError(t, err, "cancelling gives the redemption back")
+	_, err = f.bookWithCode(t, other, "ONCE")
+	require.NoError(t, err)
+	_, err = f.bookWithCode(t, other, "FIRST")
+	require.ErrorIs(t, err, ErrPromotionNotApplicable)
+
+	twice, err := f.bookWithCode(t, f.passengerID, "TWICE")
+	require.NoError(t, err)
+	_, err = f.bookWithCode(t, other, "TWICE")
+	require.NoError(t, err)
+	_, err = f.bookWithCode(t, f.passengerID, "TWICE")
+	require.ErrorIs(t, err, ErrPromotionExhausted)
+	require.NoError(t, f.service.DeleteBooking(twice.BookingID, f.passengerID))
+	_, err = f.bookWithCode(t, f.passengerID, "TWICE")
+	require.NoError(t, err)
+	_, err = f.service.RestoreBooking(twice.BookingID)
+	require.ErrorIs(t, err, ErrNotRestorable, "the redemption was taken since")
+
+	f.promote(t, Promotion{Code: "DECLINED", Kind: PromotionAmount, Amount: eur(500), MaxPerUser: 1})
+	f.provider.Decline = func(request PaymentRequest) bool { return true }
+	_, err = f.bookWithCode(t, f.passengerID, "DECLINED")
+	require.ErrorIs(t, err, ErrPaymentDeclined)
+	promotion, err := f.service.promotions.GetPromotionByCode("DECLINED")
+	require.NoError(t, err)
+	require.Zero(t, promotion.Redemptions, "the unpaid booking gives the redemption back")
+}
+
+func TestPromotionsHandler(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	promotion := Promotion{PromotionID: uuid.New(), Code: "WELCOME10", Kind: PromotionPercent, Percent: 10}
+	redeemed, missing := uuid.New(), uuid.New()
+	mockSvc.On("GetPromotions").Return([]Promotion{promotion}, nil)
+	mockSvc.On("CreatePromotion", mock.MatchedBy(func(p Promotion) bool { return p.Code == "WELCOME10" })).Return(promotion, nil)
+	mockSvc.On("CreatePromotion", mock.MatchedBy(func(p Promotion) bool { return p.Code == "TAKEN" })).Return(Promotion{}, ErrPromoCodeTaken)
+	mockSvc.On("CreatePromotion", mock.MatchedBy(func(p Promotion) bool { return p.Code == "" })).Return(Promotion{}, ErrInvalidPromotion)
+	mockSvc.On("UpdatePromotion", mock.MatchedBy(func(p Promotion) bool { return p.PromotionID == promotion.PromotionID })).Return(promotion, nil)
+	mockSvc.On("UpdatePromotion", mock.MatchedBy(func(p Promotion) bool { return p.PromotionID == missing })).Return(Promotion{}, ErrPromotionNotFound)
+	mockSvc.On("DeletePromotion", promotion.PromotionID).Return(nil)
+	mockSvc.On("DeletePromotion", redeemed).Return(ErrPromotionRedeemed)
+	mockSvc.On("DeletePromotion", missing).Return(ErrPromotionNotFound)
+
+	passenger := Actor{UserID: uuid.New(), Role: RolePassenger}
+	for _, tc := range []struct {
+		name   string
+		actor  Actor
+		method string
+		query  string
+		body   Promotion
+		status int
+	}{
+		{"list", admin, http.MethodGet, "", Promotion{}, http.StatusOK},
+		{"list as a passenger", passenger, http.MethodGet, "", Promotion{}, http.StatusForbidden},
+		{"create", admin, http.MethodPost, "", Promotion{Code: "WELCOME10"}, http.StatusCreated},
+		{"create as a passenger", passenger, http.MethodPost, "", Promotion{Code: "WELCOME10"}, http.StatusForbidden},
+		{"create invalid", admin, http.MethodPost, "", Promotion{}, http.StatusBadRequest},
+		{"create taken", admin, http.MethodPost, "", Promotion{Code: "TAKEN"}, http.StatusConflict},
+		{"update", admin, http.MethodPatch, "?promotion_id=" + promotion.PromotionID.String(), Promotion{Code: "WELCOME10"}, http.StatusOK},
+		{"update missing", admin, http.MethodPatch, "?promotion_id=" + missing.String(), Promotion{Code: "WELCOME10"}, http.StatusNotFound},
+		{"update bad id", admin, http.MethodPatch, "?promotion_id=nope", Promotion{Code: "WELCOME10"}, http.StatusBadRequest},
+		{"delete", admin, http.MethodDelete, "?promotion_id=" + promotion.PromotionID.String(), Promotion{}, http.StatusNoContent},
+		{"delete redeemed", admin, http.MethodDelete, "?promotion_id=" + redeemed.String(), Promotion{}, http.StatusConflict},
+		{"delete missing", admin, http.MethodDelete, "?promotion_id=" + missing.String(), Promotion{}, http.StatusNotFound},
+	} {
+		body, _ := json.Marshal(tc.body)
+		w := httptest.NewRecorder()
+		h.PromotionsHandler(w, asActor(httptest.NewRequest(tc.method, "/admin/promotions"+tc.query, bytes.NewReader(body)), tc.actor))
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
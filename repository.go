@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"log"
 
@@ -17,29 +20,38 @@ type Repository interface {
 	GetUserByEmail(email string) (User, error)
 	GetUserById(userID uuid.UUID) (User, error)
 	CreateNewUser(user User) (User, error)
-	DeleteUser(userID uuid.UUID) error
 	UpdateUser(user User) (User, error)
 
 	GetAllRides() ([]Ride, error)
 	GetRideById(rideID uuid.UUID) (Ride, error)
 	CreateRide(ride Ride) (Ride, error)
-	DeleteRide(rideID uuid.UUID) error
+	DeleteRide(rideID uuid.UUID, actorID uuid.UUID, at time.Time) error
 	UpdateRide(ride Ride) (Ride, error)
+	CompleteRide(rideID uuid.UUID, noShows []uuid.UUID) error
+	GetRidesByDriver(driverID uuid.UUID) ([]Ride, error)
 
 	GetAllBookings() ([]Booking, error)
 	GetBookingById(bookingID uuid.UUID) (Booking, error)
 	CreateBooking(booking Booking) (Booking, error)
-	DeleteBooking(bookingID uuid.UUID) error
+	DeleteBooking(bookingID uuid.UUID, actorID uuid.UUID, at time.Time) error
 	UpdateBooking(booking Booking) (Booking, error)
+	ApproveBooking(bookingID uuid.UUID) (Booking, error)
+	GetBookingsForUser(userID uuid.UUID) ([]Booking, error)
+	GetBookingsByUser(userID uuid.UUID) ([]Booking, error)
+	GetBookingsByRide(rideID uuid.UUID) ([]Booking, error)
+	AreCounterparts(userID uuid.UUID, otherID uuid.UUID) (bool, error)
 }
 
+// models are the entities migrated on startup, one table each.
+var models = []any{&User{}, &Ride{}, &Booking{}, &EmailVerification{}, &PhoneVerification{}, &Session{}, &PasswordReset{}, &AuditEvent{}, &Review{}, &Reputation{}, &Vehicle{}, &DataExport{}, &Erasure{}, &Block{}, &Message{}, &MessageReceipt{}, &Notification{}, &Webhook{}, &WebhookDelivery{}, &Job{}, &Payment{}, &Journal{}, &Posting{}, &Invoice{}, &InvoiceSequence{}, &Promotion{}, &PayoutAccount{}, &PayoutBatch{}, &Payout{}}
+
 type CovoitRepository struct {
 	db *gorm.DB
 }
 
 func NewCovoitRepository() *CovoitRepository {
 	dsn := "host=localhost user=mehdi password=mehdi dbname=covoit port=5432 sslmode=disable"
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -48,10 +60,16 @@ func NewCovoitRepository() *CovoitRepository {
 	db.Exec(`CREATE EXTENSION IF NOT EXISTS "uuid-ossp";`)
 
 	// Auto-migrate tables
-	err = db.AutoMigrate(&User{}, &Ride{}, &Booking{})
+	err = db.AutoMigrate(models...)
 	if err != nil {
 		log.Fatal("Auto migration failed:", err)
 	}
+	if err := migrateMoney(db); err != nil {
+		log.Fatal("Money migration failed:", err)
+	}
+	if err := db.Exec(invoiceImmutability).Error; err != nil {
+		log.Fatal("Invoice immutability failed:", err)
+	}
 
 	fmt.Println("Tables created or already exist!")
 	return &CovoitRepository{db: db}
@@ -92,19 +110,18 @@ func (repository *CovoitRepository) CreateNewUser(user User) (User, error) {
 	return user, nil
 }
 
-func (repository *CovoitRepository) DeleteUser(userID uuid.UUID) error {
+func (repository *CovoitRepository) UpdateUser(user User) (User, error) {
 	ctx := context.Background()
-
-	_, err := gorm.G[User](repository.db).Where("user_id = ?", userID).Delete(ctx)
-	if err != nil {
-		return fmt.Errorf("could not delete user %s, err : %s", userID, err)
+	_, err := gorm.G[User](repository.db).
+		Where("user_id = ?", user.UserID).
+		Select("first_name", "last_name", "email", "phone", "address", "bio", "preferences", "email_verified_at", "phone_verified_at").
+		Updates(ctx, user)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return User{}, ErrEmailTaken
+	} else if err != nil {
+		return User{}, fmt.Errorf("could not update user %s, err : %s", user.UserID, err)
 	}
-	return nil
-}
-
-// TODO
-func (repository *CovoitRepository) UpdateUser(user User) (User, error) {
-	return user, nil
+	return repository.GetUserById(user.UserID)
 }
 
 func (repository *CovoitRepository) GetAllRides() ([]Ride, error) {
@@ -121,20 +138,161 @@ func (repository *CovoitRepository) GetRideById(rideID uuid.UUID) (Ride, error)
 	return ride, nil
 }
 func (repository *CovoitRepository) CreateRide(ride Ride) (Ride, error) {
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		if err := gorm.G[Ride](tx).Create(ctx, &ride); err != nil {
+			return fmt.Errorf("could not create ride, err : %s", err)
+		}
+		if err := scheduleJobs(tx, rideJobs(ride)...); err != nil {
+			return err
+		}
+		return publishWebhookEvent(tx, WebhookRideCreated, ride)
+	})
+	if err != nil {
+		return Ride{}, err
+	}
+	return ride, nil
+}
+
+// DeleteRide soft deletes the ride and its bookings, they can be restored
+// together until they are purged. The passengers of a scheduled ride are told
+// it is cancelled.
+func (repository *CovoitRepository) DeleteRide(rideID uuid.UUID, actorID uuid.UUID, at time.Time) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		ride, err := gorm.G[Ride](tx).Where("ride_id = ?", rideID).First(ctx)
+		if err != nil {
+			return fmt.Errorf("Ride %v not found, err : %s", rideID, err)
+		}
+		bookings, err := gorm.G[Booking](tx).Where("ride_id = ? AND status IN ?", rideID, []string{BookingPending, BookingConfirmed}).Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get bookings of ride %s, err : %s", rideID, err)
+		}
+		deletedAt := gorm.DeletedAt{Time: at, Valid: true}
+		_, err = gorm.G[Ride](tx).Where("ride_id = ?", rideID).Updates(ctx, Ride{DeletedAt: deletedAt, DeletedBy: &actorID})
+		if err != nil {
+			return fmt.Errorf("could not delete ride %s, err : %s", rideID, err)
+		}
+		_, err = gorm.G[Booking](tx).Where("ride_id = ?", rideID).Updates(ctx, Booking{DeletedAt: deletedAt, DeletedBy: &actorID})
+		if err != nil {
+			return fmt.Errorf("could not delete bookings of ride %s, err : %s", rideID, err)
+		}
+		if err := settlePayments(tx, PaymentRelease, 0, bookingIDs(bookings)...); err != nil {
+			return err
+		}
+		if err := releasePromotions(tx, bookings...); err != nil {
+			return err
+		}
+		if ride.Status != RideScheduled {
+			return nil
+		}
+		notifications := []Notification{}
+		for _, booking := range bookings {
+			notifications = append(notifications, rideNotification(NotificationRideCancelled, booking.UserID, ride, &booking))
+		}
+		if err := enqueueNotifications(tx, notifications...); err != nil {
+			return err
+		}
+		return publishWebhookEvent(tx, WebhookRideCancelled, ride)
+	})
+}
+
+// UpdateRide saves the editable fields of a scheduled ride.
+func (repository *CovoitRepository) UpdateRide(ride Ride) (Ride, error) {
 	ctx := context.Background()
-	err := gorm.G[Ride](repository.db).Create(ctx, &ride)
+	rows, err := gorm.G[Ride](repository.db).
+		Where("ride_id = ? AND status = ?", ride.RideID, RideScheduled).
+		Select("origin", "destination", "vehicle_id", "distance", "price_minor", "price_currency", "number_of_seats").
+		Updates(ctx, ride)
 	if err != nil {
-		return Ride{}, fmt.Errorf("could not create ride, err : %s", err)
+		return Ride{}, fmt.Errorf("could not update ride %s, err : %s", ride.RideID, err)
+	}
+	if rows == 0 {
+		return Ride{}, ErrRideNotEditable
 	}
 	return ride, nil
 }
-func (repository *CovoitRepository) DeleteRide(rideID uuid.UUID) error {
+
+// CompleteRide marks a scheduled ride as completed, flags the bookings of
+// noShows and credits the driver and the passengers with the ride.
+func (repository *CovoitRepository) CompleteRide(rideID uuid.UUID, noShows []uuid.UUID) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		rows, err := gorm.G[Ride](tx).Where("ride_id = ? AND status = ?", rideID, RideScheduled).Update(ctx, "status", RideCompleted)
+		if err != nil {
+			return fmt.Errorf("could not complete ride %s, err : %s", rideID, err)
+		}
+		if rows == 0 {
+			return ErrRideNotCompletable
+		}
+		ride, err := gorm.G[Ride](tx).Where("ride_id = ?", rideID).First(ctx)
+		if err != nil {
+			return fmt.Errorf("Ride %v not found, err : %s", rideID, err)
+		}
+		if len(noShows) > 0 {
+			_, err = gorm.G[Booking](tx).
+				Where("ride_id = ? AND status = ? AND booking_id IN ?", rideID, BookingConfirmed, noShows).
+				Update(ctx, "status", BookingNoShow)
+			if err != nil {
+				return fmt.Errorf("could not flag no-shows of ride %s, err : %s", rideID, err)
+			}
+		}
+		bookings, err := gorm.G[Booking](tx).Where("ride_id = ? AND status IN ?", rideID, []string{BookingConfirmed, BookingNoShow}).Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get bookings of ride %s, err : %s", rideID, err)
+		}
+		// The passengers who showed up and the ones who did not both pay, the
+		// requests left pending are released.
+		if err := settlePayments(tx, PaymentCapture, 1, bookingIDs(bookings)...); err != nil {
+			return err
+		}
+		pending, err := gorm.G[Booking](tx).Where("ride_id = ? AND status = ?", rideID, BookingPending).Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get pending bookings of ride %s, err : %s", rideID, err)
+		}
+		if err := settlePayments(tx, PaymentRelease, 0, bookingIDs(pending)...); err != nil {
+			return err
+		}
+		if err := incrementReputation(tx, Reputation{UserID: ride.DriverID, RidesDriven: 1}); err != nil {
+			return err
+		}
+		for _, booking := range bookings {
+			delta := Reputation{UserID: booking.UserID, RidesTaken: 1}
+			if booking.Status == BookingNoShow {
+				delta = Reputation{UserID: booking.UserID, NoShows: 1}
+			}
+			if err := incrementReputation(tx, delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+func (repository *CovoitRepository) GetRidesByDriver(driverID uuid.UUID) ([]Ride, error) {
 	ctx := context.Background()
-	_, err := gorm.G[Ride](repository.db).Where("ride_id = ?", rideID).Delete(ctx)
-	return err
+	rides, err := gorm.G[Ride](repository.db).Where("driver_id = ?", driverID).Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get rides of driver %s, err : %s", driverID, err)
+	}
+	return rides, nil
 }
-func (repository *CovoitRepository) UpdateRide(ride Ride) (Ride, error) {
-	return Ride{}, nil
+
+func (repository *CovoitRepository) GetBookingsByUser(userID uuid.UUID) ([]Booking, error) {
+	ctx := context.Background()
+	bookings, err := gorm.G[Booking](repository.db).Where("user_id = ?", userID).Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get bookings of user %s, err : %s", userID, err)
+	}
+	return bookings, nil
+}
+
+func (repository *CovoitRepository) GetBookingsByRide(rideID uuid.UUID) ([]Booking, error) {
+	ctx := context.Background()
+	bookings, err := gorm.G[Booking](repository.db).Where("ride_id = ?", rideID).Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get bookings of ride %s, err : %s", rideID, err)
+	}
+	return bookings, nil
 }
 func (repository *CovoitRepository) GetAllBookings() ([]Booking, error) {
 	ctx := context.Background()
@@ -152,22 +310,163 @@ func (repository *CovoitRepository) GetBookingById(bookingID uuid.UUID) (Booking
 	}
 	return booking, nil
 }
+
+// CreateBooking stores booking and tells the driver of the ride.
+// lockSeats locks the ride of booking within tx, so that its seats are
+// counted by one booking at a time, and checks that the scheduled ride has
+// the seats of booking left besides those of its other pending and
+// confirmed bookings.
+func lockSeats(tx *gorm.DB, booking Booking) (Ride, error) {
+	ride, err := gorm.G[Ride](tx, clause.Locking{Strength: "UPDATE"}).Where("ride_id = ?", booking.RideID).First(context.Background())
+	if err != nil {
+		return Ride{}, ErrRideNotFound
+	}
+	if ride.Status != RideScheduled {
+		return Ride{}, fmt.Errorf("%w : the ride is %s", ErrInvalidBooking, ride.Status)
+	}
+	var held int
+	err = tx.Model(&Booking{}).
+		Select("COALESCE(SUM(number_of_seats), 0)").
+		Where("ride_id = ? AND booking_id <> ? AND status IN ?", booking.RideID, booking.BookingID, []string{BookingPending, BookingConfirmed}).
+		Scan(&held).Error
+	if err != nil {
+		return Ride{}, fmt.Errorf("could not count seats of ride %s, err : %s", booking.RideID, err)
+	}
+	if held+booking.NumberOfSeats > ride.NumberOfSeats {
+		return Ride{}, fmt.Errorf("%w : %d seats left", ErrInvalidBooking, max(ride.NumberOfSeats-held, 0))
+	}
+	return ride, nil
+}
+
 func (repository *CovoitRepository) CreateBooking(booking Booking) (Booking, error) {
-	ctx := context.Background()
-	err := gorm.G[Booking](repository.db).Create(ctx, &booking)
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		ride, err := lockSeats(tx, booking)
+		if err != nil {
+			return err
+		}
+		if err := redeemPromotion(tx, booking); err != nil {
+			return err
+		}
+		if err := gorm.G[Booking](tx).Create(ctx, &booking); err != nil {
+			return fmt.Errorf("could not create booking %v, err : %s", booking, err)
+		}
+		if err := enqueueNotifications(tx, rideNotification(NotificationBookingCreated, ride.DriverID, ride, &booking)); err != nil {
+			return err
+		}
+		if err := createPayment(tx, booking, ride.DriverID); err != nil {
+			return err
+		}
+		return publishWebhookEvent(tx, WebhookBookingCreated, booking)
+	})
 	if err != nil {
-		return Booking{}, fmt.Errorf("could not create booking %v, err : %s", booking, err)
+		return Booking{}, err
 	}
-	return booking, err
+	return booking, nil
 }
-func (repository *CovoitRepository) DeleteBooking(bookingID uuid.UUID) error {
-	ctx := context.Background()
-	_, err := gorm.G[Booking](repository.db).Where("booking_id = ?", bookingID).Delete(ctx)
+
+// DeleteBooking soft deletes the booking. When it still held a seat on a
+// scheduled ride, the other side of the booking is told.
+func (repository *CovoitRepository) DeleteBooking(bookingID uuid.UUID, actorID uuid.UUID, at time.Time) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		booking, err := gorm.G[Booking](tx).Where("booking_id = ?", bookingID).First(ctx)
+		if err != nil {
+			return fmt.Errorf("Booking %v not found, err : %s", bookingID, err)
+		}
+		_, err = gorm.G[Booking](tx).
+			Where("booking_id = ?", bookingID).
+			Updates(ctx, Booking{DeletedAt: gorm.DeletedAt{Time: at, Valid: true}, DeletedBy: &actorID})
+		if err != nil {
+			return fmt.Errorf("could not delete booking %s, err : %s", bookingID, err)
+		}
+		ride, err := gorm.G[Ride](tx).Where("ride_id = ?", booking.RideID).First(ctx)
+		if err != nil {
+			return fmt.Errorf("Ride %v not found, err : %s", booking.RideID, err)
+		}
+		settlement, share := cancellationSettlement(booking, ride, actorID, at)
+		if err := settlePayments(tx, settlement, share, bookingID); err != nil {
+			return err
+		}
+		if err := releasePromotions(tx, booking); err != nil {
+			return err
+		}
+		if ride.Status != RideScheduled || booking.Status == BookingCancelled {
+			return nil
+		}
+		notifications := []Notification{}
+		for _, userID := range []uuid.UUID{ride.DriverID, booking.UserID} {
+			if userID != actorID {
+				notifications = append(notifications, rideNotification(NotificationBookingCancelled, userID, ride, &booking))
+			}
+		}
+		if err := enqueueNotifications(tx, notifications...); err != nil {
+			return err
+		}
+		return publishWebhookEvent(tx, WebhookBookingCancelled, booking)
+	})
+}
+
+// ApproveBooking confirms a pending booking and tells its passenger. The
+// seats are counted again, the ride may have changed since it was booked.
+func (repository *CovoitRepository) ApproveBooking(bookingID uuid.UUID) (Booking, error) {
+	booking := Booking{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		booking, err = gorm.G[Booking](tx).Where("booking_id = ?", bookingID).First(ctx)
+		if err != nil || booking.Status != BookingPending {
+			return ErrBookingNotPending
+		}
+		ride, err := lockSeats(tx, booking)
+		if err != nil {
+			return err
+		}
+		rows, err := gorm.G[Booking](tx).Where("booking_id = ? AND status = ?", bookingID, BookingPending).Update(ctx, "status", BookingConfirmed)
+		if err != nil {
+			return fmt.Errorf("could not approve booking %s, err : %s", bookingID, err)
+		}
+		if rows == 0 {
+			return ErrBookingNotPending
+		}
+		booking.Status = BookingConfirmed
+		if err := enqueueNotifications(tx, rideNotification(NotificationBookingApproved, booking.UserID, ride, &booking)); err != nil {
+			return err
+		}
+		return publishWebhookEvent(tx, WebhookBookingApproved, booking)
+	})
 	if err != nil {
-		return fmt.Errorf("could not delete booking %s, err : %s", bookingID, err)
+		return Booking{}, err
 	}
-	return nil
+	return booking, nil
 }
 func (repository *CovoitRepository) UpdateBooking(booking Booking) (Booking, error) {
 	return Booking{}, nil
 }
+
+// GetBookingsForUser returns the bookings made by the user and the bookings
+// made on rides the user drives.
+func (repository *CovoitRepository) GetBookingsForUser(userID uuid.UUID) ([]Booking, error) {
+	ctx := context.Background()
+	drivenRides := repository.db.Model(&Ride{}).Select("ride_id").Where("driver_id = ?", userID)
+	bookings, err := gorm.G[Booking](repository.db).Where("user_id = ? OR ride_id IN (?)", userID, drivenRides).Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get bookings of user %s, err : %s", userID, err)
+	}
+	return bookings, nil
+}
+
+// AreCounterparts tells whether one of the users holds a confirmed booking on
+// a ride driven by the other.
+func (repository *CovoitRepository) AreCounterparts(userID uuid.UUID, otherID uuid.UUID) (bool, error) {
+	var count int64
+	err := repository.db.Model(&Booking{}).
+		Joins("JOIN rides ON rides.ride_id = bookings.ride_id").
+		Where("bookings.status = ?", BookingConfirmed).
+		Where("(bookings.user_id = ? AND rides.driver_id = ?) OR (bookings.user_id = ? AND rides.driver_id = ?)", userID, otherID, otherID, userID).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("could not check bookings between %s and %s, err : %s", userID, otherID, err)
+	}
+	return count > 0, nil
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,7 +17,7 @@ import (
 
 func TestNewCovoitRepository(t *testing.T) {
 	repository := NewCovoitRepository()
-	want := []string{"users", "bookings", "rides"}
+	want := []string{"users", "bookings", "rides", "email_verifications", "phone_verifications", "sessions", "password_resets", "audit_events", "reviews", "reputations", "vehicles", "data_exports", "erasures", "blocks", "messages", "message_receipts", "notifications", "webhooks", "webhook_deliveries", "jobs", "payments", "journals", "postings", "invoices", "invoice_sequences", "promotions", "payout_accounts", "payout_batches", "payouts"}
 	ctx := context.Background()
 	got, err := gorm.G[string](repository.db).Raw(`SELECT tablename FROM pg_catalog.pg_tables
 													WHERE schemaname != 'pg_catalog' AND 
@@ -88,14 +93,14 @@ func TestUserRepo(t *testing.T) {
 			t.Errorf("want %v, got %v", want, got)
 		}
 
-		err = repository.DeleteUser(got.UserID)
+		_, err = repository.EraseUser(got.UserID, time.Now())
 		if err != nil {
-			t.Errorf("could not delete the goat 🐐")
+			t.Errorf("could not erase the goat 🐐, err : %s", err)
 		}
 
 		got, err = repository.GetUserByEmail(want.Email)
 		if err == nil || got.Email == want.Email {
-			t.Errorf("goat 🐐 still in db, probably not deleted, err : %s", err)
+			t.Errorf("goat 🐐 still in db, probably not erased, err : %s", err)
 		}
 	})
 }
@@ -136,7 +141,7 @@ func TestRideRepo(t *testing.T) {
 				DepartureTime: time.Date(2025, 03, 24, 22, 34, 0, 0, time.UTC),
 				ArrivalTime:   time.Date(2025, 03, 25, 22, 34, 0, 0, time.UTC),
 				Distance:      1200,
-				Price:         160,
+				Price:         eur(16000),
 				NumberOfSeats: 4}
 		got, err := repository.CreateRide(
 			Ride{Origin: "Tlemcen",
@@ -144,7 +149,7 @@ func TestRideRepo(t *testing.T) {
 				DepartureTime: time.Date(2025, 03, 24, 22, 34, 0, 0, time.UTC),
 				ArrivalTime:   time.Date(2025, 03, 25, 22, 34, 0, 0, time.UTC),
 				Distance:      1200,
-				Price:         160,
+				Price:         eur(16000),
 				NumberOfSeats: 4})
 
 		if err != nil {
@@ -161,7 +166,7 @@ func TestRideRepo(t *testing.T) {
 			t.Errorf("want %v, got %v", want, got)
 		}
 
-		err = repository.DeleteRide(got.RideID)
+		err = repository.DeleteRide(got.RideID, got.DriverID, time.Now())
 		if err != nil {
 			t.Errorf("could not delete the ride")
 		}
@@ -221,7 +226,7 @@ func TestBookingRepo(t *testing.T) {
 			t.Errorf("want %v, got %v", want, got)
 		}
 
-		err = repository.DeleteBooking(got.BookingID)
+		err = repository.DeleteBooking(got.BookingID, got.UserID, time.Now())
 		if err != nil {
 			t.Errorf("could not delete the booking")
 		}
@@ -233,6 +238,295 @@ func TestBookingRepo(t *testing.T) {
 	})
 }
 
+// claimConcurrently runs two claims at once, as two instances would.
+func claimConcurrently[T any](t *testing.T, claim func() ([]T, error)) [2][]T {
+	t.Helper()
+	claimed := [2][]T{}
+	errs := [2]error{}
+	wg := sync.WaitGroup{}
+	for i := range claimed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claimed[i], errs[i] = claim()
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("could not claim, err : %s", err)
+		}
+	}
+	return claimed
+}
+
+// checkClaimedOnce checks that every id was claimed by exactly one claim.
+func checkClaimedOnce(t *testing.T, ids []uuid.UUID, claimed ...[]uuid.UUID) {
+	t.Helper()
+	count := map[uuid.UUID]int{}
+	for _, claim := range claimed {
+		for _, id := range claim {
+			count[id]++
+		}
+	}
+	for _, id := range ids {
+		if count[id] != 1 {
+			t.Errorf("want %v claimed once, got %d times", id, count[id])
+		}
+	}
+}
+
+func TestClaimRepo(t *testing.T) {
+	repository := NewCovoitRepository()
+	ctx := context.Background()
+	// Rows due long ago, so that the claims at claimedAt leave the others
+	// in the tables alone.
+	claimedAt := time.Date(2000, 01, 01, 0, 0, 0, 0, time.UTC)
+	dueAt := claimedAt.Add(-time.Hour)
+
+	t.Run("Test claiming jobs", func(t *testing.T) {
+		jobs := []Job{}
+		for i := range 4 {
+			jobs = append(jobs, Job{JobID: uuid.New(), Name: "test", Key: fmt.Sprintf("test-claim-%s-%d", uuid.New(), i), RunAt: dueAt})
+		}
+		if err := repository.ScheduleJobs(jobs...); err != nil {
+			t.Fatalf("could not schedule jobs, err : %s", err)
+		}
+		ids := []uuid.UUID{}
+		for _, job := range jobs {
+			ids = append(ids, job.JobID)
+		}
+		defer gorm.G[Job](repository.db).Where("job_id IN ?", ids).Delete(ctx)
+
+		claimed := claimConcurrently(t, func() ([]Job, error) { return repository.ClaimJobs(claimedAt, 3, time.Minute) })
+		claimedIDs := [2][]uuid.UUID{}
+		for i, claim := range claimed {
+			for _, job := range claim {
+				claimedIDs[i] = append(claimedIDs[i], job.JobID)
+			}
+		}
+		checkClaimedOnce(t, ids, claimedIDs[:]...)
+
+		again, err := repository.ClaimJobs(claimedAt, 10, time.Minute)
+		if err != nil || len(again) != 0 {
+			t.Errorf("want no job claimed within the lease, got %v, err : %s", again, err)
+		}
+	})
+
+	t.Run("Test claiming notifications", func(t *testing.T) {
+		userID := StringToUuid(t, "3c05d41e-344c-4661-a5fd-63e7a0a46998")
+		notifications := []Notification{}
+		for range 4 {
+			notifications = append(notifications, Notification{NotificationID: uuid.New(), UserID: userID, Type: NotificationRideCancelled, NextAttemptAt: dueAt})
+		}
+		if err := repository.EnqueueNotifications(notifications...); err != nil {
+			t.Fatalf("could not enqueue notifications, err : %s", err)
+		}
+		ids := []uuid.UUID{}
+		for _, notification := range notifications {
+			ids = append(ids, notification.NotificationID)
+		}
+		defer gorm.G[Notification](repository.db).Where("notification_id IN ?", ids).Delete(ctx)
+
+		claimed := claimConcurrently(t, func() ([]Notification, error) {
+			return repository.ClaimNotifications(claimedAt, 3, time.Minute)
+		})
+		claimedIDs := [2][]uuid.UUID{}
+		for i, claim := range claimed {
+			for _, notification := range claim {
+				claimedIDs[i] = append(claimedIDs[i], notification.NotificationID)
+			}
+		}
+		checkClaimedOnce(t, ids, claimedIDs[:]...)
+
+		again, err := repository.ClaimNotifications(claimedAt, 10, time.Minute)
+		if err != nil || len(again) != 0 {
+			t.Errorf("want no notification claimed within the lease, got %v, err : %s", again, err)
+		}
+	})
+
+	t.Run("Test claiming webhook deliveries", func(t *testing.T) {
+		webhook, err := repository.CreateWebhook(Webhook{URL: "https://example.com/hook", Events: []string{WebhookRideCreated}})
+		if err != nil {
+			t.Fatalf("could not create webhook, err : %s", err)
+		}
+		defer repository.DeleteWebhook(webhook.WebhookID)
+		deliveries := []WebhookDelivery{}
+		for range 4 {
+			deliveries = append(deliveries, WebhookDelivery{DeliveryID: uuid.New(), WebhookID: webhook.WebhookID, Event: WebhookRideCreated, Data: []byte(`{}`), NextAttemptAt: dueAt})
+		}
+		if err := gorm.G[WebhookDelivery](repository.db).CreateInBatches(ctx, &deliveries, len(deliveries)); err != nil {
+			t.Fatalf("could not enqueue deliveries, err : %s", err)
+		}
+		ids := []uuid.UUID{}
+		for _, delivery := range deliveries {
+			ids = append(ids, delivery.DeliveryID)
+		}
+
+		claimed := claimConcurrently(t, func() ([]WebhookDelivery, error) {
+			return repository.ClaimWebhookDeliveries(claimedAt, 3, time.Minute)
+		})
+		claimedIDs := [2][]uuid.UUID{}
+		for i, claim := range claimed {
+			for _, delivery := range claim {
+				claimedIDs[i] = append(claimedIDs[i], delivery.DeliveryID)
+			}
+		}
+		checkClaimedOnce(t, ids, claimedIDs[:]...)
+
+		again, err := repository.ClaimWebhookDeliveries(claimedAt, 10, time.Minute)
+		if err != nil || len(again) != 0 {
+			t.Errorf("want no delivery claimed within the lease, got %v, err : %s", again, err)
+		}
+	})
+}
+
+// errRollback ends the test transactions without leaving their rows behind.
+var errRollback = errors.New("rollback")
+
+func TestWebhookRepo(t *testing.T) {
+	repository := NewCovoitRepository()
+	t.Run("Test publishing to the subscribed webhooks", func(t *testing.T) {
+		subscribed, err := repository.CreateWebhook(Webhook{URL: "https://example.com/rides", Events: []string{WebhookRideCreated, WebhookRideCancelled}})
+		if err != nil {
+			t.Fatalf("could not create webhook, err : %s", err)
+		}
+		defer repository.DeleteWebhook(subscribed.WebhookID)
+		other, err := repository.CreateWebhook(Webhook{URL: "https://example.com/bookings", Events: []string{WebhookBookingCreated}})
+		if err != nil {
+			t.Fatalf("could not create webhook, err : %s", err)
+		}
+		defer repository.DeleteWebhook(other.WebhookID)
+
+		err = repository.db.Transaction(func(tx *gorm.DB) error {
+			if err := publishWebhookEvent(tx, WebhookRideCancelled, map[string]string{"ride_id": uuid.NewString()}); err != nil {
+				return err
+			}
+			deliveries, err := gorm.G[WebhookDelivery](tx).Where("webhook_id IN ?", []uuid.UUID{subscribed.WebhookID, other.WebhookID}).Find(context.Background())
+			if err != nil {
+				return err
+			}
+			if len(deliveries) != 1 || deliveries[0].WebhookID != subscribed.WebhookID || deliveries[0].Event != WebhookRideCancelled {
+				t.Errorf("want one %s delivery to %v, got %v", WebhookRideCancelled, subscribed.WebhookID, deliveries)
+			}
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			t.Errorf("could not publish %s, err : %s", WebhookRideCancelled, err)
+		}
+	})
+}
+
+func TestInvoiceRepo(t *testing.T) {
+	repository := NewCovoitRepository()
+	t.Run("Test numbering invoices", func(t *testing.T) {
+		issuedAt := time.Date(1999, 06, 01, 0, 0, 0, 0, time.UTC)
+		invoice := func(key string) Invoice {
+			return Invoice{Kind: InvoiceReceipt, Key: key, UserID: uuid.New(), Locale: "en", IssuedAt: issuedAt}
+		}
+		err := repository.db.Transaction(func(tx *gorm.DB) error {
+			first, issued, err := issueInvoice(tx, invoice("test-"+uuid.NewString()))
+			if err != nil || !issued {
+				return fmt.Errorf("could not issue the first invoice, err : %s", err)
+			}
+			second, issued, err := issueInvoice(tx, invoice("test-"+uuid.NewString()))
+			if err != nil || !issued {
+				return fmt.Errorf("could not issue the second invoice, err : %s", err)
+			}
+			series := invoiceSeries(InvoiceReceipt, issuedAt)
+			last, err := strconv.ParseInt(strings.TrimPrefix(first.Number, series+"-"), 10, 64)
+			if err != nil || second.Number != invoiceNumber(series, last+1) {
+				t.Errorf("want consecutive numbers, got %s and %s", first.Number, second.Number)
+			}
+			again, issued, err := issueInvoice(tx, invoice(first.Key))
+			if err != nil || issued || again.Number != first.Number {
+				t.Errorf("want %s issued once, got %s, err : %s", first.Number, again.Number, err)
+			}
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			t.Errorf("could not number invoices, err : %s", err)
+		}
+	})
+}
+
+func TestPromotionRepo(t *testing.T) {
+	repository := NewCovoitRepository()
+	ctx := context.Background()
+	t.Run("Test redeeming a promotion concurrently", func(t *testing.T) {
+		userID := StringToUuid(t, "3c05d41e-344c-4661-a5fd-63e7a0a46998")
+		ride, err := repository.CreateRide(Ride{DriverID: userID, Origin: "Oran", Destination: "Annaba",
+			DepartureTime: time.Now().Add(24 * time.Hour), ArrivalTime: time.Now().Add(30 * time.Hour),
+			Distance: 1000, Price: eur(5000), NumberOfSeats: 4})
+		if err != nil {
+			t.Fatalf("could not create ride, err : %s", err)
+		}
+		defer repository.DeleteRide(ride.RideID, userID, time.Now())
+		promotion, err := repository.CreatePromotion(Promotion{Code: "TEST" + strings.ToUpper(uuid.NewString()[:8]), Kind: PromotionPercent, Percent: 10, MaxRedemptions: 1})
+		if err != nil {
+			t.Fatalf("could not create promotion, err : %s", err)
+		}
+		defer gorm.G[Promotion](repository.db).Where("promotion_id = ?", promotion.PromotionID).Delete(ctx)
+
+		errs := [2]error{}
+		wg := sync.WaitGroup{}
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, errs[i] = repository.CreateBooking(Booking{RideID: ride.RideID, UserID: userID, NumberOfSeats: 1, PromotionID: &promotion.PromotionID})
+			}()
+		}
+		wg.Wait()
+		if (errs[0] == nil) == (errs[1] == nil) {
+			t.Errorf("want exactly one booking redeeming %s, got errors %v", promotion.Code, errs)
+		}
+
+		got, err := repository.GetPromotionById(promotion.PromotionID)
+		if err != nil || got.Redemptions != 1 {
+			t.Errorf("want 1 redemption, got %d, err : %s", got.Redemptions, err)
+		}
+	})
+}
+
+func TestTrashRepo(t *testing.T) {
+	repository := NewCovoitRepository()
+	ctx := context.Background()
+	t.Run("Test purging a deleted ride", func(t *testing.T) {
+		userID := StringToUuid(t, "3c05d41e-344c-4661-a5fd-63e7a0a46998")
+		ride, err := repository.CreateRide(Ride{DriverID: userID, Origin: "Setif", Destination: "Bejaia",
+			DepartureTime: time.Now().Add(24 * time.Hour), ArrivalTime: time.Now().Add(26 * time.Hour),
+			Distance: 100, Price: eur(1000), NumberOfSeats: 4})
+		if err != nil {
+			t.Fatalf("could not create ride, err : %s", err)
+		}
+		booking, err := repository.CreateBooking(Booking{RideID: ride.RideID, UserID: userID, NumberOfSeats: 1})
+		if err != nil {
+			t.Fatalf("could not create booking, err : %s", err)
+		}
+		deletedAt := time.Now().Add(-time.Hour)
+		if err := repository.DeleteRide(ride.RideID, userID, deletedAt); err != nil {
+			t.Fatalf("could not delete ride, err : %s", err)
+		}
+
+		summary, err := repository.PurgeDeleted(deletedAt.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("could not purge, err : %s", err)
+		}
+		if summary.RidesPurged < 1 || summary.BookingsPurged < 1 {
+			t.Errorf("want the ride and its booking purged, got %+v", summary)
+		}
+		_, err = gorm.G[Booking](repository.db).Scopes(unscoped).Where("booking_id = ?", booking.BookingID).First(ctx)
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("booking still in db, probably not purged, err : %s", err)
+		}
+		_, err = gorm.G[Ride](repository.db).Scopes(unscoped).Where("ride_id = ?", ride.RideID).First(ctx)
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("ride still in db, probably not purged, err : %s", err)
+		}
+	})
+}
+
 func StringToUuid(t *testing.T, id string) uuid.UUID {
 	t.Helper()
 	res, err := uuid.Parse(id)
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrRideNotCompletable = errors.New("ride cannot be completed")
+
+// Reputation holds the counters behind the trust metrics of a user. They are
+// bumped as rides, bookings and reviews happen so that reading a profile never
+// scans the history.
+type Reputation struct {
+	UserID      uuid.UUID `gorm:"type:uuid;primaryKey"`
+	RatingSum   int
+	RatingCount int
+	RidesDriven int
+	RidesTaken  int
+	// Commitments counts the rides published and the bookings made, it is
+	// the base of the cancellation rate.
+	Commitments   int
+	Cancellations int
+	NoShows       int
+	MemberSince   time.Time `gorm:"-"`
+}
+
+// ReputationSummary is the public view of a Reputation.
+type ReputationSummary struct {
+	AverageRating    float64 `json:"average_rating"`
+	RatingCount      int     `json:"rating_count"`
+	RidesDriven      int     `json:"rides_driven"`
+	RidesTaken       int     `json:"rides_taken"`
+	CancellationRate float64 `json:"cancellation_rate"`
+	NoShowRate       float64 `json:"no_show_rate"`
+	AccountAgeDays   int     `json:"account_age_days"`
+}
+
+func ratio(n int, total int) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return math.Round(min(float64(n)/float64(total), 1)*100) / 100
+}
+
+func (r Reputation) Summary(now time.Time) ReputationSummary {
+	summary := ReputationSummary{
+		RatingCount:      r.RatingCount,
+		RidesDriven:      r.RidesDriven,
+		RidesTaken:       r.RidesTaken,
+		CancellationRate: ratio(r.Cancellations, r.Commitments),
+		NoShowRate:       ratio(r.NoShows, r.RidesTaken+r.NoShows),
+	}
+	if r.RatingCount > 0 {
+		summary.AverageRating = math.Round(float64(r.RatingSum)/float64(r.RatingCount)*100) / 100
+	}
+	if !r.MemberSince.IsZero() && now.After(r.MemberSince) {
+		summary.AccountAgeDays = int(now.Sub(r.MemberSince) / (24 * time.Hour))
+	}
+	return summary
+}
+
+type ReputationRepository interface {
+	IncrementReputation(delta Reputation) error
+	GetReputations(userIDs []uuid.UUID) (map[uuid.UUID]Reputation, error)
+}
+
+// incrementReputation adds the counters of delta to the reputation of
+// delta.UserID, creating it on first use.
+func incrementReputation(tx *gorm.DB, delta Reputation) error {
+	err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"rating_sum":    gorm.Expr("reputations.rating_sum + ?", delta.RatingSum),
+			"rating_count":  gorm.Expr("reputations.rating_count + ?", delta.RatingCount),
+			"rides_driven":  gorm.Expr("reputations.rides_driven + ?", delta.RidesDriven),
+			"rides_taken":   gorm.Expr("reputations.rides_taken + ?", delta.RidesTaken),
+			"commitments":   gorm.Expr("reputations.commitments + ?", delta.Commitments),
+			"cancellations": gorm.Expr("reputations.cancellations + ?", delta.Cancellations),
+			"no_shows":      gorm.Expr("reputations.no_shows + ?", delta.NoShows),
+		}),
+	}).Create(&delta).Error
+	if err != nil {
+		return fmt.Errorf("could not update reputation of user %s, err : %s", delta.UserID, err)
+	}
+	return nil
+}
+
+func (repository *CovoitRepository) IncrementReputation(delta Reputation) error {
+	return incrementReputation(repository.db, delta)
+}
+
+// GetReputations returns the reputation of every existing user of userIDs,
+// users without any activity yet get zero counters.
+func (repository *CovoitRepository) GetReputations(userIDs []uuid.UUID) (map[uuid.UUID]Reputation, error) {
+	type row struct {
+		Reputation
+		CreatedAt time.Time
+	}
+	rows := []row{}
+	err := repository.db.Table("users").
+		Select(`users.user_id, users.created_at,
+			COALESCE(reputations.rating_sum, 0) AS rating_sum,
+			COALESCE(reputations.rating_count, 0) AS rating_count,
+			COALESCE(reputations.rides_driven, 0) AS rides_driven,
+			COALESCE(reputations.rides_taken, 0) AS rides_taken,
+			COALESCE(reputations.commitments, 0) AS commitments,
+			COALESCE(reputations.cancellations, 0) AS cancellations,
+			COALESCE(reputations.no_shows, 0) AS no_shows`).
+		Joins("LEFT JOIN reputations ON reputations.user_id = users.user_id").
+		Where("users.user_id IN ?", userIDs).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve reputations, err : %s", err)
+	}
+	reputations := make(map[uuid.UUID]Reputation, len(rows))
+	for _, r := range rows {
+		r.Reputation.MemberSince = r.CreatedAt
+		reputations[r.UserID] = r.Reputation
+	}
+	return reputations, nil
+}
+
+func init() {
+	registerPersonalData("reputation", []string{"reputations"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		summaries, err := service.reputationSummaries([]uuid.UUID{userID})
+		if err != nil {
+			return nil, err
+		}
+		return summaries[userID], nil
+	})
+}
+
+// bumpReputation records delta without failing the caller, the event it
+// comes from already happened.
+func (service *CovoitService) bumpReputation(delta Reputation) {
+	if err := service.reputations.IncrementReputation(delta); err != nil {
+		log.Printf("could not update reputation of user %s : %s", delta.UserID, err)
+	}
+}
+
+func (service *CovoitService) reputationSummaries(userIDs []uuid.UUID) (map[uuid.UUID]*ReputationSummary, error) {
+	reputations, err := service.reputations.GetReputations(userIDs)
+	if err != nil {
+		return nil, err
+	}
+	now := service.clock()
+	summaries := make(map[uuid.UUID]*ReputationSummary, len(reputations))
+	for userID, reputation := range reputations {
+		summary := reputation.Summary(now)
+		summaries[userID] = &summary
+	}
+	return summaries, nil
+}
+
+func (service *CovoitService) withReputations(users []User) ([]User, error) {
+	userIDs := make([]uuid.UUID, len(users))
+	for i, user := range users {
+		userIDs[i] = user.UserID
+	}
+	summaries, err := service.reputationSummaries(userIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Reputation = summaries[users[i].UserID]
+	}
+	return users, nil
+}
+
+func (service *CovoitService) withDriverReputations(rides []Ride) ([]Ride, error) {
+	driverIDs := make([]uuid.UUID, len(rides))
+	for i, ride := range rides {
+		driverIDs[i] = ride.DriverID
+	}
+	summaries, err := service.reputationSummaries(driverIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rides {
+		rides[i].DriverReputation = summaries[rides[i].DriverID]
+	}
+	return rides, nil
+}
+
+// SortByDriverReputation orders rides from the best rated driver to the worst,
+// drivers with more ratings then fewer cancellations come first on ties.
+func SortByDriverReputation(rides []Ride) {
+	slices.SortStableFunc(rides, func(a, b Ride) int {
+		if a.DriverReputation == nil || b.DriverReputation == nil {
+			if a.DriverReputation != nil {
+				return -1
+			} else if b.DriverReputation != nil {
+				return 1
+			}
+			return 0
+		}
+		ra, rb := a.DriverReputation, b.DriverReputation
+		return cmp.Or(
+			cmp.Compare(rb.AverageRating, ra.AverageRating),
+			cmp.Compare(rb.RatingCount, ra.RatingCount),
+			cmp.Compare(ra.CancellationRate, rb.CancellationRate),
+		)
+	})
+}
+
+// CompleteRide closes a ride that departed. Passengers of noShows, a list of
+// booking ids, are recorded as not having shown up.
+func (service *CovoitService) CompleteRide(rideID uuid.UUID, noShows []uuid.UUID) error {
+	ride, err := service.repository.GetRideById(rideID)
+	if err != nil {
+		return err
+	}
+	if service.clock().Before(ride.DepartureTime) {
+		return ErrRideNotCompletable
+	}
+	if err := service.repository.CompleteRide(rideID, noShows); err != nil {
+		return err
+	}
+	if bookings, err := service.repository.GetBookingsByRide(rideID); err == nil {
+		service.processBookingPayments(bookings)
+	}
+	service.publishAvailability(rideID)
+	return nil
+}
+
+func (h *Handler) CompleteRideHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rideID, err := uuid.Parse(r.URL.Query().Get("ride_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body := struct {
+		NoShows []uuid.UUID `json:"no_shows"`
+	}{}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ride, err := h.Service.GetRideById(rideID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !Authorize(actor, ActionCompleteRide, RideResource(ride)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	err = h.Service.CompleteRide(rideID, body.NoShows)
+	if errors.Is(err, ErrRideNotCompletable) {
+		w.WriteHeader(http.StatusConflict)
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
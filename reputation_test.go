@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) IncrementReputation(delta Reputation) error {
+	if m.DB.Reputations == nil {
+		m.DB.Reputations = map[uuid.UUID]Reputation{}
+	}
+	r := m.DB.Reputations[delta.UserID]
+	r.UserID = delta.UserID
+	r.RatingSum += delta.RatingSum
+	r.RatingCount += delta.RatingCount
+	r.RidesDriven += delta.RidesDriven
+	r.RidesTaken += delta.RidesTaken
+	r.Commitments += delta.Commitments
+	r.Cancellations += delta.Cancellations
+	r.NoShows += delta.NoShows
+	m.DB.Reputations[delta.UserID] = r
+	return nil
+}
+
+func (m *MockRepository) GetReputations(userIDs []uuid.UUID) (map[uuid.UUID]Reputation, error) {
+	reputations := map[uuid.UUID]Reputation{}
+	for _, user := range m.DB.Users {
+		for _, userID := range userIDs {
+			if user.UserID == userID {
+				r := m.DB.Reputations[userID]
+				r.UserID = userID
+				r.MemberSince = user.CreatedAt
+				reputations[userID] = r
+			}
+		}
+	}
+	return reputations, nil
+}
+
+func TestReputationSummary(t *testing.T) {
+	now := time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)
+	r := Reputation{
+		RatingSum:     14,
+		RatingCount:   3,
+		RidesDriven:   2,
+		RidesTaken:    3,
+		Commitments:   8,
+		Cancellations: 2,
+		NoShows:       1,
+		MemberSince:   now.Add(-30 * 24 * time.Hour),
+	}
+	require.Equal(t, ReputationSummary{
+		AverageRating:    4.67,
+		RatingCount:      3,
+		RidesDriven:      2,
+		RidesTaken:       3,
+		CancellationRate: 0.25,
+		NoShowRate:       0.25,
+		AccountAgeDays:   30,
+	}, r.Summary(now))
+	require.Equal(t, ReputationSummary{}, Reputation{}.Summary(now))
+}
+
+func TestReputationIsMaintainedIncrementally(t *testing.T) {
+	departure := time.Date(2025, 9, 1, 16, 0, 0, 0, time.UTC)
+	now := departure.Add(-time.Hour)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	absentID := uuid.New()
+	db.Users[0].EmailVerifiedAt = &now
+	db.Users[0].CreatedAt = now.Add(-10 * 24 * time.Hour)
+
+	ride, err := s.CreateRide(Ride{RideID: uuid.New(), DriverID: driverID, DepartureTime: departure, ArrivalTime: departure.Add(2 * time.Hour), NumberOfSeats: 3})
+	require.NoError(t, err)
+	db.Rides[len(db.Rides)-1].Status = RideScheduled
+	booking, err := s.CreateBooking(Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1})
+	require.NoError(t, err)
+	_, err = s.ApproveBooking(booking.BookingID)
+	require.NoError(t, err)
+	absent := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: absentID, Status: BookingConfirmed}
+	db.Bookings = append(db.Bookings, absent)
+	cancelled, err := s.CreateBooking(Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1})
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteBooking(cancelled.BookingID, passengerID))
+
+	require.ErrorIs(t, s.CompleteRide(ride.RideID, nil), ErrRideNotCompletable)
+	now = ride.ArrivalTime.Add(time.Hour)
+	require.NoError(t, s.CompleteRide(ride.RideID, []uuid.UUID{absent.BookingID}))
+	require.ErrorIs(t, s.CompleteRide(ride.RideID, nil), ErrRideNotCompletable)
+
+	_, err = s.CreateReview(passengerID, Review{BookingID: booking.BookingID, Stars: 5})
+	require.NoError(t, err)
+	user, err := s.GetUserById(driverID)
+	require.NoError(t, err)
+	require.Zero(t, user.Reputation.RatingCount, "ratings count once revealed")
+
+	_, err = s.CreateReview(driverID, Review{BookingID: booking.BookingID, Stars: 3})
+	require.NoError(t, err)
+
+	driver, err := s.GetUserById(driverID)
+	require.NoError(t, err)
+	require.Equal(t, &ReputationSummary{AverageRating: 5, RatingCount: 1, RidesDriven: 1}, driver.Reputation)
+	passenger, err := s.GetUserById(passengerID)
+	require.NoError(t, err)
+	require.Equal(t, &ReputationSummary{AverageRating: 3, RatingCount: 1, RidesTaken: 1, CancellationRate: 0.5, AccountAgeDays: 10}, passenger.Reputation)
+	require.Equal(t, 1, db.Reputations[absentID].NoShows)
+
+	rides, err := s.GetAllRides()
+	require.NoError(t, err)
+	for _, r := range rides {
+		if r.RideID == ride.RideID {
+			require.Equal(t, driver.Reputation, r.DriverReputation)
+		}
+	}
+}
+
+func TestCloseReviewWindows(t *testing.T) {
+	arrival := time.Date(2025, 9, 1, 18, 0, 0, 0, time.UTC)
+	now := arrival.Add(time.Hour)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	_, booking := completedRide(db, driverID, passengerID, arrival)
+
+	_, err := s.CreateReview(passengerID, Review{BookingID: booking.BookingID, Stars: 4})
+	require.NoError(t, err)
+	require.NoError(t, s.CloseReviewWindows())
+	require.Zero(t, db.Reputations[driverID].RatingCount)
+
+	now = arrival.Add(reviewWindow)
+	require.NoError(t, s.CloseReviewWindows())
+	require.NoError(t, s.CloseReviewWindows())
+	require.Equal(t, 1, db.Reputations[driverID].RatingCount)
+	require.Equal(t, 4, db.Reputations[driverID].RatingSum)
+}
+
+func TestSortByDriverReputation(t *testing.T) {
+	unrated := Ride{Origin: "unrated"}
+	newcomer := Ride{Origin: "newcomer", DriverReputation: &ReputationSummary{AverageRating: 5, RatingCount: 1}}
+	veteran := Ride{Origin: "veteran", DriverReputation: &ReputationSummary{AverageRating: 5, RatingCount: 40}}
+	flaky := Ride{Origin: "flaky", DriverReputation: &ReputationSummary{AverageRating: 5, RatingCount: 40, CancellationRate: 0.3}}
+	average := Ride{Origin: "average", DriverReputation: &ReputationSummary{AverageRating: 3.5, RatingCount: 12}}
+
+	rides := []Ride{unrated, average, flaky, newcomer, veteran}
+	SortByDriverReputation(rides)
+	got := []string{}
+	for _, ride := range rides {
+		got = append(got, ride.Origin)
+	}
+	require.Equal(t, []string{"veteran", "flaky", "newcomer", "average", "unrated"}, got)
+}
+
+func TestCompleteRideHandler(t *testing.T) {
+	driver := Actor{UserID: uuid.New(), Role: RoleDriver}
+	ride := Ride{RideID: uuid.New(), DriverID: driver.UserID}
+	noShow := uuid.New()
+	body := []byte(`{"no_shows":["` + noShow.String() + `"]}`)
+
+	for _, tc := range []struct {
+		name   string
+		actor  Actor
+		err    error
+		status int
+	}{
+		{"completed", driver, nil, http.StatusNoContent},
+		{"not completable", driver, ErrRideNotCompletable, http.StatusConflict},
+		{"not the driver", Actor{UserID: uuid.New(), Role: RoleDriver}, nil, http.StatusForbidden},
+	} {
+		mockSvc := new(MockService)
+		h := &Handler{Service: mockSvc}
+		mockSvc.On("GetRideById", ride.RideID).Return(ride, nil)
+		mockSvc.On("CompleteRide", ride.RideID, mock.Anything).Return(tc.err)
+		req := asActor(httptest.NewRequest(http.MethodPost, "/rides/complete?ride_id="+ride.RideID.String(), bytes.NewBuffer(body)), tc.actor)
+		w := httptest.NewRecorder()
+		h.CompleteRideHandler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+		if tc.status == http.StatusNoContent {
+			mockSvc.AssertCalled(t, "CompleteRide", ride.RideID, []uuid.UUID{noShow})
+		}
+	}
+}
+
+func TestCancellationsCountTheirAuthor(t *testing.T) {
+	departure := time.Date(2025, 9, 1, 16, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	now := departure.Add(-48 * time.Hour)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	adminID := uuid.New()
+	db.Users[0].EmailVerifiedAt = &now
+
+	ride, err := s.CreateRide(Ride{RideID: uuid.New(), DriverID: driverID, DepartureTime: departure, NumberOfSeats: 3})
+	require.NoError(t, err)
+	db.Rides[len(db.Rides)-1].Status = RideScheduled
+	for _, actorID := range []uuid.UUID{driverID, adminID, passengerID} {
+		booking, err := s.CreateBooking(Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1})
+		require.NoError(t, err)
+		require.NoError(t, s.DeleteBooking(booking.BookingID, actorID))
+		cancellations := 0
+		if actorID == passengerID {
+			cancellations = 1
+		}
+		require.Equal(t, cancellations, db.Reputations[passengerID].Cancellations, "booking deleted by %s", actorID)
+		restored, err := s.RestoreBooking(booking.BookingID)
+		require.NoError(t, err)
+		require.Nil(t, restored.DeletedBy)
+		require.Zero(t, db.Reputations[passengerID].Cancellations, "booking restored after %s deleted it", actorID)
+	}
+
+	for _, actorID := range []uuid.UUID{adminID, driverID} {
+		require.NoError(t, s.DeleteRide(ride.RideID, actorID))
+		cancellations := 0
+		if actorID == driverID {
+			cancellations = 1
+		}
+		require.Equal(t, cancellations, db.Reputations[driverID].Cancellations, "ride deleted by %s", actorID)
+		_, err = s.RestoreRide(ride.RideID)
+		require.NoError(t, err)
+		require.Zero(t, db.Reputations[driverID].Cancellations, "ride restored after %s deleted it", actorID)
+	}
+}
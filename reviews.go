@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// reviewWindow is how long after arrival the driver and passengers can rate
+// each other.
+const reviewWindow = 14 * 24 * time.Hour
+
+var ReviewTags = []string{"punctual", "friendly", "safe_driving", "clean_car", "good_conversation", "respectful"}
+
+var (
+	ErrInvalidReview    = errors.New("invalid review")
+	ErrReviewNotAllowed = errors.New("review not allowed")
+	ErrReviewWindow     = errors.New("review window is not open")
+	ErrAlreadyReviewed  = errors.New("booking already reviewed")
+)
+
+// Review is the rating left by one side of a booking to the other. It stays
+// hidden until both sides have reviewed or the window closes, so that nobody
+// rates in retaliation.
+type Review struct {
+	ReviewID       uuid.UUID  `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"review_id"`
+	BookingID      uuid.UUID  `gorm:"type:uuid;uniqueIndex:idx_review_booking_author" json:"booking_id"`
+	AuthorID       uuid.UUID  `gorm:"type:uuid;uniqueIndex:idx_review_booking_author" json:"author_id"`
+	SubjectID      uuid.UUID  `gorm:"type:uuid;index" json:"subject_id"`
+	RideID         uuid.UUID  `gorm:"type:uuid" json:"ride_id"`
+	Stars          int        `json:"stars"`
+	Comment        string     `json:"comment"`
+	Tags           []string   `gorm:"type:jsonb;serializer:json" json:"tags"`
+	CreatedAt      time.Time  `json:"created_at"`
+	WindowClosesAt time.Time  `json:"-"`
+	RevealedAt     *time.Time `json:"-"`
+}
+
+type ReviewRepository interface {
+	CreateReview(review Review) (Review, error)
+	GetRevealedReviewsForUser(userID uuid.UUID, at time.Time) ([]Review, error)
+	RevealExpiredReviews(at time.Time) (int, error)
+	GetReviewsByUser(userID uuid.UUID) ([]Review, error)
+}
+
+// CreateReview stores review and reveals both reviews of the booking when the
+// other side already reviewed. Revealed ratings count in the reputation of
+// their subject.
+func (repository *CovoitRepository) CreateReview(review Review) (Review, error) {
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		err := gorm.G[Review](tx).Create(ctx, &review)
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ErrAlreadyReviewed
+		} else if err != nil {
+			return fmt.Errorf("could not create review of booking %s, err : %s", review.BookingID, err)
+		}
+		counterpart, err := gorm.G[Review](tx).
+			Where("booking_id = ? AND author_id = ?", review.BookingID, review.SubjectID).
+			First(ctx)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not retrieve reviews of booking %s, err : %s", review.BookingID, err)
+		}
+		_, err = gorm.G[Review](tx).
+			Where("review_id IN ?", []uuid.UUID{review.ReviewID, counterpart.ReviewID}).
+			Update(ctx, "revealed_at", review.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("could not reveal reviews of booking %s, err : %s", review.BookingID, err)
+		}
+		review.RevealedAt = &review.CreatedAt
+		for _, revealed := range []Review{review, counterpart} {
+			err = incrementReputation(tx, Reputation{UserID: revealed.SubjectID, RatingSum: revealed.Stars, RatingCount: 1})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Review{}, err
+	}
+	return review, nil
+}
+
+// RevealExpiredReviews reveals the reviews whose window closed before at
+// without the other side reviewing, and counts them in the reputation of
+// their subject.
+func (repository *CovoitRepository) RevealExpiredReviews(at time.Time) (int, error) {
+	ctx := context.Background()
+	reviews, err := gorm.G[Review](repository.db).
+		Where("revealed_at IS NULL AND window_closes_at <= ?", at).
+		Find(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("could not retrieve expired reviews, err : %s", err)
+	}
+	revealed := 0
+	for _, review := range reviews {
+		err := repository.db.Transaction(func(tx *gorm.DB) error {
+			rows, err := gorm.G[Review](tx).
+				Where("review_id = ? AND revealed_at IS NULL", review.ReviewID).
+				Update(ctx, "revealed_at", review.WindowClosesAt)
+			if err != nil {
+				return fmt.Errorf("could not reveal review %s, err : %s", review.ReviewID, err)
+			}
+			if rows == 0 {
+				return nil
+			}
+			revealed++
+			return incrementReputation(tx, Reputation{UserID: review.SubjectID, RatingSum: review.Stars, RatingCount: 1})
+		})
+		if err != nil {
+			return revealed, err
+		}
+	}
+	return revealed, nil
+}
+
+func (repository *CovoitRepository) GetRevealedReviewsForUser(userID uuid.UUID, at time.Time) ([]Review, error) {
+	ctx := context.Background()
+	reviews, err := gorm.G[Review](repository.db).
+		Where("subject_id = ? AND (revealed_at IS NOT NULL OR window_closes_at <= ?)", userID, at).
+		Order("created_at DESC").
+		Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve reviews of user %s, err : %s", userID, err)
+	}
+	return reviews, nil
+}
+
+// GetReviewsByUser returns the reviews written or received by the user,
+// hidden ones included.
+func (repository *CovoitRepository) GetReviewsByUser(userID uuid.UUID) ([]Review, error) {
+	ctx := context.Background()
+	reviews, err := gorm.G[Review](repository.db).
+		Where("author_id = ? OR subject_id = ?", userID, userID).
+		Order("created_at").
+		Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get reviews of user %s, err : %s", userID, err)
+	}
+	return reviews, nil
+}
+
+func init() {
+	// Reviews received stay out of the export until they are revealed.
+	registerPersonalData("reviews", []string{"reviews"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		reviews, err := service.reviews.GetReviewsByUser(userID)
+		if err != nil {
+			return nil, err
+		}
+		now := service.clock()
+		return slices.DeleteFunc(reviews, func(review Review) bool {
+			return review.AuthorID != userID && review.RevealedAt == nil && review.WindowClosesAt.After(now)
+		}), nil
+	})
+	registerPeriodicJob("reviews.close", time.Hour, func(service *CovoitService, job Job) error {
+		return service.CloseReviewWindows()
+	})
+}
+
+func validateReview(review Review) error {
+	if review.Stars < 1 || review.Stars > 5 {
+		return fmt.Errorf("%w : stars must be between 1 and 5", ErrInvalidReview)
+	}
+	if len(review.Comment) > 1000 {
+		return fmt.Errorf("%w : comment is too long", ErrInvalidReview)
+	}
+	for _, tag := range review.Tags {
+		if !slices.Contains(ReviewTags, tag) {
+			return fmt.Errorf("%w : unknown tag %s", ErrInvalidReview, tag)
+		}
+	}
+	return nil
+}
+
+// CreateReview lets authorID rate the other side of a booking once the ride
+// is completed. Passengers rate the driver and the driver rates the passenger.
+func (service *CovoitService) CreateReview(authorID uuid.UUID, review Review) (Review, error) {
+	if err := validateReview(review); err != nil {
+		return Review{}, err
+	}
+	booking, err := service.repository.GetBookingById(review.BookingID)
+	if err != nil {
+		return Review{}, err
+	}
+	ride, err := service.repository.GetRideById(booking.RideID)
+	if err != nil {
+		return Review{}, err
+	}
+	// Only a trip that took place is reviewed : not a booking left pending,
+	// cancelled or missed.
+	if booking.Status != BookingConfirmed {
+		return Review{}, fmt.Errorf("%w : the booking is %s", ErrReviewNotAllowed, booking.Status)
+	}
+	switch authorID {
+	case booking.UserID:
+		review.SubjectID = ride.DriverID
+	case ride.DriverID:
+		review.SubjectID = booking.UserID
+	default:
+		return Review{}, ErrReviewNotAllowed
+	}
+
+	now := service.clock()
+	windowClosesAt := ride.ArrivalTime.Add(reviewWindow)
+	if now.Before(ride.ArrivalTime) || !now.Before(windowClosesAt) {
+		return Review{}, ErrReviewWindow
+	}
+	if ride.Status != RideCompleted {
+		return Review{}, fmt.Errorf("%w : the ride is not completed", ErrReviewNotAllowed)
+	}
+	review.ReviewID = uuid.Nil
+	review.AuthorID = authorID
+	review.RideID = ride.RideID
+	review.CreatedAt = now
+	review.WindowClosesAt = windowClosesAt
+	review.RevealedAt = nil
+	return service.reviews.CreateReview(review)
+}
+
+func (service *CovoitService) GetReviewsReceived(userID uuid.UUID) ([]Review, error) {
+	return service.reviews.GetRevealedReviewsForUser(userID, service.clock())
+}
+
+// CloseReviewWindows reveals the reviews left unanswered once their window
+// closed.
+func (service *CovoitService) CloseReviewWindows() error {
+	revealed, err := service.reviews.RevealExpiredReviews(service.clock())
+	if revealed > 0 {
+		log.Printf("revealed %d reviews after their window closed", revealed)
+	}
+	return err
+}
+
+func (h *Handler) ReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		{
+			userID, err := uuid.Parse(r.URL.Query().Get("user_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reviews, err := h.Service.GetReviewsReceived(userID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(reviews)
+		}
+	case http.MethodPost:
+		{
+			actor, ok := ActorFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			newReview := Review{}
+			err := json.NewDecoder(r.Body).Decode(&newReview)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			review, err := h.Service.CreateReview(actor.UserID, newReview)
+			if errors.Is(err, ErrInvalidReview) {
+				w.WriteHeader(http.StatusBadRequest)
+			} else if errors.Is(err, ErrReviewNotAllowed) {
+				w.WriteHeader(http.StatusForbidden)
+			} else if errors.Is(err, ErrReviewWindow) || errors.Is(err, ErrAlreadyReviewed) {
+				w.WriteHeader(http.StatusConflict)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(review)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) CreateReview(review Review) (Review, error) {
+	for _, existing := range m.DB.Reviews {
+		if existing.BookingID == review.BookingID && existing.AuthorID == review.AuthorID {
+			return Review{}, ErrAlreadyReviewed
+		}
+	}
+	review.ReviewID = uuid.New()
+	for i, counterpart := range m.DB.Reviews {
+		if counterpart.BookingID == review.BookingID && counterpart.AuthorID == review.SubjectID {
+			m.DB.Reviews[i].RevealedAt = &review.CreatedAt
+			review.RevealedAt = &review.CreatedAt
+			m.IncrementReputation(Reputation{UserID: review.SubjectID, RatingSum: review.Stars, RatingCount: 1})
+			m.IncrementReputation(Reputation{UserID: counterpart.SubjectID, RatingSum: counterpart.Stars, RatingCount: 1})
+		}
+	}
+	m.DB.Reviews = append(m.DB.Reviews, review)
+	return review, nil
+}
+
+func (m *MockRepository) GetRevealedReviewsForUser(userID uuid.UUID, at time.Time) ([]Review, error) {
+	reviews := []Review{}
+	for _, review := range m.DB.Reviews {
+		if review.SubjectID == userID && (review.RevealedAt != nil || !review.WindowClosesAt.After(at)) {
+			reviews = append(reviews, review)
+		}
+	}
+	return reviews, nil
+}
+
+func (m *MockRepository) RevealExpiredReviews(at time.Time) (int, error) {
+	revealed := 0
+	for i, review := range m.DB.Reviews {
+		if review.RevealedAt == nil && !review.WindowClosesAt.After(at) {
+			m.DB.Reviews[i].RevealedAt = &review.WindowClosesAt
+			m.IncrementReputation(Reputation{UserID: review.SubjectID, RatingSum: review.Stars, RatingCount: 1})
+			revealed++
+		}
+	}
+	return revealed, nil
+}
+
+func (m *MockRepository) GetReviewsByUser(userID uuid.UUID) ([]Review, error) {
+	reviews := []Review{}
+	for _, review := range m.DB.Reviews {
+		if review.AuthorID == userID || review.SubjectID == userID {
+			reviews = append(reviews, review)
+		}
+	}
+	return reviews, nil
+}
+
+// completedRide adds a ride that arrived at arrival and a confirmed booking on
+// it to db.
+func completedRide(db *MockDB, driverID uuid.UUID, passengerID uuid.UUID, arrival time.Time) (Ride, Booking) {
+	ride := Ride{RideID: uuid.New(), DriverID: driverID, DepartureTime: arrival.Add(-2 * time.Hour), ArrivalTime: arrival, Status: RideCompleted}
+	booking := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1, Status: BookingConfirmed}
+	db.Rides = append(db.Rides, ride)
+	db.Bookings = append(db.Bookings, booking)
+	return ride, booking
+}
+
+func TestReviews(t *testing.T) {
+	arrival := time.Date(2025, 9, 1, 18, 0, 0, 0, time.UTC)
+	now := arrival.Add(-time.Hour)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	_, booking := completedRide(db, driverID, passengerID, arrival)
+
+	t.Run("not before arrival", func(t *testing.T) {
+		_, err := s.CreateReview(passengerID, Review{BookingID: booking.BookingID, Stars: 5})
+		require.ErrorIs(t, err, ErrReviewWindow)
+	})
+
+	now = arrival.Add(time.Hour)
+
+	t.Run("invalid reviews", func(t *testing.T) {
+		for _, review := range []Review{
+			{BookingID: booking.BookingID, Stars: 0},
+			{BookingID: booking.BookingID, Stars: 6},
+			{BookingID: booking.BookingID, Stars: 4, Tags: []string{"rude"}},
+		} {
+			_, err := s.CreateReview(passengerID, review)
+			require.ErrorIs(t, err, ErrInvalidReview)
+		}
+	})
+
+	t.Run("only trips that took place", func(t *testing.T) {
+		_, scheduledBooking := completedRide(db, driverID, passengerID, arrival)
+		db.Rides[len(db.Rides)-1].Status = RideScheduled
+		_, err := s.CreateReview(passengerID, Review{BookingID: scheduledBooking.BookingID, Stars: 5})
+		require.ErrorIs(t, err, ErrReviewNotAllowed, "the ride is not completed")
+		for _, status := range []string{BookingPending, BookingCancelled, BookingNoShow} {
+			_, other := completedRide(db, driverID, passengerID, arrival)
+			db.Bookings[len(db.Bookings)-1].Status = status
+			_, err := s.CreateReview(driverID, Review{BookingID: other.BookingID, Stars: 1})
+			require.ErrorIs(t, err, ErrReviewNotAllowed, status)
+		}
+	})
+
+	t.Run("strangers cannot review", func(t *testing.T) {
+		_, err := s.CreateReview(uuid.New(), Review{BookingID: booking.BookingID, Stars: 1})
+		require.ErrorIs(t, err, ErrReviewNotAllowed)
+	})
+
+	t.Run("hidden until both sides reviewed", func(t *testing.T) {
+		review, err := s.CreateReview(passengerID, Review{BookingID: booking.BookingID, Stars: 5, Tags: []string{"punctual"}, SubjectID: passengerID})
+		require.NoError(t, err)
+		require.Equal(t, driverID, review.SubjectID)
+
+		received, err := s.GetReviewsReceived(driverID)
+		require.NoError(t, err)
+		require.Empty(t, received)
+
+		_, err = s.CreateReview(passengerID, Review{BookingID: booking.BookingID, Stars: 1})
+		require.ErrorIs(t, err, ErrAlreadyReviewed)
+
+		_, err = s.CreateReview(driverID, Review{BookingID: booking.BookingID, Stars: 4})
+		require.NoError(t, err)
+
+		received, err = s.GetReviewsReceived(driverID)
+		require.NoError(t, err)
+		require.Len(t, received, 1)
+		require.Equal(t, 5, received[0].Stars)
+		received, err = s.GetReviewsReceived(passengerID)
+		require.NoError(t, err)
+		require.Len(t, received, 1)
+		require.Equal(t, 4, received[0].Stars)
+	})
+}
+
+func TestReviewsRevealedWhenWindowCloses(t *testing.T) {
+	arrival := time.Date(2025, 9, 1, 18, 0, 0, 0, time.UTC)
+	now := arrival.Add(time.Hour)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	_, booking := completedRide(db, driverID, passengerID, arrival)
+
+	_, err := s.CreateReview(driverID, Review{BookingID: booking.BookingID, Stars: 2})
+	require.NoError(t, err)
+
+	now = arrival.Add(reviewWindow)
+	received, err := s.GetReviewsReceived(passengerID)
+	require.NoError(t, err)
+	require.Len(t, received, 1)
+
+	_, err = s.CreateReview(passengerID, Review{BookingID: booking.BookingID, Stars: 3})
+	require.ErrorIs(t, err, ErrReviewWindow)
+}
+
+func TestReviewsHandler(t *testing.T) {
+	actor := Actor{UserID: uuid.New(), Role: RolePassenger}
+	bookingID := uuid.New()
+	body, _ := json.Marshal(Review{BookingID: bookingID, Stars: 5})
+
+	for _, tc := range []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"created", nil, http.StatusCreated},
+		{"invalid", ErrInvalidReview, http.StatusBadRequest},
+		{"not allowed", ErrReviewNotAllowed, http.StatusForbidden},
+		{"window", ErrReviewWindow, http.StatusConflict},
+		{"twice", ErrAlreadyReviewed, http.StatusConflict},
+	} {
+		mockSvc := new(MockService)
+		h := &Handler{Service: mockSvc}
+		mockSvc.On("CreateReview", actor.UserID, mock.Anything).Return(Review{BookingID: bookingID}, tc.err)
+		req := asActor(httptest.NewRequest(http.MethodPost, "/reviews", bytes.NewBuffer(body)), actor)
+		w := httptest.NewRecorder()
+		h.ReviewsHandler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("GetReviewsReceived", actor.UserID).Return([]Review{{Stars: 5}}, nil)
+	req := httptest.NewRequest(http.MethodGet, "/reviews?user_id="+actor.UserID.String(), nil)
+	w := httptest.NewRecorder()
+	h.ReviewsHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodPost, "/reviews", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	h.ReviewsHandler(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	JobPending = "pending"
+	JobDone    = "done"
+	// JobFailed is a delayed job given up on after too many failed attempts.
+	JobFailed = "failed"
+)
+
+const (
+	JobRideReminder = "ride.reminder"
+	JobRideComplete = "ride.complete"
+)
+
+// RideReminders are how many hours before its departure a ride is reminded
+// to its driver and passengers.
+var RideReminders = []int{24, 1}
+
+const (
+	jobBatchSize   = 20
+	jobMaxAttempts = 5
+	// jobBackoff is the wait after the first failed attempt of a delayed
+	// job, it doubles with every attempt.
+	jobBackoff = time.Minute
+	// jobLease is how long a claimed job is kept from the other instances.
+	jobLease = 5 * time.Minute
+	// SchedulerInterval is how often the due jobs are polled.
+	SchedulerInterval = 5 * time.Second
+)
+
+// Job is a unit of work run by the scheduler, once at RunAt for a delayed
+// job or every Every for a periodic one. Jobs are claimed with their row
+// locked, so that a job runs on one instance at a time, and run at least
+// once : their handlers must be idempotent.
+type Job struct {
+	JobID uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"job_id"`
+	// Name selects the handler of the job.
+	Name string `json:"name"`
+	// Key identifies the job, a job is not scheduled twice under the same
+	// key.
+	Key         string          `gorm:"uniqueIndex" json:"key"`
+	Payload     json.RawMessage `gorm:"type:jsonb;serializer:json" json:"payload,omitempty"`
+	RunAt       time.Time       `gorm:"index:idx_job_due,priority:2" json:"run_at"`
+	Every       time.Duration   `json:"every,omitempty"`
+	Status      string          `gorm:"default:pending;index:idx_job_due,priority:1" json:"status"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+type jobHandler func(service *CovoitService, job Job) error
+
+var jobHandlers = map[string]jobHandler{}
+
+// periodicJobs are the periods of the periodic jobs by name.
+var periodicJobs = map[string]time.Duration{}
+
+// registerJob sets the handler of the jobs named name. Each subsystem
+// registers its jobs from an init function.
+func registerJob(name string, handler jobHandler) {
+	jobHandlers[name] = handler
+}
+
+// registerPeriodicJob registers a job that runs every period on one of the
+// instances.
+func registerPeriodicJob(name string, every time.Duration, handler jobHandler) {
+	registerJob(name, handler)
+	periodicJobs[name] = every
+}
+
+// RideJob is the payload of the jobs of a ride.
+type RideJob struct {
+	RideID      uuid.UUID `json:"ride_id"`
+	HoursBefore int       `json:"hours_before,omitempty"`
+}
+
+func rideJob(name string, key string, runAt time.Time, payload RideJob) Job {
+	data, _ := json.Marshal(payload)
+	return Job{Name: name, Key: key, Payload: data, RunAt: runAt, Status: JobPending}
+}
+
+// rideJobs returns the reminders of the ride and its completion after its
+// arrival.
+func rideJobs(ride Ride) []Job {
+	jobs := []Job{}
+	for _, hours := range RideReminders {
+		key := fmt.Sprintf("%s:%s:%dh", JobRideReminder, ride.RideID, hours)
+		runAt := ride.DepartureTime.Add(-time.Duration(hours) * time.Hour)
+		jobs = append(jobs, rideJob(JobRideReminder, key, runAt, RideJob{RideID: ride.RideID, HoursBefore: hours}))
+	}
+	arrival := ride.ArrivalTime
+	if arrival.IsZero() {
+		arrival = ride.DepartureTime
+	}
+	jobs = append(jobs, rideJob(JobRideComplete, fmt.Sprintf("%s:%s", JobRideComplete, ride.RideID), arrival, RideJob{RideID: ride.RideID}))
+	return jobs
+}
+
+// scheduleJobs writes jobs within tx, the ones whose key is already taken
+// are skipped.
+func scheduleJobs(tx *gorm.DB, jobs ...Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	if err := gorm.G[Job](tx, clause.OnConflict{DoNothing: true}).CreateInBatches(context.Background(), &jobs, len(jobs)); err != nil {
+		return fmt.Errorf("could not schedule jobs, err : %s", err)
+	}
+	return nil
+}
+
+type JobRepository interface {
+	ScheduleJobs(jobs ...Job) error
+	// ClaimJobs returns up to limit pending jobs due at at, and keeps them
+	// from the other instances for lease.
+	ClaimJobs(at time.Time, limit int, lease time.Duration) ([]Job, error)
+	// SaveJob records the outcome of a run.
+	SaveJob(job Job) error
+}
+
+func (repository *CovoitRepository) ScheduleJobs(jobs ...Job) error {
+	return scheduleJobs(repository.db, jobs...)
+}
+
+func (repository *CovoitRepository) ClaimJobs(at time.Time, limit int, lease time.Duration) ([]Job, error) {
+	jobs := []Job{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		jobs, err = gorm.G[Job](tx, clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND run_at <= ?", JobPending, at).
+			Order("run_at").
+			Limit(limit).
+			Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not claim jobs, err : %s", err)
+		}
+		if len(jobs) == 0 {
+			return nil
+		}
+		ids := make([]uuid.UUID, len(jobs))
+		for i, job := range jobs {
+			ids[i] = job.JobID
+		}
+		_, err = gorm.G[Job](tx).Where("job_id IN ?", ids).Update(ctx, "run_at", at.Add(lease))
+		if err != nil {
+			return fmt.Errorf("could not claim jobs, err : %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (repository *CovoitRepository) SaveJob(job Job) error {
+	ctx := context.Background()
+	_, err := gorm.G[Job](repository.db).
+		Where("job_id = ?", job.JobID).
+		Select("status", "attempts", "run_at", "last_error", "completed_at").
+		Updates(ctx, job)
+	if err != nil {
+		return fmt.Errorf("could not save job %s, err : %s", job.JobID, err)
+	}
+	return nil
+}
+
+func init() {
+	registerJob(JobRideReminder, (*CovoitService).remindRide)
+	registerJob(JobRideComplete, (*CovoitService).autoCompleteRide)
+	// Jobs tell about rides, which are exported on their own.
+	registerImpersonalTables("jobs")
+}
+
+// remindRide reminds the ride of job to its driver and its confirmed
+// passengers. A reminder that is late by more than half its lead time, for a
+// ride created at the last minute, is skipped.
+func (service *CovoitService) remindRide(job Job) error {
+	var payload RideJob
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("could not decode job %s, err : %s", job.Key, err)
+	}
+	ride, err := service.repository.GetRideById(payload.RideID)
+	if err != nil || ride.Status != RideScheduled {
+		return nil
+	}
+	lead := time.Duration(payload.HoursBefore) * time.Hour
+	if ride.DepartureTime.Sub(service.clock()) < lead/2 {
+		return nil
+	}
+	bookings, err := service.repository.GetBookingsByRide(ride.RideID)
+	if err != nil {
+		return err
+	}
+	notifications := []Notification{rideNotification(NotificationRideReminder, ride.DriverID, ride, nil)}
+	for _, booking := range bookings {
+		if booking.Status == BookingConfirmed {
+			notifications = append(notifications, rideNotification(NotificationRideReminder, booking.UserID, ride, &booking))
+		}
+	}
+	for i := range notifications {
+		key := fmt.Sprintf("%s:%s", job.Key, notifications[i].UserID)
+		notifications[i].DedupKey = &key
+		notifications[i].Data.HoursBefore = payload.HoursBefore
+	}
+	return service.notifications.EnqueueNotifications(notifications...)
+}
+
+// autoCompleteRide completes the ride of job once it arrived, unless its
+// driver did or it was cancelled meanwhile.
+func (service *CovoitService) autoCompleteRide(job Job) error {
+	var payload RideJob
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("could not decode job %s, err : %s", job.Key, err)
+	}
+	ride, err := service.repository.GetRideById(payload.RideID)
+	if err != nil || ride.Status != RideScheduled {
+		return nil
+	}
+	if err := service.CompleteRide(ride.RideID, nil); err != nil && !errors.Is(err, ErrRideNotCompletable) {
+		return err
+	}
+	return nil
+}
+
+// SchedulePeriodicJobs makes sure every periodic job is scheduled. The
+// instances all call it on start, the first one schedules them.
+func (service *CovoitService) SchedulePeriodicJobs() error {
+	now := service.clock()
+	jobs := []Job{}
+	for name, every := range periodicJobs {
+		jobs = append(jobs, Job{Name: name, Key: name, RunAt: now, Every: every, Status: JobPending})
+	}
+	return service.jobs.ScheduleJobs(jobs...)
+}
+
+// runScheduledJob runs job and returns it updated with the outcome. A
+// periodic job comes back after its period whatever the outcome, a failed
+// delayed job is retried with an exponential backoff until it is failed.
+func (service *CovoitService) runScheduledJob(job Job, now time.Time) Job {
+	err := fmt.Errorf("no handler for job %s", job.Name)
+	if handler, ok := jobHandlers[job.Name]; ok {
+		err = handler(service, job)
+	}
+	if err == nil {
+		job.Attempts = 0
+		job.LastError = ""
+		if job.Every > 0 {
+			job.RunAt = now.Add(job.Every)
+			return job
+		}
+		job.Status = JobDone
+		job.CompletedAt = &now
+		return job
+	}
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Every > 0 {
+		log.Printf("periodic job %s failed : %s", job.Key, err)
+		job.RunAt = now.Add(job.Every)
+		return job
+	}
+	if job.Attempts >= jobMaxAttempts {
+		job.Status = JobFailed
+		log.Printf("giving up on job %s after %d attempts : %s", job.Key, job.Attempts, job.LastError)
+		return job
+	}
+	job.RunAt = now.Add(jobBackoff << (job.Attempts - 1))
+	return job
+}
+
+// RunDueJobs runs the jobs due and returns how many succeeded.
+func (service *CovoitService) RunDueJobs() (int, error) {
+	now := service.clock()
+	jobs, err := service.jobs.ClaimJobs(now, jobBatchSize, jobLease)
+	if err != nil {
+		return 0, err
+	}
+	succeeded := 0
+	for _, job := range jobs {
+		job = service.runScheduledJob(job, now)
+		if err := service.jobs.SaveJob(job); err != nil {
+			return succeeded, err
+		}
+		if job.LastError == "" {
+			succeeded++
+		}
+	}
+	return succeeded, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// schedule adds the jobs whose key is not taken yet, like the unique key of
+// the jobs table.
+func (m *MockRepository) schedule(jobs ...Job) {
+	for _, job := range jobs {
+		if slices.ContainsFunc(m.DB.Jobs, func(j Job) bool { return j.Key == job.Key }) {
+			continue
+		}
+		job.JobID = uuid.New()
+		m.DB.Jobs = append(m.DB.Jobs, job)
+	}
+}
+
+func (m *MockRepository) ScheduleJobs(jobs ...Job) error {
+	m.schedule(jobs...)
+	return nil
+}
+
+func (m *MockRepository) ClaimJobs(at time.Time, limit int, lease time.Duration) ([]Job, error) {
+	jobs := []Job{}
+	for i, job := range m.DB.Jobs {
+		if len(jobs) == limit {
+			break
+		}
+		if job.Status != JobPending || job.RunAt.After(at) {
+			continue
+		}
+		jobs = append(jobs, job)
+		m.DB.Jobs[i].RunAt = at.Add(lease)
+	}
+	return jobs, nil
+}
+
+func (m *MockRepository) SaveJob(job Job) error {
+	i := slices.IndexFunc(m.DB.Jobs, func(j Job) bool { return j.JobID == job.JobID })
+	if i < 0 {
+		return gorm.ErrRecordNotFound
+	}
+	m.DB.Jobs[i] = job
+	return nil
+}
+
+func jobByKey(t *testing.T, db *MockDB, key string) Job {
+	t.Helper()
+	i := slices.IndexFunc(db.Jobs, func(job Job) bool { return job.Key == key })
+	require.GreaterOrEqual(t, i, 0, key)
+	return db.Jobs[i]
+}
+
+func reminders(db *MockDB, hours int) []Notification {
+	return slices.DeleteFunc(slices.Clone(db.Notifications), func(n Notification) bool {
+		return n.Type != NotificationRideReminder || n.Data.HoursBefore != hours
+	})
+}
+
+func TestRideReminders(t *testing.T) {
+	departure := time.Date(2025, 9, 12, 8, 30, 0, 0, time.UTC)
+	now := departure.Add(-48 * time.Hour)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	ride, err := s.CreateRide(Ride{RideID: uuid.New(), DriverID: driverID, Origin: "Lyon", Destination: "Paris", DepartureTime: departure, ArrivalTime: departure.Add(4 * time.Hour), NumberOfSeats: 3})
+	require.NoError(t, err)
+	db.Rides[len(db.Rides)-1].Status = RideScheduled
+	db.Bookings = append(db.Bookings,
+		Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1, Status: BookingConfirmed},
+		Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: uuid.New(), NumberOfSeats: 1, Status: BookingPending},
+	)
+	require.Len(t, db.Jobs, 3)
+	reminder24 := jobByKey(t, db, "ride.reminder:"+ride.RideID.String()+":24h")
+	require.Equal(t, departure.Add(-24*time.Hour), reminder24.RunAt)
+	require.Equal(t, departure.Add(4*time.Hour), jobByKey(t, db, "ride.complete:"+ride.RideID.String()).RunAt)
+
+	ran, err := s.RunDueJobs()
+	require.NoError(t, err)
+	require.Zero(t, ran, "nothing is due yet")
+
+	now = departure.Add(-24 * time.Hour)
+	ran, err = s.RunDueJobs()
+	require.NoError(t, err)
+	require.Equal(t, 1, ran)
+	sent := reminders(db, 24)
+	require.Len(t, sent, 2, "the driver and the confirmed passenger are reminded")
+	require.ElementsMatch(t, []uuid.UUID{driverID, passengerID}, []uuid.UUID{sent[0].UserID, sent[1].UserID})
+	require.Equal(t, JobDone, jobByKey(t, db, reminder24.Key).Status)
+
+	// An instance stopping before it saves the outcome runs the job again.
+	i := slices.IndexFunc(db.Jobs, func(job Job) bool { return job.Key == reminder24.Key })
+	db.Jobs[i].Status, db.Jobs[i].RunAt = JobPending, now
+	ran, err = s.RunDueJobs()
+	require.NoError(t, err)
+	require.Equal(t, 1, ran)
+	require.Len(t, reminders(db, 24), 2, "a reminder is not sent twice")
+
+	now = departure.Add(-time.Hour)
+	_, err = s.RunDueJobs()
+	require.NoError(t, err)
+	require.Len(t, reminders(db, 1), 2)
+
+	now = departure.Add(2 * time.Hour)
+	ran, err = s.RunDueJobs()
+	require.NoError(t, err)
+	require.Zero(t, ran, "the ride completes after its arrival")
+	now = departure.Add(4 * time.Hour)
+	ran, err = s.RunDueJobs()
+	require.NoError(t, err)
+	require.Equal(t, 1, ran)
+	completed, err := s.GetRideById(ride.RideID)
+	require.NoError(t, err)
+	require.Equal(t, RideCompleted, completed.Status)
+}
+
+func TestRideRemindersSkipped(t *testing.T) {
+	departure := time.Date(2025, 9, 12, 8, 30, 0, 0, time.UTC)
+	now := departure.Add(-2 * time.Hour)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	late, err := s.CreateRide(Ride{RideID: uuid.New(), DriverID: driverID, DepartureTime: departure})
+	require.NoError(t, err)
+	db.Rides[len(db.Rides)-1].Status = RideScheduled
+	ran, err := s.RunDueJobs()
+	require.NoError(t, err)
+	require.Equal(t, 1, ran)
+	require.Empty(t, reminders(db, 24), "a ride created two hours ahead is not reminded a day ahead")
+
+	cancelled, err := s.CreateRide(Ride{RideID: uuid.New(), DriverID: driverID, DepartureTime: departure.Add(2 * time.Hour)})
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteRide(cancelled.RideID, driverID))
+	now = departure.Add(-time.Hour)
+	_, err = s.RunDueJobs()
+	require.NoError(t, err)
+	sent := reminders(db, 1)
+	require.Len(t, sent, 1, "a cancelled ride is not reminded")
+	require.Equal(t, late.RideID, sent[0].Data.RideID)
+
+	now = departure.Add(3 * time.Hour)
+	_, err = s.RunDueJobs()
+	require.NoError(t, err)
+	require.Equal(t, JobDone, jobByKey(t, db, "ride.complete:"+cancelled.RideID.String()).Status, "a cancelled ride is not completed")
+}
+
+func TestPeriodicJobs(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	require.NoError(t, s.SchedulePeriodicJobs())
+	require.NoError(t, s.SchedulePeriodicJobs(), "every instance schedules them on start")
+	require.Len(t, db.Jobs, len(periodicJobs))
+
+	ran, err := s.RunDueJobs()
+	require.NoError(t, err)
+	require.Equal(t, len(periodicJobs), ran)
+	dispatch := jobByKey(t, db, "notifications.dispatch")
+	require.Equal(t, JobPending, dispatch.Status)
+	require.Equal(t, now.Add(NotificationDispatchInterval), dispatch.RunAt)
+	ran, err = s.RunDueJobs()
+	require.NoError(t, err)
+	require.Zero(t, ran)
+
+	now = now.Add(NotificationDispatchInterval)
+	ran, err = s.RunDueJobs()
+	require.NoError(t, err)
+	require.Equal(t, 2, ran, "the dispatchers run again, the hourly jobs do not")
+}
+
+func TestJobRetries(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	require.NoError(t, s.jobs.ScheduleJobs(Job{Name: "ride.unknown", Key: "ride.unknown", RunAt: now, Status: JobPending}))
+	for attempt := 1; attempt < jobMaxAttempts; attempt++ {
+		ran, err := s.RunDueJobs()
+		require.NoError(t, err)
+		require.Zero(t, ran)
+		job := jobByKey(t, db, "ride.unknown")
+		require.Equal(t, JobPending, job.Status)
+		require.Equal(t, attempt, job.Attempts)
+		require.Contains(t, job.LastError, "no handler")
+		require.Equal(t, now.Add(jobBackoff<<(attempt-1)), job.RunAt)
+		now = job.RunAt
+	}
+	_, err := s.RunDueJobs()
+	require.NoError(t, err)
+	require.Equal(t, JobFailed, jobByKey(t, db, "ride.unknown").Status)
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"time"
+
 	"github.com/google/uuid"
 )
 
@@ -9,58 +13,346 @@ type Service interface {
 	GetUserByEmail(email string) (User, error)
 	GetUserById(userID uuid.UUID) (User, error)
 	CreateNewUser(user User) (User, error)
-	DeleteUser(userID uuid.UUID) error
+	EraseUser(userID uuid.UUID) (Erasure, error)
 	UpdateUser(user User) (User, error)
+	PatchUser(userID uuid.UUID, patch []byte) (User, error)
 
 	GetAllRides() ([]Ride, error)
 	GetRideById(rideID uuid.UUID) (Ride, error)
 	CreateRide(ride Ride) (Ride, error)
-	DeleteRide(rideID uuid.UUID) error
+	DeleteRide(rideID uuid.UUID, actorID uuid.UUID) error
 	UpdateRide(ride Ride) (Ride, error)
+	CompleteRide(rideID uuid.UUID, noShows []uuid.UUID) error
 
 	GetAllBookings() ([]Booking, error)
 	GetBookingById(bookingID uuid.UUID) (Booking, error)
 	CreateBooking(booking Booking) (Booking, error)
-	DeleteBooking(bookingID uuid.UUID) error
+	DeleteBooking(bookingID uuid.UUID, actorID uuid.UUID) error
 	UpdateBooking(booking Booking) (Booking, error)
+	ApproveBooking(bookingID uuid.UUID) (Booking, error)
+	GetBookingsForUser(userID uuid.UUID) ([]Booking, error)
+	AreCounterparts(userID uuid.UUID, otherID uuid.UUID) (bool, error)
+
+	VerifyEmail(token string) error
+	ResendEmailVerification(email string) error
+	RequestPhoneVerification(userID uuid.UUID, phone string) error
+	VerifyPhone(userID uuid.UUID, code string) error
+
+	Login(email string, password string) (string, error)
+	AuthenticateSession(token string) (Actor, error)
+	RequestPasswordReset(email string, ip string) error
+	ResetPassword(token string, password string, ip string) error
+
+	CreateReview(authorID uuid.UUID, review Review) (Review, error)
+	GetReviewsReceived(userID uuid.UUID) ([]Review, error)
+	CloseReviewWindows() error
+
+	CreateVehicle(ownerID uuid.UUID, vehicle Vehicle) (Vehicle, error)
+	GetVehicleById(vehicleID uuid.UUID) (Vehicle, error)
+	GetVehiclesByOwner(ownerID uuid.UUID) ([]Vehicle, error)
+	DeleteVehicle(vehicleID uuid.UUID) error
+
+	RequestDataExport(userID uuid.UUID) (DataExport, error)
+	GetDataExports(userID uuid.UUID) ([]DataExport, error)
+	DownloadDataExport(token string) ([]byte, error)
+
+	DeactivateUser(userID uuid.UUID, actorID uuid.UUID) error
+	GetDeletedRides() ([]Ride, error)
+	GetDeletedBookings() ([]Booking, error)
+	GetDeactivatedUsers() ([]User, error)
+	RestoreRide(rideID uuid.UUID) (Ride, error)
+	RestoreBooking(bookingID uuid.UUID) (Booking, error)
+	RestoreUser(userID uuid.UUID) (User, error)
+	PurgeDeleted() (PurgeSummary, error)
+
+	BlockUser(blockerID uuid.UUID, blockedID uuid.UUID) error
+	UnblockUser(blockerID uuid.UUID, blockedID uuid.UUID) error
+	GetBlockedUsers(blockerID uuid.UUID) ([]Block, error)
+	GetRidesFor(viewerID uuid.UUID) ([]Ride, error)
+
+	SendMessage(senderID uuid.UUID, conversation Conversation, body string) (Message, error)
+	GetMessages(userID uuid.UUID, conversation Conversation, before *uuid.UUID, limit int) ([]Message, error)
+	MarkConversationRead(userID uuid.UUID, conversation Conversation) error
+
+	DispatchNotifications() (int, error)
+	GetNotifications(userID uuid.UUID) ([]Notification, error)
+	MarkNotificationRead(userID uuid.UUID, notificationID uuid.UUID) error
+	GetDeadNotifications() ([]Notification, error)
+	RequeueNotification(notificationID uuid.UUID) error
+
+	CreateWebhook(webhook Webhook) (Webhook, error)
+	GetWebhooks() ([]Webhook, error)
+	DeleteWebhook(webhookID uuid.UUID) error
+	GetWebhookDeliveries(webhookID uuid.UUID) ([]WebhookDelivery, error)
+	RedeliverWebhook(deliveryID uuid.UUID) error
+	DispatchWebhooks() (int, error)
+
+	SubscribeAvailability(rideIDs []uuid.UUID, lastEventID *uint64) (*AvailabilitySubscription, []AvailabilityEvent, error)
+
+	GetPaymentsForUser(userID uuid.UUID) ([]Payment, error)
+	RefundPayment(paymentID uuid.UUID, amount Money) (Payment, error)
+	ApplyPaymentWebhook(header http.Header, body []byte) error
+	ReconcilePayments() (int, error)
+
+	GetWallet(userID uuid.UUID) (Wallet, error)
+	GetWalletTransactions(userID uuid.UUID) ([]WalletTransaction, error)
+	CheckLedger() (LedgerReport, error)
+	SuggestRidePrice(ride Ride) (PriceSuggestion, error)
+	GetInvoicesForUser(userID uuid.UUID) ([]Invoice, error)
+	GetInvoice(invoiceID uuid.UUID) (Invoice, error)
+	GetPromotions() ([]Promotion, error)
+	CreatePromotion(promotion Promotion) (Promotion, error)
+	UpdatePromotion(promotion Promotion) (Promotion, error)
+	DeletePromotion(promotionID uuid.UUID) error
+	GetPayoutAccount(userID uuid.UUID) (PayoutAccount, error)
+	SavePayoutAccount(account PayoutAccount) (PayoutAccount, error)
+	GetPayoutsForUser(userID uuid.UUID) ([]Payout, error)
+	GetPayoutBatches() ([]PayoutBatch, error)
+	GetPayoutsByBatch(batchID uuid.UUID) ([]Payout, error)
+	BatchPayouts() (PayoutBatch, error)
+	ExportPayoutBatch(batchID uuid.UUID) ([]byte, error)
+	UpdatePayoutStatus(payoutID uuid.UUID, status string, reason string) (Payout, error)
+
+	SchedulePeriodicJobs() error
+	RunDueJobs() (int, error)
 }
 
 type CovoitService struct {
-	repository Repository
+	repository    Repository
+	verifications VerificationRepository
+	mailer        Mailer
+	sms           SMSSender
+	push          PushSender
+	auth          AuthRepository
+	audits        AuditRepository
+	reviews       ReviewRepository
+	reputations   ReputationRepository
+	vehicles      VehicleRepository
+	exports       DataExportRepository
+	erasures      ErasureRepository
+	trash         TrashRepository
+	blocks        BlockRepository
+	messages      MessageRepository
+	notifications NotificationRepository
+	webhooks      WebhookRepository
+	jobs          JobRepository
+	payments      PaymentRepository
+	ledger        LedgerRepository
+	invoices      InvoiceRepository
+	promotions    PromotionRepository
+	payouts       PayoutRepository
+	// paymentProvider holds the prices of the bookings in escrow.
+	paymentProvider PaymentProvider
+	// webhookClient posts the webhook deliveries, a client with a timeout is
+	// used when nil.
+	webhookClient *http.Client
+	availability  *AvailabilityBus
+	now           func() time.Time
+	runJob        func(job func())
+	// trashRetention is how long deleted rows stay restorable.
+	trashRetention time.Duration
+	// pricing caps the price of the seats and suggests it.
+	pricing *Pricing
+	// payoutSettings tell which earnings are paid out, and from which
+	// account.
+	payoutSettings *PayoutSettings
+	// phoneCodeSecret keys the hashes of the codes sent by SMS.
+	phoneCodeSecret []byte
+}
+
+func (service *CovoitService) clock() time.Time {
+	if service.now != nil {
+		return service.now()
+	}
+	return time.Now()
 }
 
 func (service *CovoitService) GetAllUsers() ([]User, error) {
-	return service.repository.GetAllUsers()
+	users, err := service.repository.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	return service.withReputations(users)
 }
 func (service *CovoitService) GetUserByEmail(email string) (User, error) {
 	return service.repository.GetUserByEmail(email)
 }
 func (service *CovoitService) GetUserById(userID uuid.UUID) (User, error) {
-	return service.repository.GetUserById(userID)
+	user, err := service.repository.GetUserById(userID)
+	if err != nil {
+		return User{}, err
+	}
+	users, err := service.withReputations([]User{user})
+	if err != nil {
+		return User{}, err
+	}
+	return users[0], nil
 }
 func (service *CovoitService) CreateNewUser(user User) (User, error) {
-	return service.repository.CreateNewUser(user)
-}
-func (service *CovoitService) DeleteUser(userID uuid.UUID) error {
-	return service.repository.DeleteUser(userID)
+	user.EmailVerifiedAt = nil
+	user.PhoneVerifiedAt = nil
+	user.CreatedAt = time.Time{}
+	if err := validateEmail(user.Email); err != nil {
+		return User{}, err
+	}
+	if user.Phone != "" {
+		phone, err := NormalizePhone(user.Phone)
+		if err != nil {
+			return User{}, err
+		}
+		user.Phone = phone
+	}
+	if user.Password != "" {
+		passwordHash, err := hashPassword(user.Password)
+		if err != nil {
+			return User{}, err
+		}
+		user.PasswordHash = passwordHash
+		user.Password = ""
+	}
+	user, err := service.repository.CreateNewUser(user)
+	if err != nil {
+		return User{}, err
+	}
+	logMailError(service.sendEmailVerification(user))
+	return user, nil
 }
+
+// UpdateUser saves the profile of user. Role, password and verification state
+// are kept from the stored user.
 func (service *CovoitService) UpdateUser(user User) (User, error) {
-	return service.repository.UpdateUser(user)
+	current, err := service.repository.GetUserById(user.UserID)
+	if err != nil {
+		return User{}, err
+	}
+	user.Role = current.Role
+	user.PasswordHash = current.PasswordHash
+	user.Password = ""
+	user.EmailVerifiedAt = current.EmailVerifiedAt
+	emailChanged := user.Email != current.Email
+	if emailChanged {
+		if err := validateEmail(user.Email); err != nil {
+			return User{}, err
+		}
+		if other, err := service.repository.GetUserByEmail(user.Email); err == nil && other.UserID != user.UserID {
+			return User{}, ErrEmailTaken
+		}
+		// A new email has to be verified again.
+		user.EmailVerifiedAt = nil
+	}
+	if user.Phone != "" {
+		phone, err := NormalizePhone(user.Phone)
+		if err != nil {
+			return User{}, err
+		}
+		user.Phone = phone
+	}
+	// A new phone number has to be verified again.
+	if user.Phone != current.Phone {
+		user.PhoneVerifiedAt = nil
+	} else {
+		user.PhoneVerifiedAt = current.PhoneVerifiedAt
+	}
+	user, err = service.repository.UpdateUser(user)
+	if err != nil {
+		return User{}, err
+	}
+	if emailChanged {
+		logMailError(service.sendEmailVerification(user))
+	}
+	return user, nil
 }
 func (service *CovoitService) GetAllRides() ([]Ride, error) {
-	return service.repository.GetAllRides()
+	rides, err := service.repository.GetAllRides()
+	if err != nil {
+		return nil, err
+	}
+	return service.withDriverReputations(rides)
 }
 func (service *CovoitService) GetRideById(rideID uuid.UUID) (Ride, error) {
 	return service.repository.GetRideById(rideID)
 }
 func (service *CovoitService) CreateRide(ride Ride) (Ride, error) {
-	return service.repository.CreateRide(ride)
+	if err := service.requireVerifiedEmail(ride.DriverID); err != nil {
+		return Ride{}, err
+	}
+	if err := service.checkRideVehicle(ride); err != nil {
+		return Ride{}, err
+	}
+	if err := service.pricing.Check(ride); err != nil {
+		return Ride{}, err
+	}
+	ride.Status = ""
+	ride, err := service.repository.CreateRide(ride)
+	if err != nil {
+		return Ride{}, err
+	}
+	service.bumpReputation(Reputation{UserID: ride.DriverID, Commitments: 1})
+	return ride, nil
 }
-func (service *CovoitService) DeleteRide(rideID uuid.UUID) error {
-	return service.repository.DeleteRide(rideID)
+func (service *CovoitService) DeleteRide(rideID uuid.UUID, actorID uuid.UUID) error {
+	ride, err := service.repository.GetRideById(rideID)
+	if err != nil {
+		return err
+	}
+	bookings, err := service.repository.GetBookingsByRide(rideID)
+	if err != nil {
+		return err
+	}
+	if err := service.repository.DeleteRide(rideID, actorID, service.clock()); err != nil {
+		return err
+	}
+	service.processBookingPayments(bookings)
+	service.publishAvailability(rideID)
+	// A ride taken down by an admin is not its driver's cancellation.
+	if ride.Status != RideCompleted && actorID == ride.DriverID {
+		service.bumpReputation(Reputation{UserID: ride.DriverID, Cancellations: 1})
+	}
+	return nil
 }
+
+// UpdateRide edits the route, vehicle, price and seats of a scheduled ride.
+// Its schedule stays as the passengers booked it, and the bookings already
+// made keep their price.
 func (service *CovoitService) UpdateRide(ride Ride) (Ride, error) {
-	return service.repository.UpdateRide(ride)
+	current, err := service.repository.GetRideById(ride.RideID)
+	if err != nil {
+		return Ride{}, ErrRideNotFound
+	}
+	if current.Status != RideScheduled {
+		return Ride{}, fmt.Errorf("%w : the ride is %s", ErrRideNotEditable, current.Status)
+	}
+	if !ride.DepartureTime.Equal(current.DepartureTime) || !ride.ArrivalTime.Equal(current.ArrivalTime) {
+		return Ride{}, fmt.Errorf("%w : the schedule of a ride is not edited, cancel it instead", ErrRideNotEditable)
+	}
+	current.Origin, current.Destination = ride.Origin, ride.Destination
+	current.VehicleID, current.Distance = ride.VehicleID, ride.Distance
+	current.Price, current.NumberOfSeats = ride.Price, ride.NumberOfSeats
+	if err := service.checkRideVehicle(current); err != nil {
+		return Ride{}, err
+	}
+	if err := service.pricing.Check(current); err != nil {
+		return Ride{}, err
+	}
+	bookings, err := service.repository.GetBookingsByRide(current.RideID)
+	if err != nil {
+		return Ride{}, err
+	}
+	booked := 0
+	for _, booking := range bookings {
+		if booking.Status == BookingPending || booking.Status == BookingConfirmed {
+			booked += booking.NumberOfSeats
+		}
+	}
+	if current.NumberOfSeats < booked {
+		return Ride{}, fmt.Errorf("%w : %d seats are booked", ErrRideNotEditable, booked)
+	}
+	ride, err = service.repository.UpdateRide(current)
+	if err != nil {
+		return Ride{}, err
+	}
+	service.publishAvailability(ride.RideID)
+	return ride, nil
 }
 func (service *CovoitService) GetAllBookings() ([]Booking, error) {
 	return service.repository.GetAllBookings()
@@ -69,11 +361,120 @@ func (service *CovoitService) GetBookingById(bookingID uuid.UUID) (Booking, erro
 	return service.repository.GetBookingById(bookingID)
 }
 func (service *CovoitService) CreateBooking(booking Booking) (Booking, error) {
-	return service.repository.CreateBooking(booking)
+	if err := service.requireVerifiedEmail(booking.UserID); err != nil {
+		return Booking{}, err
+	}
+	if err := service.checkBookingBlock(booking); err != nil {
+		return Booking{}, err
+	}
+	if booking.NumberOfSeats < 1 {
+		return Booking{}, fmt.Errorf("%w : at least one seat must be booked", ErrInvalidBooking)
+	}
+	if booking.Status != "" {
+		return Booking{}, fmt.Errorf("%w : the status is not set by the passenger", ErrInvalidBooking)
+	}
+	// Bookings await the driver's approval.
+	booking.Status = BookingPending
+	ride, err := service.repository.GetRideById(booking.RideID)
+	if err != nil {
+		return Booking{}, ErrRideNotFound
+	}
+	if ride.DriverID == booking.UserID {
+		return Booking{}, fmt.Errorf("%w : drivers do not book their own ride", ErrInvalidBooking)
+	}
+	if err := service.checkRideBookable(ride); err != nil {
+		return Booking{}, err
+	}
+	// The seats are paid the ride's price, whatever the passenger sent.
+	booking.TotalPrice = ride.Price.Times(int64(booking.NumberOfSeats))
+	booking.PromotionID, booking.Discount = nil, Money{}
+	if booking.PromoCode != "" {
+		if err := service.applyPromotion(&booking, ride); err != nil {
+			return Booking{}, err
+		}
+	}
+	booking, err = service.repository.CreateBooking(booking)
+	if err != nil {
+		return Booking{}, err
+	}
+	if err := service.authorizeBooking(booking); err != nil {
+		return Booking{}, err
+	}
+	service.bumpReputation(Reputation{UserID: booking.UserID, Commitments: 1})
+	service.publishAvailability(booking.RideID)
+	return booking, nil
 }
-func (service *CovoitService) DeleteBooking(bookingID uuid.UUID) error {
-	return service.repository.DeleteBooking(bookingID)
+func (service *CovoitService) DeleteBooking(bookingID uuid.UUID, actorID uuid.UUID) error {
+	booking, err := service.repository.GetBookingById(bookingID)
+	if err != nil {
+		return err
+	}
+	if err := service.repository.DeleteBooking(bookingID, actorID, service.clock()); err != nil {
+		return err
+	}
+	service.processBookingPayments([]Booking{booking})
+	service.publishAvailability(booking.RideID)
+	// Only the passenger cancels their booking : the driver or an admin
+	// removing it is not the passenger's cancellation. Deleting a booking of
+	// a completed ride is not a cancellation either, nor is the blocker
+	// dropping a booking with the user it blocked.
+	if actorID != booking.UserID {
+		return nil
+	}
+	if booking.FreeCancellationFor != nil && *booking.FreeCancellationFor == actorID {
+		return nil
+	}
+	if ride, err := service.repository.GetRideById(booking.RideID); err != nil || ride.Status != RideCompleted {
+		service.bumpReputation(Reputation{UserID: booking.UserID, Cancellations: 1})
+	}
+	return nil
 }
 func (service *CovoitService) UpdateBooking(booking Booking) (Booking, error) {
 	return service.repository.UpdateBooking(booking)
 }
+
+// checkRideBookable refuses bookings on a ride that is not scheduled or has
+// left already. The seats left are counted as the booking is written.
+func (service *CovoitService) checkRideBookable(ride Ride) error {
+	if ride.Status != RideScheduled {
+		return fmt.Errorf("%w : the ride is %s", ErrInvalidBooking, ride.Status)
+	}
+	if !ride.DepartureTime.After(service.clock()) {
+		return fmt.Errorf("%w : the ride has left", ErrInvalidBooking)
+	}
+	return nil
+}
+
+// ApproveBooking confirms a pending booking, its passenger is told so.
+func (service *CovoitService) ApproveBooking(bookingID uuid.UUID) (Booking, error) {
+	booking, err := service.repository.GetBookingById(bookingID)
+	if err != nil {
+		return Booking{}, ErrBookingNotPending
+	}
+	ride, err := service.repository.GetRideById(booking.RideID)
+	if err != nil {
+		return Booking{}, ErrRideNotFound
+	}
+	if err := service.checkRideBookable(ride); err != nil {
+		return Booking{}, err
+	}
+	booking, err = service.repository.ApproveBooking(bookingID)
+	if err != nil {
+		return Booking{}, err
+	}
+	service.publishAvailability(booking.RideID)
+	return booking, nil
+}
+func (service *CovoitService) GetBookingsForUser(userID uuid.UUID) ([]Booking, error) {
+	bookings, err := service.repository.GetBookingsForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i, booking := range bookings {
+		bookings[i].FreeCancellation = booking.FreeCancellationFor != nil && *booking.FreeCancellationFor == userID
+	}
+	return service.withBookingVehicles(bookings)
+}
+func (service *CovoitService) AreCounterparts(userID uuid.UUID, otherID uuid.UUID) (bool, error) {
+	return service.repository.AreCounterparts(userID, otherID)
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 func TestGetAllUsers(t *testing.T) {
 	db := CreateNewMockDB(t)
-	s := CovoitService{&MockRepository{db}}
+	s := NewMockService(db)
 	users, err := s.GetAllUsers()
 	if err != nil {
 		t.Errorf("could not retrieve all users, err : %s", err)
@@ -22,7 +26,7 @@ func TestGetAllUsers(t *testing.T) {
 }
 func TestUserService(t *testing.T) {
 	db := CreateNewMockDB(t)
-	s := CovoitService{&MockRepository{db}}
+	s := NewMockService(db)
 	t.Run("test get all users", func(t *testing.T) {
 		users, err := s.GetAllUsers()
 		if err != nil {
@@ -51,10 +55,11 @@ func TestUserService(t *testing.T) {
 	})
 	t.Run("test get user by id", func(t *testing.T) {
 		want := User{
-			UserID:    StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7"),
-			FirstName: "Mehdi",
-			LastName:  "BENFREDJ",
-			Email:     "mehdibenfredj3@gmail.com",
+			UserID:     StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7"),
+			FirstName:  "Mehdi",
+			LastName:   "BENFREDJ",
+			Email:      "mehdibenfredj3@gmail.com",
+			Reputation: &ReputationSummary{},
 		}
 		got, err := s.GetUserById(StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7"))
 		if err != nil {
@@ -65,7 +70,7 @@ func TestUserService(t *testing.T) {
 			t.Errorf("got : %v, want : %v", got, want)
 		}
 	})
-	t.Run("test create & delete user", func(t *testing.T) {
+	t.Run("test create & erase user", func(t *testing.T) {
 		u := User{
 			FirstName: "Faten",
 			LastName:  "Sayeh",
@@ -80,19 +85,35 @@ func TestUserService(t *testing.T) {
 			t.Errorf("created : %v, want : %v", user, u)
 		}
 
-		err = s.DeleteUser(StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7"))
-		if err != nil || len(db.Users) != 2 {
-			fmt.Printf("%d", len(db.Users))
-			t.Errorf("could not delete user %s, err : %s", "652c99d0-39a5-4797-97a6-09eba33f2bd7", err)
+		_, err = s.EraseUser(StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7"))
+		if err != nil || len(db.Users) != 3 {
+			t.Errorf("could not erase user %s, err : %s", "652c99d0-39a5-4797-97a6-09eba33f2bd7", err)
+		}
+		if _, err := s.GetUserByEmail("mehdibenfredj3@gmail.com"); err == nil {
+			t.Errorf("user %s still has its email after erasure", "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+		}
+	})
+	t.Run("test update user", func(t *testing.T) {
+		u := User{
+			UserID:    StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2"),
+			FirstName: "Faten",
+			LastName:  "Benfredj",
+			Email:     "sayehfaten1195@gmail.com",
+		}
+		user, err := s.UpdateUser(u)
+		if err != nil {
+			t.Errorf("could not update user %s, err : %s", u.UserID, err)
+		}
 
+		if user.LastName != "Benfredj" || user.EmailVerifiedAt == nil {
+			t.Errorf("updated : %v, want : %v", user, u)
 		}
 	})
-	t.Run("test update user", func(t *testing.T) {})
 }
 
 func TestRideService(t *testing.T) {
 	db := CreateNewMockDB(t)
-	s := CovoitService{&MockRepository{db}}
+	s := NewMockService(db)
 
 	t.Run("test get all rides", func(t *testing.T) {
 		rides, err := s.GetAllRides()
@@ -123,6 +144,7 @@ func TestRideService(t *testing.T) {
 		r := Ride{
 			Origin:      "Constantine",
 			Destination: "Alger",
+			DriverID:    StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2"),
 		}
 		ride, err := s.CreateRide(r)
 		if err != nil || len(db.Rides) != 3 {
@@ -133,19 +155,52 @@ func TestRideService(t *testing.T) {
 			t.Errorf("created : %v, want : %v", ride, r)
 		}
 
-		err = s.DeleteRide(StringToUuid(t, "ef5e1eda-e5e0-4f90-81ac-110b0bf84281"))
-		if err != nil || len(db.Rides) != 2 {
+		err = s.DeleteRide(StringToUuid(t, "ef5e1eda-e5e0-4f90-81ac-110b0bf84281"), uuid.New())
+		if err != nil || len(db.Rides) != 2 || len(db.DeletedRides) != 1 {
 			fmt.Printf("%d", len(db.Rides))
 			t.Errorf("could not delete ride %s, err : %s", "ef5e1eda-e5e0-4f90-81ac-110b0bf84281", err)
 
 		}
 	})
-	t.Run("test update ride", func(t *testing.T) {})
+	t.Run("test update ride", func(t *testing.T) {
+		driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+		departure := time.Date(2025, 9, 1, 16, 0, 0, 0, time.UTC)
+		ride := Ride{RideID: uuid.New(), DriverID: driverID, Origin: "Lyon", Destination: "Paris", DepartureTime: departure, NumberOfSeats: 3, Status: RideScheduled}
+		db.Rides = append(db.Rides, ride)
+		db.Bookings = append(db.Bookings, Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: uuid.New(), NumberOfSeats: 2, Status: BookingConfirmed})
+
+		edit := ride
+		edit.Destination, edit.NumberOfSeats = "Dijon", 2
+		edit.DriverID, edit.Status = uuid.New(), RideCancelled
+		got, err := s.UpdateRide(edit)
+		want := ride
+		want.Destination, want.NumberOfSeats = "Dijon", 2
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("updated : %v, want : %v, err : %s", got, want, err)
+		}
+
+		for _, tc := range []struct {
+			name string
+			edit func(ride *Ride)
+			err  error
+		}{
+			{"fewer seats than booked", func(ride *Ride) { ride.NumberOfSeats = 1 }, ErrRideNotEditable},
+			{"new departure", func(ride *Ride) { ride.DepartureTime = departure.Add(time.Hour) }, ErrRideNotEditable},
+			{"vehicle of someone else", func(ride *Ride) { ride.VehicleID = &uuid.UUID{} }, ErrInvalidVehicle},
+			{"unknown ride", func(ride *Ride) { ride.RideID = uuid.New() }, ErrRideNotFound},
+		} {
+			edit := want
+			tc.edit(&edit)
+			if _, err := s.UpdateRide(edit); !errors.Is(err, tc.err) {
+				t.Errorf("%s : got %v, want %v", tc.name, err, tc.err)
+			}
+		}
+	})
 }
 
 func TestBookingService(t *testing.T) {
 	db := CreateNewMockDB(t)
-	s := CovoitService{&MockRepository{db}}
+	s := NewMockService(db)
 
 	t.Run("test get all bookings", func(t *testing.T) {
 		bookings, err := s.GetAllBookings()
@@ -173,40 +228,150 @@ func TestBookingService(t *testing.T) {
 		}
 	})
 	t.Run("test create & delete  booking", func(t *testing.T) {
+		db.Rides[0].Status, db.Rides[0].NumberOfSeats, db.Rides[0].DepartureTime = RideScheduled, 3, time.Now().Add(24*time.Hour)
 		b := Booking{
-			RideID: StringToUuid(t, "46f45ea1-3f50-45cb-8556-797fe2688566"),
-			UserID: StringToUuid(t, "3c05d41e-344c-4661-a5fd-63e7a0a46998"),
+			RideID:        StringToUuid(t, "630cbfed-d023-41a4-884c-b1b1de76fb9f"),
+			UserID:        StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2"),
+			NumberOfSeats: 1,
 		}
 		booking, err := s.CreateBooking(b)
 		if err != nil || len(db.Bookings) != 2 {
 			t.Errorf("could not create booking %v, err : %s", b, err)
 		}
 
+		b.Status = BookingPending
 		if !reflect.DeepEqual(booking, b) {
 			t.Errorf("created : %v, want : %v", booking, b)
 		}
+		for _, status := range []string{BookingConfirmed, BookingNoShow, BookingCancelled} {
+			b.Status = status
+			if _, err := s.CreateBooking(b); !errors.Is(err, ErrInvalidBooking) {
+				t.Errorf("created booking with status %s, err : %s", status, err)
+			}
+		}
 
-		err = s.DeleteBooking(StringToUuid(t, "ac925d60-1455-4d17-baeb-c4ffd4ed8205"))
-		if err != nil || len(db.Bookings) != 1 {
+		err = s.DeleteBooking(StringToUuid(t, "ac925d60-1455-4d17-baeb-c4ffd4ed8205"), uuid.New())
+		if err != nil || len(db.Bookings) != 1 || len(db.DeletedBookings) != 1 {
 			fmt.Printf("%d", len(db.Bookings))
 			t.Errorf("could not delete booking %s, err : %s", "ac925d60-1455-4d17-baeb-c4ffd4ed8205", err)
 
 		}
 	})
+	t.Run("test booking limits", func(t *testing.T) {
+		passengerID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+		departure := time.Now().Add(24 * time.Hour)
+		own := Ride{RideID: uuid.New(), DriverID: passengerID, DepartureTime: departure, NumberOfSeats: 3, Status: RideScheduled}
+		small := Ride{RideID: uuid.New(), DriverID: uuid.New(), DepartureTime: departure, NumberOfSeats: 2, Status: RideScheduled}
+		gone := Ride{RideID: uuid.New(), DriverID: uuid.New(), DepartureTime: time.Now().Add(-time.Hour), NumberOfSeats: 3, Status: RideScheduled}
+		cancelled := Ride{RideID: uuid.New(), DriverID: uuid.New(), DepartureTime: departure, NumberOfSeats: 3, Status: RideCancelled}
+		db.Rides = append(db.Rides, own, small, gone, cancelled)
+		for _, ride := range []Ride{own, gone, cancelled} {
+			if _, err := s.CreateBooking(Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 1}); !errors.Is(err, ErrInvalidBooking) {
+				t.Errorf("booked ride %v, err : %s", ride, err)
+			}
+		}
+
+		booking, err := s.CreateBooking(Booking{BookingID: uuid.New(), RideID: small.RideID, UserID: passengerID, NumberOfSeats: 2})
+		if err != nil {
+			t.Errorf("could not book the seats left, err : %s", err)
+		}
+		if _, err := s.CreateBooking(Booking{BookingID: uuid.New(), RideID: small.RideID, UserID: passengerID, NumberOfSeats: 1}); !errors.Is(err, ErrInvalidBooking) {
+			t.Errorf("booked a full ride, err : %s", err)
+		}
+		db.Rides[len(db.Rides)-3].NumberOfSeats = 1
+		if _, err := s.ApproveBooking(booking.BookingID); !errors.Is(err, ErrInvalidBooking) {
+			t.Errorf("approved more seats than the ride has, err : %s", err)
+		}
+	})
 	t.Run("test update booking", func(t *testing.T) {})
 }
 
 type MockDB struct {
-	Users    []User
-	Bookings []Booking
-	Rides    []Ride
+	Users              []User
+	Bookings           []Booking
+	Rides              []Ride
+	EmailVerifications []EmailVerification
+	PhoneVerifications []PhoneVerification
+	Sessions           []Session
+	PasswordResets     []PasswordReset
+	AuditEvents        []AuditEvent
+	Reviews            []Review
+	Reputations        map[uuid.UUID]Reputation
+	Vehicles           []Vehicle
+	DataExports        []DataExport
+	Erasures           []Erasure
+	Blocks             []Block
+	Messages           []Message
+	Notifications      []Notification
+	Webhooks           []Webhook
+	WebhookDeliveries  []WebhookDelivery
+	Jobs               []Job
+	Payments           []Payment
+	Journals           []Journal
+	Invoices           []Invoice
+	InvoiceSequences   map[string]int64
+	Promotions         []Promotion
+	PayoutAccounts     []PayoutAccount
+	PayoutBatches      []PayoutBatch
+	Payouts            []Payout
+	// Soft deleted rows are kept apart so that the other mocks ignore them.
+	DeletedUsers    []User
+	DeletedRides    []Ride
+	DeletedBookings []Booking
 }
 
 type MockRepository struct {
 	DB *MockDB
 }
 
+func NewMockService(db *MockDB) *CovoitService {
+	repository := &MockRepository{db}
+	return &CovoitService{
+		runJob:        func(job func()) { job() },
+		repository:    repository,
+		verifications: repository,
+		mailer:        &MemoryMailer{},
+		sms:           &LogSMSSender{},
+		push:          &LogPushSender{},
+		auth:          repository,
+		audits:        repository,
+		reviews:       repository,
+		reputations:   repository,
+		vehicles:      repository,
+		exports:       repository,
+		erasures:      repository,
+		trash:         repository,
+		blocks:        repository,
+		messages:      repository,
+		notifications: repository,
+		webhooks:      repository,
+		jobs:          repository,
+		payments:      repository,
+		ledger:        repository,
+		invoices:      repository,
+		promotions:    repository,
+		payouts:       repository,
+		availability:  NewAvailabilityBus(),
+
+		paymentProvider: NewFakePaymentProvider("secret"),
+
+		pricing: &Pricing{
+			Currency:   "EUR",
+			FuelPrices: map[string]int64{VehicleFuelPetrol: 1800, VehicleFuelDiesel: 1700, VehicleFuelLPG: 1000, VehicleFuelElectric: 250},
+			Tolls:      []Toll{{Origin: "Lyon", Destination: "Paris", Amount: NewMoney(3650, "EUR")}},
+			MaxPerKm:   DefaultMaxPricePerKm,
+		},
+		payoutSettings: &PayoutSettings{
+			HoldingPeriod: DefaultPayoutHoldingPeriod,
+			Minimum:       NewMoney(defaultPayoutMinimum, "EUR"),
+			Debtor:        PayoutAccount{HolderName: "Covoit SAS", IBAN: "FR7630006000011234567890189", BIC: "AGRIFRPPXXX"},
+		},
+		phoneCodeSecret: []byte("secret"),
+	}
+}
+
 func CreateNewMockDB(t *testing.T) *MockDB {
+	verifiedAt := time.Date(2025, 8, 18, 0, 0, 0, 0, time.UTC)
 	return &MockDB{
 		Users: []User{
 			User{
@@ -216,10 +381,11 @@ func CreateNewMockDB(t *testing.T) *MockDB {
 				Email:     "mehdibenfredj3@gmail.com",
 			},
 			User{
-				UserID:    StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2"),
-				FirstName: "Faten",
-				LastName:  "Sayeh",
-				Email:     "sayehfaten1195@gmail.com",
+				UserID:          StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2"),
+				FirstName:       "Faten",
+				LastName:        "Sayeh",
+				Email:           "sayehfaten1195@gmail.com",
+				EmailVerifiedAt: &verifiedAt,
 			},
 		},
 		Rides: []Ride{
@@ -241,7 +407,7 @@ func CreateNewMockDB(t *testing.T) *MockDB {
 }
 
 func (m *MockRepository) GetAllUsers() ([]User, error) {
-	return m.DB.Users, nil
+	return slices.Clone(m.DB.Users), nil
 }
 func (m *MockRepository) GetUserByEmail(email string) (User, error) {
 	for _, user := range m.DB.Users {
@@ -266,22 +432,17 @@ func (m *MockRepository) CreateNewUser(user User) (User, error) {
 	return user, nil
 }
 
-func (m *MockRepository) DeleteUser(userID uuid.UUID) error {
-	for i, user := range m.DB.Users {
-		if user.UserID == userID {
-			m.DB.Users = append(m.DB.Users[:i], m.DB.Users[i+1:]...)
-			return nil
+func (m *MockRepository) UpdateUser(user User) (User, error) {
+	for i := range m.DB.Users {
+		if m.DB.Users[i].UserID == user.UserID {
+			m.DB.Users[i] = user
 		}
 	}
-	return fmt.Errorf("could not delete user : %s", userID)
-}
-
-func (m *MockRepository) UpdateUser(user User) (User, error) {
 	return user, nil
 }
 
 func (m *MockRepository) GetAllRides() ([]Ride, error) {
-	return m.DB.Rides, nil
+	return slices.Clone(m.DB.Rides), nil
 }
 
 func (m *MockRepository) GetRideById(rideID uuid.UUID) (Ride, error) {
@@ -295,13 +456,35 @@ func (m *MockRepository) GetRideById(rideID uuid.UUID) (Ride, error) {
 
 func (m *MockRepository) CreateRide(ride Ride) (Ride, error) {
 	m.DB.Rides = append(m.DB.Rides, ride)
+	m.schedule(rideJobs(ride)...)
+	m.publish(WebhookRideCreated, ride)
 	return ride, nil
 }
 
-func (m *MockRepository) DeleteRide(rideID uuid.UUID) error {
+func (m *MockRepository) DeleteRide(rideID uuid.UUID, actorID uuid.UUID, at time.Time) error {
 	for i, ride := range m.DB.Rides {
 		if ride.RideID == rideID {
 			m.DB.Rides = append(m.DB.Rides[:i], m.DB.Rides[i+1:]...)
+			ride.DeletedAt, ride.DeletedBy = gorm.DeletedAt{Time: at, Valid: true}, &actorID
+			m.DB.DeletedRides = append(m.DB.DeletedRides, ride)
+			m.DB.Bookings = slices.DeleteFunc(m.DB.Bookings, func(booking Booking) bool {
+				if booking.RideID != rideID {
+					return false
+				}
+				if ride.Status == RideScheduled && (booking.Status == BookingPending || booking.Status == BookingConfirmed) {
+					m.enqueue(rideNotification(NotificationRideCancelled, booking.UserID, ride, &booking))
+				}
+				if booking.Status == BookingPending || booking.Status == BookingConfirmed {
+					m.settle(PaymentRelease, 0, booking.BookingID)
+					m.releasePromotions(booking)
+				}
+				booking.DeletedAt, booking.DeletedBy = ride.DeletedAt, &actorID
+				m.DB.DeletedBookings = append(m.DB.DeletedBookings, booking)
+				return true
+			})
+			if ride.Status == RideScheduled {
+				m.publish(WebhookRideCancelled, ride)
+			}
 			return nil
 		}
 	}
@@ -309,7 +492,53 @@ func (m *MockRepository) DeleteRide(rideID uuid.UUID) error {
 }
 
 func (m *MockRepository) UpdateRide(ride Ride) (Ride, error) {
-	return ride, nil
+	for i := range m.DB.Rides {
+		if m.DB.Rides[i].RideID == ride.RideID && m.DB.Rides[i].Status == RideScheduled {
+			m.DB.Rides[i] = ride
+			return ride, nil
+		}
+	}
+	return Ride{}, ErrRideNotEditable
+}
+
+func (m *MockRepository) CompleteRide(rideID uuid.UUID, noShows []uuid.UUID) error {
+	var ride *Ride
+	for i := range m.DB.Rides {
+		if m.DB.Rides[i].RideID == rideID {
+			ride = &m.DB.Rides[i]
+		}
+	}
+	if ride == nil || ride.Status == RideCompleted {
+		return ErrRideNotCompletable
+	}
+	ride.Status = RideCompleted
+	m.IncrementReputation(Reputation{UserID: ride.DriverID, RidesDriven: 1})
+	for i, booking := range m.DB.Bookings {
+		if booking.RideID == rideID && booking.Status == BookingPending {
+			m.settle(PaymentRelease, 0, booking.BookingID)
+		}
+		if booking.RideID != rideID || booking.Status != BookingConfirmed {
+			continue
+		}
+		m.settle(PaymentCapture, 100, booking.BookingID)
+		if slices.Contains(noShows, booking.BookingID) {
+			m.DB.Bookings[i].Status = BookingNoShow
+			m.IncrementReputation(Reputation{UserID: booking.UserID, NoShows: 1})
+		} else {
+			m.IncrementReputation(Reputation{UserID: booking.UserID, RidesTaken: 1})
+		}
+	}
+	return nil
+}
+
+func (m *MockRepository) GetRidesByDriver(driverID uuid.UUID) ([]Ride, error) {
+	rides := []Ride{}
+	for _, ride := range m.DB.Rides {
+		if ride.DriverID == driverID {
+			rides = append(rides, ride)
+		}
+	}
+	return rides, nil
 }
 
 func (m *MockRepository) GetAllBookings() ([]Booking, error) {
@@ -325,15 +554,62 @@ func (m *MockRepository) GetBookingById(bookingID uuid.UUID) (Booking, error) {
 	return Booking{}, fmt.Errorf("booking not found, booking id : %s ", bookingID)
 }
 
+func (m *MockRepository) lockSeats(booking Booking) error {
+	ride, err := m.GetRideById(booking.RideID)
+	if err != nil {
+		return ErrRideNotFound
+	}
+	if ride.Status != RideScheduled {
+		return ErrInvalidBooking
+	}
+	held := 0
+	for _, other := range m.DB.Bookings {
+		if other.RideID == booking.RideID && other.BookingID != booking.BookingID && (other.Status == BookingPending || other.Status == BookingConfirmed) {
+			held += other.NumberOfSeats
+		}
+	}
+	if held+booking.NumberOfSeats > ride.NumberOfSeats {
+		return ErrInvalidBooking
+	}
+	return nil
+}
+
 func (m *MockRepository) CreateBooking(booking Booking) (Booking, error) {
+	if err := m.lockSeats(booking); err != nil {
+		return Booking{}, err
+	}
+	if err := m.redeem(booking); err != nil {
+		return Booking{}, err
+	}
 	m.DB.Bookings = append(m.DB.Bookings, booking)
+	if ride, err := m.GetRideById(booking.RideID); err == nil {
+		m.enqueue(rideNotification(NotificationBookingCreated, ride.DriverID, ride, &booking))
+		m.createPayment(booking, ride.DriverID)
+		m.publish(WebhookBookingCreated, booking)
+	}
 	return booking, nil
 }
 
-func (m *MockRepository) DeleteBooking(bookingID uuid.UUID) error {
+func (m *MockRepository) DeleteBooking(bookingID uuid.UUID, actorID uuid.UUID, at time.Time) error {
 	for i, booking := range m.DB.Bookings {
 		if booking.BookingID == bookingID {
+			ride, err := m.GetRideById(booking.RideID)
+			if err == nil {
+				settlement, percent := cancellationSettlement(booking, ride, actorID, at)
+				m.settle(settlement, percent, bookingID)
+			}
+			m.releasePromotions(booking)
+			if err == nil && ride.Status == RideScheduled && booking.Status != BookingCancelled {
+				for _, userID := range []uuid.UUID{ride.DriverID, booking.UserID} {
+					if userID != actorID {
+						m.enqueue(rideNotification(NotificationBookingCancelled, userID, ride, &booking))
+					}
+				}
+				m.publish(WebhookBookingCancelled, booking)
+			}
 			m.DB.Bookings = append(m.DB.Bookings[:i], m.DB.Bookings[i+1:]...)
+			booking.DeletedAt, booking.DeletedBy = gorm.DeletedAt{Time: at, Valid: true}, &actorID
+			m.DB.DeletedBookings = append(m.DB.DeletedBookings, booking)
 			return nil
 		}
 	}
@@ -343,3 +619,73 @@ func (m *MockRepository) DeleteBooking(bookingID uuid.UUID) error {
 func (m *MockRepository) UpdateBooking(booking Booking) (Booking, error) {
 	return booking, nil
 }
+
+func (m *MockRepository) ApproveBooking(bookingID uuid.UUID) (Booking, error) {
+	i := slices.IndexFunc(m.DB.Bookings, func(booking Booking) bool { return booking.BookingID == bookingID })
+	if i < 0 || m.DB.Bookings[i].Status != BookingPending {
+		return Booking{}, ErrBookingNotPending
+	}
+	if err := m.lockSeats(m.DB.Bookings[i]); err != nil {
+		return Booking{}, err
+	}
+	m.DB.Bookings[i].Status = BookingConfirmed
+	if ride, err := m.GetRideById(m.DB.Bookings[i].RideID); err == nil {
+		m.enqueue(rideNotification(NotificationBookingApproved, m.DB.Bookings[i].UserID, ride, &m.DB.Bookings[i]))
+		m.publish(WebhookBookingApproved, m.DB.Bookings[i])
+	}
+	return m.DB.Bookings[i], nil
+}
+
+func (m *MockRepository) GetBookingsForUser(userID uuid.UUID) ([]Booking, error) {
+	bookings := []Booking{}
+	for _, booking := range m.DB.Bookings {
+		if booking.UserID == userID {
+			bookings = append(bookings, booking)
+			continue
+		}
+		for _, ride := range m.DB.Rides {
+			if ride.RideID == booking.RideID && ride.DriverID == userID {
+				bookings = append(bookings, booking)
+			}
+		}
+	}
+	return bookings, nil
+}
+
+func (m *MockRepository) GetBookingsByUser(userID uuid.UUID) ([]Booking, error) {
+	bookings := []Booking{}
+	for _, booking := range m.DB.Bookings {
+		if booking.UserID == userID {
+			bookings = append(bookings, booking)
+		}
+	}
+	return bookings, nil
+}
+
+func (m *MockRepository) GetBookingsByRide(rideID uuid.UUID) ([]Booking, error) {
+	bookings := []Booking{}
+	for _, booking := range m.DB.Bookings {
+		if booking.RideID == rideID {
+			bookings = append(bookings, booking)
+		}
+	}
+	return bookings, nil
+}
+
+func (m *MockRepository) AreCounterparts(userID uuid.UUID, otherID uuid.UUID) (bool, error) {
+	for _, booking := range m.DB.Bookings {
+		if booking.Status != BookingConfirmed {
+			continue
+		}
+		for _, ride := range m.DB.Rides {
+			if ride.RideID != booking.RideID {
+				continue
+			}
+			if (booking.UserID == userID && ride.DriverID == otherID) ||
+				(booking.UserID == otherID && ride.DriverID == userID) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import "log"
+
+type SMSSender interface {
+	Send(to string, body string) error
+}
+
+// LogSMSSender prints text messages instead of sending them, for local
+// development.
+type LogSMSSender struct{}
+
+func (s *LogSMSSender) Send(to string, body string) error {
+	log.Printf("sms to %s : %s", to, body)
+	return nil
+}
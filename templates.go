@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The templates of a notification type live in templates/<locale>/ :
+// <type>.txt defines its "subject" and its "text" body, <type>.html defines
+// the "content" of templates/layout.html.
+//
+//go:embed templates
+var templateFiles embed.FS
+
+const defaultLocale = "en"
+
+var Locales = []string{"en", "fr"}
+
+var ErrTemplateNotFound = errors.New("template not found")
+
+// TemplateData is what the templates render from.
+type TemplateData struct {
+	Recipient User
+	Ride      Ride
+	// Booking is nil for the notifications about a whole ride.
+	Booking *Booking
+	// HoursBefore is how long before the departure a reminder is sent.
+	HoursBefore int
+	AppURL      string
+}
+
+// currencySymbols are the symbols the templates write prices with, other
+// currencies are written with their code.
+var currencySymbols = map[string]string{"EUR": "€", "GBP": "£", "USD": "$"}
+
+var templateFuncs = map[string]any{
+	"date": func(t time.Time) string {
+		return t.Format("02/01/2006 15:04")
+	},
+	"day": func(t time.Time) string {
+		return t.Format("02/01/2006")
+	},
+	"vatPercent": func() int {
+		return VATPercent
+	},
+	"price": func(price Money) string {
+		if symbol, ok := currencySymbols[price.Currency]; ok {
+			return price.Decimal() + " " + symbol
+		}
+		return price.String()
+	},
+}
+
+type mailTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// MailTemplates holds the parsed templates by locale and notification type.
+type MailTemplates struct {
+	templates map[string]map[string]mailTemplates
+}
+
+// ParseMailTemplates parses the templates of every locale and notification
+// type, any of them missing is an error.
+func ParseMailTemplates() (*MailTemplates, error) {
+	layout, err := templateFiles.ReadFile("templates/layout.html")
+	if err != nil {
+		return nil, fmt.Errorf("could not read layout, err : %s", err)
+	}
+	parsed := &MailTemplates{templates: map[string]map[string]mailTemplates{}}
+	for _, locale := range Locales {
+		parsed.templates[locale] = map[string]mailTemplates{}
+		for _, notificationType := range NotificationTypes {
+			name := fmt.Sprintf("templates/%s/%s", locale, notificationType)
+			text, err := texttemplate.New(notificationType).Funcs(templateFuncs).ParseFS(templateFiles, name+".txt")
+			if err != nil {
+				return nil, fmt.Errorf("could not parse %s.txt, err : %s", name, err)
+			}
+			html, err := htmltemplate.New("layout").Funcs(templateFuncs).Parse(string(layout))
+			if err != nil {
+				return nil, fmt.Errorf("could not parse layout, err : %s", err)
+			}
+			if html, err = html.ParseFS(templateFiles, name+".html"); err != nil {
+				return nil, fmt.Errorf("could not parse %s.html, err : %s", name, err)
+			}
+			for _, define := range []string{"subject", "text"} {
+				if text.Lookup(define) == nil {
+					return nil, fmt.Errorf("%s.txt does not define %s", name, define)
+				}
+			}
+			parsed.templates[locale][notificationType] = mailTemplates{text: text, html: html}
+		}
+	}
+	return parsed, nil
+}
+
+var mailTemplateSet = mustParseMailTemplates()
+
+func mustParseMailTemplates() *MailTemplates {
+	parsed, err := ParseMailTemplates()
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// Render renders the mail of notificationType in locale, in the default
+// locale when there is no such locale.
+func (t *MailTemplates) Render(locale string, notificationType string, data TemplateData) (Mail, error) {
+	templates, ok := t.templates[locale]
+	if !ok {
+		templates = t.templates[defaultLocale]
+	}
+	tmpl, ok := templates[notificationType]
+	if !ok {
+		return Mail{}, fmt.Errorf("%w : %s", ErrTemplateNotFound, notificationType)
+	}
+	subject, text, html := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	if err := tmpl.text.ExecuteTemplate(subject, "subject", data); err != nil {
+		return Mail{}, fmt.Errorf("could not render subject of %s, err : %s", notificationType, err)
+	}
+	if err := tmpl.text.ExecuteTemplate(text, "text", data); err != nil {
+		return Mail{}, fmt.Errorf("could not render text of %s, err : %s", notificationType, err)
+	}
+	if err := tmpl.html.ExecuteTemplate(html, "layout", data); err != nil {
+		return Mail{}, fmt.Errorf("could not render html of %s, err : %s", notificationType, err)
+	}
+	return Mail{
+		To:      data.Recipient.Email,
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    strings.TrimSpace(text.String()),
+		HTML:    html.String(),
+	}, nil
+}
+
+// notificationTemplateData gathers what the templates of notification need.
+// The ride and the booking are read again for their latest state, the copy
+// kept in the notification stands in for them once they are deleted.
+func (service *CovoitService) notificationTemplateData(recipient User, notification Notification) TemplateData {
+	data := notification.Data
+	ride := Ride{RideID: data.RideID, Origin: data.Origin, Destination: data.Destination, DepartureTime: data.DepartureTime}
+	if current, err := service.repository.GetRideById(data.RideID); err == nil {
+		ride = current
+	}
+	var booking *Booking
+	if data.BookingID != nil {
+		booking = &Booking{BookingID: *data.BookingID, RideID: data.RideID}
+		if current, err := service.repository.GetBookingById(*data.BookingID); err == nil {
+			booking = &current
+		}
+	}
+	return TemplateData{Recipient: recipient, Ride: ride, Booking: booking, HoursBefore: data.HoursBefore, AppURL: appURL}
+}
+
+// renderNotification renders the mail telling recipient about notification,
+// in its language.
+func (service *CovoitService) renderNotification(recipient User, notification Notification) (Mail, error) {
+	return mailTemplateSet.Render(recipient.Preferences.Language, notification.Type, service.notificationTemplateData(recipient, notification))
+}
+
+// previewTemplateData is the sample the admins preview the templates with.
+func previewTemplateData() TemplateData {
+	departure := time.Date(2025, 9, 12, 8, 30, 0, 0, time.UTC)
+	rideID := uuid.MustParse("7d6f4a1e-3c1b-4c39-9d55-1f3e7f1b2a10")
+	return TemplateData{
+		Recipient:   User{UserID: uuid.MustParse("0b5e3c2a-8f4d-4e6b-a1c7-2d9f8e7a6b54"), FirstName: "Camille", LastName: "Martin", Email: "camille.martin@example.com"},
+		Ride:        Ride{RideID: rideID, Origin: "Lyon", Destination: "Paris", DepartureTime: departure, ArrivalTime: departure.Add(4*time.Hour + 30*time.Minute), Price: NewMoney(2500, PaymentCurrency), NumberOfSeats: 3, Status: RideScheduled},
+		Booking:     &Booking{BookingID: uuid.MustParse("c2a7e9b4-5d3f-4a8e-b6c1-9e0f2d4a7b38"), RideID: rideID, NumberOfSeats: 2, TotalPrice: NewMoney(5000, PaymentCurrency), Status: BookingConfirmed},
+		HoursBefore: 24,
+		AppURL:      appURL,
+	}
+}
+
+// TemplatePreviewHandler renders a template with sample data, as HTML or as
+// plain text when format is text.
+func (h *Handler) TemplatePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManageNotifications, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	locale := query.Get("locale")
+	if locale == "" {
+		locale = defaultLocale
+	}
+	if !slices.Contains(Locales, locale) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	mail, err := mailTemplateSet.Render(locale, query.Get("type"), previewTemplateData())
+	if errors.Is(err, ErrTemplateNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if query.Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Subject: %s\n\n%s\n", mail.Subject, mail.Body)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, mail.HTML)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the templates")
+
+// TestMailTemplatesGolden renders every template with the preview data and
+// compares it to testdata/templates, run it with -update to accept a wording
+// change.
+func TestMailTemplatesGolden(t *testing.T) {
+	for _, locale := range Locales {
+		for _, notificationType := range NotificationTypes {
+			t.Run(locale+"/"+notificationType, func(t *testing.T) {
+				mail, err := mailTemplateSet.Render(locale, notificationType, previewTemplateData())
+				require.NoError(t, err)
+				for _, golden := range []struct {
+					name    string
+					content string
+				}{
+					{notificationType + ".txt.golden", fmt.Sprintf("Subject: %s\n\n%s\n", mail.Subject, mail.Body)},
+					{notificationType + ".html.golden", mail.HTML},
+				} {
+					path := filepath.Join("testdata", "templates", locale, golden.name)
+					if *updateGolden {
+						require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+						require.NoError(t, os.WriteFile(path, []byte(golden.content), 0o644))
+					}
+					want, err := os.ReadFile(path)
+					require.NoError(t, err, "run go test -run TestMailTemplatesGolden -update to create it")
+					require.Equal(t, string(want), golden.content, path)
+				}
+			})
+		}
+	}
+}
+
+// previewInvoices are an invoice of every kind, as golden files render them.
+func previewInvoices() []Invoice {
+	issuedAt := time.Date(2025, 9, 3, 12, 0, 0, 0, time.UTC)
+	departure := time.Date(2025, 9, 12, 8, 30, 0, 0, time.UTC)
+	passenger := User{FirstName: "Camille", LastName: "Martin", Email: "camille.martin@example.com"}
+	driver := User{FirstName: "Louis", LastName: "Bernard", Email: "louis.bernard@example.com"}
+	trip := &InvoiceTrip{Origin: "Lyon", Destination: "Paris", DepartureTime: departure, Seats: 2}
+
+	receipt := newInvoice(InvoiceReceipt, "receipt:preview", passenger, issuedAt,
+		InvoiceLine{Kind: InvoiceLineContribution, Amount: eur(4500), VAT: eur(0)},
+		InvoiceLine{Kind: InvoiceLineFee, Amount: eur(500), VAT: vatIncluded(eur(500))},
+		InvoiceLine{Kind: InvoiceLineDiscount, Amount: eur(-750), VAT: eur(0)},
+	)
+	receipt.Number, receipt.Trip = "R-2025-000042", trip
+
+	creditNote := newInvoice(InvoiceCreditNote, "credit_note:preview", passenger, issuedAt.AddDate(0, 0, 1),
+		InvoiceLine{Kind: InvoiceLineContribution, Amount: eur(-2250), VAT: eur(0)},
+		InvoiceLine{Kind: InvoiceLineFee, Amount: eur(-250), VAT: vatIncluded(eur(-250))},
+	)
+	creditNote.Number, creditNote.CreditedNumber, creditNote.Trip = "C-2025-000007", receipt.Number, trip
+
+	from, to := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)
+	statement := newInvoice(InvoiceStatement, "statement:preview", driver, issuedAt,
+		InvoiceLine{Kind: InvoiceLineFares, Amount: eur(18000), VAT: eur(0)},
+		InvoiceLine{Kind: InvoiceLineFeesWithheld, Amount: eur(-1800), VAT: vatIncluded(eur(-1800))},
+	)
+	statement.Number, statement.PeriodStart, statement.PeriodEnd = "S-2025-000003", &from, &to
+	return []Invoice{receipt, creditNote, statement}
+}
+
+// TestInvoiceTemplatesGolden renders an invoice of every kind in every locale
+// and compares it to testdata/templates, like TestMailTemplatesGolden.
+func TestInvoiceTemplatesGolden(t *testing.T) {
+	for _, locale := range Locales {
+		for _, invoice := range previewInvoices() {
+			invoice.Locale = locale
+			t.Run(locale+"/"+invoice.Kind, func(t *testing.T) {
+				for _, format := range []string{"txt", "html"} {
+					renderFormat := format
+					if format == "txt" {
+						renderFormat = "text"
+					}
+					document, _, err := RenderInvoice(invoice, renderFormat)
+					require.NoError(t, err)
+					path := filepath.Join("testdata", "templates", locale, "invoice."+invoice.Kind+"."+format+".golden")
+					if *updateGolden {
+						require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+						require.NoError(t, os.WriteFile(path, document, 0o644))
+					}
+					want, err := os.ReadFile(path)
+					require.NoError(t, err, "run go test -run TestInvoiceTemplatesGolden -update to create it")
+					require.Equal(t, string(want), string(document), path)
+				}
+			})
+		}
+	}
+}
+
+func TestMailTemplatesLocale(t *testing.T) {
+	data := previewTemplateData()
+	mail, err := mailTemplateSet.Render("fr", NotificationRideCancelled, data)
+	require.NoError(t, err)
+	require.Equal(t, "Votre trajet a été annulé", mail.Subject)
+	require.Equal(t, data.Recipient.Email, mail.To)
+	mail, err = mailTemplateSet.Render("de", NotificationRideCancelled, data)
+	require.NoError(t, err)
+	require.Equal(t, "Your ride has been cancelled", mail.Subject, "unknown locales fall back to english")
+	_, err = mailTemplateSet.Render("en", "ride.updated", data)
+	require.ErrorIs(t, err, ErrTemplateNotFound)
+
+	data.Recipient.FirstName = "<script>alert(1)</script>"
+	mail, err = mailTemplateSet.Render("en", NotificationRideCancelled, data)
+	require.NoError(t, err)
+	require.NotContains(t, mail.HTML, "<script>")
+	require.Contains(t, mail.Body, "<script>", "the text version is not escaped")
+}
+
+func TestNotificationMailsFollowLanguage(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	s := NewMockService(db)
+	s.mailer = mailer
+	s.now = func() time.Time { return now }
+	passengerID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	i := 0
+	for db.Users[i].UserID != passengerID {
+		i++
+	}
+	db.Users[i].Preferences.Language = "fr"
+	ride := Ride{RideID: uuid.New(), DriverID: StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7"), Origin: "Lyon", Destination: "Paris", DepartureTime: now.Add(24 * time.Hour), Price: eur(2500), NumberOfSeats: 3, Status: RideScheduled}
+	booking := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, NumberOfSeats: 2, TotalPrice: eur(5000), Status: BookingPending}
+	db.Rides = append(db.Rides, ride)
+	db.Bookings = append(db.Bookings, booking)
+
+	_, err := s.ApproveBooking(booking.BookingID)
+	require.NoError(t, err)
+	_, err = s.DispatchNotifications()
+	require.NoError(t, err)
+	mail, ok := mailer.Last()
+	require.True(t, ok)
+	require.Equal(t, "Votre réservation est confirmée", mail.Subject)
+	require.Contains(t, mail.Body, "2 place(s)")
+	require.Contains(t, mail.Body, "50.00 €")
+	require.Contains(t, mail.HTML, "<strong>Lyon</strong>")
+}
+
+func TestTemplatePreviewHandler(t *testing.T) {
+	h := &Handler{Service: new(MockService)}
+	for _, tc := range []struct {
+		name        string
+		url         string
+		actor       Actor
+		status      int
+		contentType string
+	}{
+		{"html", "/admin/templates/preview?type=booking.approved&locale=fr", admin, http.StatusOK, "text/html; charset=utf-8"},
+		{"text", "/admin/templates/preview?type=booking.approved&format=text", admin, http.StatusOK, "text/plain; charset=utf-8"},
+		{"unknown type", "/admin/templates/preview?type=ride.updated", admin, http.StatusNotFound, ""},
+		{"unknown locale", "/admin/templates/preview?type=booking.approved&locale=de", admin, http.StatusNotFound, ""},
+		{"as a user", "/admin/templates/preview?type=booking.approved", Actor{UserID: uuid.New(), Role: RolePassenger}, http.StatusForbidden, ""},
+	} {
+		req := asActor(httptest.NewRequest(http.MethodGet, tc.url, nil), tc.actor)
+		w := httptest.NewRecorder()
+		h.TemplatePreviewHandler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+		if tc.contentType != "" {
+			require.Equal(t, tc.contentType, w.Result().Header.Get("Content-Type"), tc.name)
+			require.Contains(t, w.Body.String(), "Camille", tc.name)
+		}
+	}
+}
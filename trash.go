@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// defaultTrashRetention is how long soft deleted rows stay restorable when
+// TRASH_RETENTION_DAYS is not set.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+var (
+	ErrNotDeleted     = errors.New("not deleted")
+	ErrNotRestorable  = errors.New("cannot be restored")
+	ErrUnknownTrashed = errors.New("unknown kind of deleted item")
+)
+
+// PurgeSummary tells what a retention run removed for good, and what it
+// archived because reviews or payments still refer to it.
+type PurgeSummary struct {
+	RidesPurged      int `json:"rides_purged"`
+	BookingsPurged   int `json:"bookings_purged"`
+	RidesArchived    int `json:"rides_archived"`
+	BookingsArchived int `json:"bookings_archived"`
+	UsersErased      int `json:"users_erased"`
+}
+
+// TrashRepository reaches the soft deleted rides, bookings and users that
+// every other query ignores.
+type TrashRepository interface {
+	// DeactivateUser soft deletes the user with its future rides and bookings.
+	// The other passengers of the rides taken down are told.
+	DeactivateUser(userID uuid.UUID, actorID uuid.UUID, at time.Time) error
+	GetDeletedRides() ([]Ride, error)
+	GetDeletedBookings() ([]Booking, error)
+	GetDeactivatedUsers() ([]User, error)
+	// RestoreRide and RestoreBooking return the row as it was in the trash,
+	// with who deleted it. The payments released by the deletion are to be
+	// authorized again.
+	RestoreRide(rideID uuid.UUID) (Ride, error)
+	RestoreBooking(bookingID uuid.UUID) (Booking, error)
+	RestoreUser(userID uuid.UUID) (User, error)
+	// PurgeDeleted permanently deletes the rides and bookings deleted before
+	// before. Rows still referenced by reviews or payments are archived
+	// instead, out of the trash and no longer restorable.
+	PurgeDeleted(before time.Time) (PurgeSummary, error)
+}
+
+// unscoped lets a query see soft deleted rows.
+func unscoped(statement *gorm.Statement) {
+	statement.Unscoped = true
+}
+
+func (repository *CovoitRepository) DeactivateUser(userID uuid.UUID, actorID uuid.UUID, at time.Time) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		deletedAt := gorm.DeletedAt{Time: at, Valid: true}
+		rows, err := gorm.G[User](tx).Where("user_id = ?", userID).Updates(ctx, User{DeletedAt: deletedAt, DeletedBy: &actorID})
+		if err != nil {
+			return fmt.Errorf("could not deactivate user %s, err : %s", userID, err)
+		}
+		if rows == 0 {
+			return fmt.Errorf("User %v not found", userID)
+		}
+
+		rides, err := gorm.G[Ride](tx).Where("driver_id = ? AND status = ? AND departure_time > ?", userID, RideScheduled, at).Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get future rides of user %s, err : %s", userID, err)
+		}
+		rideIDs := make([]uuid.UUID, len(rides))
+		for i, ride := range rides {
+			rideIDs[i] = ride.RideID
+		}
+		futureRides := tx.Model(&Ride{}).Select("ride_id").Where("status = ? AND departure_time > ?", RideScheduled, at)
+		bookings, err := gorm.G[Booking](tx).Where("ride_id IN ? OR (user_id = ? AND ride_id IN (?))", rideIDs, userID, futureRides).Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get future bookings of user %s, err : %s", userID, err)
+		}
+		bookingIDs := make([]uuid.UUID, len(bookings))
+		notifications := []Notification{}
+		for i, booking := range bookings {
+			bookingIDs[i] = booking.BookingID
+			if booking.UserID == userID || booking.Status != BookingConfirmed {
+				continue
+			}
+			for _, ride := range rides {
+				if ride.RideID == booking.RideID {
+					notifications = append(notifications, rideNotification(NotificationRideCancelled, booking.UserID, ride, &booking))
+				}
+			}
+		}
+
+		if len(bookingIDs) > 0 {
+			_, err = gorm.G[Booking](tx).Where("booking_id IN ?", bookingIDs).Updates(ctx, Booking{DeletedAt: deletedAt, DeletedBy: &actorID})
+			if err != nil {
+				return fmt.Errorf("could not delete bookings of user %s, err : %s", userID, err)
+			}
+		}
+		if err := settlePayments(tx, PaymentRelease, 0, bookingIDs...); err != nil {
+			return err
+		}
+		if err := releasePromotions(tx, bookings...); err != nil {
+			return err
+		}
+		if len(rideIDs) > 0 {
+			_, err = gorm.G[Ride](tx).Where("ride_id IN ?", rideIDs).Updates(ctx, Ride{DeletedAt: deletedAt, DeletedBy: &actorID})
+			if err != nil {
+				return fmt.Errorf("could not delete rides of user %s, err : %s", userID, err)
+			}
+		}
+		if err := enqueueNotifications(tx, notifications...); err != nil {
+			return err
+		}
+		for _, ride := range rides {
+			if err := publishWebhookEvent(tx, WebhookRideCancelled, ride); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (repository *CovoitRepository) GetDeletedRides() ([]Ride, error) {
+	ctx := context.Background()
+	rides, err := gorm.G[Ride](repository.db).Scopes(unscoped).Where("deleted_at IS NOT NULL AND purged_at IS NULL").Order("deleted_at DESC").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get deleted rides, err : %s", err)
+	}
+	return rides, nil
+}
+
+func (repository *CovoitRepository) GetDeletedBookings() ([]Booking, error) {
+	ctx := context.Background()
+	bookings, err := gorm.G[Booking](repository.db).Scopes(unscoped).Where("deleted_at IS NOT NULL AND purged_at IS NULL").Order("deleted_at DESC").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get deleted bookings, err : %s", err)
+	}
+	return bookings, nil
+}
+
+func (repository *CovoitRepository) GetDeactivatedUsers() ([]User, error) {
+	ctx := context.Background()
+	users, err := gorm.G[User](repository.db).Scopes(unscoped).Where("deleted_at IS NOT NULL").Order("deleted_at DESC").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get deactivated users, err : %s", err)
+	}
+	return users, nil
+}
+
+// reauthorizePayments puts the payments of the bookings brought back in
+// escrow again, within tx. The release decided by their deletion is dropped,
+// and the payments released already get a new authorization, made once the
+// transaction commits. Bookings charged for their cancellation, or with a
+// provider call in flight, cannot be brought back.
+func reauthorizePayments(tx *gorm.DB, bookings *gorm.DB) error {
+	live := tx.Model(&Booking{}).Unscoped().Select("booking_id").Where("booking_id IN (?) AND status IN ?", bookings, []string{BookingPending, BookingConfirmed})
+	var settled int64
+	err := tx.Model(&Payment{}).
+		Where("booking_id IN (?) AND (action <> '' OR settlement = ? OR status IN ?)", live, PaymentCapture, []string{PaymentCaptured, PaymentRefunded}).
+		Count(&settled).Error
+	if err != nil {
+		return fmt.Errorf("could not check payments, err : %s", err)
+	}
+	if settled > 0 {
+		return fmt.Errorf("%w : the payment is captured or being settled", ErrNotRestorable)
+	}
+	err = tx.Model(&Payment{}).
+		Where("booking_id IN (?) AND status = ?", live, PaymentAuthorized).
+		Updates(map[string]any{"settlement": "", "settlement_amount_minor": 0, "settlement_amount_currency": ""}).Error
+	if err != nil {
+		return fmt.Errorf("could not keep payments in escrow, err : %s", err)
+	}
+	err = tx.Model(&Payment{}).
+		Where("booking_id IN (?) AND status IN ?", live, []string{PaymentReleased, PaymentFailed}).
+		Updates(map[string]any{
+			"status":                     PaymentPending,
+			"reference":                  "",
+			"settlement":                 "",
+			"settlement_amount_minor":    0,
+			"settlement_amount_currency": "",
+			"action":                     PaymentAuthorize,
+			"action_key":                 gorm.Expr("uuid_generate_v4()::text"),
+			"attempted_at":               nil,
+			"last_error":                 "",
+		}).Error
+	if err != nil {
+		return fmt.Errorf("could not authorize payments again, err : %s", err)
+	}
+	return nil
+}
+
+// RestoreRide brings back the ride with the bookings deleted along with it.
+// It is refused once one of them was charged for its cancellation.
+func (repository *CovoitRepository) RestoreRide(rideID uuid.UUID) (Ride, error) {
+	ride := Ride{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		ride, err = gorm.G[Ride](tx).Scopes(unscoped).Where("ride_id = ? AND deleted_at IS NOT NULL AND purged_at IS NULL", rideID).First(ctx)
+		if err != nil {
+			return ErrNotDeleted
+		}
+		if _, err := gorm.G[User](tx).Where("user_id = ?", ride.DriverID).First(ctx); err != nil {
+			return fmt.Errorf("%w : the driver is deactivated", ErrNotRestorable)
+		}
+		bookings := tx.Model(&Booking{}).Unscoped().Select("booking_id").Where("ride_id = ? AND deleted_at = ?", rideID, ride.DeletedAt.Time)
+		if err := reauthorizePayments(tx, bookings); err != nil {
+			return err
+		}
+		restored, err := gorm.G[Booking](tx).Scopes(unscoped).Where("ride_id = ? AND deleted_at = ?", rideID, ride.DeletedAt.Time).Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get bookings of ride %s, err : %s", rideID, err)
+		}
+		if err := reclaimPromotions(tx, restored...); err != nil {
+			return err
+		}
+		_, err = gorm.G[Booking](tx).Scopes(unscoped).
+			Where("ride_id = ? AND deleted_at = ?", rideID, ride.DeletedAt.Time).
+			Select("deleted_at", "deleted_by").
+			Updates(ctx, Booking{})
+		if err != nil {
+			return fmt.Errorf("could not restore bookings of ride %s, err : %s", rideID, err)
+		}
+		_, err = gorm.G[Ride](tx).Scopes(unscoped).Where("ride_id = ?", rideID).Select("deleted_at", "deleted_by").Updates(ctx, Ride{})
+		if err != nil {
+			return fmt.Errorf("could not restore ride %s, err : %s", rideID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Ride{}, err
+	}
+	return ride, nil
+}
+
+// RestoreBooking brings back the booking, unless it was charged for its
+// cancellation.
+func (repository *CovoitRepository) RestoreBooking(bookingID uuid.UUID) (Booking, error) {
+	booking := Booking{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		booking, err = gorm.G[Booking](tx).Scopes(unscoped).Where("booking_id = ? AND deleted_at IS NOT NULL AND purged_at IS NULL", bookingID).First(ctx)
+		if err != nil {
+			return ErrNotDeleted
+		}
+		if _, err := gorm.G[Ride](tx).Where("ride_id = ?", booking.RideID).First(ctx); err != nil {
+			return fmt.Errorf("%w : the ride is deleted", ErrNotRestorable)
+		}
+		if _, err := gorm.G[User](tx).Where("user_id = ?", booking.UserID).First(ctx); err != nil {
+			return fmt.Errorf("%w : the passenger is deactivated", ErrNotRestorable)
+		}
+		if err := reauthorizePayments(tx, tx.Model(&Booking{}).Unscoped().Select("booking_id").Where("booking_id = ?", bookingID)); err != nil {
+			return err
+		}
+		if err := reclaimPromotions(tx, booking); err != nil {
+			return err
+		}
+		_, err = gorm.G[Booking](tx).Scopes(unscoped).Where("booking_id = ?", bookingID).Select("deleted_at", "deleted_by").Updates(ctx, Booking{})
+		if err != nil {
+			return fmt.Errorf("could not restore booking %s, err : %s", bookingID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Booking{}, err
+	}
+	return booking, nil
+}
+
+// RestoreUser reactivates the user with the rides and bookings its
+// deactivation took down. It is refused once one of the bookings was charged
+// for its cancellation.
+func (repository *CovoitRepository) RestoreUser(userID uuid.UUID) (User, error) {
+	user := User{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		user, err = gorm.G[User](tx).Scopes(unscoped).Where("user_id = ? AND deleted_at IS NOT NULL", userID).First(ctx)
+		if err != nil {
+			return ErrNotDeleted
+		}
+		if user.ErasedAt != nil {
+			return fmt.Errorf("%w : the user is erased", ErrNotRestorable)
+		}
+		deletedAt := user.DeletedAt.Time
+		rides, err := gorm.G[Ride](tx).Scopes(unscoped).Where("driver_id = ? AND deleted_at = ?", userID, deletedAt).Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get rides of user %s, err : %s", userID, err)
+		}
+		rideIDs := make([]uuid.UUID, len(rides))
+		for i, ride := range rides {
+			rideIDs[i] = ride.RideID
+		}
+		bookings := tx.Model(&Booking{}).Unscoped().Select("booking_id").Where("deleted_at = ? AND (user_id = ? OR ride_id IN ?)", deletedAt, userID, rideIDs)
+		if err := reauthorizePayments(tx, bookings); err != nil {
+			return err
+		}
+		restored, err := gorm.G[Booking](tx).Scopes(unscoped).Where("deleted_at = ? AND (user_id = ? OR ride_id IN ?)", deletedAt, userID, rideIDs).Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get bookings of user %s, err : %s", userID, err)
+		}
+		if err := reclaimPromotions(tx, restored...); err != nil {
+			return err
+		}
+		_, err = gorm.G[Booking](tx).Scopes(unscoped).
+			Where("deleted_at = ? AND (user_id = ? OR ride_id IN ?)", deletedAt, userID, rideIDs).
+			Select("deleted_at", "deleted_by").
+			Updates(ctx, Booking{})
+		if err != nil {
+			return fmt.Errorf("could not restore bookings of user %s, err : %s", userID, err)
+		}
+		if len(rideIDs) > 0 {
+			_, err = gorm.G[Ride](tx).Scopes(unscoped).Where("ride_id IN ?", rideIDs).Select("deleted_at", "deleted_by").Updates(ctx, Ride{})
+			if err != nil {
+				return fmt.Errorf("could not restore rides of user %s, err : %s", userID, err)
+			}
+		}
+		_, err = gorm.G[User](tx).Scopes(unscoped).Where("user_id = ?", userID).Select("deleted_at", "deleted_by").Updates(ctx, User{})
+		if err != nil {
+			return fmt.Errorf("could not restore user %s, err : %s", userID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	user.DeletedAt, user.DeletedBy = gorm.DeletedAt{}, nil
+	return user, nil
+}
+
+func (repository *CovoitRepository) PurgeDeleted(before time.Time) (PurgeSummary, error) {
+	summary := PurgeSummary{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		// The ledger journals and the invoices of a payment are accounting
+		// records about its booking, and a review about its trip. Those are
+		// archived, and their ride with them.
+		bookingReferenced := `(EXISTS (SELECT 1 FROM reviews WHERE reviews.booking_id = bookings.booking_id)
+			OR EXISTS (SELECT 1 FROM payments WHERE payments.booking_id = bookings.booking_id))`
+		summary.BookingsPurged, err = gorm.G[Booking](tx).Scopes(unscoped).
+			Where("deleted_at < ? AND purged_at IS NULL AND NOT "+bookingReferenced, before).
+			Delete(ctx)
+		if err != nil {
+			return fmt.Errorf("could not purge bookings, err : %s", err)
+		}
+		summary.BookingsArchived, err = gorm.G[Booking](tx).Scopes(unscoped).
+			Where("deleted_at < ? AND purged_at IS NULL AND "+bookingReferenced, before).
+			Update(ctx, "purged_at", gorm.Expr("CURRENT_TIMESTAMP"))
+		if err != nil {
+			return fmt.Errorf("could not archive bookings, err : %s", err)
+		}
+		rideReferenced := `(EXISTS (SELECT 1 FROM bookings WHERE bookings.ride_id = rides.ride_id)
+			OR EXISTS (SELECT 1 FROM reviews WHERE reviews.ride_id = rides.ride_id))`
+		summary.RidesPurged, err = gorm.G[Ride](tx).Scopes(unscoped).
+			Where("deleted_at < ? AND purged_at IS NULL AND NOT "+rideReferenced, before).
+			Delete(ctx)
+		if err != nil {
+			return fmt.Errorf("could not purge rides, err : %s", err)
+		}
+		summary.RidesArchived, err = gorm.G[Ride](tx).Scopes(unscoped).
+			Where("deleted_at < ? AND purged_at IS NULL AND "+rideReferenced, before).
+			Update(ctx, "purged_at", gorm.Expr("CURRENT_TIMESTAMP"))
+		if err != nil {
+			return fmt.Errorf("could not archive rides, err : %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return PurgeSummary{}, err
+	}
+	return summary, nil
+}
+
+// trashRetentionFromEnv reads the retention period of deleted rows, in days,
+// from TRASH_RETENTION_DAYS.
+func trashRetentionFromEnv() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		return defaultTrashRetention
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func (service *CovoitService) retention() time.Duration {
+	if service.trashRetention > 0 {
+		return service.trashRetention
+	}
+	return defaultTrashRetention
+}
+
+// DeactivateUser hides the account until an admin restores it. Its future
+// rides go down with it and their passengers are told so.
+func (service *CovoitService) DeactivateUser(userID uuid.UUID, actorID uuid.UUID) error {
+	rideIDs := service.ridesOf(userID)
+	if err := service.trash.DeactivateUser(userID, actorID, service.clock()); err != nil {
+		return err
+	}
+	service.publishAvailability(rideIDs...)
+	return nil
+}
+
+func (service *CovoitService) GetDeletedRides() ([]Ride, error) {
+	return service.trash.GetDeletedRides()
+}
+
+func (service *CovoitService) GetDeletedBookings() ([]Booking, error) {
+	return service.trash.GetDeletedBookings()
+}
+
+func (service *CovoitService) GetDeactivatedUsers() ([]User, error) {
+	return service.trash.GetDeactivatedUsers()
+}
+
+// RestoreRide undoes DeleteRide, the cancellation it cost the driver and the
+// release of the payments included.
+func (service *CovoitService) RestoreRide(rideID uuid.UUID) (Ride, error) {
+	ride, err := service.trash.RestoreRide(rideID)
+	if err != nil {
+		return Ride{}, err
+	}
+	if bookings, err := service.repository.GetBookingsByRide(rideID); err == nil {
+		service.processBookingPayments(bookings)
+	}
+	if ride.Status != RideCompleted && ride.DeletedBy != nil && *ride.DeletedBy == ride.DriverID {
+		service.bumpReputation(Reputation{UserID: ride.DriverID, Cancellations: -1})
+	}
+	ride.DeletedAt, ride.DeletedBy = gorm.DeletedAt{}, nil
+	service.publishAvailability(rideID)
+	return ride, nil
+}
+
+// RestoreBooking undoes DeleteBooking, the cancellation it cost the passenger
+// and the release of the payment included.
+func (service *CovoitService) RestoreBooking(bookingID uuid.UUID) (Booking, error) {
+	booking, err := service.trash.RestoreBooking(bookingID)
+	if err != nil {
+		return Booking{}, err
+	}
+	service.processBookingPayments([]Booking{booking})
+	if booking.DeletedBy != nil && *booking.DeletedBy == booking.UserID {
+		if ride, err := service.repository.GetRideById(booking.RideID); err != nil || ride.Status != RideCompleted {
+			service.bumpReputation(Reputation{UserID: booking.UserID, Cancellations: -1})
+		}
+	}
+	booking.DeletedAt, booking.DeletedBy = gorm.DeletedAt{}, nil
+	service.publishAvailability(booking.RideID)
+	return booking, nil
+}
+
+func init() {
+	registerPeriodicJob("trash.purge", time.Hour, func(service *CovoitService, job Job) error {
+		_, err := service.PurgeDeleted()
+		return err
+	})
+}
+
+// RestoreUser undoes DeactivateUser, the payments it released are
+// authorized again.
+func (service *CovoitService) RestoreUser(userID uuid.UUID) (User, error) {
+	user, err := service.trash.RestoreUser(userID)
+	if err != nil {
+		return User{}, err
+	}
+	if bookings, err := service.repository.GetBookingsByUser(userID); err == nil {
+		service.processBookingPayments(bookings)
+	}
+	if rides, err := service.repository.GetRidesByDriver(userID); err == nil {
+		for _, ride := range rides {
+			if bookings, err := service.repository.GetBookingsByRide(ride.RideID); err == nil {
+				service.processBookingPayments(bookings)
+			}
+		}
+	}
+	return user, nil
+}
+
+// PurgeDeleted permanently removes what has been deleted for longer than the
+// retention period. Deactivated accounts are erased rather than deleted, the
+// history they are part of is kept.
+func (service *CovoitService) PurgeDeleted() (PurgeSummary, error) {
+	before := service.clock().Add(-service.retention())
+	summary, err := service.trash.PurgeDeleted(before)
+	if err != nil {
+		return PurgeSummary{}, err
+	}
+	users, err := service.trash.GetDeactivatedUsers()
+	if err != nil {
+		return summary, err
+	}
+	for _, user := range users {
+		if user.ErasedAt != nil || !user.DeletedAt.Time.Before(before) {
+			continue
+		}
+		if _, err := service.EraseUser(user.UserID); err != nil {
+			return summary, err
+		}
+		summary.UsersErased++
+	}
+	return summary, nil
+}
+
+func (h *Handler) DeactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	userID, err := uuid.Parse(r.URL.Query().Get("user_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !Authorize(actor, ActionDeleteUser, Resource{OwnerID: userID}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := h.Service.DeactivateUser(userID, actor.UserID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TrashHandler lists the deleted rides, bookings or users, by ?type=.
+func (h *Handler) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManageTrash, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var items any
+	var err error
+	switch r.URL.Query().Get("type") {
+	case "rides":
+		items, err = h.Service.GetDeletedRides()
+	case "bookings":
+		items, err = h.Service.GetDeletedBookings()
+	case "users":
+		items, err = h.Service.GetDeactivatedUsers()
+	default:
+		err = ErrUnknownTrashed
+	}
+	if errors.Is(err, ErrUnknownTrashed) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// RestoreHandler brings back a deleted item, by ?type= and ?id=.
+func (h *Handler) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManageTrash, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	id, err := uuid.Parse(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var item any
+	switch r.URL.Query().Get("type") {
+	case "rides":
+		item, err = h.Service.RestoreRide(id)
+	case "bookings":
+		item, err = h.Service.RestoreBooking(id)
+	case "users":
+		item, err = h.Service.RestoreUser(id)
+	default:
+		err = ErrUnknownTrashed
+	}
+	if errors.Is(err, ErrUnknownTrashed) {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if errors.Is(err, ErrNotDeleted) {
+		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, ErrNotRestorable) {
+		w.WriteHeader(http.StatusConflict)
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(item)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func (m *MockRepository) DeactivateUser(userID uuid.UUID, actorID uuid.UUID, at time.Time) error {
+	i := slices.IndexFunc(m.DB.Users, func(user User) bool { return user.UserID == userID })
+	if i < 0 {
+		return errors.New("user not found")
+	}
+	deletedAt := gorm.DeletedAt{Time: at, Valid: true}
+	user := m.DB.Users[i]
+	user.DeletedAt, user.DeletedBy = deletedAt, &actorID
+	m.DB.Users = slices.Delete(m.DB.Users, i, i+1)
+	m.DB.DeletedUsers = append(m.DB.DeletedUsers, user)
+
+	future := map[uuid.UUID]bool{}
+	rides := []Ride{}
+	m.DB.Rides = slices.DeleteFunc(m.DB.Rides, func(ride Ride) bool {
+		if ride.Status != RideScheduled || !ride.DepartureTime.After(at) {
+			return false
+		}
+		future[ride.RideID] = true
+		if ride.DriverID != userID {
+			return false
+		}
+		ride.DeletedAt, ride.DeletedBy = deletedAt, &actorID
+		m.DB.DeletedRides = append(m.DB.DeletedRides, ride)
+		rides = append(rides, ride)
+		return true
+	})
+	m.DB.Bookings = slices.DeleteFunc(m.DB.Bookings, func(booking Booking) bool {
+		j := slices.IndexFunc(rides, func(ride Ride) bool { return ride.RideID == booking.RideID })
+		if j < 0 && (booking.UserID != userID || !future[booking.RideID]) {
+			return false
+		}
+		if j >= 0 && booking.UserID != userID && booking.Status == BookingConfirmed {
+			m.enqueue(rideNotification(NotificationRideCancelled, booking.UserID, rides[j], &booking))
+		}
+		m.settle(PaymentRelease, 0, booking.BookingID)
+		m.releasePromotions(booking)
+		booking.DeletedAt, booking.DeletedBy = deletedAt, &actorID
+		m.DB.DeletedBookings = append(m.DB.DeletedBookings, booking)
+		return true
+	})
+	for _, ride := range rides {
+		m.publish(WebhookRideCancelled, ride)
+	}
+	return nil
+}
+
+func (m *MockRepository) GetDeletedRides() ([]Ride, error) {
+	return slices.DeleteFunc(slices.Clone(m.DB.DeletedRides), func(ride Ride) bool { return ride.PurgedAt != nil }), nil
+}
+
+func (m *MockRepository) GetDeletedBookings() ([]Booking, error) {
+	return slices.DeleteFunc(slices.Clone(m.DB.DeletedBookings), func(booking Booking) bool { return booking.PurgedAt != nil }), nil
+}
+
+func (m *MockRepository) GetDeactivatedUsers() ([]User, error) {
+	return slices.Clone(m.DB.DeletedUsers), nil
+}
+
+func (m *MockRepository) deletedBookings(match func(booking Booking) bool) []Booking {
+	bookings := []Booking{}
+	for _, booking := range m.DB.DeletedBookings {
+		if match(booking) {
+			bookings = append(bookings, booking)
+		}
+	}
+	return bookings
+}
+
+// restoreBookings brings back the deleted bookings matching keep.
+func (m *MockRepository) restoreBookings(keep func(booking Booking) bool) {
+	m.DB.DeletedBookings = slices.DeleteFunc(m.DB.DeletedBookings, func(booking Booking) bool {
+		if !keep(booking) {
+			return false
+		}
+		booking.DeletedAt, booking.DeletedBy = gorm.DeletedAt{}, nil
+		m.DB.Bookings = append(m.DB.Bookings, booking)
+		return true
+	})
+}
+
+func (m *MockRepository) reauthorizePayments(match func(booking Booking) bool) error {
+	live := func(payment Payment) bool {
+		return slices.ContainsFunc(m.DB.DeletedBookings, func(booking Booking) bool {
+			return booking.BookingID == payment.BookingID && match(booking) && (booking.Status == BookingPending || booking.Status == BookingConfirmed)
+		})
+	}
+	for _, payment := range m.DB.Payments {
+		if live(payment) && (payment.Action != "" || payment.Settlement == PaymentCapture || payment.Status == PaymentCaptured || payment.Status == PaymentRefunded) {
+			return ErrNotRestorable
+		}
+	}
+	for i, payment := range m.DB.Payments {
+		if !live(payment) {
+			continue
+		}
+		payment.Settlement, payment.SettlementAmount = "", Money{}
+		if payment.Status == PaymentReleased || payment.Status == PaymentFailed {
+			payment.Status, payment.Reference = PaymentPending, ""
+			payment.Action, payment.ActionKey = PaymentAuthorize, uuid.NewString()
+			payment.AttemptedAt, payment.LastError = nil, ""
+		}
+		m.DB.Payments[i] = payment
+	}
+	return nil
+}
+
+func (m *MockRepository) RestoreRide(rideID uuid.UUID) (Ride, error) {
+	i := slices.IndexFunc(m.DB.DeletedRides, func(ride Ride) bool { return ride.RideID == rideID && ride.PurgedAt == nil })
+	if i < 0 {
+		return Ride{}, ErrNotDeleted
+	}
+	ride := m.DB.DeletedRides[i]
+	if _, err := m.GetUserById(ride.DriverID); err != nil {
+		return Ride{}, ErrNotRestorable
+	}
+	withRide := func(booking Booking) bool {
+		return booking.RideID == rideID && booking.DeletedAt.Time.Equal(ride.DeletedAt.Time)
+	}
+	if err := m.reauthorizePayments(withRide); err != nil {
+		return Ride{}, err
+	}
+	if err := m.reclaimPromotions(m.deletedBookings(withRide)...); err != nil {
+		return Ride{}, err
+	}
+	m.restoreBookings(withRide)
+	m.DB.DeletedRides = slices.Delete(m.DB.DeletedRides, i, i+1)
+	restored := ride
+	restored.DeletedAt, restored.DeletedBy = gorm.DeletedAt{}, nil
+	m.DB.Rides = append(m.DB.Rides, restored)
+	return ride, nil
+}
+
+func (m *MockRepository) RestoreBooking(bookingID uuid.UUID) (Booking, error) {
+	i := slices.IndexFunc(m.DB.DeletedBookings, func(booking Booking) bool { return booking.BookingID == bookingID && booking.PurgedAt == nil })
+	if i < 0 {
+		return Booking{}, ErrNotDeleted
+	}
+	booking := m.DB.DeletedBookings[i]
+	if _, err := m.GetRideById(booking.RideID); err != nil {
+		return Booking{}, ErrNotRestorable
+	}
+	if _, err := m.GetUserById(booking.UserID); err != nil {
+		return Booking{}, ErrNotRestorable
+	}
+	itself := func(b Booking) bool { return b.BookingID == bookingID }
+	if err := m.reauthorizePayments(itself); err != nil {
+		return Booking{}, err
+	}
+	if err := m.reclaimPromotions(booking); err != nil {
+		return Booking{}, err
+	}
+	m.restoreBookings(itself)
+	return booking, nil
+}
+
+func (m *MockRepository) RestoreUser(userID uuid.UUID) (User, error) {
+	i := slices.IndexFunc(m.DB.DeletedUsers, func(user User) bool { return user.UserID == userID })
+	if i < 0 {
+		return User{}, ErrNotDeleted
+	}
+	user := m.DB.DeletedUsers[i]
+	if user.ErasedAt != nil {
+		return User{}, ErrNotRestorable
+	}
+	deletedAt := user.DeletedAt.Time
+	rideIDs := []uuid.UUID{}
+	for _, ride := range m.DB.DeletedRides {
+		if ride.DriverID == userID && ride.DeletedAt.Time.Equal(deletedAt) {
+			rideIDs = append(rideIDs, ride.RideID)
+		}
+	}
+	withUser := func(booking Booking) bool {
+		return booking.DeletedAt.Time.Equal(deletedAt) && (booking.UserID == userID || slices.Contains(rideIDs, booking.RideID))
+	}
+	if err := m.reauthorizePayments(withUser); err != nil {
+		return User{}, err
+	}
+	if err := m.reclaimPromotions(m.deletedBookings(withUser)...); err != nil {
+		return User{}, err
+	}
+	m.DB.DeletedRides = slices.DeleteFunc(m.DB.DeletedRides, func(ride Ride) bool {
+		if !slices.Contains(rideIDs, ride.RideID) {
+			return false
+		}
+		ride.DeletedAt, ride.DeletedBy = gorm.DeletedAt{}, nil
+		m.DB.Rides = append(m.DB.Rides, ride)
+		return true
+	})
+	m.restoreBookings(withUser)
+	m.DB.DeletedUsers = slices.Delete(m.DB.DeletedUsers, i, i+1)
+	user.DeletedAt, user.DeletedBy = gorm.DeletedAt{}, nil
+	m.DB.Users = append(m.DB.Users, user)
+	return user, nil
+}
+
+func (m *MockRepository) PurgeDeleted(before time.Time) (PurgeSummary, error) {
+	summary := PurgeSummary{}
+	now := time.Now()
+	m.DB.DeletedBookings = slices.DeleteFunc(m.DB.DeletedBookings, func(booking Booking) bool {
+		if booking.PurgedAt != nil || !booking.DeletedAt.Time.Before(before) {
+			return false
+		}
+		reviewed := slices.ContainsFunc(m.DB.Reviews, func(review Review) bool { return review.BookingID == booking.BookingID })
+		paid := slices.ContainsFunc(m.DB.Payments, func(payment Payment) bool { return payment.BookingID == booking.BookingID })
+		if reviewed || paid {
+			return false
+		}
+		summary.BookingsPurged++
+		return true
+	})
+	for i, booking := range m.DB.DeletedBookings {
+		if booking.PurgedAt == nil && booking.DeletedAt.Time.Before(before) {
+			m.DB.DeletedBookings[i].PurgedAt = &now
+			summary.BookingsArchived++
+		}
+	}
+	m.DB.DeletedRides = slices.DeleteFunc(m.DB.DeletedRides, func(ride Ride) bool {
+		if ride.PurgedAt != nil || !ride.DeletedAt.Time.Before(before) {
+			return false
+		}
+		referenced := slices.ContainsFunc(m.DB.DeletedBookings, func(booking Booking) bool { return booking.RideID == ride.RideID }) ||
+			slices.ContainsFunc(m.DB.Bookings, func(booking Booking) bool { return booking.RideID == ride.RideID }) ||
+			slices.ContainsFunc(m.DB.Reviews, func(review Review) bool { return review.RideID == ride.RideID })
+		if referenced {
+			return false
+		}
+		summary.RidesPurged++
+		return true
+	})
+	for i, ride := range m.DB.DeletedRides {
+		if ride.PurgedAt == nil && ride.DeletedAt.Time.Before(before) {
+			m.DB.DeletedRides[i].PurgedAt = &now
+			summary.RidesArchived++
+		}
+	}
+	return summary, nil
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	ride, err := s.CreateRide(Ride{RideID: uuid.New(), DriverID: driverID, DepartureTime: now.Add(24 * time.Hour), NumberOfSeats: 3})
+	require.NoError(t, err)
+	db.Rides[len(db.Rides)-1].Status = RideScheduled
+	booking := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, Status: BookingConfirmed}
+	db.Bookings = append(db.Bookings, booking)
+
+	t.Run("ride", func(t *testing.T) {
+		require.NoError(t, s.DeleteRide(ride.RideID, driverID))
+		_, err := s.GetRideById(ride.RideID)
+		require.Error(t, err, "deleted rides are hidden")
+		_, err = s.GetBookingById(booking.BookingID)
+		require.Error(t, err, "bookings go down with their ride")
+		deleted, err := s.GetDeletedRides()
+		require.NoError(t, err)
+		require.Len(t, deleted, 1)
+		require.Equal(t, &driverID, deleted[0].DeletedBy)
+		require.Equal(t, 1, db.Reputations[driverID].Cancellations)
+
+		_, err = s.RestoreBooking(booking.BookingID)
+		require.ErrorIs(t, err, ErrNotRestorable)
+		_, err = s.RestoreRide(ride.RideID)
+		require.NoError(t, err)
+		_, err = s.GetBookingById(booking.BookingID)
+		require.NoError(t, err)
+		require.Equal(t, 0, db.Reputations[driverID].Cancellations)
+		_, err = s.RestoreRide(ride.RideID)
+		require.ErrorIs(t, err, ErrNotDeleted)
+	})
+
+	t.Run("booking", func(t *testing.T) {
+		require.NoError(t, s.DeleteBooking(booking.BookingID, passengerID))
+		_, err := s.GetBookingById(booking.BookingID)
+		require.Error(t, err)
+		require.Equal(t, 1, db.Reputations[passengerID].Cancellations)
+		restored, err := s.RestoreBooking(booking.BookingID)
+		require.NoError(t, err)
+		require.Nil(t, restored.DeletedBy)
+		require.Equal(t, 0, db.Reputations[passengerID].Cancellations)
+	})
+
+	t.Run("user", func(t *testing.T) {
+		mailer := &MemoryMailer{}
+		s.mailer = mailer
+		require.NoError(t, s.DeactivateUser(driverID, admin.UserID))
+		_, err := s.DispatchNotifications()
+		require.NoError(t, err)
+		_, err = s.GetUserById(driverID)
+		require.Error(t, err)
+		_, err = s.GetRideById(ride.RideID)
+		require.Error(t, err, "future rides go down with their driver")
+		mail, ok := mailer.Last()
+		require.True(t, ok)
+		require.Equal(t, "mehdibenfredj3@gmail.com", mail.To)
+
+		_, err = s.RestoreRide(ride.RideID)
+		require.ErrorIs(t, err, ErrNotRestorable)
+		_, err = s.RestoreUser(driverID)
+		require.NoError(t, err)
+		_, err = s.GetRideById(ride.RideID)
+		require.NoError(t, err)
+		_, err = s.GetBookingById(booking.BookingID)
+		require.NoError(t, err)
+	})
+}
+
+func TestRestorePaidBooking(t *testing.T) {
+	f := newPaymentFixture(t)
+	booking, err := f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	released := f.payment(t, booking.BookingID)
+	require.NoError(t, f.service.DeleteBooking(booking.BookingID, f.passengerID))
+	require.Equal(t, PaymentReleased, f.payment(t, booking.BookingID).Status)
+	_, err = f.service.RestoreBooking(booking.BookingID)
+	require.NoError(t, err)
+	payment := f.payment(t, booking.BookingID)
+	require.Equal(t, PaymentAuthorized, payment.Status, "the payment is authorized again")
+	require.Empty(t, payment.Settlement)
+	require.NotEqual(t, released.Reference, payment.Reference)
+	held, ok := f.provider.Payment(payment.Reference)
+	require.True(t, ok)
+	require.Equal(t, eur(5000), held.Authorized)
+
+	f = newPaymentFixture(t)
+	_, err = f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	require.NoError(t, f.service.DeleteRide(f.ride.RideID, f.driverID))
+	_, err = f.service.RestoreRide(f.ride.RideID)
+	require.NoError(t, err)
+	bookings, err := f.service.repository.GetBookingsByRide(f.ride.RideID)
+	require.NoError(t, err)
+	require.Len(t, bookings, 1)
+	require.Equal(t, PaymentAuthorized, f.payment(t, bookings[0].BookingID).Status)
+
+	f = newPaymentFixture(t)
+	booking, err = f.book(t, BookingConfirmed)
+	require.NoError(t, err)
+	*f.now = f.ride.DepartureTime.Add(-time.Hour)
+	require.NoError(t, f.service.DeleteBooking(booking.BookingID, f.passengerID))
+	require.Equal(t, PaymentCapture, f.payment(t, booking.BookingID).Settlement)
+	_, err = f.service.RestoreBooking(booking.BookingID)
+	require.ErrorIs(t, err, ErrNotRestorable, "the passenger was charged for the cancellation")
+	_, err = f.service.GetBookingById(booking.BookingID)
+	require.Error(t, err)
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	s.trashRetention = 7 * 24 * time.Hour
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	reviewed, reviewedBooking := completedRide(db, driverID, passengerID, now.Add(-time.Hour))
+	db.Reviews = append(db.Reviews, Review{ReviewID: uuid.New(), BookingID: reviewedBooking.BookingID, RideID: reviewed.RideID})
+	require.NoError(t, s.DeleteRide(reviewed.RideID, driverID))
+	paid, paidBooking := completedRide(db, driverID, passengerID, now.Add(-time.Hour))
+	db.Payments = append(db.Payments, Payment{PaymentID: uuid.New(), BookingID: paidBooking.BookingID, Amount: eur(1000), Settlement: PaymentCapture})
+	require.NoError(t, s.DeleteRide(paid.RideID, driverID))
+	require.NoError(t, s.DeleteRide(StringToUuid(t, "630cbfed-d023-41a4-884c-b1b1de76fb9f"), admin.UserID))
+	require.NoError(t, s.DeactivateUser(passengerID, passengerID))
+
+	summary, err := s.PurgeDeleted()
+	require.NoError(t, err)
+	require.Equal(t, PurgeSummary{}, summary, "nothing is purged within the retention period")
+
+	now = now.Add(s.trashRetention + time.Hour)
+	summary, err = s.PurgeDeleted()
+	require.NoError(t, err)
+	require.Equal(t, PurgeSummary{RidesPurged: 1, RidesArchived: 2, BookingsArchived: 2, UsersErased: 1}, summary)
+	require.Len(t, db.DeletedRides, 2, "reviewed and paid rides are archived")
+	require.ElementsMatch(t, []uuid.UUID{reviewed.RideID, paid.RideID}, []uuid.UUID{db.DeletedRides[0].RideID, db.DeletedRides[1].RideID})
+	require.True(t, slices.ContainsFunc(db.DeletedBookings, func(booking Booking) bool { return booking.BookingID == paidBooking.BookingID }), "the booking of a payment is archived")
+	deleted, err := s.GetDeletedBookings()
+	require.NoError(t, err)
+	require.Empty(t, deleted, "archived bookings leave the trash")
+	_, err = s.RestoreBooking(paidBooking.BookingID)
+	require.ErrorIs(t, err, ErrNotDeleted, "archived bookings cannot be restored")
+	_, err = s.RestoreRide(paid.RideID)
+	require.ErrorIs(t, err, ErrNotDeleted)
+	require.NotNil(t, db.DeletedUsers[0].ErasedAt)
+
+	summary, err = s.PurgeDeleted()
+	require.NoError(t, err)
+	require.Equal(t, PurgeSummary{}, summary)
+}
+
+func TestTrashHandlers(t *testing.T) {
+	owner := Actor{UserID: uuid.New(), Role: RolePassenger}
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	rideID, bookingID, userID := uuid.New(), uuid.New(), uuid.New()
+	mockSvc.On("GetDeletedRides").Return([]Ride{{RideID: rideID}}, nil)
+	mockSvc.On("RestoreRide", rideID).Return(Ride{RideID: rideID}, nil)
+	mockSvc.On("RestoreBooking", bookingID).Return(Booking{}, ErrNotRestorable)
+	mockSvc.On("RestoreUser", userID).Return(User{}, ErrNotDeleted)
+	mockSvc.On("DeactivateUser", owner.UserID, owner.UserID).Return(nil)
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		url     string
+		actor   Actor
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"list", http.MethodGet, "/admin/trash?type=rides", admin, h.TrashHandler, http.StatusOK},
+		{"list unknown type", http.MethodGet, "/admin/trash?type=cars", admin, h.TrashHandler, http.StatusBadRequest},
+		{"list as a user", http.MethodGet, "/admin/trash?type=rides", owner, h.TrashHandler, http.StatusForbidden},
+		{"restore", http.MethodPost, "/admin/trash/restore?type=rides&id=" + rideID.String(), admin, h.RestoreHandler, http.StatusOK},
+		{"restore blocked", http.MethodPost, "/admin/trash/restore?type=bookings&id=" + bookingID.String(), admin, h.RestoreHandler, http.StatusConflict},
+		{"restore live", http.MethodPost, "/admin/trash/restore?type=users&id=" + userID.String(), admin, h.RestoreHandler, http.StatusNotFound},
+		{"restore as a user", http.MethodPost, "/admin/trash/restore?type=rides&id=" + rideID.String(), owner, h.RestoreHandler, http.StatusForbidden},
+		{"deactivate own account", http.MethodPost, "/users/deactivate?user_id=" + owner.UserID.String(), owner, h.DeactivateUserHandler, http.StatusNoContent},
+		{"deactivate someone else", http.MethodPost, "/users/deactivate?user_id=" + userID.String(), owner, h.DeactivateUserHandler, http.StatusForbidden},
+	} {
+		req := asActor(httptest.NewRequest(tc.method, tc.url, nil), tc.actor)
+		w := httptest.NewRecorder()
+		tc.handler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ComfortOptions = []string{"air_conditioning", "heated_seats", "usb_charger", "wifi", "bike_rack", "ski_rack", "child_seat", "extra_luggage"}
+
+const (
+	VehicleFuelPetrol   = "petrol"
+	VehicleFuelDiesel   = "diesel"
+	VehicleFuelLPG      = "lpg"
+	VehicleFuelElectric = "electric"
+)
+
+var VehicleFuels = []string{VehicleFuelPetrol, VehicleFuelDiesel, VehicleFuelLPG, VehicleFuelElectric}
+
+var (
+	ErrInvalidVehicle = errors.New("invalid vehicle")
+	ErrTooManySeats   = errors.New("more seats offered than the vehicle can carry")
+	ErrVehicleInUse   = errors.New("vehicle is used by rides")
+)
+
+// Vehicle is a car registered by a user. Seats counts every seat of the car,
+// the driver's included.
+type Vehicle struct {
+	VehicleID uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"vehicle_id"`
+	OwnerID   uuid.UUID `gorm:"type:uuid;index" json:"owner_id"`
+	Make      string    `json:"make"`
+	Model     string    `json:"model"`
+	Color     string    `json:"color"`
+	Plate     string    `json:"plate"`
+	Seats     int       `json:"seats"`
+	Comfort   []string  `gorm:"type:jsonb;serializer:json" json:"comfort"`
+	// Fuel and Consumption, in litres or kWh per 100 km, price the rides of
+	// the vehicle. Either may be left out for the defaults.
+	Fuel        string    `json:"fuel,omitempty"`
+	Consumption float64   `json:"consumption,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// PassengerCapacity is the number of seats a ride in the vehicle can offer.
+func (v Vehicle) PassengerCapacity() int {
+	return v.Seats - 1
+}
+
+type VehicleRepository interface {
+	CreateVehicle(vehicle Vehicle) (Vehicle, error)
+	GetVehicleById(vehicleID uuid.UUID) (Vehicle, error)
+	GetVehiclesByOwner(ownerID uuid.UUID) ([]Vehicle, error)
+	// DeleteVehicle deletes a vehicle no ride refers to, the deleted rides
+	// included since they can be restored.
+	DeleteVehicle(vehicleID uuid.UUID) error
+	// GetBookingVehicles returns the vehicle of the ride of every confirmed
+	// booking of bookingIDs, by booking id.
+	GetBookingVehicles(bookingIDs []uuid.UUID) (map[uuid.UUID]Vehicle, error)
+}
+
+func (repository *CovoitRepository) CreateVehicle(vehicle Vehicle) (Vehicle, error) {
+	ctx := context.Background()
+	err := gorm.G[Vehicle](repository.db).Create(ctx, &vehicle)
+	if err != nil {
+		return Vehicle{}, fmt.Errorf("could not create vehicle, err : %s", err)
+	}
+	return vehicle, nil
+}
+
+func (repository *CovoitRepository) GetVehicleById(vehicleID uuid.UUID) (Vehicle, error) {
+	ctx := context.Background()
+	vehicle, err := gorm.G[Vehicle](repository.db).Where("vehicle_id = ?", vehicleID).First(ctx)
+	if err != nil {
+		return Vehicle{}, fmt.Errorf("Vehicle %v not found, err : %s", vehicleID, err)
+	}
+	return vehicle, nil
+}
+
+func (repository *CovoitRepository) GetVehiclesByOwner(ownerID uuid.UUID) ([]Vehicle, error) {
+	ctx := context.Background()
+	vehicles, err := gorm.G[Vehicle](repository.db).Where("owner_id = ?", ownerID).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get vehicles of user %s, err : %s", ownerID, err)
+	}
+	return vehicles, nil
+}
+
+func (repository *CovoitRepository) DeleteVehicle(vehicleID uuid.UUID) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		rides, err := gorm.G[Ride](tx).Scopes(unscoped).Where("vehicle_id = ?", vehicleID).Count(ctx, "ride_id")
+		if err != nil {
+			return fmt.Errorf("could not count rides of vehicle %s, err : %s", vehicleID, err)
+		}
+		if rides > 0 {
+			return ErrVehicleInUse
+		}
+		_, err = gorm.G[Vehicle](tx).Where("vehicle_id = ?", vehicleID).Delete(ctx)
+		if errors.Is(err, gorm.ErrForeignKeyViolated) {
+			return ErrVehicleInUse
+		} else if err != nil {
+			return fmt.Errorf("could not delete vehicle %s, err : %s", vehicleID, err)
+		}
+		return nil
+	})
+}
+
+func (repository *CovoitRepository) GetBookingVehicles(bookingIDs []uuid.UUID) (map[uuid.UUID]Vehicle, error) {
+	type row struct {
+		Vehicle
+		BookingID uuid.UUID
+	}
+	rows := []row{}
+	err := repository.db.Table("bookings").
+		Select("bookings.booking_id, vehicles.*").
+		Joins("JOIN rides ON rides.ride_id = bookings.ride_id").
+		Joins("JOIN vehicles ON vehicles.vehicle_id = rides.vehicle_id").
+		Where("bookings.booking_id IN ? AND bookings.status = ?", bookingIDs, BookingConfirmed).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("could not get vehicles of bookings, err : %s", err)
+	}
+	vehicles := make(map[uuid.UUID]Vehicle, len(rows))
+	for _, r := range rows {
+		vehicles[r.BookingID] = r.Vehicle
+	}
+	return vehicles, nil
+}
+
+func init() {
+	registerPersonalData("vehicles", []string{"vehicles"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.vehicles.GetVehiclesByOwner(userID)
+	})
+}
+
+func validateVehicle(vehicle Vehicle) error {
+	if vehicle.Make == "" || vehicle.Model == "" || vehicle.Plate == "" {
+		return fmt.Errorf("%w : make, model and plate are required", ErrInvalidVehicle)
+	}
+	if vehicle.Seats < 2 || vehicle.Seats > 9 {
+		return fmt.Errorf("%w : seats must be between 2 and 9", ErrInvalidVehicle)
+	}
+	for _, option := range vehicle.Comfort {
+		if !slices.Contains(ComfortOptions, option) {
+			return fmt.Errorf("%w : unknown comfort option %s", ErrInvalidVehicle, option)
+		}
+	}
+	if vehicle.Fuel != "" && !slices.Contains(VehicleFuels, vehicle.Fuel) {
+		return fmt.Errorf("%w : unknown fuel %s", ErrInvalidVehicle, vehicle.Fuel)
+	}
+	if vehicle.Consumption < 0 || vehicle.Consumption > 50 {
+		return fmt.Errorf("%w : consumption must be between 0 and 50 per 100 km", ErrInvalidVehicle)
+	}
+	return nil
+}
+
+// normalizePlate uppercases a plate and drops its separators so that
+// "ab-123-cd" and "AB 123 CD" are the same car.
+func normalizePlate(plate string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(plate)))
+}
+
+func (service *CovoitService) CreateVehicle(ownerID uuid.UUID, vehicle Vehicle) (Vehicle, error) {
+	vehicle.VehicleID = uuid.Nil
+	vehicle.OwnerID = ownerID
+	vehicle.Plate = normalizePlate(vehicle.Plate)
+	if err := validateVehicle(vehicle); err != nil {
+		return Vehicle{}, err
+	}
+	return service.vehicles.CreateVehicle(vehicle)
+}
+
+func (service *CovoitService) GetVehicleById(vehicleID uuid.UUID) (Vehicle, error) {
+	return service.vehicles.GetVehicleById(vehicleID)
+}
+
+func (service *CovoitService) GetVehiclesByOwner(ownerID uuid.UUID) ([]Vehicle, error) {
+	return service.vehicles.GetVehiclesByOwner(ownerID)
+}
+
+func (service *CovoitService) DeleteVehicle(vehicleID uuid.UUID) error {
+	return service.vehicles.DeleteVehicle(vehicleID)
+}
+
+// checkRideVehicle makes sure the vehicle of ride, when there is one, belongs
+// to its driver and has room for the seats offered.
+func (service *CovoitService) checkRideVehicle(ride Ride) error {
+	if ride.VehicleID == nil {
+		return nil
+	}
+	vehicle, err := service.vehicles.GetVehicleById(*ride.VehicleID)
+	if err != nil || vehicle.OwnerID != ride.DriverID {
+		return fmt.Errorf("%w : vehicle %s is not registered to the driver", ErrInvalidVehicle, *ride.VehicleID)
+	}
+	if ride.NumberOfSeats > vehicle.PassengerCapacity() {
+		return ErrTooManySeats
+	}
+	return nil
+}
+
+// withBookingVehicles attaches the vehicle of the ride to the confirmed
+// bookings, the car is only disclosed once a seat is secured.
+func (service *CovoitService) withBookingVehicles(bookings []Booking) ([]Booking, error) {
+	bookingIDs := make([]uuid.UUID, len(bookings))
+	for i, booking := range bookings {
+		bookingIDs[i] = booking.BookingID
+	}
+	vehicles, err := service.vehicles.GetBookingVehicles(bookingIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range bookings {
+		if vehicle, ok := vehicles[bookings[i].BookingID]; ok && bookings[i].Status == BookingConfirmed {
+			bookings[i].Vehicle = &vehicle
+		}
+	}
+	return bookings, nil
+}
+
+func (h *Handler) VehiclesHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			ownerID := actor.UserID
+			if idStr := r.URL.Query().Get("user_id"); idStr != "" {
+				userID, err := uuid.Parse(idStr)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				ownerID = userID
+			}
+			if !Authorize(actor, ActionManageVehicle, Resource{OwnerID: ownerID}) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			vehicles, err := h.Service.GetVehiclesByOwner(ownerID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(vehicles)
+		}
+	case http.MethodPost:
+		{
+			newVehicle := Vehicle{}
+			err := json.NewDecoder(r.Body).Decode(&newVehicle)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			vehicle, err := h.Service.CreateVehicle(actor.UserID, newVehicle)
+			if errors.Is(err, ErrInvalidVehicle) {
+				w.WriteHeader(http.StatusBadRequest)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(vehicle)
+			}
+		}
+	case http.MethodDelete:
+		{
+			vehicleID, err := uuid.Parse(r.URL.Query().Get("vehicle_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			vehicle, err := h.Service.GetVehicleById(vehicleID)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if !Authorize(actor, ActionManageVehicle, Resource{OwnerID: vehicle.OwnerID}) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			err = h.Service.DeleteVehicle(vehicleID)
+			if errors.Is(err, ErrVehicleInUse) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) CreateVehicle(vehicle Vehicle) (Vehicle, error) {
+	vehicle.VehicleID = uuid.New()
+	m.DB.Vehicles = append(m.DB.Vehicles, vehicle)
+	return vehicle, nil
+}
+
+func (m *MockRepository) GetVehicleById(vehicleID uuid.UUID) (Vehicle, error) {
+	for _, vehicle := range m.DB.Vehicles {
+		if vehicle.VehicleID == vehicleID {
+			return vehicle, nil
+		}
+	}
+	return Vehicle{}, ErrInvalidVehicle
+}
+
+func (m *MockRepository) GetVehiclesByOwner(ownerID uuid.UUID) ([]Vehicle, error) {
+	vehicles := []Vehicle{}
+	for _, vehicle := range m.DB.Vehicles {
+		if vehicle.OwnerID == ownerID {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	return vehicles, nil
+}
+
+func (m *MockRepository) DeleteVehicle(vehicleID uuid.UUID) error {
+	usedBy := func(ride Ride) bool { return ride.VehicleID != nil && *ride.VehicleID == vehicleID }
+	if slices.ContainsFunc(m.DB.Rides, usedBy) || slices.ContainsFunc(m.DB.DeletedRides, usedBy) {
+		return ErrVehicleInUse
+	}
+	for i, vehicle := range m.DB.Vehicles {
+		if vehicle.VehicleID == vehicleID {
+			m.DB.Vehicles = append(m.DB.Vehicles[:i], m.DB.Vehicles[i+1:]...)
+			return nil
+		}
+	}
+	return ErrInvalidVehicle
+}
+
+func (m *MockRepository) GetBookingVehicles(bookingIDs []uuid.UUID) (map[uuid.UUID]Vehicle, error) {
+	vehicles := map[uuid.UUID]Vehicle{}
+	for _, booking := range m.DB.Bookings {
+		if !slices.Contains(bookingIDs, booking.BookingID) || booking.Status != BookingConfirmed {
+			continue
+		}
+		ride, err := m.GetRideById(booking.RideID)
+		if err != nil || ride.VehicleID == nil {
+			continue
+		}
+		if vehicle, err := m.GetVehicleById(*ride.VehicleID); err == nil {
+			vehicles[booking.BookingID] = vehicle
+		}
+	}
+	return vehicles, nil
+}
+
+func TestCreateVehicle(t *testing.T) {
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	ownerID := uuid.New()
+
+	for _, vehicle := range []Vehicle{
+		{Model: "Clio", Plate: "AB-123-CD", Seats: 5},
+		{Make: "Renault", Model: "Clio", Seats: 5},
+		{Make: "Renault", Model: "Clio", Plate: "AB-123-CD", Seats: 1},
+		{Make: "Renault", Model: "Clio", Plate: "AB-123-CD", Seats: 5, Comfort: []string{"jacuzzi"}},
+		{Make: "Renault", Model: "Clio", Plate: "AB-123-CD", Seats: 5, Fuel: "coal"},
+		{Make: "Renault", Model: "Clio", Plate: "AB-123-CD", Seats: 5, Consumption: -1},
+	} {
+		_, err := s.CreateVehicle(ownerID, vehicle)
+		require.ErrorIs(t, err, ErrInvalidVehicle)
+	}
+
+	vehicle, err := s.CreateVehicle(ownerID, Vehicle{OwnerID: uuid.New(), Make: "Renault", Model: "Clio", Plate: " ab-123 cd", Seats: 5, Comfort: []string{"air_conditioning"}})
+	require.NoError(t, err)
+	require.Equal(t, ownerID, vehicle.OwnerID)
+	require.Equal(t, "AB123CD", vehicle.Plate)
+	require.Equal(t, 4, vehicle.PassengerCapacity())
+}
+
+func TestRideVehicle(t *testing.T) {
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	passengerID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	vehicle, err := s.CreateVehicle(driverID, Vehicle{Make: "Peugeot", Model: "208", Plate: "EF-456-GH", Seats: 4})
+	require.NoError(t, err)
+	other, err := s.CreateVehicle(passengerID, Vehicle{Make: "Fiat", Model: "500", Plate: "IJ-789-KL", Seats: 4})
+	require.NoError(t, err)
+
+	_, err = s.CreateRide(Ride{DriverID: driverID, VehicleID: &other.VehicleID, NumberOfSeats: 2})
+	require.ErrorIs(t, err, ErrInvalidVehicle)
+	_, err = s.CreateRide(Ride{DriverID: driverID, VehicleID: &vehicle.VehicleID, NumberOfSeats: 4})
+	require.ErrorIs(t, err, ErrTooManySeats)
+	ride, err := s.CreateRide(Ride{RideID: uuid.New(), DriverID: driverID, VehicleID: &vehicle.VehicleID, NumberOfSeats: 3})
+	require.NoError(t, err)
+
+	confirmed := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, Status: BookingConfirmed}
+	cancelled := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, Status: BookingCancelled}
+	db.Bookings = append(db.Bookings, confirmed, cancelled)
+
+	bookings, err := s.GetBookingsForUser(passengerID)
+	require.NoError(t, err)
+	require.Len(t, bookings, 2)
+	for _, booking := range bookings {
+		if booking.BookingID == confirmed.BookingID {
+			require.Equal(t, &vehicle, booking.Vehicle)
+		} else {
+			require.Nil(t, booking.Vehicle)
+		}
+	}
+
+	rides, err := s.GetAllRides()
+	require.NoError(t, err)
+	body, err := json.Marshal(rides)
+	require.NoError(t, err)
+	require.NotContains(t, string(body), vehicle.Plate)
+
+	require.ErrorIs(t, s.DeleteVehicle(vehicle.VehicleID), ErrVehicleInUse)
+	require.NoError(t, s.DeleteRide(ride.RideID, driverID))
+	require.ErrorIs(t, s.DeleteVehicle(vehicle.VehicleID), ErrVehicleInUse, "the ride can be restored")
+	require.NoError(t, s.DeleteVehicle(other.VehicleID))
+}
+
+func TestVehiclesHandler(t *testing.T) {
+	owner := Actor{UserID: uuid.New(), Role: RoleDriver}
+	stranger := Actor{UserID: uuid.New(), Role: RolePassenger}
+	vehicle := Vehicle{VehicleID: uuid.New(), OwnerID: owner.UserID, Make: "Renault", Model: "Clio", Plate: "AB123CD", Seats: 5}
+	body, _ := json.Marshal(vehicle)
+
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("CreateVehicle", owner.UserID, mock.Anything).Return(vehicle, nil).Once()
+	mockSvc.On("CreateVehicle", owner.UserID, mock.Anything).Return(Vehicle{}, ErrInvalidVehicle).Once()
+	mockSvc.On("GetVehiclesByOwner", owner.UserID).Return([]Vehicle{vehicle}, nil)
+	mockSvc.On("GetVehicleById", vehicle.VehicleID).Return(vehicle, nil)
+	mockSvc.On("DeleteVehicle", vehicle.VehicleID).Return(nil).Once()
+	mockSvc.On("DeleteVehicle", vehicle.VehicleID).Return(ErrVehicleInUse).Once()
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		actor  Actor
+		status int
+	}{
+		{"register", http.MethodPost, "/vehicles", owner, http.StatusCreated},
+		{"invalid", http.MethodPost, "/vehicles", owner, http.StatusBadRequest},
+		{"list own", http.MethodGet, "/vehicles", owner, http.StatusOK},
+		{"list someone else's", http.MethodGet, "/vehicles?user_id=" + owner.UserID.String(), stranger, http.StatusForbidden},
+		{"delete someone else's", http.MethodDelete, "/vehicles?vehicle_id=" + vehicle.VehicleID.String(), stranger, http.StatusForbidden},
+		{"delete own", http.MethodDelete, "/vehicles?vehicle_id=" + vehicle.VehicleID.String(), owner, http.StatusNoContent},
+		{"delete one in use", http.MethodDelete, "/vehicles?vehicle_id=" + vehicle.VehicleID.String(), owner, http.StatusConflict},
+	} {
+		req := asActor(httptest.NewRequest(tc.method, tc.url, bytes.NewBuffer(body)), tc.actor)
+		w := httptest.NewRecorder()
+		h.VehiclesHandler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/vehicles", nil)
+	w := httptest.NewRecorder()
+	h.VehiclesHandler(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
+
+func TestRidesHandler_PostTooManySeats(t *testing.T) {
+	driver := Actor{UserID: uuid.New(), Role: RoleDriver}
+	ride := Ride{DriverID: driver.UserID, NumberOfSeats: 8}
+	body, _ := json.Marshal(ride)
+
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("CreateRide", mock.Anything).Return(Ride{}, ErrTooManySeats)
+	req := asActor(httptest.NewRequest(http.MethodPost, "/rides", bytes.NewBuffer(body)), driver)
+	w := httptest.NewRecorder()
+	h.RidesHandler(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	emailVerificationTTL = 24 * time.Hour
+	emailResendInterval  = time.Minute
+	emailResendLimit     = 5
+)
+
+var (
+	ErrInvalidToken     = errors.New("invalid or expired token")
+	ErrTooManyRequests  = errors.New("too many requests")
+	ErrEmailNotVerified = errors.New("email not verified")
+)
+
+type EmailVerification struct {
+	VerificationID uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"verification_id"`
+	UserID         uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	// Email is the address the token was sent to, the only one it confirms.
+	Email     string     `json:"email"`
+	TokenHash string     `gorm:"uniqueIndex" json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+type VerificationRepository interface {
+	CreateEmailVerification(verification EmailVerification) (EmailVerification, error)
+	GetEmailVerificationByTokenHash(tokenHash string) (EmailVerification, error)
+	GetEmailVerificationsSince(userID uuid.UUID, since time.Time) ([]EmailVerification, error)
+	GetEmailVerificationsByUser(userID uuid.UUID) ([]EmailVerification, error)
+	// ConfirmEmail returns ErrInvalidToken when email is no longer the
+	// address of the user.
+	ConfirmEmail(userID uuid.UUID, email string, at time.Time) error
+
+	CreatePhoneVerification(verification PhoneVerification) (PhoneVerification, error)
+	GetPhoneVerificationsSince(userID uuid.UUID, since time.Time) ([]PhoneVerification, error)
+	GetPhoneVerificationsByUser(userID uuid.UUID) ([]PhoneVerification, error)
+	ConsumePhoneVerificationAttempt(verificationID uuid.UUID, maxAttempts int) (bool, error)
+	ConfirmPhone(userID uuid.UUID, verificationID uuid.UUID, phone string, at time.Time) error
+}
+
+// generateToken returns a random token to hand out to the user and the hash
+// we keep in database.
+func generateToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("could not generate token, err : %s", err)
+	}
+	token := hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (repository *CovoitRepository) CreateEmailVerification(verification EmailVerification) (EmailVerification, error) {
+	ctx := context.Background()
+	err := gorm.G[EmailVerification](repository.db).Create(ctx, &verification)
+	if err != nil {
+		return EmailVerification{}, fmt.Errorf("could not create email verification for user %s, err : %s", verification.UserID, err)
+	}
+	return verification, nil
+}
+
+func (repository *CovoitRepository) GetEmailVerificationByTokenHash(tokenHash string) (EmailVerification, error) {
+	ctx := context.Background()
+	verification, err := gorm.G[EmailVerification](repository.db).Where("token_hash = ?", tokenHash).First(ctx)
+	if err != nil {
+		return EmailVerification{}, fmt.Errorf("could not retrieve email verification, err : %s", err)
+	}
+	return verification, nil
+}
+
+func (repository *CovoitRepository) GetEmailVerificationsSince(userID uuid.UUID, since time.Time) ([]EmailVerification, error) {
+	ctx := context.Background()
+	verifications, err := gorm.G[EmailVerification](repository.db).
+		Where("user_id = ? AND created_at >= ?", userID, since).
+		Order("created_at DESC").
+		Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve email verifications of user %s, err : %s", userID, err)
+	}
+	return verifications, nil
+}
+
+func (repository *CovoitRepository) GetEmailVerificationsByUser(userID uuid.UUID) ([]EmailVerification, error) {
+	ctx := context.Background()
+	verifications, err := gorm.G[EmailVerification](repository.db).Where("user_id = ?", userID).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get email verifications of user %s, err : %s", userID, err)
+	}
+	return verifications, nil
+}
+
+func init() {
+	registerPersonalData("email_verifications", []string{"email_verifications"}, func(service *CovoitService, userID uuid.UUID) (any, error) {
+		return service.verifications.GetEmailVerificationsByUser(userID)
+	})
+}
+
+// ConfirmEmail marks the user email as verified and burns every pending token.
+func (repository *CovoitRepository) ConfirmEmail(userID uuid.UUID, email string, at time.Time) error {
+	return repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		rows, err := gorm.G[User](tx).Where("user_id = ? AND email = ?", userID, email).Update(ctx, "email_verified_at", at)
+		if err != nil {
+			return fmt.Errorf("could not verify email of user %s, err : %s", userID, err)
+		}
+		if rows == 0 {
+			return ErrInvalidToken
+		}
+		_, err = gorm.G[EmailVerification](tx).Where("user_id = ? AND used_at IS NULL", userID).Update(ctx, "used_at", at)
+		if err != nil {
+			return fmt.Errorf("could not consume email verifications of user %s, err : %s", userID, err)
+		}
+		return nil
+	})
+}
+
+func (service *CovoitService) sendEmailVerification(user User) error {
+	token, tokenHash, err := generateToken()
+	if err != nil {
+		return err
+	}
+	now := service.clock()
+	_, err = service.verifications.CreateEmailVerification(EmailVerification{
+		UserID:    user.UserID,
+		Email:     user.Email,
+		TokenHash: tokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(emailVerificationTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return service.mailer.Send(Mail{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nPlease confirm your email address by opening the following link :\n%s/users/verify-email?token=%s\n\nThis link expires in 24 hours.",
+			user.FirstName, appURL, token),
+	})
+}
+
+func (service *CovoitService) VerifyEmail(token string) error {
+	verification, err := service.verifications.GetEmailVerificationByTokenHash(hashToken(token))
+	if err != nil {
+		return ErrInvalidToken
+	}
+	now := service.clock()
+	if verification.UsedAt != nil || !now.Before(verification.ExpiresAt) {
+		return ErrInvalidToken
+	}
+	return service.verifications.ConfirmEmail(verification.UserID, verification.Email, now)
+}
+
+// ResendEmailVerification sends a new token unless one was sent too recently.
+// Unknown and already verified emails are silently ignored so that callers
+// cannot probe which addresses are registered.
+func (service *CovoitService) ResendEmailVerification(email string) error {
+	user, err := service.repository.GetUserByEmail(email)
+	if err != nil || user.EmailVerifiedAt != nil {
+		return nil
+	}
+	now := service.clock()
+	recent, err := service.verifications.GetEmailVerificationsSince(user.UserID, now.Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	if len(recent) >= emailResendLimit {
+		return ErrTooManyRequests
+	}
+	for _, verification := range recent {
+		if now.Sub(verification.CreatedAt) < emailResendInterval {
+			return ErrTooManyRequests
+		}
+	}
+	return service.sendEmailVerification(user)
+}
+
+func (service *CovoitService) requireVerifiedEmail(userID uuid.UUID) error {
+	user, err := service.repository.GetUserById(userID)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerifiedAt == nil {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+func logMailError(err error) {
+	if err != nil {
+		log.Println("could not send mail, err :", err)
+	}
+}
+
+// EmailVerificationHandler confirms an email address from the token posted,
+// or from the link of the verification email opened in a browser.
+func (h *Handler) EmailVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.verifyEmailLink(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body := struct {
+		Token string `json:"token"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = h.Service.VerifyEmail(body.Token)
+	if errors.Is(err, ErrInvalidToken) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) verifyEmailLink(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "This link is incomplete.", http.StatusBadRequest)
+		return
+	}
+	err := h.Service.VerifyEmail(token)
+	if errors.Is(err, ErrInvalidToken) {
+		http.Error(w, "This link is invalid or has expired, you can ask for a new one.", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "Your email address is confirmed, you can close this page.")
+}
+
+func (h *Handler) ResendEmailVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body := struct {
+		Email string `json:"email"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = h.Service.ResendEmailVerification(body.Email)
+	if errors.Is(err, ErrTooManyRequests) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) CreateEmailVerification(verification EmailVerification) (EmailVerification, error) {
+	verification.VerificationID = uuid.New()
+	m.DB.EmailVerifications = append(m.DB.EmailVerifications, verification)
+	return verification, nil
+}
+
+func (m *MockRepository) GetEmailVerificationByTokenHash(tokenHash string) (EmailVerification, error) {
+	for _, verification := range m.DB.EmailVerifications {
+		if verification.TokenHash == tokenHash {
+			return verification, nil
+		}
+	}
+	return EmailVerification{}, fmt.Errorf("email verification not found")
+}
+
+func (m *MockRepository) GetEmailVerificationsSince(userID uuid.UUID, since time.Time) ([]EmailVerification, error) {
+	verifications := []EmailVerification{}
+	for _, verification := range m.DB.EmailVerifications {
+		if verification.UserID == userID && !verification.CreatedAt.Before(since) {
+			verifications = append(verifications, verification)
+		}
+	}
+	return verifications, nil
+}
+
+func (m *MockRepository) ConfirmEmail(userID uuid.UUID, email string, at time.Time) error {
+	i := slices.IndexFunc(m.DB.Users, func(user User) bool { return user.UserID == userID && user.Email == email })
+	if i < 0 {
+		return ErrInvalidToken
+	}
+	m.DB.Users[i].EmailVerifiedAt = &at
+	for i := range m.DB.EmailVerifications {
+		if m.DB.EmailVerifications[i].UserID == userID && m.DB.EmailVerifications[i].UsedAt == nil {
+			m.DB.EmailVerifications[i].UsedAt = &at
+		}
+	}
+	return nil
+}
+
+func (m *MockRepository) GetEmailVerificationsByUser(userID uuid.UUID) ([]EmailVerification, error) {
+	found := []EmailVerification{}
+	for _, emailVerification := range m.DB.EmailVerifications {
+		if emailVerification.UserID == userID {
+			found = append(found, emailVerification)
+		}
+	}
+	return found, nil
+}
+
+// tokenFromMail extracts the verification token from the link of a mail.
+func tokenFromMail(t *testing.T, mail Mail) string {
+	t.Helper()
+	_, token, found := strings.Cut(mail.Body, "token=")
+	require.True(t, found, "no token in mail %q", mail.Body)
+	return strings.Fields(token)[0]
+}
+
+func TestEmailVerification(t *testing.T) {
+	now := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	s := NewMockService(db)
+	s.mailer = mailer
+	s.now = func() time.Time { return now }
+
+	user, err := s.CreateNewUser(User{UserID: uuid.New(), FirstName: "Amel", Email: "amel@test.com"})
+	require.NoError(t, err)
+	mail, ok := mailer.Last()
+	require.True(t, ok)
+	require.Equal(t, "amel@test.com", mail.To)
+	require.Contains(t, mail.Body, appURL+"/users/verify-email?token=", "the link opens EmailVerificationHandler")
+	token := tokenFromMail(t, mail)
+
+	t.Run("unverified user cannot publish nor book", func(t *testing.T) {
+		_, err := s.CreateRide(Ride{DriverID: user.UserID})
+		require.ErrorIs(t, err, ErrEmailNotVerified)
+		_, err = s.CreateBooking(Booking{UserID: user.UserID})
+		require.ErrorIs(t, err, ErrEmailNotVerified)
+	})
+
+	t.Run("resend is throttled", func(t *testing.T) {
+		require.ErrorIs(t, s.ResendEmailVerification(user.Email), ErrTooManyRequests)
+		now = now.Add(emailResendInterval)
+		require.NoError(t, s.ResendEmailVerification(user.Email))
+		require.Len(t, mailer.Sent, 2)
+	})
+
+	t.Run("resend ignores unknown emails", func(t *testing.T) {
+		require.NoError(t, s.ResendEmailVerification("nobody@test.com"))
+		require.Len(t, mailer.Sent, 2)
+	})
+
+	t.Run("confirm marks the email verified", func(t *testing.T) {
+		require.NoError(t, s.VerifyEmail(token))
+		got, err := s.GetUserById(user.UserID)
+		require.NoError(t, err)
+		require.NotNil(t, got.EmailVerifiedAt)
+
+		_, err = s.CreateRide(Ride{DriverID: user.UserID})
+		require.NoError(t, err)
+	})
+
+	t.Run("token is single use", func(t *testing.T) {
+		require.ErrorIs(t, s.VerifyEmail(token), ErrInvalidToken)
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		require.ErrorIs(t, s.VerifyEmail("deadbeef"), ErrInvalidToken)
+	})
+}
+
+func TestEmailVerificationAfterEmailChange(t *testing.T) {
+	now := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	s := NewMockService(db)
+	s.mailer = mailer
+	s.now = func() time.Time { return now }
+
+	user, err := s.CreateNewUser(User{UserID: uuid.New(), FirstName: "Amel", Email: "amel@test.com"})
+	require.NoError(t, err)
+	mail, _ := mailer.Last()
+	token := tokenFromMail(t, mail)
+
+	user.Email = "someone.else@test.com"
+	_, err = s.UpdateUser(user)
+	require.NoError(t, err)
+	require.ErrorIs(t, s.VerifyEmail(token), ErrInvalidToken, "a token only confirms the address it was sent to")
+	got, err := s.GetUserById(user.UserID)
+	require.NoError(t, err)
+	require.Nil(t, got.EmailVerifiedAt)
+
+	mail, _ = mailer.Last()
+	require.Equal(t, "someone.else@test.com", mail.To)
+	require.NoError(t, s.VerifyEmail(tokenFromMail(t, mail)))
+}
+
+func TestEmailVerificationExpiry(t *testing.T) {
+	now := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	mailer := &MemoryMailer{}
+	s := NewMockService(db)
+	s.mailer = mailer
+	s.now = func() time.Time { return now }
+
+	_, err := s.CreateNewUser(User{UserID: uuid.New(), Email: "late@test.com"})
+	require.NoError(t, err)
+	mail, _ := mailer.Last()
+
+	now = now.Add(emailVerificationTTL)
+	require.ErrorIs(t, s.VerifyEmail(tokenFromMail(t, mail)), ErrInvalidToken)
+}
+
+func TestResendEmailVerificationLimit(t *testing.T) {
+	now := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+
+	user, err := s.CreateNewUser(User{UserID: uuid.New(), Email: "spam@test.com"})
+	require.NoError(t, err)
+	for range emailResendLimit - 1 {
+		now = now.Add(emailResendInterval)
+		require.NoError(t, s.ResendEmailVerification(user.Email))
+	}
+	now = now.Add(emailResendInterval)
+	require.ErrorIs(t, s.ResendEmailVerification(user.Email), ErrTooManyRequests)
+
+	now = now.Add(time.Hour)
+	require.NoError(t, s.ResendEmailVerification(user.Email))
+}
+
+func TestEmailVerificationHandler(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("VerifyEmail", "good").Return(nil)
+	mockSvc.On("VerifyEmail", "bad").Return(ErrInvalidToken)
+
+	req := httptest.NewRequest(http.MethodPost, "/users/verify-email", bytes.NewBufferString(`{"token":"good"}`))
+	w := httptest.NewRecorder()
+	h.EmailVerificationHandler(w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodPost, "/users/verify-email", bytes.NewBufferString(`{"token":"bad"}`))
+	w = httptest.NewRecorder()
+	h.EmailVerificationHandler(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodPost, "/users/verify-email", bytes.NewBufferString(`bad`))
+	w = httptest.NewRecorder()
+	h.EmailVerificationHandler(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"?token=good", http.StatusOK},
+		{"?token=bad", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	} {
+		w = httptest.NewRecorder()
+		h.EmailVerificationHandler(w, httptest.NewRequest(http.MethodGet, "/users/verify-email"+tc.query, nil))
+		require.Equal(t, tc.status, w.Result().StatusCode, "link %s", tc.query)
+	}
+}
+
+func TestResendEmailVerificationHandler(t *testing.T) {
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("ResendEmailVerification", "a@test.com").Return(nil)
+	mockSvc.On("ResendEmailVerification", "b@test.com").Return(ErrTooManyRequests)
+	mockSvc.On("ResendEmailVerification", "c@test.com").Return(errors.New("fail"))
+
+	for email, status := range map[string]int{
+		"a@test.com": http.StatusAccepted,
+		"b@test.com": http.StatusTooManyRequests,
+		"c@test.com": http.StatusInternalServerError,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/users/verify-email/resend", bytes.NewBufferString(`{"email":"`+email+`"}`))
+		w := httptest.NewRecorder()
+		h.ResendEmailVerificationHandler(w, req)
+		require.Equal(t, status, w.Result().StatusCode, email)
+	}
+}
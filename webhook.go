@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	WebhookRideCreated      = "ride.created"
+	WebhookRideCancelled    = "ride.cancelled"
+	WebhookBookingCreated   = "booking.created"
+	WebhookBookingApproved  = "booking.approved"
+	WebhookBookingCancelled = "booking.cancelled"
+)
+
+var WebhookEvents = []string{WebhookRideCreated, WebhookRideCancelled, WebhookBookingCreated, WebhookBookingApproved, WebhookBookingCancelled}
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	// WebhookDeliveryDead is a delivery given up on after too many failed
+	// attempts, an admin may redeliver it.
+	WebhookDeliveryDead = "dead"
+)
+
+const (
+	// The headers of a delivery. The signature is the hex encoded
+	// HMAC-SHA256, keyed with the secret of the webhook, of the timestamp, a
+	// dot and the body : "t=<unix timestamp>,v1=<signature>".
+	WebhookSignatureHeader = "X-Covoit-Signature"
+	WebhookEventHeader     = "X-Covoit-Event"
+	WebhookDeliveryHeader  = "X-Covoit-Delivery"
+)
+
+const (
+	webhookBatchSize   = 50
+	webhookMaxAttempts = 8
+	// webhookBackoff is the wait after the first failed attempt, it doubles
+	// with every attempt.
+	webhookBackoff = time.Minute
+	// webhookLease is how long a claimed delivery is kept from the other
+	// dispatchers, it outlasts webhookTimeout.
+	webhookLease   = 5 * time.Minute
+	webhookTimeout = 10 * time.Second
+	// webhookErrorLength caps the response body kept in the delivery log.
+	webhookErrorLength = 512
+	// WebhookDispatchInterval is how often the pending deliveries are polled.
+	WebhookDispatchInterval = 10 * time.Second
+)
+
+var (
+	ErrInvalidWebhook          = errors.New("invalid webhook")
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+// Webhook is an endpoint of a partner, called with the events it subscribed
+// to.
+type Webhook struct {
+	WebhookID uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"webhook_id"`
+	URL       string    `json:"url"`
+	Events    []string  `gorm:"type:jsonb;serializer:json" json:"events"`
+	// Secret signs the deliveries, it is only shown when the webhook is
+	// created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// WebhookDelivery is an event to post to a webhook. It is written in the
+// transaction of the operation it tells about, and kept once delivered as the
+// delivery log of the webhook.
+type WebhookDelivery struct {
+	DeliveryID     uuid.UUID       `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()" json:"delivery_id"`
+	WebhookID      uuid.UUID       `gorm:"type:uuid;index" json:"webhook_id"`
+	Event          string          `json:"event"`
+	Data           json.RawMessage `gorm:"type:jsonb;serializer:json" json:"data"`
+	Status         string          `gorm:"default:pending;index:idx_webhook_delivery_due,priority:1" json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `gorm:"default:CURRENT_TIMESTAMP;index:idx_webhook_delivery_due,priority:2" json:"next_attempt_at"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// WebhookPayload is the body posted to a webhook. The delivery id stays the
+// same across retries, so that receivers can ignore duplicates.
+type WebhookPayload struct {
+	DeliveryID uuid.UUID       `json:"delivery_id"`
+	Event      string          `json:"event"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// SignWebhook returns the signature of body sent at timestamp.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliveries returns the deliveries of event to the webhooks
+// subscribed to it.
+func webhookDeliveries(webhooks []Webhook, event string, data any) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	for _, webhook := range webhooks {
+		if !slices.Contains(webhook.Events, event) {
+			continue
+		}
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode %s event, err : %s", event, err)
+		}
+		deliveries = append(deliveries, WebhookDelivery{WebhookID: webhook.WebhookID, Event: event, Data: raw, Status: WebhookDeliveryPending})
+	}
+	return deliveries, nil
+}
+
+// publishWebhookEvent writes the deliveries of event within tx, they are sent
+// only if tx commits.
+func publishWebhookEvent(tx *gorm.DB, event string, data any) error {
+	ctx := context.Background()
+	webhooks, err := gorm.G[Webhook](tx).Where("events @> ?", fmt.Sprintf("[%q]", event)).Find(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get webhooks of %s, err : %s", event, err)
+	}
+	deliveries, err := webhookDeliveries(webhooks, event, data)
+	if err != nil || len(deliveries) == 0 {
+		return err
+	}
+	if err := gorm.G[WebhookDelivery](tx).CreateInBatches(ctx, &deliveries, len(deliveries)); err != nil {
+		return fmt.Errorf("could not enqueue %s deliveries, err : %s", event, err)
+	}
+	return nil
+}
+
+type WebhookRepository interface {
+	CreateWebhook(webhook Webhook) (Webhook, error)
+	GetWebhooks() ([]Webhook, error)
+	GetWebhookById(webhookID uuid.UUID) (Webhook, error)
+	// DeleteWebhook removes the webhook along with its delivery log.
+	DeleteWebhook(webhookID uuid.UUID) error
+	// ClaimWebhookDeliveries returns up to limit pending deliveries due at at,
+	// and keeps them from the other dispatchers for lease.
+	ClaimWebhookDeliveries(at time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	// SaveWebhookAttempt records the outcome of a delivery attempt.
+	SaveWebhookAttempt(delivery WebhookDelivery) error
+	// GetWebhookDeliveries returns the delivery log of the webhook, newest
+	// first.
+	GetWebhookDeliveries(webhookID uuid.UUID) ([]WebhookDelivery, error)
+	// RedeliverWebhook sends a delivery again, with a fresh set of attempts.
+	RedeliverWebhook(deliveryID uuid.UUID, at time.Time) error
+}
+
+func (repository *CovoitRepository) CreateWebhook(webhook Webhook) (Webhook, error) {
+	ctx := context.Background()
+	if err := gorm.G[Webhook](repository.db).Create(ctx, &webhook); err != nil {
+		return Webhook{}, fmt.Errorf("could not create webhook, err : %s", err)
+	}
+	return webhook, nil
+}
+
+func (repository *CovoitRepository) GetWebhooks() ([]Webhook, error) {
+	ctx := context.Background()
+	webhooks, err := gorm.G[Webhook](repository.db).Order("created_at").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get webhooks, err : %s", err)
+	}
+	return webhooks, nil
+}
+
+func (repository *CovoitRepository) GetWebhookById(webhookID uuid.UUID) (Webhook, error) {
+	ctx := context.Background()
+	webhook, err := gorm.G[Webhook](repository.db).Where("webhook_id = ?", webhookID).First(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Webhook{}, ErrWebhookNotFound
+	} else if err != nil {
+		return Webhook{}, fmt.Errorf("could not get webhook %s, err : %s", webhookID, err)
+	}
+	return webhook, nil
+}
+
+func (repository *CovoitRepository) DeleteWebhook(webhookID uuid.UUID) error {
+	ctx := context.Background()
+	rows, err := gorm.G[Webhook](repository.db).Where("webhook_id = ?", webhookID).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("could not delete webhook %s, err : %s", webhookID, err)
+	}
+	if rows == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (repository *CovoitRepository) ClaimWebhookDeliveries(at time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := repository.db.Transaction(func(tx *gorm.DB) error {
+		ctx := context.Background()
+		var err error
+		deliveries, err = gorm.G[WebhookDelivery](tx, clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", WebhookDeliveryPending, at).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(ctx)
+		if err != nil {
+			return fmt.Errorf("could not claim webhook deliveries, err : %s", err)
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+		ids := make([]uuid.UUID, len(deliveries))
+		for i, delivery := range deliveries {
+			ids[i] = delivery.DeliveryID
+		}
+		_, err = gorm.G[WebhookDelivery](tx).Where("delivery_id IN ?", ids).Update(ctx, "next_attempt_at", at.Add(lease))
+		if err != nil {
+			return fmt.Errorf("could not claim webhook deliveries, err : %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (repository *CovoitRepository) SaveWebhookAttempt(delivery WebhookDelivery) error {
+	ctx := context.Background()
+	_, err := gorm.G[WebhookDelivery](repository.db).
+		Where("delivery_id = ?", delivery.DeliveryID).
+		Select("status", "attempts", "next_attempt_at", "last_status_code", "last_error", "delivered_at").
+		Updates(ctx, delivery)
+	if err != nil {
+		return fmt.Errorf("could not save webhook delivery %s, err : %s", delivery.DeliveryID, err)
+	}
+	return nil
+}
+
+func (repository *CovoitRepository) GetWebhookDeliveries(webhookID uuid.UUID) ([]WebhookDelivery, error) {
+	ctx := context.Background()
+	deliveries, err := gorm.G[WebhookDelivery](repository.db).Where("webhook_id = ?", webhookID).Order("created_at DESC").Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get deliveries of webhook %s, err : %s", webhookID, err)
+	}
+	return deliveries, nil
+}
+
+func (repository *CovoitRepository) RedeliverWebhook(deliveryID uuid.UUID, at time.Time) error {
+	ctx := context.Background()
+	rows, err := gorm.G[WebhookDelivery](repository.db).
+		Where("delivery_id = ?", deliveryID).
+		Select("status", "attempts", "next_attempt_at").
+		Updates(ctx, WebhookDelivery{Status: WebhookDeliveryPending, NextAttemptAt: at})
+	if err != nil {
+		return fmt.Errorf("could not redeliver webhook delivery %s, err : %s", deliveryID, err)
+	}
+	if rows == 0 {
+		return ErrWebhookDeliveryNotFound
+	}
+	return nil
+}
+
+func init() {
+	// Webhooks belong to partners, their deliveries tell about rides and
+	// bookings which are exported on their own.
+	registerImpersonalTables("webhooks", "webhook_deliveries")
+	registerPeriodicJob("webhooks.dispatch", WebhookDispatchInterval, func(service *CovoitService, job Job) error {
+		_, err := service.DispatchWebhooks()
+		return err
+	})
+}
+
+func validateWebhook(webhook Webhook) error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w : url must be an absolute http(s) url", ErrInvalidWebhook)
+	}
+	if len(webhook.Events) == 0 {
+		return fmt.Errorf("%w : no events", ErrInvalidWebhook)
+	}
+	for _, event := range webhook.Events {
+		if !slices.Contains(WebhookEvents, event) {
+			return fmt.Errorf("%w : unknown event %s", ErrInvalidWebhook, event)
+		}
+	}
+	return nil
+}
+
+// CreateWebhook registers an endpoint and returns it with the secret its
+// deliveries are signed with.
+func (service *CovoitService) CreateWebhook(webhook Webhook) (Webhook, error) {
+	if err := validateWebhook(webhook); err != nil {
+		return Webhook{}, err
+	}
+	secret, _, err := generateToken()
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhook.WebhookID = uuid.Nil
+	webhook.Secret = secret
+	webhook.CreatedAt = service.clock()
+	return service.webhooks.CreateWebhook(webhook)
+}
+
+func (service *CovoitService) GetWebhooks() ([]Webhook, error) {
+	webhooks, err := service.webhooks.GetWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	return webhooks, nil
+}
+
+func (service *CovoitService) DeleteWebhook(webhookID uuid.UUID) error {
+	return service.webhooks.DeleteWebhook(webhookID)
+}
+
+func (service *CovoitService) GetWebhookDeliveries(webhookID uuid.UUID) ([]WebhookDelivery, error) {
+	if _, err := service.webhooks.GetWebhookById(webhookID); err != nil {
+		return nil, err
+	}
+	return service.webhooks.GetWebhookDeliveries(webhookID)
+}
+
+func (service *CovoitService) RedeliverWebhook(deliveryID uuid.UUID) error {
+	return service.webhooks.RedeliverWebhook(deliveryID, service.clock())
+}
+
+func (service *CovoitService) httpClient() *http.Client {
+	if service.webhookClient != nil {
+		return service.webhookClient
+	}
+	return &http.Client{Timeout: webhookTimeout}
+}
+
+// postWebhook sends delivery to webhook and returns the status code of the
+// response.
+func (service *CovoitService) postWebhook(webhook Webhook, delivery WebhookDelivery, now time.Time) (int, error) {
+	body, err := json.Marshal(WebhookPayload{DeliveryID: delivery.DeliveryID, Event: delivery.Event, CreatedAt: delivery.CreatedAt, Data: delivery.Data})
+	if err != nil {
+		return 0, fmt.Errorf("could not encode delivery, err : %s", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, delivery.DeliveryID.String())
+	req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, SignWebhook(webhook.Secret, timestamp, body)))
+	res, err := service.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		response, _ := io.ReadAll(io.LimitReader(res.Body, webhookErrorLength))
+		return res.StatusCode, fmt.Errorf("%s : %s", res.Status, response)
+	}
+	return res.StatusCode, nil
+}
+
+// deliverWebhook attempts delivery. A failed attempt is retried with an
+// exponential backoff until the delivery is dead.
+func (service *CovoitService) deliverWebhook(delivery WebhookDelivery, now time.Time) WebhookDelivery {
+	delivery.Attempts++
+	webhook, err := service.webhooks.GetWebhookById(delivery.WebhookID)
+	if err != nil {
+		delivery.Status = WebhookDeliveryDead
+		delivery.LastError = fmt.Sprintf("webhook not found : %s", err)
+		return delivery
+	}
+	delivery.LastStatusCode, err = service.postWebhook(webhook, delivery, now)
+	if err == nil {
+		delivery.Status = WebhookDeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+		return delivery
+	}
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= webhookMaxAttempts {
+		delivery.Status = WebhookDeliveryDead
+		log.Printf("giving up on webhook delivery %s after %d attempts : %s", delivery.DeliveryID, delivery.Attempts, delivery.LastError)
+		return delivery
+	}
+	delivery.NextAttemptAt = now.Add(webhookBackoff << (delivery.Attempts - 1))
+	return delivery
+}
+
+// DispatchWebhooks sends the due webhook deliveries and returns how many were
+// delivered.
+func (service *CovoitService) DispatchWebhooks() (int, error) {
+	now := service.clock()
+	deliveries, err := service.webhooks.ClaimWebhookDeliveries(now, webhookBatchSize, webhookLease)
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, delivery := range deliveries {
+		delivery = service.deliverWebhook(delivery, now)
+		if err := service.webhooks.SaveWebhookAttempt(delivery); err != nil {
+			return delivered, err
+		}
+		if delivery.Status == WebhookDeliveryDelivered {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+func (h *Handler) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManageWebhooks, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			webhooks, err := h.Service.GetWebhooks()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(webhooks)
+		}
+	case http.MethodPost:
+		{
+			var webhook Webhook
+			if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			webhook, err := h.Service.CreateWebhook(webhook)
+			if errors.Is(err, ErrInvalidWebhook) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(webhook)
+		}
+	case http.MethodDelete:
+		{
+			webhookID, err := uuid.Parse(r.URL.Query().Get("webhook_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err = h.Service.DeleteWebhook(webhookID)
+			if errors.Is(err, ErrWebhookNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// WebhookDeliveriesHandler shows the delivery log of a webhook and redelivers
+// one of its deliveries.
+func (h *Handler) WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := ActorFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !Authorize(actor, ActionManageWebhooks, Resource{}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			webhookID, err := uuid.Parse(r.URL.Query().Get("webhook_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			deliveries, err := h.Service.GetWebhookDeliveries(webhookID)
+			if errors.Is(err, ErrWebhookNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(deliveries)
+		}
+	case http.MethodPost:
+		{
+			deliveryID, err := uuid.Parse(r.URL.Query().Get("delivery_id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err = h.Service.RedeliverWebhook(deliveryID)
+			if errors.Is(err, ErrWebhookDeliveryNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
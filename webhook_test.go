@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *MockRepository) publish(event string, data any) {
+	deliveries, err := webhookDeliveries(m.DB.Webhooks, event, data)
+	if err != nil {
+		panic(err)
+	}
+	for _, delivery := range deliveries {
+		delivery.DeliveryID = uuid.New()
+		m.DB.WebhookDeliveries = append(m.DB.WebhookDeliveries, delivery)
+	}
+}
+
+func (m *MockRepository) CreateWebhook(webhook Webhook) (Webhook, error) {
+	webhook.WebhookID = uuid.New()
+	m.DB.Webhooks = append(m.DB.Webhooks, webhook)
+	return webhook, nil
+}
+
+func (m *MockRepository) GetWebhooks() ([]Webhook, error) {
+	return slices.Clone(m.DB.Webhooks), nil
+}
+
+func (m *MockRepository) GetWebhookById(webhookID uuid.UUID) (Webhook, error) {
+	for _, webhook := range m.DB.Webhooks {
+		if webhook.WebhookID == webhookID {
+			return webhook, nil
+		}
+	}
+	return Webhook{}, ErrWebhookNotFound
+}
+
+func (m *MockRepository) DeleteWebhook(webhookID uuid.UUID) error {
+	i := slices.IndexFunc(m.DB.Webhooks, func(webhook Webhook) bool { return webhook.WebhookID == webhookID })
+	if i < 0 {
+		return ErrWebhookNotFound
+	}
+	m.DB.Webhooks = slices.Delete(m.DB.Webhooks, i, i+1)
+	m.DB.WebhookDeliveries = slices.DeleteFunc(m.DB.WebhookDeliveries, func(delivery WebhookDelivery) bool { return delivery.WebhookID == webhookID })
+	return nil
+}
+
+func (m *MockRepository) ClaimWebhookDeliveries(at time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	for i, delivery := range m.DB.WebhookDeliveries {
+		if len(deliveries) == limit {
+			break
+		}
+		if delivery.Status != WebhookDeliveryPending || delivery.NextAttemptAt.After(at) {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+		m.DB.WebhookDeliveries[i].NextAttemptAt = at.Add(lease)
+	}
+	return deliveries, nil
+}
+
+func (m *MockRepository) SaveWebhookAttempt(delivery WebhookDelivery) error {
+	i := slices.IndexFunc(m.DB.WebhookDeliveries, func(d WebhookDelivery) bool { return d.DeliveryID == delivery.DeliveryID })
+	if i < 0 {
+		return ErrWebhookDeliveryNotFound
+	}
+	m.DB.WebhookDeliveries[i] = delivery
+	return nil
+}
+
+func (m *MockRepository) GetWebhookDeliveries(webhookID uuid.UUID) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range m.DB.WebhookDeliveries {
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	slices.Reverse(deliveries)
+	return deliveries, nil
+}
+
+func (m *MockRepository) RedeliverWebhook(deliveryID uuid.UUID, at time.Time) error {
+	for i, delivery := range m.DB.WebhookDeliveries {
+		if delivery.DeliveryID == deliveryID {
+			m.DB.WebhookDeliveries[i].Status = WebhookDeliveryPending
+			m.DB.WebhookDeliveries[i].Attempts = 0
+			m.DB.WebhookDeliveries[i].NextAttemptAt = at
+			return nil
+		}
+	}
+	return ErrWebhookDeliveryNotFound
+}
+
+// webhookReceiver is the endpoint of a partner, it answers with status and
+// keeps what it received.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(t *testing.T) (*webhookReceiver, *httptest.Server) {
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+		w.WriteHeader(receiver.status)
+		fmt.Fprint(w, http.StatusText(receiver.status))
+	}))
+	t.Cleanup(server.Close)
+	return receiver, server
+}
+
+func TestWebhooks(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	receiver, server := newWebhookReceiver(t)
+	driverID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+
+	for _, webhook := range []Webhook{
+		{URL: "ftp://partner.example/hook", Events: []string{WebhookRideCreated}},
+		{URL: "/hook", Events: []string{WebhookRideCreated}},
+		{URL: server.URL},
+		{URL: server.URL, Events: []string{"ride.updated"}},
+	} {
+		_, err := s.CreateWebhook(webhook)
+		require.ErrorIs(t, err, ErrInvalidWebhook, webhook)
+	}
+	webhook, err := s.CreateWebhook(Webhook{URL: server.URL, Events: []string{WebhookRideCreated, WebhookBookingCreated}})
+	require.NoError(t, err)
+	require.NotEmpty(t, webhook.Secret)
+	webhooks, err := s.GetWebhooks()
+	require.NoError(t, err)
+	require.Len(t, webhooks, 1)
+	require.Empty(t, webhooks[0].Secret, "the secret is only shown once")
+
+	ride, err := s.CreateRide(Ride{RideID: uuid.New(), DriverID: driverID, Origin: "Lyon", Destination: "Paris", DepartureTime: now.Add(24 * time.Hour)})
+	require.NoError(t, err)
+	require.Len(t, db.WebhookDeliveries, 1)
+	require.Empty(t, receiver.requests, "nothing leaves before the dispatcher runs")
+
+	delivered, err := s.DispatchWebhooks()
+	require.NoError(t, err)
+	require.Equal(t, 1, delivered)
+	require.Len(t, receiver.requests, 1)
+	req, body := receiver.requests[0], receiver.bodies[0]
+	delivery := db.WebhookDeliveries[0]
+	require.Equal(t, WebhookRideCreated, req.Header.Get(WebhookEventHeader))
+	require.Equal(t, delivery.DeliveryID.String(), req.Header.Get(WebhookDeliveryHeader))
+	require.Equal(t, fmt.Sprintf("t=%d,v1=%s", now.Unix(), SignWebhook(webhook.Secret, now.Unix(), body)), req.Header.Get(WebhookSignatureHeader))
+	require.NotEqual(t, SignWebhook("another secret", now.Unix(), body), SignWebhook(webhook.Secret, now.Unix(), body))
+	var payload WebhookPayload
+	require.NoError(t, json.Unmarshal(body, &payload))
+	require.Equal(t, delivery.DeliveryID, payload.DeliveryID)
+	require.Equal(t, WebhookRideCreated, payload.Event)
+	var data Ride
+	require.NoError(t, json.Unmarshal(payload.Data, &data))
+	require.Equal(t, ride.RideID, data.RideID)
+	require.Equal(t, WebhookDeliveryDelivered, delivery.Status)
+	require.Equal(t, http.StatusOK, delivery.LastStatusCode)
+
+	ride.Status = RideScheduled
+	db.Rides[len(db.Rides)-1] = ride
+	require.NoError(t, s.DeleteRide(ride.RideID, driverID))
+	require.Len(t, db.WebhookDeliveries, 1, "not subscribed to ride.cancelled")
+
+	require.NoError(t, s.DeleteWebhook(webhook.WebhookID))
+	require.ErrorIs(t, s.DeleteWebhook(webhook.WebhookID), ErrWebhookNotFound)
+	_, err = s.GetWebhookDeliveries(webhook.WebhookID)
+	require.ErrorIs(t, err, ErrWebhookNotFound)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := CreateNewMockDB(t)
+	s := NewMockService(db)
+	s.now = func() time.Time { return now }
+	receiver, server := newWebhookReceiver(t)
+	receiver.status = http.StatusServiceUnavailable
+	driverID := StringToUuid(t, "652c99d0-39a5-4797-97a6-09eba33f2bd7")
+	passengerID := StringToUuid(t, "90ed9f80-d22f-482a-8194-ec04cfeedcb2")
+	ride := Ride{RideID: uuid.New(), DriverID: driverID, Origin: "Lyon", Destination: "Paris", DepartureTime: now.Add(24 * time.Hour), Status: RideScheduled}
+	booking := Booking{BookingID: uuid.New(), RideID: ride.RideID, UserID: passengerID, Status: BookingConfirmed}
+	db.Rides = append(db.Rides, ride)
+	db.Bookings = append(db.Bookings, booking)
+	webhook, err := s.CreateWebhook(Webhook{URL: server.URL, Events: []string{WebhookBookingCancelled}})
+	require.NoError(t, err)
+
+	require.NoError(t, s.DeleteBooking(booking.BookingID, passengerID))
+	require.Len(t, db.WebhookDeliveries, 1)
+	delivered, err := s.DispatchWebhooks()
+	require.NoError(t, err)
+	require.Zero(t, delivered)
+	delivery := db.WebhookDeliveries[0]
+	require.Equal(t, WebhookDeliveryPending, delivery.Status)
+	require.Equal(t, 1, delivery.Attempts)
+	require.Equal(t, http.StatusServiceUnavailable, delivery.LastStatusCode)
+	require.Contains(t, delivery.LastError, "Service Unavailable")
+	require.Equal(t, now.Add(time.Minute), delivery.NextAttemptAt)
+
+	_, err = s.DispatchWebhooks()
+	require.NoError(t, err)
+	require.Len(t, receiver.requests, 1, "not due yet")
+	for attempt := 2; attempt <= webhookMaxAttempts; attempt++ {
+		now = db.WebhookDeliveries[0].NextAttemptAt
+		_, err = s.DispatchWebhooks()
+		require.NoError(t, err)
+		require.Equal(t, attempt, db.WebhookDeliveries[0].Attempts)
+		if attempt == 2 {
+			require.Equal(t, now.Add(2*time.Minute), db.WebhookDeliveries[0].NextAttemptAt, "the backoff doubles")
+		}
+	}
+	require.Equal(t, WebhookDeliveryDead, db.WebhookDeliveries[0].Status)
+	require.Len(t, receiver.requests, webhookMaxAttempts)
+	for _, req := range receiver.requests {
+		require.Equal(t, delivery.DeliveryID.String(), req.Header.Get(WebhookDeliveryHeader), "retries keep the delivery id")
+	}
+
+	receiver.status = http.StatusNoContent
+	require.NoError(t, s.RedeliverWebhook(delivery.DeliveryID))
+	require.ErrorIs(t, s.RedeliverWebhook(uuid.New()), ErrWebhookDeliveryNotFound)
+	delivered, err = s.DispatchWebhooks()
+	require.NoError(t, err)
+	require.Equal(t, 1, delivered)
+	deliveries, err := s.GetWebhookDeliveries(webhook.WebhookID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, WebhookDeliveryDelivered, deliveries[0].Status)
+	require.Equal(t, 1, deliveries[0].Attempts)
+	require.Empty(t, deliveries[0].LastError)
+
+	require.NoError(t, s.RedeliverWebhook(delivery.DeliveryID), "a delivered delivery can be sent again")
+	_, err = s.DispatchWebhooks()
+	require.NoError(t, err)
+	require.Len(t, receiver.requests, webhookMaxAttempts+2)
+}
+
+func TestWebhookHandlers(t *testing.T) {
+	user := Actor{UserID: uuid.New(), Role: RoleDriver}
+	webhookID, deliveryID, unknownID := uuid.New(), uuid.New(), uuid.New()
+	webhook := Webhook{URL: "https://partner.example/hook", Events: []string{WebhookRideCreated}}
+	invalid := Webhook{URL: "https://partner.example/hook"}
+	mockSvc := new(MockService)
+	h := &Handler{Service: mockSvc}
+	mockSvc.On("GetWebhooks").Return([]Webhook{}, nil)
+	mockSvc.On("CreateWebhook", webhook).Return(Webhook{WebhookID: webhookID, Secret: "secret"}, nil)
+	mockSvc.On("CreateWebhook", invalid).Return(Webhook{}, fmt.Errorf("%w : no events", ErrInvalidWebhook))
+	mockSvc.On("DeleteWebhook", webhookID).Return(nil)
+	mockSvc.On("DeleteWebhook", unknownID).Return(ErrWebhookNotFound)
+	mockSvc.On("GetWebhookDeliveries", webhookID).Return([]WebhookDelivery{}, nil)
+	mockSvc.On("GetWebhookDeliveries", unknownID).Return([]WebhookDelivery(nil), ErrWebhookNotFound)
+	mockSvc.On("RedeliverWebhook", deliveryID).Return(nil)
+	mockSvc.On("RedeliverWebhook", unknownID).Return(ErrWebhookDeliveryNotFound)
+
+	encode := func(webhook Webhook) []byte {
+		body, _ := json.Marshal(webhook)
+		return body
+	}
+	for _, tc := range []struct {
+		name    string
+		method  string
+		url     string
+		body    []byte
+		actor   Actor
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"list", http.MethodGet, "/admin/webhooks", nil, admin, h.WebhooksHandler, http.StatusOK},
+		{"list as a user", http.MethodGet, "/admin/webhooks", nil, user, h.WebhooksHandler, http.StatusForbidden},
+		{"create", http.MethodPost, "/admin/webhooks", encode(webhook), admin, h.WebhooksHandler, http.StatusCreated},
+		{"create invalid", http.MethodPost, "/admin/webhooks", encode(invalid), admin, h.WebhooksHandler, http.StatusBadRequest},
+		{"create as a user", http.MethodPost, "/admin/webhooks", encode(webhook), user, h.WebhooksHandler, http.StatusForbidden},
+		{"delete", http.MethodDelete, "/admin/webhooks?webhook_id=" + webhookID.String(), nil, admin, h.WebhooksHandler, http.StatusNoContent},
+		{"delete unknown", http.MethodDelete, "/admin/webhooks?webhook_id=" + unknownID.String(), nil, admin, h.WebhooksHandler, http.StatusNotFound},
+		{"delivery log", http.MethodGet, "/admin/webhooks/deliveries?webhook_id=" + webhookID.String(), nil, admin, h.WebhookDeliveriesHandler, http.StatusOK},
+		{"delivery log of unknown", http.MethodGet, "/admin/webhooks/deliveries?webhook_id=" + unknownID.String(), nil, admin, h.WebhookDeliveriesHandler, http.StatusNotFound},
+		{"delivery log as a user", http.MethodGet, "/admin/webhooks/deliveries?webhook_id=" + webhookID.String(), nil, user, h.WebhookDeliveriesHandler, http.StatusForbidden},
+		{"redeliver", http.MethodPost, "/admin/webhooks/deliveries?delivery_id=" + deliveryID.String(), nil, admin, h.WebhookDeliveriesHandler, http.StatusNoContent},
+		{"redeliver unknown", http.MethodPost, "/admin/webhooks/deliveries?delivery_id=" + unknownID.String(), nil, admin, h.WebhookDeliveriesHandler, http.StatusNotFound},
+	} {
+		req := asActor(httptest.NewRequest(tc.method, tc.url, bytes.NewReader(tc.body)), tc.actor)
+		w := httptest.NewRecorder()
+		tc.handler(w, req)
+		require.Equal(t, tc.status, w.Result().StatusCode, tc.name)
+	}
+}